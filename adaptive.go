@@ -0,0 +1,189 @@
+package riverrun
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/v2fly/riverrun/analysis"
+	f "github.com/v2fly/riverrun/common/framing"
+)
+
+// DefaultAdaptiveWindow is the number of wire bytes measured per entropy
+// sample with Config.AdaptiveBias.
+const DefaultAdaptiveWindow = 64 * 1024
+
+const (
+	// retuneLength is the size of a PacketTypeRenegotiate body that also
+	// moves the sender's direction to another bias: the epoch followed by
+	// the big-endian bits of the float64 bias.
+	retuneLength = renegotiateLength + 8
+
+	// biasStep is how far one retune moves the bias.
+	biasStep = .02
+	// minAdaptiveBias and maxAdaptiveBias bound the retuned bias.  Lower
+	// biases make the tables slow to sample, .5 is uniform noise.
+	minAdaptiveBias = .1
+	maxAdaptiveBias = .45
+
+	// retuneInterval is the least time between two retunes of a direction.
+	// Each one has the peer derive new tables inside Read, which it must
+	// not be made to do at will, so a retune arriving within half of it
+	// fails the Read with ErrRetuneTooSoon.
+	retuneInterval = 10 * time.Second
+)
+
+// ErrRetuneTooSoon is the error returned by Read when the peer retuned the
+// table bias again too soon after the previous retune, see
+// Config.AdaptiveBias.
+var ErrRetuneTooSoon = errors.New("riverrun: table bias retuned too soon")
+
+// tableParams holds what deriving the tables of another bias takes, for the
+// built-in codec.
+type tableParams struct {
+	bits8, bits  uint64
+	compressed   uint64
+	tableDir     string
+	constantTime bool
+	lowMemory    bool
+	// biasMin and biasMax bound the retuned biases, the adaptive bounds
+	// narrowed to those of Config.Shape.
+	biasMin, biasMax float64
+
+	writeKey, writeIV []byte
+	readKey, readIV   []byte
+}
+
+// biasTuner measures the byte entropy of the written wire bytes.  It is only
+// used under the write lock.
+type biasTuner struct {
+	window   int
+	min, max float64
+
+	counts [256]uint64
+	n      int
+	// step is the direction of the retune due, -1, 0 or 1, last the time
+	// of the last retune.
+	step int
+	last time.Time
+}
+
+func (t *biasTuner) observe(b []byte) {
+	for _, c := range b {
+		t.counts[c]++
+	}
+	t.n += len(b)
+	if t.n < t.window {
+		return
+	}
+	entropy := analysis.Entropy(t.counts[:])
+	t.counts, t.n = [256]uint64{}, 0
+	switch {
+	case entropy < t.min:
+		t.step = 1
+	case entropy > t.max:
+		t.step = -1
+	default:
+		t.step = 0
+	}
+}
+
+// biasTableKey derives the table key of a direction retuned to bias at epoch.
+func biasTableKey(key []byte, epoch uint32, bias float64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("riverrun bias"))
+	var buf [retuneLength]byte
+	binary.BigEndian.PutUint32(buf[:], epoch)
+	binary.BigEndian.PutUint64(buf[renegotiateLength:], math.Float64bits(bias))
+	mac.Write(buf[:])
+	return mac.Sum(nil)[:16]
+}
+
+// biasCodec returns the codec of the tables for bias, derived from the key and
+// iv of a direction.
+func (rr *Conn) biasCodec(key, iv []byte, epoch uint32, bias float64, read bool) (f.Codec, error) {
+	p := rr.tables
+	tableKey := biasTableKey(key, epoch, bias)
+	block, err := aes.NewCipher(tableKey)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := getTables(rr.ctx, nil, p.bits8, p.bits, bias, tableKey, block, iv, p.tableDir, rr.logger)
+	if err != nil {
+		return nil, err
+	}
+	codec := &ctstretchCodec{
+		table8:              tables.table8,
+		table16:             tables.table16,
+		compressedBlockBits: p.compressed,
+		expandedBlockBits:   p.bits,
+		logger:              rr.logger,
+	}
+	if read {
+		codec.inv8, codec.inv16 = tables.inversions(p.constantTime, p.lowMemory)
+	}
+	return codec, nil
+}
+
+// retune moves the write direction one step towards the entropy window, if
+// the tuner asks for it.  It must be called with the write lock held.
+func (rr *Conn) retune() error {
+	step := rr.tuner.step
+	rr.tuner.step = 0
+	bias := math.Max(rr.tables.biasMin, math.Min(rr.tables.biasMax, rr.bias+float64(step)*biasStep))
+	if step == 0 || bias == rr.bias || time.Since(rr.tuner.last) < retuneInterval {
+		return nil
+	}
+	rr.tuner.last = time.Now()
+
+	rr.shapeLock.Lock()
+	epoch := rr.shapeEpoch + 1
+	rr.shapeLock.Unlock()
+
+	codec, err := rr.biasCodec(rr.tables.writeKey, rr.tables.writeIV, epoch, bias, false)
+	if err != nil {
+		return err
+	}
+	var body [retuneLength]byte
+	binary.BigEndian.PutUint32(body[:], epoch)
+	binary.BigEndian.PutUint64(body[renegotiateLength:], math.Float64bits(bias))
+	frameBuf, _, err := rr.Encoder.Chop(body[:], PacketTypeRenegotiate)
+	if err != nil {
+		return err
+	}
+	logParams(rr.logger, "riverrun: Retuned bias from %f to %f", rr.bias, bias)
+	rr.Encoder.codec = codec
+	rr.bias, rr.biasEpoch = bias, epoch
+	if _, err = rr.setShape(epoch, true, bias); err != nil {
+		return err
+	}
+	_, err = rr.writeFrames(&frameBuf)
+	return err
+}
+
+// applyBias moves the read direction to the bias of a retune body.
+func (rr *Conn) applyBias(body []byte) error {
+	bias := math.Float64frombits(binary.BigEndian.Uint64(body[renegotiateLength:]))
+	epoch := binary.BigEndian.Uint32(body)
+	// Retunes move to a later epoch, never to the initial one.
+	if rr.tables == nil || epoch == 0 || !(bias >= rr.tables.biasMin && bias <= rr.tables.biasMax) {
+		return f.InvalidPacketLengthError(len(body))
+	}
+	now := time.Now()
+	if now.Sub(rr.readRetuned) < retuneInterval/2 {
+		return ErrRetuneTooSoon
+	}
+	rr.readRetuned = now
+	codec, err := rr.biasCodec(rr.tables.readKey, rr.tables.readIV, epoch, bias, true)
+	if err != nil {
+		return err
+	}
+	logParams(rr.logger, "riverrun: Peer retuned bias to %f", bias)
+	rr.Decoder.codec = codec
+	rr.readBias, rr.readBiasEpoch = bias, epoch
+	return nil
+}
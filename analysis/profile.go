@@ -0,0 +1,345 @@
+// Package analysis records wire-level traffic profiles of a connection and
+// compares them against target distributions, as a tool for tuning the
+// detectability of riverrun's shaping parameters.
+package analysis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	// DefaultLengthBucket is the histogram bucket width for wire lengths,
+	// in bytes.
+	DefaultLengthBucket = 16
+
+	// DefaultGapBucket is the histogram bucket width for inter-arrival
+	// times, in microseconds.
+	DefaultGapBucket = 1000
+
+	// MaxBuckets bounds the buckets of a Histogram, so that an outlier
+	// cannot grow it without bound.
+	MaxBuckets = 1 << 16
+)
+
+var (
+	// ErrBucketMismatch is the error returned when comparing histograms
+	// with different bucket widths.
+	ErrBucketMismatch = errors.New("analysis: histogram bucket widths differ")
+	// ErrBucketWidth is the error returned for histograms whose bucket
+	// width is not a positive number, or with more than MaxBuckets
+	// buckets.
+	ErrBucketWidth = errors.New("analysis: invalid histogram buckets")
+)
+
+// Histogram counts samples in fixed width buckets starting at zero.
+type Histogram struct {
+	BucketWidth float64  `json:"bucket_width"`
+	Counts      []uint64 `json:"counts"`
+}
+
+// NewHistogram returns an empty histogram with the given bucket width.  It
+// panics unless bucketWidth is a positive number.
+func NewHistogram(bucketWidth float64) *Histogram {
+	h := &Histogram{BucketWidth: bucketWidth}
+	if err := h.validate(); err != nil {
+		panic(fmt.Sprintf("%s: bucket width %v", err, bucketWidth))
+	}
+	return h
+}
+
+func (h *Histogram) validate() error {
+	if !(h.BucketWidth > 0) || math.IsInf(h.BucketWidth, 1) || len(h.Counts) > MaxBuckets {
+		return ErrBucketWidth
+	}
+	return nil
+}
+
+// Add records one sample.  Negative samples are counted in the first bucket,
+// samples beyond MaxBuckets buckets in the last one.
+func (h *Histogram) Add(v float64) {
+	idx := 0
+	if v > 0 {
+		idx = MaxBuckets - 1
+		if bucket := v / h.BucketWidth; bucket < MaxBuckets-1 {
+			idx = int(bucket)
+		}
+	}
+	for len(h.Counts) <= idx {
+		h.Counts = append(h.Counts, 0)
+	}
+	h.Counts[idx]++
+}
+
+// Total returns the number of recorded samples.
+func (h *Histogram) Total() uint64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	return total
+}
+
+// Mean returns the mean sample value, using bucket midpoints.
+func (h *Histogram) Mean() float64 {
+	total := h.Total()
+	if total == 0 {
+		return 0
+	}
+	var sum float64
+	for i, c := range h.Counts {
+		sum += (float64(i) + 0.5) * h.BucketWidth * float64(c)
+	}
+	return sum / float64(total)
+}
+
+func (h *Histogram) clone() *Histogram {
+	return &Histogram{
+		BucketWidth: h.BucketWidth,
+		Counts:      append([]uint64(nil), h.Counts...),
+	}
+}
+
+// Direction is the profile of the traffic flowing one way on a connection.
+type Direction struct {
+	// Lengths is the histogram of the sizes of individual reads or writes.
+	Lengths *Histogram `json:"lengths"`
+	// Gaps is the histogram of the time between successive reads or writes,
+	// in microseconds.
+	Gaps *Histogram `json:"gaps"`
+	// ByteCounts is the frequency of each byte value.
+	ByteCounts [256]uint64 `json:"byte_counts"`
+}
+
+func newDirection(lengthBucket, gapBucket float64) *Direction {
+	return &Direction{
+		Lengths: NewHistogram(lengthBucket),
+		Gaps:    NewHistogram(gapBucket),
+	}
+}
+
+// Entropy returns the Shannon entropy of the recorded bytes, in bits per
+// byte.
+func (d *Direction) Entropy() float64 {
+	return Entropy(d.ByteCounts[:])
+}
+
+func (d *Direction) clone() *Direction {
+	return &Direction{
+		Lengths:    d.Lengths.clone(),
+		Gaps:       d.Gaps.clone(),
+		ByteCounts: d.ByteCounts,
+	}
+}
+
+// Profile is the recorded traffic profile of a connection.
+type Profile struct {
+	Sent     *Direction `json:"sent"`
+	Received *Direction `json:"received"`
+}
+
+// NewProfile returns an empty profile with the given bucket widths, which
+// must be positive, see NewHistogram.
+func NewProfile(lengthBucket, gapBucket float64) *Profile {
+	return &Profile{
+		Sent:     newDirection(lengthBucket, gapBucket),
+		Received: newDirection(lengthBucket, gapBucket),
+	}
+}
+
+// Save writes the profile to w as JSON.
+func (p *Profile) Save(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// WriteFile saves the profile to the named file.
+func (p *Profile) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = p.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadProfile reads a profile previously written by Save.
+func LoadProfile(r io.Reader) (*Profile, error) {
+	p := new(Profile)
+	if err := json.NewDecoder(r).Decode(p); err != nil {
+		return nil, err
+	}
+	if p.Sent == nil || p.Received == nil || p.Sent.Lengths == nil || p.Sent.Gaps == nil ||
+		p.Received.Lengths == nil || p.Received.Gaps == nil {
+		return nil, fmt.Errorf("analysis: incomplete profile")
+	}
+	for _, h := range []*Histogram{p.Sent.Lengths, p.Sent.Gaps, p.Received.Lengths, p.Received.Gaps} {
+		if err := h.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// ReadFile loads a profile from the named file.
+func ReadFile(path string) (*Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadProfile(f)
+}
+
+// Entropy returns the Shannon entropy in bits of the distribution described
+// by counts.
+func Entropy(counts []uint64) float64 {
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	var h float64
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / float64(total)
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+func normalize(counts []uint64, n int) []float64 {
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	res := make([]float64, n)
+	if total == 0 {
+		return res
+	}
+	for i, c := range counts {
+		res[i] = float64(c) / float64(total)
+	}
+	return res
+}
+
+func distributions(a, b []uint64) ([]float64, []float64) {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	return normalize(a, n), normalize(b, n)
+}
+
+// TotalVariation returns the total variation distance between the two
+// histograms, in [0, 1].
+func TotalVariation(a, b *Histogram) (float64, error) {
+	if err := validatePair(a, b); err != nil {
+		return 0, err
+	}
+	if a.BucketWidth != b.BucketWidth {
+		return 0, ErrBucketMismatch
+	}
+	return totalVariation(a.Counts, b.Counts), nil
+}
+
+func validatePair(a, b *Histogram) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	return b.validate()
+}
+
+func totalVariation(a, b []uint64) float64 {
+	p, q := distributions(a, b)
+	var d float64
+	for i := range p {
+		d += math.Abs(p[i] - q[i])
+	}
+	return d / 2
+}
+
+// KolmogorovSmirnov returns the Kolmogorov-Smirnov statistic (the largest
+// difference between the cumulative distributions) of the two histograms.
+func KolmogorovSmirnov(a, b *Histogram) (float64, error) {
+	if err := validatePair(a, b); err != nil {
+		return 0, err
+	}
+	if a.BucketWidth != b.BucketWidth {
+		return 0, ErrBucketMismatch
+	}
+	p, q := distributions(a.Counts, b.Counts)
+	var cp, cq, d float64
+	for i := range p {
+		cp += p[i]
+		cq += q[i]
+		d = math.Max(d, math.Abs(cp-cq))
+	}
+	return d, nil
+}
+
+// DirectionReport holds the distances between two Directions.
+type DirectionReport struct {
+	LengthTV      float64 `json:"length_tv"`
+	LengthKS      float64 `json:"length_ks"`
+	GapTV         float64 `json:"gap_tv"`
+	GapKS         float64 `json:"gap_ks"`
+	ByteTV        float64 `json:"byte_tv"`
+	EntropyDelta  float64 `json:"entropy_delta"`
+	MeanLenDelta  float64 `json:"mean_length_delta"`
+	SampleCount   uint64  `json:"sample_count"`
+	TargetSamples uint64  `json:"target_samples"`
+}
+
+// Report is the result of comparing a recorded profile against a target.
+type Report struct {
+	Sent     DirectionReport `json:"sent"`
+	Received DirectionReport `json:"received"`
+}
+
+// Compare measures how far the recorded profile is from the target.
+// Positive deltas mean the recording is above the target.
+func Compare(recorded, target *Profile) (*Report, error) {
+	sent, err := compareDirection(recorded.Sent, target.Sent)
+	if err != nil {
+		return nil, err
+	}
+	received, err := compareDirection(recorded.Received, target.Received)
+	if err != nil {
+		return nil, err
+	}
+	return &Report{Sent: sent, Received: received}, nil
+}
+
+func compareDirection(recorded, target *Direction) (r DirectionReport, err error) {
+	if r.LengthTV, err = TotalVariation(recorded.Lengths, target.Lengths); err != nil {
+		return
+	}
+	if r.LengthKS, err = KolmogorovSmirnov(recorded.Lengths, target.Lengths); err != nil {
+		return
+	}
+	if r.GapTV, err = TotalVariation(recorded.Gaps, target.Gaps); err != nil {
+		return
+	}
+	if r.GapKS, err = KolmogorovSmirnov(recorded.Gaps, target.Gaps); err != nil {
+		return
+	}
+	r.ByteTV = totalVariation(recorded.ByteCounts[:], target.ByteCounts[:])
+	r.EntropyDelta = recorded.Entropy() - target.Entropy()
+	r.MeanLenDelta = recorded.Lengths.Mean() - target.Lengths.Mean()
+	r.SampleCount = recorded.Lengths.Total()
+	r.TargetSamples = target.Lengths.Total()
+	return
+}
@@ -0,0 +1,111 @@
+package analysis
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"testing"
+)
+
+func TestEntropy(t *testing.T) {
+	var uniform [256]uint64
+	for i := range uniform {
+		uniform[i] = 4
+	}
+	if h := Entropy(uniform[:]); math.Abs(h-8) > 1e-9 {
+		t.Errorf("uniform entropy = %f, want 8", h)
+	}
+	if h := Entropy([]uint64{10, 0, 0}); h != 0 {
+		t.Errorf("constant entropy = %f, want 0", h)
+	}
+}
+
+func TestRecorderCompare(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	rec := NewRecorder(a)
+
+	go func() {
+		io.Copy(io.Discard, b)
+	}()
+	for _, n := range []int{10, 100, 1000} {
+		if _, err := rec.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec.Close()
+
+	p := rec.Profile()
+	if got := p.Sent.Lengths.Total(); got != 3 {
+		t.Fatalf("recorded %d writes, want 3", got)
+	}
+	if p.Sent.ByteCounts[0] != 1110 {
+		t.Fatalf("recorded %d zero bytes, want 1110", p.Sent.ByteCounts[0])
+	}
+
+	var buf bytes.Buffer
+	if err := p.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadProfile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Compare(p, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sent.LengthTV != 0 || report.Sent.LengthKS != 0 || report.Sent.ByteTV != 0 {
+		t.Errorf("profile differs from its own copy: %+v", report.Sent)
+	}
+
+	other := NewProfile(DefaultLengthBucket, DefaultGapBucket)
+	other.Sent.Lengths.Add(5000)
+	report, err = Compare(p, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sent.LengthTV != 1 {
+		t.Errorf("disjoint length TV = %f, want 1", report.Sent.LengthTV)
+	}
+
+	if _, err = Compare(p, NewProfile(1, 1)); err != ErrBucketMismatch {
+		t.Errorf("Compare with mismatched buckets returned %v", err)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := NewHistogram(DefaultLengthBucket)
+	for _, v := range []float64{-1, 0, 1e300, math.Inf(1), math.NaN()} {
+		h.Add(v)
+	}
+	if len(h.Counts) != MaxBuckets || h.Counts[0] != 3 || h.Counts[MaxBuckets-1] != 2 {
+		t.Fatalf("got %d buckets, %d first and %d last", len(h.Counts), h.Counts[0], h.Counts[len(h.Counts)-1])
+	}
+
+	for _, width := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewHistogram(%v) did not panic", width)
+				}
+			}()
+			NewHistogram(width)
+		}()
+		if _, err := TotalVariation(&Histogram{BucketWidth: width}, &Histogram{BucketWidth: width}); !errors.Is(err, ErrBucketWidth) {
+			t.Errorf("bucket width %v: got %v, want ErrBucketWidth", width, err)
+		}
+	}
+	p := NewProfile(DefaultLengthBucket, DefaultGapBucket)
+	p.Received.Gaps.BucketWidth = 0
+	var buf bytes.Buffer
+	if err := p.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProfile(&buf); !errors.Is(err, ErrBucketWidth) {
+		t.Fatalf("got %v, want ErrBucketWidth", err)
+	}
+}
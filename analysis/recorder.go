@@ -0,0 +1,81 @@
+package analysis
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Recorder is a net.Conn that records the profile of the traffic passing
+// through it.  Wrap the carrier connection (the one handed to
+// riverrun.NewConn) to observe what is actually put on the wire.
+type Recorder struct {
+	net.Conn
+
+	lock      sync.Mutex
+	profile   *Profile
+	lastRead  time.Time
+	lastWrite time.Time
+}
+
+// NewRecorder wraps conn using the default bucket widths.
+func NewRecorder(conn net.Conn) *Recorder {
+	return NewRecorderWithBuckets(conn, DefaultLengthBucket, DefaultGapBucket)
+}
+
+// NewRecorderWithBuckets wraps conn using the given length (bytes) and gap
+// (microseconds) bucket widths, which must be positive.
+func NewRecorderWithBuckets(conn net.Conn, lengthBucket, gapBucket float64) *Recorder {
+	return &Recorder{
+		Conn:    conn,
+		profile: NewProfile(lengthBucket, gapBucket),
+	}
+}
+
+func (r *Recorder) record(d *Direction, last *time.Time, b []byte) {
+	now := time.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !last.IsZero() {
+		d.Gaps.Add(float64(now.Sub(*last).Microseconds()))
+	}
+	*last = now
+	d.Lengths.Add(float64(len(b)))
+	for _, v := range b {
+		d.ByteCounts[v]++
+	}
+}
+
+// Read implements net.Conn, recording what was received.
+func (r *Recorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n > 0 {
+		r.record(r.profile.Received, &r.lastRead, b[:n])
+	}
+	return n, err
+}
+
+// Write implements net.Conn, recording what was sent.
+func (r *Recorder) Write(b []byte) (int, error) {
+	n, err := r.Conn.Write(b)
+	if n > 0 {
+		r.record(r.profile.Sent, &r.lastWrite, b[:n])
+	}
+	return n, err
+}
+
+// Profile returns a snapshot of the profile recorded so far.
+func (r *Recorder) Profile() *Profile {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return &Profile{
+		Sent:     r.profile.Sent.clone(),
+		Received: r.profile.Received.clone(),
+	}
+}
+
+// WriteFile saves a snapshot of the recorded profile to the named file.
+func (r *Recorder) WriteFile(path string) error {
+	return r.Profile().WriteFile(path)
+}
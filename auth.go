@@ -0,0 +1,163 @@
+package riverrun
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	// MinAuthorityKeyLength is the smallest key of a TokenAuthority.
+	MinAuthorityKeyLength = 32
+	// MaxClientIDLength is the longest client id a token names.
+	MaxClientIDLength = 255
+
+	authTagLength = 16
+	authLabel     = "riverrun auth token"
+)
+
+// ErrUnauthorized is the error returned by Read on a Listener with an
+// Authority when the client sends payload without an accepted token.
+var ErrUnauthorized = errors.New("riverrun: unauthorized client")
+
+// TokenAuthority issues the authorization tokens of a private bridge, and
+// verifies them for a Listener, see Listener.Authority and Config.AuthToken.
+// Tokens are independent of the seed, so that a leaked seed alone does not
+// get anyone in.  A token names a client id and is authenticated by the key
+// of the authority, so servers only need the key and a revocation list:
+//
+//	id length uint8, id, tag [16]byte  HMAC-SHA256(key, label, id), truncated
+//
+// A TokenAuthority is safe for concurrent use.
+type TokenAuthority struct {
+	key []byte
+
+	lock    sync.RWMutex
+	revoked map[string]struct{}
+}
+
+// NewTokenAuthority returns an authority with key, which must be at least
+// MinAuthorityKeyLength random bytes kept by the operator.
+func NewTokenAuthority(key []byte) (*TokenAuthority, error) {
+	if len(key) < MinAuthorityKeyLength {
+		return nil, fmt.Errorf("riverrun: authority key of %d bytes, want at least %d", len(key), MinAuthorityKeyLength)
+	}
+	return &TokenAuthority{key: append([]byte(nil), key...), revoked: make(map[string]struct{})}, nil
+}
+
+// Issue returns the token of clientID.
+func (a *TokenAuthority) Issue(clientID string) ([]byte, error) {
+	if len(clientID) == 0 || len(clientID) > MaxClientIDLength {
+		return nil, fmt.Errorf("riverrun: invalid client id length: %d", len(clientID))
+	}
+	token := append([]byte{byte(len(clientID))}, clientID...)
+	return append(token, a.tag(clientID)...), nil
+}
+
+func (a *TokenAuthority) tag(clientID string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(authLabel))
+	mac.Write([]byte(clientID))
+	return mac.Sum(nil)[:authTagLength]
+}
+
+// Verify returns the client id of token, or ErrUnauthorized if the token is
+// invalid or its client revoked.
+func (a *TokenAuthority) Verify(token []byte) (string, error) {
+	if len(token) < 1 || len(token) != 1+int(token[0])+authTagLength || token[0] == 0 {
+		return "", ErrUnauthorized
+	}
+	clientID := string(token[1 : 1+token[0]])
+	if !hmac.Equal(token[1+token[0]:], a.tag(clientID)) || a.Revoked(clientID) {
+		return "", ErrUnauthorized
+	}
+	return clientID, nil
+}
+
+// Revoke refuses the tokens of clientID from now on.  Connections already
+// authorized are not affected.
+func (a *TokenAuthority) Revoke(clientID string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.revoked[clientID] = struct{}{}
+}
+
+// Revoked reports whether clientID is revoked.
+func (a *TokenAuthority) Revoked(clientID string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	_, ok := a.revoked[clientID]
+	return ok
+}
+
+// LoadRevocations replaces the revocation list with the client ids read from
+// r, one per line.  Blank lines and lines starting with # are skipped.
+func (a *TokenAuthority) LoadRevocations(r io.Reader) error {
+	revoked := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		revoked[line] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.revoked = revoked
+	return nil
+}
+
+// queueAuth queues the token frame behind the salt and any key exchange
+// message, so that it is the first frame the server decodes after them.
+func (rr *Conn) queueAuth(token []byte) error {
+	frameBuf, _, err := rr.Encoder.Chop(token, PacketTypeAuth)
+	rr.frameLens = rr.frameLens[:0]
+	rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
+	if err != nil {
+		return err
+	}
+	rr.saltOut = append(rr.saltOut, frameBuf.Bytes()...)
+	return nil
+}
+
+// requireAuth makes rr refuse everything but key exchange frames until an
+// accepted token arrived.
+func (rr *Conn) requireAuth(authority *TokenAuthority) {
+	rr.Decoder.expectAuth = true
+	rr.Decoder.onAuth = func(token []byte) error {
+		clientID, err := authority.Verify(token)
+		if err != nil {
+			return err
+		}
+		rr.clientID.Store(&clientID)
+		rr.Decoder.expectAuth = false
+		return nil
+	}
+}
+
+// ClientID returns the client id of the token that authorized rr on a
+// Listener with an Authority, and "" before or without one.
+func (rr *Conn) ClientID() string {
+	if id := rr.clientID.Load(); id != nil {
+		return *id
+	}
+	return ""
+}
+
+// checkAuth fails frames other than key exchange messages and the token
+// while one is expected.
+func (decoder *riverrunDecoder) checkAuth(pktType uint8) error {
+	if decoder.expectAuth && pktType != PacketTypeAuth && pktType != PacketTypeKeyExchange {
+		return ErrUnauthorized
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package riverrun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+func TestAuthority(t *testing.T) {
+	authority, err := NewTokenAuthority(bytes.Repeat([]byte{7}, MinAuthorityKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := authority.Issue("alice")
+	bob, _ := authority.Issue("bob")
+	forged := append([]byte(nil), alice...)
+	forged[len(forged)-1] ^= 1
+	if err = authority.LoadRevocations(strings.NewReader("# leaked\nbob\n")); err != nil {
+		t.Fatal(err)
+	}
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token []byte
+		kex   KeyExchange
+		want  error
+	}{
+		{"valid", alice, KeyExchangeNone, nil},
+		{"key exchange", alice, KeyExchangeX25519Kyber768, nil},
+		{"revoked", bob, KeyExchangeNone, ErrUnauthorized},
+		{"forged", forged, KeyExchangeNone, ErrUnauthorized},
+		{"missing", nil, KeyExchangeNone, ErrUnauthorized},
+	} {
+		l, err := Listen("tcp", "127.0.0.1:0", seed, &Config{KeyExchange: tc.kex})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Authority = authority
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			rr, err := NewConnConfig(context.Background(), conn, false, seed, &Config{AuthToken: tc.token, KeyExchange: tc.kex})
+			if err != nil {
+				conn.Close()
+				return
+			}
+			defer rr.Close()
+			rr.Write([]byte("hello"))
+			drain(rr)
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := conn.(*Conn)
+		buf := make([]byte, 5)
+		_, err = rr.Read(buf)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: Read failed with %v, want %v", tc.name, err, tc.want)
+		} else if err == nil && (string(buf) != "hello" || rr.ClientID() != "alice") {
+			t.Errorf("%s: read %q as %q", tc.name, buf, rr.ClientID())
+		}
+		rr.Close()
+		l.Close()
+	}
+}
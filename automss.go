@@ -0,0 +1,92 @@
+package riverrun
+
+import "time"
+
+// DefaultAutoMSSRate is the payload rate, in bytes per second, that
+// Config.AutoMSS takes for a bulk transfer.
+const DefaultAutoMSSRate = 4 << 20
+
+const (
+	// autoMSSInterval is the goodput measurement interval of Config.AutoMSS,
+	// autoMSSStreak the number of intervals in a row at the rate it takes to
+	// grow the chunks.
+	autoMSSInterval = time.Second
+	autoMSSStreak   = 3
+	// shapeSearch is how many epochs ahead a shape shift looks.
+	shapeSearch = 64
+)
+
+// mssTuner measures the goodput of the write direction.  It is only used
+// under the write lock.
+type mssTuner struct {
+	rate     int64
+	interval time.Duration
+	// readSeed and readMSS are the shape seed of the read direction and its
+	// chunk length at epoch 0.
+	readSeed []byte
+	readMSS  int
+
+	start  time.Time
+	bytes  int64
+	streak int
+}
+
+// observe counts n payload bytes written at now, and reports whether the
+// rate was sustained long enough to grow the chunks.
+func (t *mssTuner) observe(n int, now time.Time) bool {
+	if t.start.IsZero() {
+		t.start = now
+	}
+	t.bytes += int64(n)
+	elapsed := now.Sub(t.start)
+	if elapsed < t.interval {
+		return false
+	}
+	// A window stretched by an idle gap is no sustained transfer.
+	if elapsed < 2*t.interval && float64(t.bytes) >= float64(t.rate)*elapsed.Seconds() {
+		t.streak++
+	} else {
+		t.streak = 0
+	}
+	t.start, t.bytes = now, 0
+	if t.streak < autoMSSStreak {
+		return false
+	}
+	t.streak = 0
+	return true
+}
+
+// growShape renegotiates to the next epoch that grows the chunks of the write
+// direction without shrinking those of the read direction, nor growing them
+// beyond the MTU of a Carrier, so that bulk
+// transfers take fewer, larger writes while the lengths keep following the
+// distribution of the epochs.  Nothing changes if no epoch within
+// shapeSearch qualifies.  It must be called with the write lock held.
+func (rr *Conn) growShape() error {
+	rr.shapeLock.Lock()
+	epoch, mssMax := rr.shapeEpoch, rr.mss_max
+	rr.shapeLock.Unlock()
+
+	readMSS := rr.mssTuner.readMSS
+	if epoch != 0 {
+		var err error
+		if readMSS, _, err = shapeAt(rr.mssTuner.readSeed, epoch); err != nil {
+			return err
+		}
+	}
+	for next := epoch + 1; next <= epoch+shapeSearch; next++ {
+		write, _, err := shapeAt(rr.shapeSeed, next)
+		if err != nil {
+			return err
+		}
+		read, _, err := shapeAt(rr.mssTuner.readSeed, next)
+		if err != nil {
+			return err
+		}
+		if write > mssMax && read >= readMSS && (rr.mssCeiling == 0 || write <= rr.mssCeiling) && rr.clampMSS(write) == write {
+			logParams(rr.logger, "riverrun: Auto MSS grows mss_max from %d to %d", mssMax, write)
+			return rr.renegotiateTo(next)
+		}
+	}
+	return nil
+}
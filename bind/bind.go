@@ -0,0 +1,199 @@
+// Package bind is a simplified riverrun client API for gomobile bind, so that
+// Android and iOS apps can embed a client without glue code of their own.
+// It only uses types gomobile supports: seeds are hex strings, I/O goes
+// through byte slices and callbacks are interfaces of such types.
+//
+// Clients are configured by an option string in the SIP003 syntax of the
+// plugin:
+//
+//	profile=<name>;personalization=<string>;codec=<name>;loglevel=<level>;lowmemory=<0|1>;keyexchange=<0|1>
+//
+// All options are optional, loglevel defaults to none.
+package bind
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/common/log"
+	"github.com/v2fly/riverrun/plugin/sip003"
+)
+
+// NewSeed returns a fresh random seed, hex encoded.
+func NewSeed() (string, error) {
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		return "", err
+	}
+	return seed.Hex(), nil
+}
+
+// Progress receives the fraction of the tables generated while a Client
+// dials, see Client.SetProgress.
+type Progress interface {
+	OnProgress(fraction float64)
+}
+
+// Client dials riverrun servers sharing one seed and configuration.
+type Client struct {
+	seed   *drbg.Seed
+	config *riverrun.Config
+
+	mu       sync.Mutex
+	progress Progress
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewClient returns a client for the hex encoded seed, configured by options.
+func NewClient(seedHex, options string) (*Client, error) {
+	seed, err := drbg.SeedFromHex(seedHex)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := sip003.ParseOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	config, err := riverrun.LookupProfile(opts.Get("profile", ""))
+	if err != nil {
+		return nil, err
+	}
+	if config.Logger, err = log.NewLogger(opts.Get("loglevel", "none")); err != nil {
+		return nil, err
+	}
+	config.Personalization = opts.Get("personalization", "")
+	if codec := opts.Get("codec", ""); codec != "" {
+		config.Codec = codec
+	}
+	if config.LowMemory, err = boolOption(opts, "lowmemory"); err != nil {
+		return nil, err
+	}
+	kex, err := boolOption(opts, "keyexchange")
+	if err != nil {
+		return nil, err
+	}
+	if kex {
+		config.KeyExchange = riverrun.KeyExchangeX25519Kyber768
+	}
+	c := &Client{seed: seed, config: config}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	config.TableProgress = c.onProgress
+	return c, nil
+}
+
+func boolOption(opts sip003.Options, key string) (bool, error) {
+	if !opts.Has(key) {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(opts.Get(key, ""))
+	if err != nil {
+		return false, fmt.Errorf("bind: invalid %s option: %w", key, err)
+	}
+	return v, nil
+}
+
+// SetProgress sets the receiver of the table generation progress, or removes
+// it for nil.  It is called from the dialing goroutine.
+func (c *Client) SetProgress(p Progress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress = p
+}
+
+func (c *Client) onProgress(fraction float64) {
+	c.mu.Lock()
+	p := c.progress
+	c.mu.Unlock()
+	if p != nil {
+		p.OnProgress(fraction)
+	}
+}
+
+// Dial connects to the TCP address of a server, and gives up after
+// timeoutMillis, if positive, or once Cancel is called.
+func (c *Client) Dial(address string, timeoutMillis int64) (*Conn, error) {
+	c.mu.Lock()
+	ctx := c.ctx
+	c.mu.Unlock()
+	if timeoutMillis > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMillis)*time.Millisecond)
+		defer cancel()
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	rr, err := riverrun.NewConnConfig(ctx, conn, false, c.seed, c.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{rr: rr}, nil
+}
+
+// Cancel aborts the dials in progress, table generation included.  Later
+// dials are not affected.
+func (c *Client) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancel()
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+}
+
+// Conn is a client connection.
+type Conn struct {
+	rr *riverrun.Conn
+}
+
+// Read returns the payload received, at most max bytes.  It blocks until
+// there is some, the read timeout passes or the connection fails.
+func (c *Conn) Read(max int) ([]byte, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("bind: invalid read size: %d", max)
+	}
+	b := make([]byte, max)
+	n, err := c.rr.Read(b)
+	return b[:n], err
+}
+
+// Write sends b, and returns how much of it was sent.
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.rr.Write(b)
+}
+
+// SetReadTimeout makes reads fail once millis have passed, or never for zero.
+func (c *Conn) SetReadTimeout(millis int64) error {
+	return c.rr.SetReadDeadline(deadline(millis))
+}
+
+// SetWriteTimeout makes writes fail once millis have passed, or never for
+// zero.
+func (c *Conn) SetWriteTimeout(millis int64) error {
+	return c.rr.SetWriteDeadline(deadline(millis))
+}
+
+func deadline(millis int64) time.Time {
+	if millis <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(millis) * time.Millisecond)
+}
+
+// KeyExchanged reports whether the keyexchange option took effect, see
+// riverrun.Conn.KeyExchanged.
+func (c *Conn) KeyExchanged() bool {
+	return c.rr.KeyExchanged()
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.rr.Close()
+}
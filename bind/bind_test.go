@@ -0,0 +1,84 @@
+package bind
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+type progress struct{ last float64 }
+
+func (p *progress) OnProgress(fraction float64) { p.last = fraction }
+
+func TestClient(t *testing.T) {
+	seedHex, err := NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := drbg.SeedFromHex(seedHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		config := &riverrun.Config{Personalization: "example.com", KeyExchange: riverrun.KeyExchangeX25519Kyber768}
+		rr, err := riverrun.NewConnConfig(context.Background(), conn, true, seed, config)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		defer rr.Close()
+		io.Copy(rr, rr)
+	}()
+
+	client, err := NewClient(seedHex, "personalization=example.com;lowmemory=1;keyexchange=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := new(progress)
+	client.SetProgress(p)
+	conn, err := client.Dial(ln.Addr().String(), 120000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if p.last != 1 {
+		t.Errorf("progress ended at %f", p.last)
+	}
+
+	msg := []byte("from the app")
+	if n, err := conn.Write(msg); err != nil || n != len(msg) {
+		t.Fatalf("Write: %d, %v", n, err)
+	}
+	if err := conn.SetReadTimeout(10000); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for len(got) < len(msg) {
+		b, err := conn.Read(64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo mismatch")
+	}
+
+	if _, err := NewClient(seedHex, "lowmemory=maybe"); err == nil {
+		t.Error("invalid option accepted")
+	}
+}
@@ -0,0 +1,72 @@
+package riverrun
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// blackholeStalls is the number of stalled carrier writes in a row that make
+// Config.BlackholeStall shrink the chunks.
+const blackholeStalls = 3
+
+// BlackholeEvent describes a Conn shrinking its chunks after repeated write
+// stalls, see Config.BlackholeStall.
+type BlackholeEvent struct {
+	Time    time.Time
+	TraceID string
+	// Epoch is the shaping epoch switched to.  OldMSS and NewMSS are the
+	// largest chunk length of the write direction before and after.
+	Epoch  uint32
+	OldMSS int
+	NewMSS int
+}
+
+// stallDetector counts the carrier writes that block for stall or longer.  It
+// is used from the scheduler, which need not hold the write lock.
+type stallDetector struct {
+	stall  time.Duration
+	streak atomic.Int32
+	// due is set once enough stalls came in a row, until the next Write
+	// shrinks the chunks.
+	due atomic.Bool
+}
+
+func (d *stallDetector) observe(took time.Duration) {
+	if took < d.stall {
+		d.streak.Store(0)
+		return
+	}
+	if d.streak.Add(1) >= blackholeStalls {
+		d.streak.Store(0)
+		d.due.Store(true)
+	}
+}
+
+// shrinkShape renegotiates to the next epoch whose chunks are smaller in the
+// write direction, and keeps Config.AutoMSS from growing them back.  Segments
+// above the path MTU vanish when path MTU discovery is broken, so smaller
+// chunks keep more writes going through.  Nothing changes if no epoch within
+// shapeSearch qualifies.  It must be called with the write lock held.
+func (rr *Conn) shrinkShape() error {
+	rr.shapeLock.Lock()
+	epoch, mssMax := rr.shapeEpoch, rr.mss_max
+	rr.shapeLock.Unlock()
+
+	for next := epoch + 1; next <= epoch+shapeSearch; next++ {
+		write, _, err := shapeAt(rr.shapeSeed, next)
+		if err != nil {
+			return err
+		}
+		if write >= mssMax {
+			continue
+		}
+		logParams(rr.logger, "riverrun: Write stalls, shrinking mss_max from %d to %d", mssMax, write)
+		rr.mssCeiling = write
+		if err = rr.renegotiateTo(next); err != nil {
+			return err
+		}
+		rr.hooks.OnBlackhole(BlackholeEvent{Time: time.Now(), TraceID: rr.traceID, Epoch: next, OldMSS: mssMax, NewMSS: write})
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package riverrun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/v2fly/riverrun/common/csrand"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// FailurePolicy selects how a server connection behaves once the client sent
+// a frame that does not decode.  Resetting right away tells a prober exactly
+// when its garbage was rejected, the other policies blur that signal.
+type FailurePolicy int
+
+const (
+	// FailClose leaves the connection to the caller, which usually closes
+	// it right away.
+	FailClose FailurePolicy = iota
+	// FailDrain keeps reading and discarding for a fixed time, then closes.
+	FailDrain
+	// FailIdle discards whatever arrives and closes once the client has
+	// been silent for an idle timeout, like a server waiting for a request.
+	FailIdle
+	// FailDecoy hands the connection, including the bytes received so far,
+	// to Listener.Decoy or Listener.DecoyHandler.
+	FailDecoy
+)
+
+const (
+	// captureMax bounds the bytes kept for replay to the decoy.
+	captureMax = 64 * 1024
+
+	camouflageLabel = "riverrun camouflage v1"
+)
+
+// failureHandler is the camouflage of the connections of one Listener.
+type failureHandler struct {
+	policy FailurePolicy
+	drain  time.Duration
+	idle   time.Duration
+	decoy  string
+	site   http.Handler
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newFailureHandler derives the drain and idle times from the seed, so that
+// all servers sharing it look alike, without revealing the seed's other
+// uses.
+func newFailureHandler(l *Listener, seed *drbg.Seed) *failureHandler {
+	sum := sha256.Sum256(append([]byte(camouflageLabel), seed.Bytes()[:]...))
+	rng := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:]))))
+	h := &failureHandler{
+		policy: l.Failure,
+		drain:  10*time.Second + time.Duration(rng.Int63n(int64(50*time.Second))),
+		idle:   30*time.Second + time.Duration(rng.Int63n(int64(150*time.Second))),
+		decoy:  l.Decoy,
+		site:   l.DecoyHandler,
+		dial:   l.Dial,
+	}
+	if h.dial == nil {
+		h.dial = (&net.Dialer{}).DialContext
+	}
+	return h
+}
+
+// jitter spreads d by up to a tenth, so that timing is not exact.
+func jitter(d time.Duration) time.Duration {
+	return d - d/10 + time.Duration(csrand.Intn(int(d/5)+1))
+}
+
+// camouflage takes the underlying conn away from rr after a rejected frame,
+// and runs the failure policy on it in the background.
+func (rr *Conn) camouflage(err error) {
+	if !rr.camouflaged.CompareAndSwap(false, true) {
+		return
+	}
+	rr.failErr = err
+	rr.wire.detached.Store(true)
+	rr.logger.Infof("riverrun: bad frame, camouflaging: %s", err)
+
+	go rr.failure.run(rr.Conn, rr.wire.stopCapture())
+}
+
+// run applies the policy of h to conn, a client that failed after sending
+// captured, and closes it.
+func (h *failureHandler) run(conn net.Conn, captured []byte) {
+	defer conn.Close()
+	switch h.policy {
+	case FailDrain:
+		conn.SetReadDeadline(time.Now().Add(jitter(h.drain)))
+		io.Copy(io.Discard, conn)
+	case FailIdle:
+		buf := make([]byte, 4096)
+		for {
+			conn.SetReadDeadline(time.Now().Add(jitter(h.idle)))
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	case FailDecoy:
+		if h.site != nil {
+			serveDecoy(h.site, conn, captured)
+			return
+		}
+		decoy, err := h.dial(context.Background(), "tcp", h.decoy)
+		if err != nil {
+			return
+		}
+		defer decoy.Close()
+		if _, err = decoy.Write(captured); err != nil {
+			return
+		}
+		done := make(chan struct{}, 2)
+		cp := func(dst, src net.Conn) {
+			io.Copy(dst, src)
+			done <- struct{}{}
+		}
+		go cp(decoy, conn)
+		go cp(conn, decoy)
+		<-done
+	}
+}
+
+// Listener accepts riverrun server connections.
+type Listener struct {
+	net.Listener
+
+	Seed   *drbg.Seed
+	Config *Config
+
+	// Failure is the camouflage of connections sending invalid frames.
+	Failure FailurePolicy
+	// Decoy is the address of the backend used by FailDecoy, e.g. a web
+	// server.
+	Decoy string
+	// DecoyHandler, if set, serves the connections of FailDecoy over HTTP
+	// in place of Decoy, e.g. a NewCoverSite, so that the server port
+	// is shared by riverrun and the visitors of a website.  With
+	// Config.KeyCommitment they are told apart right after the salt, so
+	// that requests of a few dozen bytes are served too, not only those
+	// longer than a frame.
+	DecoyHandler http.Handler
+	// Dial connects to Decoy.  It defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Socket tunes the accepted TCP conns.
+	Socket SocketOptions
+	// FirstFrameTimeout, if set, closes connections that have not sent a
+	// valid frame within about that long, jittered per connection, as
+	// probers connecting without sending tend to.  Nothing is written to
+	// them, provided the application reads before it writes.
+	FirstFrameTimeout time.Duration
+	// Authority, if set, only admits clients sending a token it accepts,
+	// see Config.AuthToken: Read fails with ErrUnauthorized, and Failure
+	// applies, on any frame but key exchange messages before the token.
+	Authority *TokenAuthority
+	// Replay, if set, refuses clients whose salt it has seen, so that a
+	// recorded connection replayed by a prober fails like garbage: Read
+	// fails with ErrReplay, and Failure applies.
+	Replay *ReplayFilter
+
+	// lock guards Seed, Config and failure against Reload.
+	lock        sync.RWMutex
+	once        sync.Once
+	failure     *failureHandler
+	silentDrops atomic.Uint64
+
+	// rotation is set by SetRotation, from when on the accept loop
+	// classifies the conns.
+	rotation atomic.Pointer[listenerRotation]
+	// The accept loop hands the conns set up to Accept through accepted,
+	// until it fails with acceptErr and closes acceptDone.
+	loopOnce   sync.Once
+	accepted   chan acceptResult
+	acceptDone chan struct{}
+	acceptErr  error
+}
+
+// acceptResult is a connection set up for Accept, nil with the error of its
+// setup.
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Listen announces on the local network address and returns a Listener for
+// the given seed and settings.
+func Listen(network, address string, seed *drbg.Seed, config *Config) (*Listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{Listener: ln, Seed: seed, Config: config}, nil
+}
+
+// Accept waits for the next connection and returns it as a *Conn.  The
+// connections are set up by an accept loop, which Accept starts on first use,
+// each on a goroutine of its own, so that a slow one does not hold up the
+// others.  A connection failing its setup is returned as the error of
+// Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	if l.Failure < FailClose || l.Failure > FailDecoy {
+		return nil, fmt.Errorf("riverrun: invalid failure policy: %d", l.Failure)
+	}
+	if l.Failure == FailDecoy && l.Decoy == "" && l.DecoyHandler == nil {
+		return nil, fmt.Errorf("riverrun: FailDecoy needs a Decoy address or DecoyHandler")
+	}
+	l.once.Do(func() {
+		l.lock.Lock()
+		l.failure = newFailureHandler(l, l.Seed)
+		l.lock.Unlock()
+	})
+	l.loopOnce.Do(func() {
+		l.accepted = make(chan acceptResult)
+		l.acceptDone = make(chan struct{})
+		go l.acceptLoop()
+	})
+	select {
+	case res := <-l.accepted:
+		return res.conn, res.err
+	case <-l.acceptDone:
+		return nil, l.acceptErr
+	}
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			// Leave the backing off to the caller of Accept, as
+			// without the loop.
+			l.accepted <- acceptResult{err: err}
+			continue
+		}
+		if err != nil {
+			l.acceptErr = err
+			close(l.acceptDone)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake sets up conn, with the seed its client uses amid a rotation, and
+// hands it to Accept.
+func (l *Listener) handshake(conn net.Conn) {
+	var rr *Conn
+	err := l.Socket.Apply(conn)
+	if err == nil {
+		if r := l.rotation.Load(); r != nil {
+			if rr, err = l.classify(conn, r); rr == nil && err == nil {
+				return
+			}
+		} else {
+			seed, _ := l.settings()
+			rr, err = l.setup(conn, seed)
+		}
+	}
+	res := acceptResult{err: err}
+	if err != nil {
+		conn.Close()
+	} else {
+		res.conn = rr
+	}
+	select {
+	case l.accepted <- res:
+	case <-l.acceptDone:
+		if err == nil {
+			rr.Close()
+		}
+	}
+}
+
+// setup returns the server Conn over conn keyed by seed, with the settings of
+// the Listener.
+func (l *Listener) setup(conn net.Conn, seed *drbg.Seed) (*Conn, error) {
+	l.lock.RLock()
+	config, failure := l.Config, l.failure
+	l.lock.RUnlock()
+	rr, err := NewConnConfig(context.Background(), conn, true, seed, config)
+	if err != nil {
+		return nil, err
+	}
+	if l.Failure != FailClose {
+		rr.failure = failure
+		if l.Failure == FailDecoy {
+			rr.wire.captureMax = captureMax
+		}
+	}
+	if l.FirstFrameTimeout > 0 {
+		l.armFirstFrame(rr)
+	}
+	if l.Authority != nil {
+		rr.requireAuth(l.Authority)
+	}
+	rr.replay = l.Replay
+	return rr, nil
+}
+
+// armFirstFrame closes rr unless its first frame arrives within the jittered
+// FirstFrameTimeout.
+func (l *Listener) armFirstFrame(rr *Conn) {
+	rr.Decoder.onFirstFrame = func() {
+		if rr.firstFrameDone.CompareAndSwap(false, true) {
+			rr.firstFrame.Stop()
+		}
+	}
+	rr.firstFrame = time.AfterFunc(jitter(l.FirstFrameTimeout), func() {
+		if rr.firstFrameDone.CompareAndSwap(false, true) {
+			l.silentDrops.Add(1)
+			rr.teardown(CloseSilentDrop)
+		}
+	})
+}
+
+// SilentDrops returns the number of connections closed by FirstFrameTimeout.
+func (l *Listener) SilentDrops() uint64 {
+	return l.silentDrops.Load()
+}
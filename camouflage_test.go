@@ -0,0 +1,260 @@
+package riverrun
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// probe connects to l, sends garbage, and returns the client conn along with
+// the error the server side Read failed with.
+func probe(t *testing.T, l *Listener, garbage []byte) (net.Conn, error) {
+	t.Helper()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	go client.Write(garbage)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	for {
+		if _, err = conn.Read(buf); err != nil {
+			// The caller giving up must not affect the camouflage.
+			conn.Close()
+			return client, err
+		}
+	}
+}
+
+func newTestListener(t *testing.T, policy FailurePolicy) *Listener {
+	t.Helper()
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen("tcp", "127.0.0.1:0", seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	l.Failure = policy
+	return l
+}
+
+func TestFailDecoy(t *testing.T) {
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	garbage := make([]byte, 8000)
+	rand.Read(garbage)
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := decoy.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		got := make([]byte, len(garbage))
+		io.ReadFull(conn, got)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		received <- got
+	}()
+
+	l := newTestListener(t, FailDecoy)
+	l.Decoy = decoy.Addr().String()
+	client, err := probe(t, l, garbage)
+	if !isFrameError(err) {
+		t.Fatalf("server read failed with %v", err)
+	}
+	if got := <-received; !bytes.Equal(got, garbage) {
+		t.Fatal("decoy did not receive the probe")
+	}
+	reply, _ := io.ReadAll(client)
+	if !bytes.HasPrefix(reply, []byte("HTTP/1.1 400")) {
+		t.Fatalf("client got %q from the decoy", reply)
+	}
+}
+
+func TestFailDrain(t *testing.T) {
+	l := newTestListener(t, FailDrain)
+	const drain = 300 * time.Millisecond
+	l.once.Do(func() { l.failure = &failureHandler{policy: FailDrain, drain: drain} })
+
+	garbage := make([]byte, 8000)
+	rand.Read(garbage)
+	start := time.Now()
+	client, err := probe(t, l, garbage)
+	if !isFrameError(err) {
+		t.Fatalf("server read failed with %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client read: got %v, want EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed < drain-drain/10 {
+		t.Fatalf("closed after %s, before the drain time", elapsed)
+	}
+}
+
+func TestFirstFrameTimeout(t *testing.T) {
+	l := newTestListener(t, FailClose)
+	l.FirstFrameTimeout = 200 * time.Millisecond
+
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Fatal("silent connection not dropped")
+	}
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if reply, err := io.ReadAll(silent); err != nil || len(reply) != 0 {
+		t.Fatalf("silent client got %q, %v", reply, err)
+	}
+	if n := l.SilentDrops(); n != 1 {
+		t.Fatalf("%d silent drops, want 1", n)
+	}
+
+	carrier, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewConn(carrier, false, l.Seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Write([]byte("hello"))
+	conn, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	go client.Write([]byte("again"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatalf("read after the timeout: %s", err)
+	}
+	if n := l.SilentDrops(); n != 1 {
+		t.Fatalf("%d silent drops, want 1", n)
+	}
+}
+
+func TestCoverSite(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-For") != "" {
+			t.Error("forwarding header sent upstream")
+		}
+		io.WriteString(w, "cover page "+r.URL.Path)
+	}))
+	defer upstream.Close()
+	site, err := NewCoverSite(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewCoverSite("ftp://cover.example"); err == nil {
+		t.Fatal("accepted an ftp cover site")
+	}
+
+	l := newTestListener(t, FailDecoy)
+	l.Config = &Config{KeyCommitment: true}
+	l.DecoyHandler = site
+	client, err := probe(t, l, []byte("GET /index.html HTTP/1.1\r\nHost: cover.example\r\n\r\n"))
+	if !isFrameError(err) {
+		t.Fatalf("server read failed with %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "cover page /index.html" {
+		t.Fatalf("got %s %q", resp.Status, body)
+	}
+}
+
+func TestListenerSlowSetup(t *testing.T) {
+	// The first connection sets up with a fresh seed, whose tables take
+	// until release to generate.
+	slow, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	config := &Config{TableProgress: func(float64) {
+		once.Do(func() { close(started) })
+		<-release
+	}}
+	l, err := Listen("tcp", "127.0.0.1:0", slow, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	defer close(release)
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	<-started
+
+	// The next connection must not wait for the first one.
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Reload(seed, nil); err != nil {
+		t.Fatal(err)
+	}
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if conn.RemoteAddr().String() != second.LocalAddr().String() {
+			t.Fatalf("accepted %s, want %s", conn.RemoteAddr(), second.LocalAddr())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the slow setup holds up Accept")
+	}
+}
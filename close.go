@@ -0,0 +1,140 @@
+package riverrun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/v2fly/riverrun/common/csrand"
+)
+
+const closeLabel = "riverrun close"
+
+// closeCodeTimeout bounds the write of the close code ahead of a read idle
+// teardown.
+const closeCodeTimeout = time.Second
+
+// CloseCode tells the peer why a Conn was closed, see Conn.CloseWithCode.
+type CloseCode uint8
+
+const (
+	// CloseCodeNormal is the end of the session.
+	CloseCodeNormal CloseCode = iota
+	// CloseCodeRekeyFailure is a failed renegotiation or key exchange.  A
+	// Conn sends it by itself once its Read fails one.
+	CloseCodeRekeyFailure
+	// CloseCodePolicy is the connection refused by a policy, e.g. a quota
+	// or an access rule.
+	CloseCodePolicy
+	// CloseCodeIdle is the connection closed for inactivity.  A Conn sends
+	// it by itself ahead of the teardown of Config.ReadIdleTimeout.
+	CloseCodeIdle
+)
+
+func (c CloseCode) String() string {
+	switch c {
+	case CloseCodeNormal:
+		return "normal"
+	case CloseCodeRekeyFailure:
+		return "rekey failure"
+	case CloseCodePolicy:
+		return "policy"
+	case CloseCodeIdle:
+		return "idle"
+	}
+	return fmt.Sprintf("CloseCode(%d)", uint8(c))
+}
+
+// ErrCloseCode is the error returned by Read for a close frame that does not
+// open.
+var ErrCloseCode = errors.New("riverrun: invalid close frame")
+
+// CloseError is the error returned by Read once the peer closed with
+// Conn.CloseWithCode, in place of io.EOF, which it wraps.
+type CloseError struct {
+	Code CloseCode
+}
+
+func (e *CloseError) Error() string {
+	return "riverrun: closed by peer: " + e.Code.String()
+}
+
+func (e *CloseError) Unwrap() error {
+	return io.EOF
+}
+
+// CloseWithCode sends code to the peer sealed under the keys of this session,
+// so that its Read fails with a CloseError telling why, then closes rr.  A
+// failure to send is returned, but rr is closed regardless.
+func (rr *Conn) CloseWithCode(code CloseCode) error {
+	err := rr.writeCloseFrame(code)
+	if cerr := rr.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (rr *Conn) writeCloseFrame(code CloseCode) error {
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+	return rr.sendCloseFrame(code)
+}
+
+// tryCloseCode sends code ahead of a teardown or after a failed rekey, as far
+// as it goes without waiting for a Write in progress.  Peers rr never wrote
+// to are told nothing, as probers must not be.
+func (rr *Conn) tryCloseCode(code CloseCode) {
+	if !rr.writeLock.TryLock() {
+		return
+	}
+	defer rr.writeLock.Unlock()
+	if rr.saltOut != nil {
+		return
+	}
+	if rr.sendCloseFrame(code) == nil {
+		rr.scheduler.Flush()
+	}
+}
+
+// sendCloseFrame is writeCloseFrame with writeLock held.
+func (rr *Conn) sendCloseFrame(code CloseCode) error {
+	if rr.closed.Load() || rr.camouflaged.Load() {
+		return net.ErrClosed
+	}
+	aead, err := sealingAEAD(rr.Encoder.drbgKey, closeLabel)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if err = csrand.Bytes(nonce); err != nil {
+		return err
+	}
+	frameBuf, _, err := rr.Encoder.Chop(aead.Seal(nonce, nonce, []byte{byte(code)}, nil), PacketTypeClose)
+	if err != nil {
+		rr.frameLens = rr.frameLens[:0]
+		rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
+		return err
+	}
+	_, err = rr.writeFrames(&frameBuf)
+	return err
+}
+
+// handlePeerClose opens a close frame.  Read returns the CloseError once the
+// payload before it is consumed and the carrier ends.
+func (rr *Conn) handlePeerClose(body []byte) error {
+	aead, err := sealingAEAD(rr.Decoder.drbgKey, closeLabel)
+	if err != nil {
+		return err
+	}
+	if len(body) < aead.NonceSize() {
+		return ErrCloseCode
+	}
+	plain, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], nil)
+	if err != nil || len(plain) != 1 {
+		return ErrCloseCode
+	}
+	rr.peerClose = &CloseError{Code: CloseCode(plain[0])}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Command riverrun-sip003 runs riverrun as a Shadowsocks SIP003 plugin.
+//
+// Plugin options (SS_PLUGIN_OPTIONS):
+//
+//	seed=<hex>      shared riverrun seed (required)
+//	profile=<name>  riverrun profile, see riverrun.ProfileNames
+//	server          run the server side
+//	personalization=<string>  mixed into the seed, e.g. the server hostname
+//	loglevel=<lvl>  one of none, info, debug (default info)
+package main
+
+import (
+	"context"
+	"fmt"
+	stdlog "log"
+	"net"
+	"os/signal"
+	"syscall"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/common/log"
+	"github.com/v2fly/riverrun/forward"
+	"github.com/v2fly/riverrun/plugin/sip003"
+)
+
+// newForwarder returns the Forwarder described by args, along with the
+// addresses it should listen on.
+func newForwarder(args *sip003.Args) (*forward.Forwarder, []string, error) {
+	isServer := args.Options.Has("server")
+
+	logger, err := log.NewLogger(args.Options.Get("loglevel", ""))
+	if err != nil {
+		return nil, nil, err
+	}
+	seedHex := args.Options.Get("seed", "")
+	if seedHex == "" {
+		return nil, nil, fmt.Errorf("missing seed option")
+	}
+	seed, err := drbg.SeedFromHex(seedHex)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := riverrun.LookupProfile(args.Options.Get("profile", ""))
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Logger = logger
+	config.Personalization = args.Options.Get("personalization", "")
+
+	if isServer {
+		return forward.New(true, args.LocalAddr(), seed, config), args.RemoteAddrs(), nil
+	}
+	return forward.New(false, args.RemoteAddrs()[0], seed, config), []string{args.LocalAddr()}, nil
+}
+
+func main() {
+	stdlog.SetPrefix("[riverrun] ")
+	args, err := sip003.ParseEnv()
+	if err != nil {
+		stdlog.Fatal(err)
+	}
+	fw, listenAddrs, err := newForwarder(args)
+	if err != nil {
+		stdlog.Fatal(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	for _, addr := range listenAddrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+		go fw.Serve(ln)
+	}
+
+	<-ctx.Done()
+	fw.Close()
+}
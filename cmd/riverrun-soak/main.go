@@ -0,0 +1,44 @@
+// Command riverrun-soak runs randomized riverrun connection pairs in
+// process for a while, failing on corrupted payload, leaked goroutines or
+// unbounded memory.  It is meant to run before a release:
+//
+//	riverrun-soak -duration 1h -concurrency 32
+//
+// A failing run prints its seed, which repeats it with -seed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	stdlog "log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/v2fly/riverrun/internal/soak"
+)
+
+func main() {
+	var opts soak.Options
+	flag.DurationVar(&opts.Duration, "duration", 10*time.Minute, "how long to run, 0 until interrupted")
+	flag.Uint64Var(&opts.Pairs, "pairs", 0, "number of pairs to run, 0 until the duration passed")
+	flag.IntVar(&opts.Concurrency, "concurrency", soak.DefaultConcurrency, "number of pairs running at once")
+	flag.Int64Var(&opts.Seed, "seed", time.Now().UnixNano(), "seed of the settings and payloads")
+	flag.Uint64Var(&opts.MaxHeap, "max-heap", soak.DefaultMaxHeap, "bound of the heap in bytes")
+	flag.DurationVar(&opts.PairTimeout, "pair-timeout", soak.DefaultPairTimeout, "bound of the exchange of one pair")
+	flag.Parse()
+	opts.Logf = stdlog.Printf
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	start := time.Now()
+	report, err := soak.Run(ctx, opts)
+	if report != nil {
+		fmt.Printf("%d pairs, %d bytes in %s, heap up to %d bytes\n", report.Pairs, report.Bytes, time.Since(start).Round(time.Second), report.MaxHeap)
+	}
+	if err != nil {
+		stdlog.Fatalf("seed %d: %s", opts.Seed, err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/forward"
+)
+
+// errAdminAddr is the error returned by listenAdmin for a TCP address other
+// hosts could reach.
+var errAdminAddr = errors.New("admin: TCP address must be on loopback")
+
+// listenAdmin listens on addr, a loopback TCP address or unix:path.  A stale
+// socket at path is replaced, and only the owner may connect to a new one.
+func listenAdmin(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if !isLoopback(host) {
+			return nil, errAdminAddr
+		}
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return listenUnixPrivate(path)
+}
+
+// isLoopback reports whether host, a name or IP address, is on loopback.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminHandler serves the admin endpoints of fw:
+//
+//	GET  /sessions[?format=text]  live connections and their stats
+//	POST /sessions/close?id=N     close a connection
+//	GET  /cache                   table cache occupancy
+//
+// Requests from browsers are refused, so that web pages can not reach the
+// endpoint, see guardAdmin.  tcp tells that it is served over TCP.
+func adminHandler(fw *forward.Forwarder, tcp bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sessions := fw.Sessions()
+		if r.URL.Query().Get("format") == "text" {
+			writeSessions(w, sessions)
+			return
+		}
+		writeJSON(w, sessions)
+	})
+	mux.HandleFunc("/sessions/close", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		if !fw.CloseSession(id) {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, riverrun.TableCache())
+	})
+	return guardAdmin(mux, tcp)
+}
+
+// guardAdmin refuses the requests of browsers to next: those naming an
+// Origin or a cross-site fetch, as pages send them against 127.0.0.1, and
+// with tcp, those for a Host other than loopback, as pages send them after
+// rebinding their own name to 127.0.0.1.  curl sends neither.
+func guardAdmin(next http.Handler, tcp bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		site := r.Header.Get("Sec-Fetch-Site")
+		if r.Header.Get("Origin") != "" || site != "" && site != "none" {
+			http.Error(w, "cross-origin requests refused", http.StatusForbidden)
+			return
+		}
+		if tcp {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if !isLoopback(host) {
+				http.Error(w, "host must be on loopback", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeSessions writes sessions as a table for the terminal.
+func writeSessions(w http.ResponseWriter, sessions []forward.Session) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tREMOTE\tTARGET\tAGE\tIN\tOUT\tWIRE IN\tWIRE OUT\tTRACE")
+	for _, s := range sessions {
+		var stats riverrun.Stats
+		if s.Stats != nil {
+			stats = *s.Stats
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n", s.ID, s.Remote, s.Target,
+			time.Since(s.Started).Round(time.Second), stats.BytesIn, stats.BytesOut,
+			stats.WireBytesIn, stats.WireBytesOut, s.TraceID)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/v2fly/riverrun/forward"
+)
+
+func TestAdminGuard(t *testing.T) {
+	h := adminHandler(new(forward.Forwarder), true)
+	for _, tc := range []struct {
+		method, target string
+		header         map[string]string
+		want           int
+	}{
+		{"GET", "http://127.0.0.1/sessions", nil, http.StatusOK},
+		{"POST", "http://localhost:9/sessions/close?id=1", nil, http.StatusNotFound},
+		{"POST", "http://127.0.0.1/sessions/close?id=1", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"POST", "http://127.0.0.1/sessions/close?id=1", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"GET", "http://evil.example/sessions", nil, http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %s %v: status %d, want %d", tc.method, tc.target, tc.header, w.Code, tc.want)
+		}
+	}
+}
+
+func TestListenAdmin(t *testing.T) {
+	if _, err := listenAdmin("0.0.0.0:0"); err != errAdminAddr {
+		t.Fatalf("listenAdmin(0.0.0.0:0) = %v, want %v", err, errAdminAddr)
+	}
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := listenAdmin("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		t.Fatalf("socket mode %v, want owner only", perm)
+	}
+}
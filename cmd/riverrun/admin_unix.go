@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnixPrivate listens on a unix socket at path that only the owner
+// may connect to.  The socket is created under a umask, so that it is never
+// open to others, not even until a chmod.  The umask is process wide, which
+// is fine at startup.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
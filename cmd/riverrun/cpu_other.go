@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// cpuTime returns 0, process CPU time is only measured on Unix.
+func cpuTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,323 @@
+// Command riverrun is a TCP port forwarder that obfuscates the forwarded
+// connections with riverrun.
+//
+// Usage:
+//
+//	riverrun genseed
+//	riverrun server -listen :443 -forward 127.0.0.1:8080 -seed-file seed.txt
+//	riverrun client -listen 127.0.0.1:1080 -forward bridge.example:443 -seed-file seed.txt
+//	riverrun speedtest -duration 10s -direction both -pattern random
+//
+// With -socks the client is a SOCKS5 proxy instead, and the server must be
+// started with -dynamic (and no -forward) to connect to the requested
+// targets.  It refuses loopback and link-local targets unless -allow lists
+// their networks, and those -deny lists.
+//
+// With -transparent redirect or -transparent tproxy (and no -forward), the
+// server is deployed behind a Linux router which diverts the carriers to it
+// with the netfilter REDIRECT or TPROXY targets, and connects each tunnel to
+// the original destination of its carrier.  TPROXY needs CAP_NET_ADMIN.
+//
+// With -admin unix:/run/riverrun.sock (or a loopback TCP address) a local HTTP
+// endpoint lists the live connections with their stats, as JSON or with
+// ?format=text as a table, closes them and reports the table cache:
+//
+//	curl --unix-socket /run/riverrun.sock http://admin/sessions?format=text
+//	curl --unix-socket /run/riverrun.sock -X POST http://admin/sessions/close?id=3
+//
+// speedtest runs a client and a server of the given profile over loopback TCP
+// in one process, and reports the round trip, goodput, wire bytes, expansion
+// and CPU use, to tune a deployment for its hardware.
+//
+// On SIGHUP the seed file and profile are re-read and apply to new
+// connections.  With -storm-failures a client does so on its own, also
+// deriving the tables afresh, once that many connections failed to decode
+// within -storm-window, e.g. after the server changed profile.  On SIGINT or
+// SIGTERM the listener is closed and active connections are given
+// -shutdown-timeout to finish.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/common/framing"
+	_ "github.com/v2fly/riverrun/common/fte"
+	"github.com/v2fly/riverrun/common/log"
+	"github.com/v2fly/riverrun/forward"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <client|server|speedtest|genseed> [flags]\n", os.Args[0])
+	os.Exit(2)
+}
+
+type options struct {
+	listen          string
+	forward         string
+	seed            string
+	seedFile        string
+	profile         string
+	profileFile     string
+	logLevel        string
+	shutdownTimeout time.Duration
+	socks           bool
+	dynamic         bool
+	policy          forward.Policy
+	transparent     string
+	keyLogFile      string
+	personalization string
+	codec           string
+	maxFrame        int
+	admin           string
+	socket          riverrun.SocketOptions
+	stormFailures   int
+	stormWindow     time.Duration
+
+	keyLog *os.File
+	// storm is the detector of -storm-failures, kept across reloads.  Its
+	// storms request a reload on reloads.
+	storm   *riverrun.StormDetector
+	reloads chan struct{}
+}
+
+func parseFlags(name string, args []string) *options {
+	opts := new(options)
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&opts.listen, "listen", "", "address to listen on")
+	fs.StringVar(&opts.forward, "forward", "", "address to forward connections to")
+	fs.StringVar(&opts.seed, "seed", "", "shared seed in hex")
+	fs.StringVar(&opts.seedFile, "seed-file", "", "file holding the shared seed in hex, re-read on SIGHUP")
+	fs.StringVar(&opts.profile, "profile", riverrun.DefaultProfile, "profile, one of "+strings.Join(riverrun.ProfileNames(), ", "))
+	fs.StringVar(&opts.profileFile, "profile-file", "", "YAML or JSON profile file replacing -profile, re-read on SIGHUP")
+	fs.StringVar(&opts.logLevel, "loglevel", "info", "log level, one of none, info, debug")
+	fs.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 10*time.Second, "time given to active connections on shutdown")
+	fs.StringVar(&opts.personalization, "personalization", "", "string mixed into the seed, the same on both ends, e.g. the server hostname")
+	fs.StringVar(&opts.codec, "codec", "", "frame codec, one of "+strings.Join(append([]string{riverrun.CodecCtstretch}, framing.CodecNames()...), ", "))
+	fs.IntVar(&opts.maxFrame, "max-frame", 0, "largest frame in bytes, the same on both ends, 0 for the default")
+	fs.BoolVar(&opts.socket.Nagle, "nagle", false, "enable Nagle's algorithm on the riverrun side")
+	fs.IntVar(&opts.socket.SendBuffer, "sndbuf", 0, "socket send buffer size of the riverrun side, 0 for the system default")
+	fs.IntVar(&opts.socket.ReceiveBuffer, "rcvbuf", 0, "socket receive buffer size of the riverrun side, 0 for the system default")
+	fs.DurationVar(&opts.socket.KeepAlive, "keepalive", 0, "TCP keepalive period of the riverrun side, 0 for the default, negative to disable")
+	fs.StringVar(&opts.admin, "admin", "", "serve the local admin endpoint on this TCP address or unix:path")
+	fs.StringVar(&opts.keyLogFile, "keylog", "", "append connection secrets to this file for lab analysis (insecure)")
+	if name == "client" {
+		fs.BoolVar(&opts.socks, "socks", false, "accept SOCKS5 connections and tunnel them to a -dynamic server")
+		fs.IntVar(&opts.stormFailures, "storm-failures", 0, "reload and derive the tables afresh once this many connections fail to decode within -storm-window, 0 to disable")
+		fs.DurationVar(&opts.stormWindow, "storm-window", time.Minute, "window of -storm-failures")
+	} else {
+		fs.BoolVar(&opts.dynamic, "dynamic", false, "connect to the targets requested by -socks clients")
+		fs.Func("allow", "comma separated networks a -dynamic server may connect to despite being loopback or link-local", func(s string) (err error) {
+			opts.policy.Allow, err = forward.ParseNetworks(s)
+			return
+		})
+		fs.Func("deny", "comma separated networks a -dynamic server refuses to connect to", func(s string) (err error) {
+			opts.policy.Deny, err = forward.ParseNetworks(s)
+			return
+		})
+		fs.StringVar(&opts.transparent, "transparent", "", "connect to the original destinations of redirected carriers, redirect or tproxy")
+	}
+	fs.Parse(args)
+
+	switch opts.transparent {
+	case "", "redirect", "tproxy":
+	default:
+		stdlog.Fatalf("%s: -transparent must be redirect or tproxy", name)
+	}
+	if opts.dynamic && opts.transparent != "" {
+		stdlog.Fatalf("%s: -dynamic and -transparent are exclusive", name)
+	}
+	if opts.listen == "" || (opts.forward == "") != (opts.dynamic || opts.transparent != "") {
+		stdlog.Fatalf("%s: -listen and either -forward, -dynamic or -transparent are required", name)
+	}
+	if (opts.seed == "") == (opts.seedFile == "") {
+		stdlog.Fatalf("%s: exactly one of -seed and -seed-file is required", name)
+	}
+	return opts
+}
+
+// load returns the seed and Config described by opts.
+func (opts *options) load() (*drbg.Seed, *riverrun.Config, error) {
+	seedHex := opts.seed
+	if opts.seedFile != "" {
+		raw, err := os.ReadFile(opts.seedFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		seedHex = strings.TrimSpace(string(raw))
+	}
+	seed, err := drbg.SeedFromHex(seedHex)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config *riverrun.Config
+	if opts.profileFile != "" {
+		config, err = riverrun.LoadProfile(opts.profileFile)
+	} else {
+		config, err = riverrun.LookupProfile(opts.profile)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.Logger, err = log.NewLogger(opts.logLevel); err != nil {
+		return nil, nil, err
+	}
+	if opts.keyLog != nil {
+		config.KeyLog = opts.keyLog
+	}
+	config.Personalization = opts.personalization
+	config.DecodeStorm = opts.storm
+	if opts.codec != "" {
+		config.Codec = opts.codec
+	}
+	if opts.maxFrame != 0 {
+		config.MaxFrameLength = opts.maxFrame
+	}
+	return seed, config, nil
+}
+
+func run(isServer bool, opts *options) error {
+	if opts.keyLogFile != "" {
+		f, err := os.OpenFile(opts.keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		opts.keyLog = f
+	}
+	opts.reloads = make(chan struct{}, 1)
+	if opts.stormFailures > 0 {
+		opts.storm = riverrun.NewStormDetector(opts.stormFailures, opts.stormWindow)
+		opts.storm.OnStorm = func(*riverrun.Conn) {
+			select {
+			case opts.reloads <- struct{}{}:
+			default:
+			}
+		}
+	}
+	seed, config, err := opts.load()
+	if err != nil {
+		return err
+	}
+	var fw *forward.Forwarder
+	switch {
+	case opts.socks:
+		fw = forward.NewSocks(opts.forward, seed, config)
+	case opts.dynamic:
+		fw = forward.NewDynamic(seed, config)
+	case opts.transparent == "redirect":
+		fw = forward.NewTransparent(forward.Redirect, seed, config)
+	case opts.transparent == "tproxy":
+		fw = forward.NewTransparent(forward.TProxy, seed, config)
+	default:
+		fw = forward.New(isServer, opts.forward, seed, config)
+	}
+	fw.Socket = opts.socket
+	fw.Policy = opts.policy
+
+	if opts.admin != "" {
+		aln, err := listenAdmin(opts.admin)
+		if err != nil {
+			return err
+		}
+		_, tcp := aln.Addr().(*net.TCPAddr)
+		admin := &http.Server{Handler: adminHandler(fw, tcp), ReadHeaderTimeout: 10 * time.Second}
+		go admin.Serve(aln)
+		defer admin.Close()
+		config.Logger.Infof("riverrun: admin endpoint on %s", aln.Addr())
+	}
+
+	var ln net.Listener
+	if opts.transparent == "tproxy" {
+		ln, err = forward.ListenTProxy(context.Background(), "tcp", opts.listen)
+	} else {
+		ln, err = net.Listen("tcp", opts.listen)
+	}
+	if err != nil {
+		return err
+	}
+	config.Logger.Infof("riverrun: listening on %s", ln.Addr())
+
+	served := make(chan error, 1)
+	go func() { served <- fw.Serve(ln) }()
+
+	reload := func() {
+		seed, config, err := opts.load()
+		if err != nil {
+			stdlog.Printf("riverrun: reload failed: %s", err)
+			return
+		}
+		changed := fw.Update(seed, config)
+		if len(changed) == 0 {
+			config.Logger.Infof("riverrun: reloaded, nothing changed")
+		} else {
+			config.Logger.Infof("riverrun: reloaded, changed: %s", strings.Join(changed, ", "))
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case err := <-served:
+			return err
+		case <-opts.reloads:
+			config.Logger.Infof("riverrun: decode failure storm, reloading")
+			reload()
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				reload()
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+			if err := fw.Shutdown(ctx); err != nil {
+				stdlog.Printf("riverrun: closed remaining connections: %s", err)
+			}
+			cancel()
+			if err := <-served; !errors.Is(err, forward.ErrServerClosed) {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+func main() {
+	stdlog.SetPrefix("[riverrun] ")
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch cmd := os.Args[1]; cmd {
+	case "genseed":
+		seed, err := drbg.NewSeed()
+		if err != nil {
+			stdlog.Fatal(err)
+		}
+		fmt.Println(seed.Hex())
+	case "client", "server":
+		if err := run(cmd == "server", parseFlags(cmd, os.Args[2:])); err != nil {
+			stdlog.Fatal(err)
+		}
+	case "speedtest":
+		if err := speedtest(parseSpeedtestFlags(os.Args[2:])); err != nil {
+			stdlog.Fatal(err)
+		}
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/common/framing"
+)
+
+// speedtestOptions are the flags of the speedtest subcommand.
+type speedtestOptions struct {
+	options
+	duration  time.Duration
+	direction string
+	pattern   string
+	writeSize int
+}
+
+func parseSpeedtestFlags(args []string) *speedtestOptions {
+	opts := new(speedtestOptions)
+	fs := flag.NewFlagSet("speedtest", flag.ExitOnError)
+	fs.DurationVar(&opts.duration, "duration", 5*time.Second, "time to send for")
+	fs.StringVar(&opts.direction, "direction", "both", "direction to send in, one of up, down, both")
+	fs.StringVar(&opts.pattern, "pattern", "random", "payload pattern, one of zero, random, text")
+	fs.IntVar(&opts.writeSize, "write-size", 32*1024, "bytes per Write")
+	fs.StringVar(&opts.seed, "seed", "", "shared seed in hex, a fresh one by default")
+	fs.StringVar(&opts.profile, "profile", riverrun.DefaultProfile, "profile, one of "+strings.Join(riverrun.ProfileNames(), ", "))
+	fs.StringVar(&opts.profileFile, "profile-file", "", "YAML or JSON profile file replacing -profile")
+	fs.StringVar(&opts.logLevel, "loglevel", "none", "log level, one of none, info, debug")
+	fs.StringVar(&opts.personalization, "personalization", "", "string mixed into the seed")
+	fs.StringVar(&opts.codec, "codec", "", "frame codec, one of "+strings.Join(append([]string{riverrun.CodecCtstretch}, framing.CodecNames()...), ", "))
+	fs.IntVar(&opts.maxFrame, "max-frame", 0, "largest frame in bytes, 0 for the default")
+	fs.Parse(args)
+
+	switch opts.direction {
+	case "up", "down", "both":
+	default:
+		fmt.Fprintln(os.Stderr, "speedtest: -direction must be up, down or both")
+		os.Exit(2)
+	}
+	switch opts.pattern {
+	case "zero", "random", "text":
+	default:
+		fmt.Fprintln(os.Stderr, "speedtest: -pattern must be zero, random or text")
+		os.Exit(2)
+	}
+	if opts.duration <= 0 || opts.writeSize <= 0 {
+		fmt.Fprintln(os.Stderr, "speedtest: -duration and -write-size must be positive")
+		os.Exit(2)
+	}
+	return opts
+}
+
+// payload returns a Write buffer of the pattern of opts.
+func (opts *speedtestOptions) payload() []byte {
+	b := make([]byte, opts.writeSize)
+	switch opts.pattern {
+	case "random":
+		rand.Read(b)
+	case "text":
+		for i := range b {
+			b[i] = "riverrun speedtest "[i%19]
+		}
+	}
+	return b
+}
+
+// counter is an io.Writer counting what it is given.
+type counter struct {
+	n atomic.Int64
+}
+
+func (c *counter) Write(b []byte) (int, error) {
+	c.n.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// speedtest runs a client and a server over loopback TCP in this process and
+// reports the round trip, goodput, wire bytes and CPU use of the profile on
+// this machine.
+func speedtest(opts *speedtestOptions) error {
+	if opts.seed == "" {
+		seed, err := drbg.NewSeed()
+		if err != nil {
+			return err
+		}
+		opts.seed = seed.Hex()
+	}
+	seed, config, err := opts.load()
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	rl := &riverrun.Listener{Listener: ln, Seed: seed, Config: config}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := rl.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	carrier, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	client, err := riverrun.NewConnConfig(context.Background(), carrier, false, seed, config)
+	if err != nil {
+		carrier.Close()
+		return err
+	}
+	defer client.Close()
+	conn, ok := <-accepted
+	if !ok {
+		return errors.New("speedtest: accept failed")
+	}
+	server := conn.(*riverrun.Conn)
+	defer server.Close()
+
+	var up, down counter
+	go io.Copy(&up, server)
+	go io.Copy(&down, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	probe, err := client.Probe(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("speedtest: probe: %w", err)
+	}
+	upStart, downStart := up.n.Load(), down.n.Load()
+	clientStart, serverStart := client.Snapshot(), server.Snapshot()
+	cpuStart := cpuTime()
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	send := func(rr *riverrun.Conn) {
+		defer wg.Done()
+		b := opts.payload()
+		for !stop.Load() {
+			if _, err := rr.Write(b); err != nil {
+				return
+			}
+		}
+	}
+	if opts.direction != "down" {
+		wg.Add(1)
+		go send(client)
+	}
+	if opts.direction != "up" {
+		wg.Add(1)
+		go send(server)
+	}
+	start := time.Now()
+	time.Sleep(opts.duration)
+	elapsed := time.Since(start).Seconds()
+	upBytes, downBytes := up.n.Load()-upStart, down.n.Load()-downStart
+	clientEnd, serverEnd := client.Snapshot(), server.Snapshot()
+	cpu := cpuTime() - cpuStart
+	stop.Store(true)
+	// Unblock writers waiting on a full carrier.
+	client.Close()
+	server.Close()
+	wg.Wait()
+
+	payload := clientEnd.BytesOut - clientStart.BytesOut + serverEnd.BytesOut - serverStart.BytesOut
+	wire := clientEnd.WireBytesOut - clientStart.WireBytesOut + serverEnd.WireBytesOut - serverStart.WireBytesOut
+	mbits := func(n int64) string { return fmt.Sprintf("%.1f Mbit/s", float64(n)*8/elapsed/1e6) }
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "direction\t%s, %s payload in %d byte writes, %s\n", opts.direction, opts.pattern, opts.writeSize, opts.duration)
+	fmt.Fprintf(tw, "rtt\t%s\n", probe.RTT)
+	if opts.direction != "down" {
+		fmt.Fprintf(tw, "up\t%s\n", mbits(upBytes))
+	}
+	if opts.direction != "up" {
+		fmt.Fprintf(tw, "down\t%s\n", mbits(downBytes))
+	}
+	fmt.Fprintf(tw, "wire\t%d bytes, %s\n", wire, mbits(int64(wire)))
+	if payload > 0 {
+		fmt.Fprintf(tw, "expansion\t%.3f\n", float64(wire)/float64(payload))
+	}
+	if cpu > 0 {
+		fmt.Fprintf(tw, "cpu\t%.2f cores\n", cpu.Seconds()/elapsed)
+	}
+	return tw.Flush()
+}
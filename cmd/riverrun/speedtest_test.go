@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSpeedtest(t *testing.T) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	err = speedtest(parseSpeedtestFlags([]string{"-duration", "100ms", "-write-size", "4096"}))
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("speedtest: %v", err)
+	}
+	b, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"rtt", "up", "down", "wire", "expansion"} {
+		if !strings.Contains(string(b), "\n"+line+" ") {
+			t.Errorf("speedtest output lacks %q:\n%s", line, b)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package riverrun
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"math/rand"
+
+	"github.com/v2fly/riverrun/common/ctstretch"
+	"github.com/v2fly/riverrun/common/drbg"
+	f "github.com/v2fly/riverrun/common/framing"
+	"github.com/v2fly/riverrun/common/log"
+)
+
+// CodecCtstretch names the built-in codec, which expands frames with the
+// biased tables derived from the seed.
+const CodecCtstretch = "ctstretch"
+
+// ctstretchCodec is the built-in codec, holding the tables of one direction.
+type ctstretchCodec struct {
+	table8  []uint64
+	table16 []uint64
+	inv8    ctstretch.Inversion
+	inv16   ctstretch.Inversion
+
+	compressedBlockBits uint64
+	expandedBlockBits   uint64
+
+	logger log.Logger
+}
+
+func (c *ctstretchCodec) ExpandedLen(n int) int {
+	return int(ctstretch.ExpandedNBytes(uint64(n), c.compressedBlockBits, c.expandedBlockBits))
+}
+
+func (c *ctstretchCodec) CompressedLen(n int) int {
+	return int(ctstretch.CompressedNBytes_floor(uint64(n), c.expandedBlockBits, c.compressedBlockBits))
+}
+
+func (c *ctstretchCodec) BlockLen() int {
+	return int(c.expandedBlockBits / 8)
+}
+
+func (c *ctstretchCodec) Expand(dst, src []byte, stream cipher.Stream) error {
+	return ctstretch.ExpandBytes(src, dst, c.compressedBlockBits, c.expandedBlockBits, c.table16, c.table8, stream, rand.Int(), c.logger)
+}
+
+func (c *ctstretchCodec) Compress(dst, src []byte, stream cipher.Stream) error {
+	return ctstretch.CompressBytesWith(src, dst, c.expandedBlockBits, c.compressedBlockBits, c.inv16, c.inv8, stream, rand.Int(), c.logger)
+}
+
+// expandCost is the keystream consumed by expanding n bytes.
+func (c *ctstretchCodec) expandCost(n int) uint64 {
+	blockBytes := int(c.compressedBlockBits / 8)
+	cost := uint64(n/blockBytes) * shuffleCost(c.expandedBlockBits)
+	if n%blockBytes != 0 {
+		cost += shuffleCost(c.expandedBlockBits / 2)
+	}
+	return cost
+}
+
+// codecLabel separates the codec randomness from the other uses of the seed.
+const codecLabel = "\x00riverrun codec "
+
+// newCodecs builds the write and read codecs of a connection with a
+// registered codec.
+func newCodecs(name string, isServer bool, seed *drbg.Seed, config *Config) (writeCodec, readCodec f.Codec, err error) {
+	factory, ok := f.LookupCodec(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("riverrun: unknown codec %q", name)
+	}
+	codec := func(dir string) (f.Codec, error) {
+		xdrbg, err := drbg.NewHashDrbgPersonalized(seed, []byte(config.Personalization+codecLabel+name+" "+dir))
+		if err != nil {
+			return nil, err
+		}
+		return factory(f.CodecParams{Rand: rand.New(xdrbg), Logger: config.Logger})
+	}
+	up, err := codec("c2s")
+	if err != nil {
+		return nil, nil, err
+	}
+	down, err := codec("s2c")
+	if err != nil {
+		return nil, nil, err
+	}
+	if isServer {
+		return down, up, nil
+	}
+	return up, down, nil
+}
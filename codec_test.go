@@ -0,0 +1,113 @@
+package riverrun
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"io"
+	"regexp"
+	"sync"
+	"testing"
+
+	f "github.com/v2fly/riverrun/common/framing"
+	"github.com/v2fly/riverrun/common/fte"
+)
+
+// nibbleCodec writes every nibble, masked with the keystream, as one of 16
+// letters drawn from the codec randomness.
+type nibbleCodec struct {
+	alphabet [16]byte
+	index    [256]byte
+}
+
+func (c *nibbleCodec) ExpandedLen(n int) int   { return 2 * n }
+func (c *nibbleCodec) CompressedLen(n int) int { return n / 2 }
+func (c *nibbleCodec) BlockLen() int           { return 2 }
+
+func (c *nibbleCodec) Expand(dst, src []byte, stream cipher.Stream) error {
+	masked := make([]byte, len(src))
+	stream.XORKeyStream(masked, src)
+	for i, b := range masked {
+		dst[2*i], dst[2*i+1] = c.alphabet[b>>4], c.alphabet[b&15]
+	}
+	return nil
+}
+
+func (c *nibbleCodec) Compress(dst, src []byte, stream cipher.Stream) error {
+	for i := range dst {
+		dst[i] = c.index[src[2*i]]<<4 | c.index[src[2*i+1]]
+	}
+	stream.XORKeyStream(dst, dst)
+	return nil
+}
+
+func init() {
+	f.RegisterCodec("test-nibble", func(params f.CodecParams) (f.Codec, error) {
+		c := new(nibbleCodec)
+		for i, j := range params.Rand.Perm(26)[:16] {
+			c.alphabet[i] = 'a' + byte(j)
+			c.index['a'+byte(j)] = byte(i)
+		}
+		return c, nil
+	})
+}
+
+func TestRegisteredCodec(t *testing.T) {
+	config := &Config{Codec: "test-nibble"}
+	client, server := newTestPair(t, config, config)
+	msg := bytes.Repeat([]byte("codec "), 1000)
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+
+	if _, err := NewConnConfig(context.Background(), nil, false, nil, &Config{Codec: "missing"}); err == nil {
+		t.Fatal("unknown codec accepted")
+	}
+}
+
+// captureScheduler keeps a copy of everything written.
+type captureScheduler struct {
+	Scheduler
+	lock *sync.Mutex
+	buf  *bytes.Buffer
+}
+
+func (s captureScheduler) Write(chunk []byte) error {
+	s.lock.Lock()
+	s.buf.Write(chunk)
+	s.lock.Unlock()
+	return s.Scheduler.Write(chunk)
+}
+
+func TestFTECodec(t *testing.T) {
+	var lock sync.Mutex
+	var wire bytes.Buffer
+	client, server := newTestPair(t, &Config{
+		Codec: fte.CodecBase64,
+		Scheduler: func(carrier io.Writer) Scheduler {
+			return captureScheduler{ImmediateScheduler()(carrier), &lock, &wire}
+		},
+	}, &Config{Codec: fte.CodecBase64})
+	msg := make([]byte, 5000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !regexp.MustCompile(`^[A-Za-z0-9+/]+$`).Match(wire.Bytes()) {
+		t.Fatal("wire bytes outside the base64 alphabet")
+	}
+}
@@ -0,0 +1,32 @@
+// Package ctr jumps CTR keystreams ahead in constant time.  Advancing a
+// cipher.Stream otherwise means XORing as many dummy bytes as are skipped.
+package ctr
+
+import "crypto/cipher"
+
+// CounterAt returns the counter block that produces the keystream offset
+// bytes past the start of iv, and the bytes of its keystream to skip.  The
+// counter is the whole IV taken as a big-endian number, as with
+// cipher.NewCTR.
+func CounterAt(iv []byte, blockSize int, offset uint64) (counter []byte, skip int) {
+	counter = append([]byte(nil), iv...)
+	carry := offset / uint64(blockSize)
+	for i := len(counter) - 1; i >= 0 && carry != 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	return counter, int(offset % uint64(blockSize))
+}
+
+// NewStreamAt returns a CTR stream of block and iv that starts offset bytes
+// into the keystream.
+func NewStreamAt(block cipher.Block, iv []byte, offset uint64) cipher.Stream {
+	counter, skip := CounterAt(iv, block.BlockSize(), offset)
+	stream := cipher.NewCTR(block, counter)
+	if skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	return stream
+}
@@ -0,0 +1,28 @@
+package ctr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+func TestNewStreamAt(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The low 64 bits are about to wrap and carry into the high ones.
+	iv := bytes.Repeat([]byte{0xff}, aes.BlockSize)
+	iv[0] = 0
+	keystream := make([]byte, 4096)
+	cipher.NewCTR(block, iv).XORKeyStream(keystream, keystream)
+
+	for _, offset := range []uint64{0, 1, 15, 16, 17, 255 * 16, 4000} {
+		got := make([]byte, len(keystream)-int(offset))
+		NewStreamAt(block, iv, offset).XORKeyStream(got, got)
+		if !bytes.Equal(got, keystream[offset:]) {
+			t.Errorf("offset %d: keystream mismatch", offset)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"sort"
 	"unsafe"
 
 	"github.com/v2fly/riverrun/common/log"
@@ -123,27 +124,18 @@ func SampleBiasedString(numBits uint64, bias float64, stream cipher.Stream) (uin
 }
 
 func SampleBiasedStrings(numBits, n uint64, bias float64, stream cipher.Stream) ([]uint64, error) {
-	vals := make([]uint64, n)
-	m := make(map[uint64]bool)
-	var err error
-	for idx := uint64(0); idx < n; idx += 1 {
-
-		s := uint64(0)
-		haveKey := true
-
-		for haveKey == true {
-			s, err = SampleBiasedString(numBits, bias, stream)
-			if err != nil {
-				return nil, err
-			}
-			_, haveKey = m[s]
-		}
+	return SampleBiasedStringsFunc(numBits, n, bias, stream, nil)
+}
 
-		vals[idx] = s
-		m[s] = true
-	}
+// SampleStep is the number of strings SampleTable samples between calls of
+// step.
+const SampleStep = 1024
 
-	return vals, nil
+// SampleBiasedStringsFunc is like SampleBiasedStrings, and calls step, if not
+// nil, with the number of strings sampled every SampleStep strings and once
+// done.  An error from step aborts the sampling and is returned.
+func SampleBiasedStringsFunc(numBits, n uint64, bias float64, stream cipher.Stream, step func(done uint64) error) ([]uint64, error) {
+	return SampleTable(Biased(bias), numBits, n, stream, step)
 }
 
 func InvertTable(vals []uint64) map[uint64]uint64 {
@@ -201,7 +193,9 @@ func ExpandBytes(src, dst []byte, inputBlockBits, outputBlockBits uint64, table1
 		}
 		return ExpandBytes(src[srcNBytes-1:], dst[uint64(srcNBytes-1)*outputBlockBytes/inputBlockBytes:], 8, outputBlockBits/2, table16, table8, stream, tb, logger)
 	}
-	logger.Debugf("Expanding to %f, tb: %d", uint64(srcNBytes)*outputBlockBytes/inputBlockBytes, tb)
+	if !log.Hardened {
+		logger.Debugf("Expanding to %f, tb: %d", uint64(srcNBytes)*outputBlockBytes/inputBlockBytes, tb)
+	}
 
 	var table *[]uint64
 	if inputBlockBits == 8 {
@@ -246,10 +240,79 @@ func ExpandBytes(src, dst []byte, inputBlockBits, outputBlockBits uint64, table1
 	return nil
 }
 
+// Inversion maps an expanded block back to its index in the forward table.
+// Values missing from the table map to 0.
+type Inversion interface {
+	Lookup(v uint64) uint64
+}
+
+// MapInversion is the inverted table built by InvertTable.  Lookups take
+// time depending on the value looked up.
+type MapInversion map[uint64]uint64
+
+func (m MapInversion) Lookup(v uint64) uint64 {
+	return m[v]
+}
+
+// ScanInversion looks values up by scanning the whole forward table, without
+// branches or memory accesses that depend on the value, so that its timing
+// does not leak the plaintext to co-located processes.  It is many orders of
+// magnitude slower than MapInversion.
+type ScanInversion []uint64
+
+func (t ScanInversion) Lookup(v uint64) uint64 {
+	var res uint64
+	for i, x := range t {
+		d := x ^ v
+		// eq is all ones iff d is zero.
+		eq := ((d | -d) >> 63) - 1
+		res |= uint64(i) & eq
+	}
+	return res
+}
+
+// SortedInversion looks values up by binary search over the forward table
+// sorted by value.  It takes a fraction of the memory of MapInversion, and
+// somewhat more time per lookup.
+type SortedInversion struct {
+	vals []uint64
+	idx  []uint32
+}
+
+// NewSortedInversion returns the SortedInversion of table.
+func NewSortedInversion(table []uint64) *SortedInversion {
+	order := make([]uint32, len(table))
+	for i := range order {
+		order[i] = uint32(i)
+	}
+	sort.Slice(order, func(i, j int) bool { return table[order[i]] < table[order[j]] })
+	s := &SortedInversion{vals: make([]uint64, len(table)), idx: order}
+	for i, j := range order {
+		s.vals[i] = table[j]
+	}
+	return s
+}
+
+func (s *SortedInversion) Lookup(v uint64) uint64 {
+	i := sort.Search(len(s.vals), func(i int) bool { return s.vals[i] >= v })
+	if i == len(s.vals) || s.vals[i] != v {
+		return 0
+	}
+	return uint64(s.idx[i])
+}
+
 func CompressBytes(src, dst []byte, inputBlockBits, outputBlockBits uint64, inversion16, inversion8 map[uint64]uint64, stream cipher.Stream, tb int, logger log.Logger) error {
+	return CompressBytesWith(src, dst, inputBlockBits, outputBlockBits, MapInversion(inversion16), MapInversion(inversion8), stream, tb, logger)
+}
+
+// CompressBytesWith is CompressBytes with the table inversions given as
+// Inversion.
+func CompressBytesWith(src, dst []byte, inputBlockBits, outputBlockBits uint64, inversion16, inversion8 Inversion, stream cipher.Stream, tb int, logger log.Logger) error {
 	// XXX: tb is for tracing purposes. Remove before release.
 	srcNBytes := len(src) // 1: 1074 2: 2
-	logger.Debugf("srcNBytes: %d, iBB: %d, oBB: %d, tb: %d", srcNBytes, inputBlockBits, outputBlockBits, tb)
+	if !log.Hardened {
+		logger.Debugf("srcNBytes: %d, iBB: %d, oBB: %d, tb: %d", srcNBytes, inputBlockBits, outputBlockBits, tb)
+	}
 	if inputBlockBits%8 != 0 || inputBlockBits > 64 {
 		return fmt.Errorf("ctstretch/bit_manip: input block size must be a multiple of 8 and less than 64")
 	}
@@ -271,27 +334,25 @@ func CompressBytes(src, dst []byte, inputBlockBits, outputBlockBits uint64, inve
 	blocks := uint64(srcNBytes) / inputBlockBytes   // 1: 134 2: 0
 	if (uint64(srcNBytes) % inputBlockBytes) != 0 { // 1: True (=2) 2: True (=2)
 		if blocks == 0 { // 1: False // 2: True
-			return CompressBytes(src, dst, inputBlockBits/2, outputBlockBits/2, inversion16, inversion8, stream, tb, logger)
+			return CompressBytesWith(src, dst, inputBlockBits/2, outputBlockBits/2, inversion16, inversion8, stream, tb, logger)
 		}
 
 		endSrc := blocks * inputBlockBytes  // 1072
 		endDst := blocks * outputBlockBytes // 268
-		err := CompressBytes(src[0:endSrc], dst[0:endDst], inputBlockBits, outputBlockBits, inversion16, inversion8, stream, tb, logger)
+		err := CompressBytesWith(src[0:endSrc], dst[0:endDst], inputBlockBits, outputBlockBits, inversion16, inversion8, stream, tb, logger)
 		if err != nil {
 			return err
 		}
-		return CompressBytes(src[endSrc:], dst[endDst:], inputBlockBits/2, outputBlockBits/2, inversion16, inversion8, stream, tb, logger)
+		return CompressBytesWith(src[endSrc:], dst[endDst:], inputBlockBits/2, outputBlockBits/2, inversion16, inversion8, stream, tb, logger)
 
 	}
 
 	inputIdx := uint64(0)
 	outputIdx := uint64(0)
 
-	var inversion *map[uint64]uint64
+	inversion := inversion16
 	if outputBlockBits == 8 {
-		inversion = &inversion8
-	} else {
-		inversion = &inversion16
+		inversion = inversion8
 	}
 	for ; inputIdx < uint64(srcNBytes); inputIdx = inputIdx + inputBlockBytes {
 		err := BitShuffle(src[inputIdx:inputIdx+inputBlockBytes], stream, true)
@@ -304,7 +365,7 @@ func CompressBytes(src, dst []byte, inputBlockBits, outputBlockBits uint64, inve
 		y = 0
 		copy((*[unsafe.Sizeof(x)]byte)(unsafe.Pointer(&x))[:],
 			src[inputIdx:inputIdx+inputBlockBytes])
-		y = (*inversion)[x]
+		y = inversion.Lookup(x)
 		if outputBlockBytes == 1 {
 			z := uint8(y)
 			dst[outputIdx] = z
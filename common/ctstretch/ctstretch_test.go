@@ -1,20 +1,28 @@
-package ctstretch
+package ctstretch_test
 
 import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"fmt"
+	"errors"
+	"testing"
+
+	"github.com/v2fly/riverrun/common/ctstretch"
 )
 
-func main() {
+type nopLogger struct{}
+
+func (nopLogger) Infof(format string, a ...interface{})  {}
+func (nopLogger) Debugf(format string, a ...interface{}) {}
+
+func TestRoundTrip(t *testing.T) {
 	key := make([]byte, 16)
 	rand.Read(key)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		t.Fatal(err)
 	}
 
 	iv := make([]byte, block.BlockSize())
@@ -29,22 +37,31 @@ func main() {
 	outputNBits8 := []uint64{16, 24, 32, 40, 48, 56, 64}
 	outputNBits16 := []uint64{32, 48, 64}
 
-	for _, msgLen := range msgLens {
-		for _, outputNBits := range outputNBits8 {
-			runTest(msgLen, 8, outputNBits, bias, streamClient, streamServer)
-		}
+	for _, outputNBits := range outputNBits8 {
+		runTest(t, msgLens, 8, outputNBits, bias, streamClient, streamServer)
+	}
 
-		for _, outputNBits := range outputNBits16 {
-			runTest(msgLen, 16, outputNBits, bias, streamClient, streamServer)
-		}
+	for _, outputNBits := range outputNBits16 {
+		runTest(t, msgLens, 16, outputNBits, bias, streamClient, streamServer)
 	}
 }
 
-func runTest(msgNBytes, inputBlockBits, outputBlockBits uint64, bias float64,
+func runTest(t *testing.T, msgLens []uint64, inputBlockBits, outputBlockBits uint64, bias float64,
 	streamClient, streamServer cipher.Stream) {
 
-	clientTable16 := ctstretch.SampleBiasedStrings(outputBlockBits, 65536, bias, streamClient)
-	serverTable16 := ctstretch.InvertTable(ctstretch.SampleBiasedStrings(outputBlockBits, 65536, bias, streamServer))
+	var clientTable16, serverTable16Fwd []uint64
+	var err error
+	if inputBlockBits == 16 {
+		clientTable16, err = ctstretch.SampleBiasedStrings(outputBlockBits, 65536, bias, streamClient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverTable16Fwd, err = ctstretch.SampleBiasedStrings(outputBlockBits, 65536, bias, streamServer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	serverTable16 := ctstretch.InvertTable(serverTable16Fwd)
 
 	var outputBlockBits8 uint64
 	if inputBlockBits == 8 {
@@ -53,24 +70,204 @@ func runTest(msgNBytes, inputBlockBits, outputBlockBits uint64, bias float64,
 		outputBlockBits8 = outputBlockBits / 2
 	}
 
-	clientTable8 := ctstretch.SampleBiasedStrings(outputBlockBits8, 256, bias, streamClient)
-	serverTable8 := ctstretch.InvertTable(ctstretch.SampleBiasedStrings(outputBlockBits8, 256, bias, streamServer))
+	clientTable8, err := ctstretch.SampleBiasedStrings(outputBlockBits8, 256, bias, streamClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTable8Fwd, err := ctstretch.SampleBiasedStrings(outputBlockBits8, 256, bias, streamServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTable8 := ctstretch.InvertTable(serverTable8Fwd)
 
-	msg := make([]byte, msgNBytes)
-	expandedNBytes := ctstretch.ExpandedNBytes(msgNBytes, inputBlockBits, outputBlockBits)
-	compressedNBytes := ctstretch.CompressedNBytes(expandedNBytes, outputBlockBits, inputBlockBits)
+	for _, msgNBytes := range msgLens {
+		msg := make([]byte, msgNBytes)
+		expandedNBytes := ctstretch.ExpandedNBytes(msgNBytes, inputBlockBits, outputBlockBits)
+		compressedNBytes := ctstretch.CompressedNBytes(expandedNBytes, outputBlockBits, inputBlockBits)
 
-	expanded := make([]byte, expandedNBytes)
-	rand.Read(msg)
-	compressed := make([]byte, compressedNBytes)
+		expanded := make([]byte, expandedNBytes)
+		rand.Read(msg)
+		compressed := make([]byte, compressedNBytes)
 
-	ctstretch.ExpandBytes(msg[:], expanded, inputBlockBits, outputBlockBits, clientTable16, clientTable8, streamClient)
-	ctstretch.CompressBytes(expanded, compressed, outputBlockBits, inputBlockBits, serverTable16, serverTable8, streamServer)
+		if err := ctstretch.ExpandBytes(msg[:], expanded, inputBlockBits, outputBlockBits, clientTable16, clientTable8, streamClient, 0, nopLogger{}); err != nil {
+			t.Fatalf("ExpandBytes(%d, %d, %d): %v", msgNBytes, inputBlockBits, outputBlockBits, err)
+		}
+		if err := ctstretch.CompressBytes(expanded, compressed, outputBlockBits, inputBlockBits, serverTable16, serverTable8, streamServer, 0, nopLogger{}); err != nil {
+			t.Fatalf("CompressBytes(%d, %d, %d): %v", msgNBytes, inputBlockBits, outputBlockBits, err)
+		}
 
-	if bytes.Equal(msg, compressed) {
-		fmt.Println("Pass:", msgNBytes, inputBlockBits, outputBlockBits)
-	} else {
-		fmt.Println(msg, compressed)
-		fmt.Println("Fail:", msgNBytes, inputBlockBits, outputBlockBits)
+		if !bytes.Equal(msg, compressed) {
+			t.Errorf("Fail: %d %d %d: %v != %v", msgNBytes, inputBlockBits, outputBlockBits, msg, compressed)
+		}
+	}
+}
+
+func TestScanInversion(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := cipher.NewCTR(block, make([]byte, block.BlockSize()))
+
+	table, err := ctstretch.SampleBiasedStrings(32, 65536, 0.55, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapInv := ctstretch.MapInversion(ctstretch.InvertTable(table))
+	scanInv := ctstretch.ScanInversion(table)
+	sortedInv := ctstretch.NewSortedInversion(table)
+
+	values := []uint64{0, 1, ^uint64(0)}
+	for i := 0; i < 256; i++ {
+		values = append(values, table[i*251%len(table)])
+	}
+	var buf [8]byte
+	for i := 0; i < 64; i++ {
+		rand.Read(buf[:])
+		values = append(values, uint64(buf[0])|uint64(buf[1])<<8|uint64(buf[2])<<16|uint64(buf[3])<<24)
+	}
+	for _, v := range values {
+		if got, want := scanInv.Lookup(v), mapInv.Lookup(v); got != want {
+			t.Fatalf("Lookup(%#x) = %d, want %d", v, got, want)
+		}
+		if got, want := sortedInv.Lookup(v), mapInv.Lookup(v); got != want {
+			t.Fatalf("sorted Lookup(%#x) = %d, want %d", v, got, want)
+		}
+	}
+}
+
+func TestLengthProperties(t *testing.T) {
+	var combos [][2]uint64
+	for out := uint64(16); out <= 64; out += 8 {
+		combos = append(combos, [2]uint64{8, out})
+	}
+	for out := uint64(32); out <= 64; out += 16 {
+		combos = append(combos, [2]uint64{16, out})
+	}
+	var buf [2]byte
+	for _, c := range combos {
+		in, out := c[0], c[1]
+		lens := []uint64{0, 1, 2, 3, 1447, 1448, 1449, 65535}
+		for i := 0; i < 64; i++ {
+			rand.Read(buf[:])
+			lens = append(lens, uint64(buf[0])|uint64(buf[1])<<8)
+		}
+		for _, n := range lens {
+			expanded := ctstretch.ExpandedNBytes(n, in, out)
+			if got := ctstretch.CompressedNBytes(expanded, out, in); got != n {
+				t.Fatalf("%d/%d: CompressedNBytes(ExpandedNBytes(%d)) = %d", in, out, n, got)
+			}
+			if got := ctstretch.CompressedNBytes_floor(expanded, out, in); got != n {
+				t.Fatalf("%d/%d: CompressedNBytes_floor(ExpandedNBytes(%d)) = %d", in, out, n, got)
+			}
+			// Any wire length decodes to no more than fits in it.
+			if got := ctstretch.ExpandedNBytes(ctstretch.CompressedNBytes_floor(n, out, in), in, out); got > n {
+				t.Fatalf("%d/%d: %d wire bytes hold %d expanded bytes", in, out, n, got)
+			}
+		}
+	}
+}
+
+func TestMarshalTable(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := ctstretch.SampleBiasedStrings(16, 256, 0.3, cipher.NewCTR(block, make([]byte, block.BlockSize())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ctstretch.MarshalTable(table, 16, key)
+	got, bits, err := ctstretch.UnmarshalTable(data, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits != 16 || len(got) != len(table) {
+		t.Fatalf("got %d entries of %d bits", len(got), bits)
+	}
+	for i := range got {
+		if got[i] != table[i] {
+			t.Fatalf("entry %d: got %#x, want %#x", i, got[i], table[i])
+		}
+	}
+
+	data[100] ^= 1
+	if _, _, err := ctstretch.UnmarshalTable(data, key); !errors.Is(err, ctstretch.ErrTableMAC) {
+		t.Fatalf("corrupted: got %v, want ErrTableMAC", err)
+	}
+	data[100] ^= 1
+	if _, _, err := ctstretch.UnmarshalTable(data, []byte("another key")); !errors.Is(err, ctstretch.ErrTableMAC) {
+		t.Fatalf("other key: got %v, want ErrTableMAC", err)
+	}
+}
+
+func TestSamplers(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := func() cipher.Stream { return cipher.NewCTR(block, make([]byte, block.BlockSize())) }
+
+	biased, err := ctstretch.SampleTable(ctstretch.Biased(0.3), 16, 256, stream(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ctstretch.SampleBiasedStrings(16, 256, 0.3, stream())
+	for i := range want {
+		if biased[i] != want[i] {
+			t.Fatalf("Biased entry %d: got %#x, want %#x", i, biased[i], want[i])
+		}
+	}
+
+	// Low byte always set, high byte fair.
+	bias := make(ctstretch.PositionBias, 16)
+	for i := 8; i < 16; i++ {
+		bias[i] = 0.5
+	}
+	table, err := ctstretch.SampleTable(bias, 16, 256, stream(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range table {
+		if v&0xff != 0xff {
+			t.Fatalf("PositionBias drew %#x", v)
+		}
+	}
+
+	// Every byte follows the one before it.
+	next := &ctstretch.Markov{Transitions: make([][]float64, 256)}
+	for b := range next.Transitions {
+		next.Transitions[b] = make([]float64, 256)
+		next.Transitions[b][(b+1)%256] = 1
+	}
+	if table, err = ctstretch.SampleTable(next, 16, 256, stream(), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range table {
+		if byte(v>>8) != byte(v)+1 {
+			t.Fatalf("Markov drew %#x", v)
+		}
+	}
+	next.Initial = []float64{1}
+	if _, err = ctstretch.SampleTable(next, 16, 2, stream(), nil); !errors.Is(err, ctstretch.ErrSamplerExhausted) {
+		t.Fatalf("single string: got %v, want ErrSamplerExhausted", err)
+	}
+}
+
+func TestVerifyTable(t *testing.T) {
+	key := []byte("table key")
+	if err := ctstretch.VerifyTable([]uint64{1, 2, 3}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctstretch.VerifyTable([]uint64{1, 4}, 2); !errors.Is(err, ctstretch.ErrInvalidTable) {
+		t.Fatalf("wide entry: got %v, want ErrInvalidTable", err)
+	}
+	data := ctstretch.MarshalTable([]uint64{3, 1, 3}, 2, key)
+	if _, _, err := ctstretch.UnmarshalTable(data, key); !errors.Is(err, ctstretch.ErrTableCollision) {
+		t.Fatalf("colliding table: got %v, want ErrTableCollision", err)
 	}
 }
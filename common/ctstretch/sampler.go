@@ -0,0 +1,168 @@
+package ctstretch
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxDuplicates bounds the strings in a row a Sampler may repeat before
+// SampleTable gives up on it.
+const maxDuplicates = 1 << 16
+
+// ErrSamplerExhausted is returned by SampleTable when a Sampler keeps drawing
+// strings already in the table, e.g. because its distribution has fewer
+// likely strings than the table has entries.
+var ErrSamplerExhausted = errors.New("ctstretch: sampler draws too few distinct strings")
+
+// Sampler draws the strings of an expansion table, and so decides the
+// statistics of the expanded output.  Samplers must be deterministic in
+// stream, both ends of a connection generate the same tables.  Note that
+// ExpandBytes shuffles the bits of every block it writes, which keeps the
+// weight of a string but not where its bits are.
+type Sampler interface {
+	// Sample returns a string of numBits bits, bit i of the result being
+	// bit i of the string.
+	Sample(numBits uint64, stream cipher.Stream) (uint64, error)
+}
+
+// Biased draws every bit as 0 with probability Bias, like
+// SampleBiasedString.
+type Biased float64
+
+func (b Biased) Sample(numBits uint64, stream cipher.Stream) (uint64, error) {
+	return SampleBiasedString(numBits, float64(b), stream)
+}
+
+// PositionBias draws bit i as 0 with probability PositionBias[i].  It needs a
+// bias for each bit of the string.
+type PositionBias []float64
+
+func (p PositionBias) Sample(numBits uint64, stream cipher.Stream) (uint64, error) {
+	if numBits > 64 || uint64(len(p)) < numBits {
+		return 0, fmt.Errorf("ctstretch: %d position biases for %d bits", len(p), numBits)
+	}
+	var r uint64
+	for idx := uint64(0); idx < numBits; idx++ {
+		x, err := unitSample(stream)
+		if err != nil {
+			return 0, err
+		}
+		if x >= p[idx] {
+			r |= 1 << idx
+		}
+	}
+	return r, nil
+}
+
+// Markov draws strings as byte sequences, byte i taking bits 8i to 8i+7: the
+// first byte with the weights of Initial, every further one with the weights
+// of Transitions indexed by the byte before it.  A missing or all zero row
+// draws uniformly.  A last partial byte is truncated.
+type Markov struct {
+	Initial     []float64
+	Transitions [][]float64
+}
+
+func (m *Markov) Sample(numBits uint64, stream cipher.Stream) (uint64, error) {
+	if numBits > 64 {
+		return 0, fmt.Errorf("ctstretch: numBits out of range")
+	}
+	var r uint64
+	weights := m.Initial
+	for shift := uint64(0); shift < numBits; shift += 8 {
+		b, err := weightedByte(weights, stream)
+		if err != nil {
+			return 0, err
+		}
+		r |= uint64(b) << shift
+		weights = nil
+		if int(b) < len(m.Transitions) {
+			weights = m.Transitions[b]
+		}
+	}
+	if numBits < 64 {
+		r &= 1<<numBits - 1
+	}
+	return r, nil
+}
+
+// weightedByte draws a byte with the given weights, uniformly without any.
+func weightedByte(weights []float64, stream cipher.Stream) (byte, error) {
+	var total float64
+	for _, w := range weights[:min(len(weights), 256)] {
+		if w > 0 {
+			total += w
+		}
+	}
+	if total == 0 {
+		v, err := UniformSample(0, 255, stream)
+		return byte(v), err
+	}
+	x, err := unitSample(stream)
+	if err != nil {
+		return 0, err
+	}
+	x *= total
+	last := 0
+	for i, w := range weights[:min(len(weights), 256)] {
+		if w <= 0 {
+			continue
+		}
+		if x < w {
+			return byte(i), nil
+		}
+		x -= w
+		last = i
+	}
+	return byte(last), nil
+}
+
+// unitSample returns a uniform sample in [0, 1], as SampleBiasedString draws
+// them.
+func unitSample(stream cipher.Stream) (float64, error) {
+	sample, err := UniformSample(0, math.MaxUint64-1, stream)
+	if err != nil {
+		return 0, err
+	}
+	return float64(sample) / float64(math.MaxUint64-1), nil
+}
+
+// SampleTable returns n distinct strings of numBits bits drawn by s, for
+// ExpandBytes.  Strings already in the table are drawn again, up to
+// maxDuplicates times in a row before failing with ErrSamplerExhausted.  It
+// calls step, if not nil, with the number of strings sampled every
+// SampleStep strings and once done.  An error from step aborts the sampling
+// and is returned.
+func SampleTable(s Sampler, numBits, n uint64, stream cipher.Stream, step func(done uint64) error) ([]uint64, error) {
+	vals := make([]uint64, n)
+	m := make(map[uint64]bool)
+	for idx := uint64(0); idx < n; idx++ {
+		var v uint64
+		for dups := 0; ; dups++ {
+			if dups == maxDuplicates {
+				return nil, ErrSamplerExhausted
+			}
+			var err error
+			if v, err = s.Sample(numBits, stream); err != nil {
+				return nil, err
+			}
+			if numBits < 64 && v>>numBits != 0 {
+				return nil, fmt.Errorf("ctstretch: sampler drew %#x, wider than %d bits", v, numBits)
+			}
+			if !m[v] {
+				break
+			}
+		}
+
+		vals[idx] = v
+		m[v] = true
+		if step != nil && ((idx+1)%SampleStep == 0 || idx+1 == n) {
+			if err := step(idx + 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return vals, nil
+}
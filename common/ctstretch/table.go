@@ -0,0 +1,105 @@
+package ctstretch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Serialized tables are a header, the entries and a MAC, all big-endian:
+//
+//	magic   [8]byte "ctstable"
+//	bits    uint32
+//	entries uint32
+//	table   [entries]uint64
+//	mac     [32]byte HMAC-SHA256 over everything before it
+const (
+	tableMagic        = "ctstable"
+	tableHeaderLength = 16
+
+	// TableMACSize is the length of the MAC closing a serialized table.
+	TableMACSize = sha256.Size
+
+	// maxTableEntries is the size of the largest table, the one of 16 bit
+	// blocks.
+	maxTableEntries = 1 << 16
+)
+
+var (
+	// ErrTableMAC is the error returned by UnmarshalTable for tables that
+	// were corrupted, or authenticated with another key.
+	ErrTableMAC = errors.New("ctstretch: table MAC mismatch")
+	// ErrInvalidTable is the error returned by UnmarshalTable for data that
+	// is not a table.
+	ErrInvalidTable = errors.New("ctstretch: invalid serialized table")
+	// ErrTableCollision is the error returned by VerifyTable for tables
+	// mapping two blocks to the same string, which would not decode.
+	ErrTableCollision = errors.New("ctstretch: table entries collide")
+)
+
+// TableMAC returns the MAC of data under key.
+func TableMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// MarshalTable serializes table, whose entries are bits wide, authenticated
+// with key.  The key should be derived from the seed the table is, so that a
+// table cannot be swapped for the one of another seed.
+func MarshalTable(table []uint64, bits uint64, key []byte) []byte {
+	buf := make([]byte, tableHeaderLength+8*len(table), tableHeaderLength+8*len(table)+TableMACSize)
+	copy(buf, tableMagic)
+	binary.BigEndian.PutUint32(buf[8:], uint32(bits))
+	binary.BigEndian.PutUint32(buf[12:], uint32(len(table)))
+	for i, v := range table {
+		binary.BigEndian.PutUint64(buf[tableHeaderLength+8*i:], v)
+	}
+	return append(buf, TableMAC(key, buf)...)
+}
+
+// UnmarshalTable checks the MAC of data under key and returns the table and
+// its entry width.
+func UnmarshalTable(data, key []byte) ([]uint64, uint64, error) {
+	if len(data) < tableHeaderLength+TableMACSize || string(data[:8]) != tableMagic {
+		return nil, 0, ErrInvalidTable
+	}
+	body, tag := data[:len(data)-TableMACSize], data[len(data)-TableMACSize:]
+	if !hmac.Equal(tag, TableMAC(key, body)) {
+		return nil, 0, ErrTableMAC
+	}
+	bits := uint64(binary.BigEndian.Uint32(data[8:]))
+	n := int(binary.BigEndian.Uint32(data[12:]))
+	if bits == 0 || bits > 64 || n > maxTableEntries || len(body) != tableHeaderLength+8*n {
+		return nil, 0, fmt.Errorf("%w: %d entries of %d bits in %d bytes", ErrInvalidTable, n, bits, len(data))
+	}
+	table := make([]uint64, n)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(body[tableHeaderLength+8*i:])
+	}
+	if err := VerifyTable(table, bits); err != nil {
+		return nil, 0, err
+	}
+	return table, bits, nil
+}
+
+// VerifyTable checks that the entries of table fit bits and are distinct, as
+// SampleTable makes them, e.g. for tables loaded from storage.
+func VerifyTable(table []uint64, bits uint64) error {
+	for i, v := range table {
+		if bits < 64 && v>>bits != 0 {
+			return fmt.Errorf("%w: entry %d exceeds %d bits", ErrInvalidTable, i, bits)
+		}
+	}
+	sorted := append([]uint64(nil), table...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1] {
+			return fmt.Errorf("%w: %#x appears twice", ErrTableCollision, sorted[i])
+		}
+	}
+	return nil
+}
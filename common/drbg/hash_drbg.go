@@ -30,6 +30,8 @@
 package drbg // import "github.com/RACECAR-GU/obfsX/common/drbg"
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -105,6 +107,8 @@ func (e InvalidSeedLengthError) Error() string {
 type HashDrbg struct {
 	sip hash.Hash64
 	ofb [Size]byte
+	// blocks counts the blocks drawn.
+	blocks uint64
 }
 
 // NewHashDrbg makes a HashDrbg instance based off an optional seed.  The seed
@@ -123,6 +127,28 @@ func NewHashDrbg(seed *Seed) (*HashDrbg, error) {
 	return drbg, nil
 }
 
+// personalizationLabel separates personalized seeds from other uses of the
+// seed.
+const personalizationLabel = "riverrun drbg personalization v1"
+
+// NewHashDrbgPersonalized is like NewHashDrbg, with personalization mixed
+// into the seed, so that deployments sharing a seed but not the
+// personalization, e.g. a server hostname, derive unrelated state.  An empty
+// personalization yields the same HashDrbg as NewHashDrbg.
+func NewHashDrbgPersonalized(seed *Seed, personalization []byte) (*HashDrbg, error) {
+	if seed == nil || len(personalization) == 0 {
+		return NewHashDrbg(seed)
+	}
+	mac := hmac.New(sha256.New, seed.Bytes()[:])
+	mac.Write([]byte(personalizationLabel))
+	mac.Write(personalization)
+	mixed, err := SeedFromBytes(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return NewHashDrbg(mixed)
+}
+
 // Int63 returns a uniformly distributed random integer [0, 1 << 63).
 func (drbg *HashDrbg) Int63() int64 {
 	block := drbg.NextBlock()
@@ -139,10 +165,28 @@ func (drbg *HashDrbg) Seed(seed int64) {
 
 // NextBlock returns the next 8 byte DRBG block.
 func (drbg *HashDrbg) NextBlock() []byte {
-	_, _ = drbg.sip.Write(drbg.ofb[:])
-	copy(drbg.ofb[:], drbg.sip.Sum(nil))
+	drbg.next()
 
 	ret := make([]byte, Size)
 	copy(ret, drbg.ofb[:])
 	return ret
 }
+
+func (drbg *HashDrbg) next() {
+	_, _ = drbg.sip.Write(drbg.ofb[:])
+	copy(drbg.ofb[:], drbg.sip.Sum(nil))
+	drbg.blocks++
+}
+
+// Blocks returns the number of blocks drawn so far.
+func (drbg *HashDrbg) Blocks() uint64 {
+	return drbg.blocks
+}
+
+// Skip draws n blocks and throws them away.  OFB mode can not jump ahead, so
+// this takes time linear in n.
+func (drbg *HashDrbg) Skip(n uint64) {
+	for ; n > 0; n-- {
+		drbg.next()
+	}
+}
@@ -0,0 +1,331 @@
+// Package fec protects groups of frames with Reed-Solomon parity, so that a
+// datagram carrier can lose some of them without stalling the stream.
+//
+// Every frame is sent right away as a data shard.  Once a group is complete,
+// parity shards are sent as well, from which the receiver rebuilds the data
+// shards it missed.  Rebuilt frames are returned late and out of order, so
+// the layer above must tolerate reordering, e.g. with package reorder.
+//
+// Shards start with a 6 byte header: the group number, the shard index and,
+// for parity shards, the number of data shards in the group.  Data shards
+// carry their frame behind a 2 byte length.  Shards are meant to be
+// obfuscated like any other frame before they hit the wire.
+package fec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// MinData and MaxData bound the number of data shards per group chosen
+	// by NewParams.
+	MinData = 4
+	MaxData = 16
+
+	headerLength = 6
+	lengthLength = 2
+
+	// maxGroups is the number of incomplete groups a Decoder keeps.
+	maxGroups = 16
+)
+
+// ErrInvalidShard is the error returned by Decoder.Add for malformed shards.
+var ErrInvalidShard = errors.New("fec: invalid shard")
+
+// Params is the data to parity split of a group.
+type Params struct {
+	Data   int
+	Parity int
+}
+
+// NewParams draws a split from rng, e.g. one derived from the shared seed,
+// with about ratio parity shards per data shard.  Both peers drawing from the
+// same rng agree on the split, which differs between seeds instead of being a
+// recognizable constant.
+func NewParams(rng *rand.Rand, ratio float64) (Params, error) {
+	if ratio <= 0 || ratio > 1 {
+		return Params{}, fmt.Errorf("fec: invalid parity ratio %f", ratio)
+	}
+	data := MinData + rng.Intn(MaxData-MinData+1)
+	jitter := .75 + rng.Float64()/2
+	parity := int(math.Round(float64(data) * ratio * jitter))
+	if parity < 1 {
+		parity = 1
+	}
+	return Params{Data: data, Parity: parity}, nil
+}
+
+func (p Params) validate() error {
+	if p.Data < 1 || p.Parity < 1 || p.Data+p.Parity > 255 {
+		return fmt.Errorf("fec: invalid split %d+%d", p.Data, p.Parity)
+	}
+	return nil
+}
+
+// Encoder turns frames into shards.
+type Encoder struct {
+	params Params
+	rs     reedsolomon.Encoder
+
+	group   uint32
+	pending [][]byte
+}
+
+// NewEncoder returns an Encoder for groups split according to p.
+func NewEncoder(p Params) (*Encoder, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	rs, err := reedsolomon.New(p.Data, p.Parity)
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{params: p, rs: rs}, nil
+}
+
+// Add returns the data shard of frame, followed by the parity shards of the
+// group if frame completed it.
+func (e *Encoder) Add(frame []byte) ([][]byte, error) {
+	if len(frame) > math.MaxUint16 {
+		return nil, fmt.Errorf("fec: frame too long: %d", len(frame))
+	}
+	shard := make([]byte, headerLength+lengthLength+len(frame))
+	e.putHeader(shard, len(e.pending), 0)
+	binary.BigEndian.PutUint16(shard[headerLength:], uint16(len(frame)))
+	copy(shard[headerLength+lengthLength:], frame)
+	e.pending = append(e.pending, shard[headerLength:])
+
+	shards := [][]byte{shard}
+	if len(e.pending) == e.params.Data {
+		parity, err := e.Flush()
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, parity...)
+	}
+	return shards, nil
+}
+
+// Flush completes the current group early and returns its parity shards, e.g.
+// when the sender goes idle.  The receiver treats the missing data shards as
+// empty.
+func (e *Encoder) Flush() ([][]byte, error) {
+	count := len(e.pending)
+	if count == 0 {
+		return nil, nil
+	}
+	size := 0
+	for _, s := range e.pending {
+		if len(s) > size {
+			size = len(s)
+		}
+	}
+
+	shards := make([][]byte, e.params.Data+e.params.Parity)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < count {
+			copy(shards[i], e.pending[i])
+		}
+	}
+	if err := e.rs.Encode(shards); err != nil {
+		return nil, err
+	}
+
+	parity := make([][]byte, 0, e.params.Parity)
+	for i := e.params.Data; i < len(shards); i++ {
+		shard := make([]byte, headerLength+size)
+		e.putHeader(shard, i, count)
+		copy(shard[headerLength:], shards[i])
+		parity = append(parity, shard)
+	}
+	e.group++
+	e.pending = e.pending[:0]
+	return parity, nil
+}
+
+func (e *Encoder) putHeader(shard []byte, index, count int) {
+	binary.BigEndian.PutUint32(shard, e.group)
+	shard[4] = byte(index)
+	shard[5] = byte(count)
+}
+
+// Decoder turns shards back into frames.
+type Decoder struct {
+	params Params
+	rs     reedsolomon.Encoder
+
+	groups map[uint32]*group
+	// done remembers recently completed groups, so that their late shards
+	// are ignored rather than starting a new group.
+	done []uint32
+}
+
+type group struct {
+	shards    [][]byte
+	delivered []bool
+	count     int
+	received  int
+}
+
+// NewDecoder returns a Decoder for groups split according to p.
+func NewDecoder(p Params) (*Decoder, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	rs, err := reedsolomon.New(p.Data, p.Parity)
+	if err != nil {
+		return nil, err
+	}
+	return &Decoder{params: p, rs: rs, groups: make(map[uint32]*group)}, nil
+}
+
+// Add processes one received shard and returns the frames it made available:
+// the frame of a data shard, or the missing frames of a group once enough of
+// its shards arrived.
+func (d *Decoder) Add(shard []byte) ([][]byte, error) {
+	if len(shard) < headerLength {
+		return nil, ErrInvalidShard
+	}
+	id := binary.BigEndian.Uint32(shard)
+	index, count := int(shard[4]), int(shard[5])
+	body := shard[headerLength:]
+	if index >= d.params.Data+d.params.Parity || count > d.params.Data {
+		return nil, ErrInvalidShard
+	}
+	for _, done := range d.done {
+		if done == id {
+			return nil, nil
+		}
+	}
+
+	g := d.groups[id]
+	if g == nil {
+		if len(d.groups) >= maxGroups {
+			d.evict()
+		}
+		g = &group{
+			shards:    make([][]byte, d.params.Data+d.params.Parity),
+			delivered: make([]bool, d.params.Data),
+		}
+		d.groups[id] = g
+	}
+	if g.shards[index] != nil {
+		return nil, nil
+	}
+	g.shards[index] = append([]byte(nil), body...)
+	g.received++
+
+	var frames [][]byte
+	if index < d.params.Data {
+		frame, err := parseData(body)
+		if err != nil {
+			return nil, err
+		}
+		g.delivered[index] = true
+		frames = append(frames, frame)
+	} else {
+		g.count = count
+	}
+	if g.count == 0 {
+		return frames, nil
+	}
+
+	// Data shards past count were never sent and are known to be empty.
+	missing := 0
+	for i := 0; i < g.count; i++ {
+		if !g.delivered[i] {
+			missing++
+		}
+	}
+	if missing == 0 {
+		d.finish(id)
+		return frames, nil
+	}
+	if g.received < g.count {
+		return frames, nil
+	}
+
+	recovered, err := d.reconstruct(g)
+	if err != nil {
+		return frames, err
+	}
+	d.finish(id)
+	return append(frames, recovered...), nil
+}
+
+func (d *Decoder) reconstruct(g *group) ([][]byte, error) {
+	size := 0
+	for i := d.params.Data; i < len(g.shards); i++ {
+		if g.shards[i] != nil {
+			size = len(g.shards[i])
+			break
+		}
+	}
+	shards := make([][]byte, len(g.shards))
+	for i, s := range g.shards {
+		switch {
+		case i >= g.count && i < d.params.Data:
+			shards[i] = make([]byte, size)
+		case s == nil:
+		case len(s) > size:
+			return nil, ErrInvalidShard
+		default:
+			shards[i] = make([]byte, size)
+			copy(shards[i], s)
+		}
+	}
+	if err := d.rs.ReconstructData(shards); err != nil {
+		return nil, err
+	}
+
+	var frames [][]byte
+	for i := 0; i < g.count; i++ {
+		if g.delivered[i] {
+			continue
+		}
+		frame, err := parseData(shards[i])
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+func (d *Decoder) finish(id uint32) {
+	delete(d.groups, id)
+	d.done = append(d.done, id)
+	if len(d.done) > maxGroups {
+		d.done = d.done[1:]
+	}
+}
+
+// evict drops the oldest incomplete group.
+func (d *Decoder) evict() {
+	first := true
+	var oldest uint32
+	for id := range d.groups {
+		if first || int32(id-oldest) < 0 {
+			oldest, first = id, false
+		}
+	}
+	delete(d.groups, oldest)
+}
+
+func parseData(body []byte) ([]byte, error) {
+	if len(body) < lengthLength {
+		return nil, ErrInvalidShard
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if lengthLength+n > len(body) {
+		return nil, ErrInvalidShard
+	}
+	return append([]byte(nil), body[lengthLength:lengthLength+n]...), nil
+}
@@ -0,0 +1,75 @@
+package fec
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestRecoverLoss(t *testing.T) {
+	p, err := NewParams(rand.New(rand.NewSource(1)), .5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := NewEncoder(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := NewDecoder(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var frames []string
+	var shards [][]byte
+	for i := 0; i < 3*p.Data+1; i++ {
+		frame := fmt.Sprintf("frame %d %s", i, bytes.Repeat([]byte{'x'}, i*7))
+		frames = append(frames, frame)
+		s, err := enc.Add([]byte(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards = append(shards, s...)
+	}
+	s, err := enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards = append(shards, s...)
+
+	// Drop as many shards of every group as it has parity.
+	var got []string
+	group := p.Data + p.Parity
+	for i, shard := range shards {
+		if i%group < p.Parity {
+			continue
+		}
+		out, err := dec.Add(shard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range out {
+			got = append(got, string(frame))
+		}
+	}
+
+	sort.Strings(frames)
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(frames) {
+		t.Fatalf("recovered %d of %d frames", len(got), len(frames))
+	}
+}
+
+func TestInvalidShard(t *testing.T) {
+	dec, err := NewDecoder(Params{Data: 4, Parity: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range [][]byte{{0}, {0, 0, 0, 0, 9, 0}, {0, 0, 0, 0, 0, 0, 0xff, 0xff}} {
+		if _, err := dec.Add(shard); err != ErrInvalidShard {
+			t.Errorf("%x: got %v, want ErrInvalidShard", shard, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package framing
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/v2fly/riverrun/common/log"
+)
+
+// Codec turns frame bytes into their wire form and back, e.g. by expanding
+// them into biased bit strings like ctstretch does.  A Codec serves one
+// direction of one connection.  The keystream is owned by the caller, and
+// each call must consume it the same way on both ends.
+//
+// Frames are expanded in pieces, the length and the payload separately, and
+// decoded in pieces of BlockLen wire bytes as they arrive, so lengths must
+// add up: ExpandedLen(a+b) is ExpandedLen(a)+ExpandedLen(b) for any a
+// decoding from a whole number of blocks.
+type Codec interface {
+	// ExpandedLen returns the wire length of n bytes.
+	ExpandedLen(n int) int
+	// CompressedLen returns the number of whole bytes n wire bytes decode
+	// to.
+	CompressedLen(n int) int
+	// BlockLen is the smallest number of wire bytes that decode on their
+	// own.
+	BlockLen() int
+
+	// Expand encodes src into dst, which is ExpandedLen(len(src)) long.
+	Expand(dst, src []byte, stream cipher.Stream) error
+	// Compress decodes src into dst, which is CompressedLen(len(src))
+	// long.
+	Compress(dst, src []byte, stream cipher.Stream) error
+}
+
+// CodecParams is what a CodecFactory builds a Codec from.
+type CodecParams struct {
+	// Rand is derived from the shared seed and the direction, so that both
+	// peers draw the same values for the same direction.
+	Rand   *rand.Rand
+	Logger log.Logger
+}
+
+// CodecFactory returns the Codec of a direction.
+type CodecFactory func(params CodecParams) (Codec, error)
+
+var (
+	codecLock sync.RWMutex
+	codecs    = make(map[string]CodecFactory)
+)
+
+// RegisterCodec makes a codec available by name, usually from the init
+// function of the package implementing it.  It panics if name is already
+// registered.
+func RegisterCodec(name string, factory CodecFactory) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	if _, ok := codecs[name]; ok {
+		panic(fmt.Sprintf("framing: codec %q registered twice", name))
+	}
+	codecs[name] = factory
+}
+
+// LookupCodec returns the factory registered as name.
+func LookupCodec(name string) (CodecFactory, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	factory, ok := codecs[name]
+	return factory, ok
+}
+
+// CodecNames returns the names of the registered codecs, sorted.
+func CodecNames() []string {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -21,6 +21,14 @@ const (
 	// LengthLength is the number of bytes used to represent length
 	LengthLength = 2
 
+	// LengthBits is the width of the length in a typed or checked length
+	// word, which carries the packet type or a checksum of the length in
+	// the bits above, see BaseEncoder.TypeBits and BaseEncoder.CheckBits.
+	LengthBits = 11
+	// MaxHeaderType is the largest packet type a typed length word
+	// carries, larger types are carried as MaxHeaderType.
+	MaxHeaderType = 1<<(16-LengthBits) - 1
+
 	// TypeLength is the number of bytes used to indicate packet type
 	TypeLength = 1
 
@@ -36,6 +44,22 @@ var ErrAgain = errors.New("framing: More data needed to decode")
 // Error returned when Decoder.Decode() failes to authenticate a frame.
 var ErrTagMismatch = errors.New("framing: Poly1305 tag mismatch")
 
+// ErrFrameTooLarge is the error returned by a strict Decoder when a frame
+// declares a length above its maximum.
+var ErrFrameTooLarge = errors.New("framing: frame exceeds maximum length")
+
+// ErrLengthChecksum is the error returned by Decode when the checksum of a
+// checked length word does not match its length, see BaseEncoder.CheckBits.
+var ErrLengthChecksum = errors.New("framing: length checksum mismatch")
+
+// ErrBufferLimit is the error returned by Read when a frame does not fit the
+// MaxBuffered bytes a Decoder may hold.
+var ErrBufferLimit = errors.New("framing: receive buffer limit exceeded")
+
+// errPartial is returned by Decode when it handed part of a frame to
+// DecodePartial, so there is nothing for ParsePacket.
+var errPartial = errors.New("framing: partial frame consumed")
+
 // InvalidPayloadLengthError is the error returned when Encoder.Encode()
 // rejects the payload length.
 type InvalidPayloadLengthError int
@@ -68,22 +92,88 @@ type BaseEncoder struct {
 	ProcessLength processLengthFunc
 	ChopPayload   chopPayloadFunc
 
+	// OnPacket, if set, is called with the length of every frame written by
+	// MakePacket, length field included.
+	OnPacket func(frameLen int)
+
+	// SegmentLength, if non-zero, replaces MaximumSegmentLength as the size
+	// of the largest frame, length field included.
+	SegmentLength int
+	frame         []byte
+
+	// TypeBits carries the packet type, the first byte of the payload, in
+	// the bits of the length word above LengthBits, see HeaderType.
+	TypeBits bool
+	// CheckBits carries a CRC-5 of the length in the bits of the length
+	// word above LengthBits, masked with it, so that a corrupted length is
+	// detected before the body.  It excludes TypeBits.
+	CheckBits bool
+
 	Type string
 }
 
+// HeaderType returns the packet type typ as carried by a typed length word.
+func HeaderType(typ uint8) uint8 {
+	if typ > MaxHeaderType {
+		return MaxHeaderType
+	}
+	return typ
+}
+
+// HeaderWord returns the length word of a frame of length bytes carrying
+// payload, before masking.
+func (encoder *BaseEncoder) HeaderWord(length uint16, payload []byte) uint16 {
+	if encoder.TypeBits && len(payload) > 0 {
+		length |= uint16(HeaderType(payload[0])) << LengthBits
+	}
+	return length
+}
+
+// MaskedHeader returns the length word of a frame of length bytes carrying
+// payload, checksummed if CheckBits is set and masked with the next DRBG
+// block.
+func (encoder *BaseEncoder) MaskedHeader(length uint16, payload []byte) uint16 {
+	word := encoder.HeaderWord(length, payload)
+	if encoder.CheckBits {
+		word |= lengthCheck(length) << LengthBits
+	}
+	return word ^ binary.BigEndian.Uint16(encoder.Drbg.NextBlock())
+}
+
+// lengthCheck returns the CRC-5 of the low LengthBits bits of length, which
+// catches any burst of up to 5 flipped bits in a checked length word.
+func lengthCheck(length uint16) uint16 {
+	const poly = 0x25 // x^5 + x^2 + 1
+	crc := uint16(length&(1<<LengthBits-1)) << 5
+	for bit := LengthBits + 4; bit >= 5; bit-- {
+		if crc&(1<<bit) != 0 {
+			crc ^= poly << (bit - 5)
+		}
+	}
+	return crc
+}
+
+func segmentLength(n int) int {
+	if n == 0 {
+		return MaximumSegmentLength
+	}
+	return n
+}
+
 // TODO: Only do this for riverrun encoder
 
 func (encoder *BaseEncoder) MakePacket(w io.Writer, payload []byte) error {
 	// Encode the packet in an AEAD frame.
-	var frame [MaximumSegmentLength]byte
+	if segLen := segmentLength(encoder.SegmentLength); len(encoder.frame) != segLen {
+		encoder.frame = make([]byte, segLen)
+	}
+	frame := encoder.frame
 	payloadLen := len(payload)
 	payloadLenWithOverhead0 := payloadLen + encoder.PayloadOverhead(payloadLen)
 	if len(frame)-encoder.LengthLength < payloadLenWithOverhead0 {
 		return io.ErrShortBuffer
 	}
-	length := uint16(payloadLenWithOverhead0)
-	lengthMask := encoder.Drbg.NextBlock()
-	length ^= binary.BigEndian.Uint16(lengthMask)
+	length := encoder.MaskedHeader(uint16(payloadLenWithOverhead0), payload)
 	processedLength, err := encoder.ProcessLength(length)
 	if err != nil {
 		return err
@@ -106,6 +196,9 @@ func (encoder *BaseEncoder) MakePacket(w io.Writer, payload []byte) error {
 	} else if wrLen < frameLen {
 		return io.ErrShortWrite
 	}
+	if encoder.OnPacket != nil {
+		encoder.OnPacket(frameLen)
+	}
 
 	return nil
 }
@@ -136,16 +229,37 @@ type decodeLengthfunc func(lengthBytes []byte) (uint16, error)
 type decodePayloadfunc func(frames *bytes.Buffer) ([]byte, error)
 type parsePacketFunc func(decoded []byte, decLen int) error
 type cleanupfunc func() error
+type decodePartialfunc func(piece []byte, offset int, final bool) error
 type BaseDecoder struct {
 	Drbg                  *drbg.HashDrbg
 	LengthLength          int
 	MinPayloadLength      int
 	PacketOverhead        int
 	MaxFramePayloadLength int
+	// SegmentLength, if non-zero, replaces MaximumSegmentLength as the size
+	// of the largest frame, length field included.
+	SegmentLength int
+	// ValidLength, if set, reports whether a frame length within range
+	// can be decoded, e.g. whether it is a whole number of encoded blocks.
+	ValidLength func(length int) bool
 
 	NextLength        uint16
 	NextLengthInvalid bool
 
+	// TypeBits expects typed length words, see BaseEncoder.TypeBits.
+	// NextType is then the packet type the last one declared.
+	TypeBits bool
+	NextType uint8
+	// CheckBits expects checked length words, see BaseEncoder.CheckBits.
+	CheckBits bool
+
+	// Strict makes Decode fail a frame with an out of range length right
+	// away, with ErrFrameTooLarge or InvalidPacketLengthError, instead of
+	// reading a random amount of data before failing with ErrTagMismatch.
+	// This helps debugging, but tells an active prober where the length
+	// check happened.
+	Strict bool
+
 	PayloadOverhead overheadFunc
 
 	DecodeLength  decodeLengthfunc
@@ -153,6 +267,30 @@ type BaseDecoder struct {
 	ParsePacket   parsePacketFunc
 	Cleanup       cleanupfunc
 
+	// PartialBlockLength, if non-zero, makes Decode hand frames to
+	// DecodePartial in pieces of whole blocks of this many encoded bytes as
+	// soon as they arrive, instead of waiting for the full frame.  piece
+	// starts offset bytes into the frame, and final is set for the piece
+	// that completes it, which need not be a whole number of blocks.
+	PartialBlockLength int
+	DecodePartial      decodePartialfunc
+	partialOffset      int
+
+	// MaxBuffered, if non-zero, caps the bytes held in ReceiveBuffer and
+	// ReceiveDecodedBuffer together: reads from the network never fill
+	// more, and frames stay undecoded until there is room again.  Only the
+	// frame decoded last can overshoot it.
+	MaxBuffered int
+
+	// SpanLength, once set by ParsePacket, is the length of a span
+	// following the frame parsed: wire bytes carrying payload without frame
+	// headers.  Decode hands it to DecodeSpan in pieces of whole
+	// PartialBlockLength blocks as they arrive, like DecodePartial, and
+	// resumes with frames after it.
+	SpanLength int
+	DecodeSpan decodePartialfunc
+	spanOffset int
+
 	ReceiveBuffer        *bytes.Buffer
 	ReceiveDecodedBuffer *bytes.Buffer
 	readBuffer           []byte
@@ -170,8 +308,53 @@ func (decoder *BaseDecoder) InitBuffers() {
 	decoder.readBuffer = make([]byte, ConsumeReadSize)
 }
 
+// FrameState is the position of a BaseDecoder within the frame it receives,
+// along with ReceiveBuffer, e.g. to move it to another process.
+type FrameState struct {
+	NextLength        uint16
+	NextLengthInvalid bool
+	NextType          uint8
+	PartialOffset     int
+	SpanLength        int
+	SpanOffset        int
+}
+
+// FrameState returns the position of the decoder within the current frame.
+func (decoder *BaseDecoder) FrameState() FrameState {
+	return FrameState{
+		NextLength:        decoder.NextLength,
+		NextLengthInvalid: decoder.NextLengthInvalid,
+		NextType:          decoder.NextType,
+		PartialOffset:     decoder.partialOffset,
+		SpanLength:        decoder.SpanLength,
+		SpanOffset:        decoder.spanOffset,
+	}
+}
+
+// SetFrameState moves the decoder to a position returned by FrameState.
+func (decoder *BaseDecoder) SetFrameState(state FrameState) {
+	decoder.NextLength = state.NextLength
+	decoder.NextLengthInvalid = state.NextLengthInvalid
+	decoder.NextType = state.NextType
+	decoder.partialOffset = state.PartialOffset
+	decoder.SpanLength = state.SpanLength
+	decoder.spanOffset = state.SpanOffset
+}
+
+// ResetFrames drops the frames received but not decoded yet, e.g. when the
+// carrier changed part way through one.  The payload already decoded is kept
+// for Read.
+func (decoder *BaseDecoder) ResetFrames() {
+	decoder.ReceiveBuffer.Reset()
+	decoder.NextLength = 0
+	decoder.NextLengthInvalid = false
+	decoder.partialOffset = 0
+	decoder.SpanLength = 0
+	decoder.spanOffset = 0
+}
+
 func (decoder *BaseDecoder) GetFrame(frames *bytes.Buffer) (int, []byte, error) {
-	maximumPayloadLength := MaximumSegmentLength - decoder.LengthLength
+	maximumPayloadLength := segmentLength(decoder.SegmentLength) - decoder.LengthLength
 	singleFrame := make([]byte, maximumPayloadLength)
 	n, err := io.ReadFull(frames, singleFrame[:decoder.NextLength])
 	if err != nil {
@@ -212,43 +395,82 @@ func (decoder *BaseDecoder) Read(b []byte, conn net.Conn) (n int, err error) {
 }
 
 func (decoder *BaseDecoder) readPackets(conn net.Conn) (err error) {
+	// Frames held back by MaxBuffered come first.
+	if err = decoder.decodePackets(); err != nil || decoder.ReceiveDecodedBuffer.Len() > 0 {
+		return
+	}
+
 	// Attempt to read off the network.
-	rdLen, rdErr := conn.Read(decoder.readBuffer)
-	decoder.ReceiveBuffer.Write(decoder.readBuffer[:rdLen])
+	readBuffer := decoder.readBuffer
+	if decoder.MaxBuffered > 0 {
+		room := decoder.MaxBuffered - decoder.ReceiveBuffer.Len()
+		if room <= 0 {
+			return ErrBufferLimit
+		} else if room < len(readBuffer) {
+			readBuffer = readBuffer[:room]
+		}
+	}
+	rdLen, rdErr := conn.Read(readBuffer)
+	decoder.ReceiveBuffer.Write(readBuffer[:rdLen])
+	err = decoder.decodePackets()
+
+	// Read errors take priority over various frame processing errors,
+	// unless they are a timeout: the frames received so far stay buffered
+	// for the next Read, which must not skip past a rejected one.
+	if rdErr != nil && (err == nil || !isTimeout(rdErr)) {
+		return rdErr
+	}
+
+	return
+}
 
+// isTimeout reports whether err is a timeout, after which the conn may be read
+// again.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// decodePackets decodes and parses the frames in ReceiveBuffer, until it runs
+// out of whole frames or, with MaxBuffered, of room for decoded data.
+func (decoder *BaseDecoder) decodePackets() (err error) {
 	decoded := make([]byte, decoder.MaxFramePayloadLength)
-	for decoder.ReceiveBuffer.Len() > 0 {
+	for decoder.ReceiveBuffer.Len() > 0 && !decoder.full() {
 		// Decrypt an AEAD frame.
 		decLen := 0
 		decLen, err = decoder.Decode(decoded[:], decoder.ReceiveBuffer)
 		if err == ErrAgain {
-			break
+			return nil
+		} else if err == errPartial {
+			err = nil
+			continue
 		} else if err != nil {
-			break
+			return
 		} else if decLen < decoder.PacketOverhead {
-			err = InvalidPacketLengthError(decLen)
-			break
+			return InvalidPacketLengthError(decLen)
 		}
 
-		err = decoder.ParsePacket(decoded, decLen)
-		if err != nil {
-			break
+		if err = decoder.ParsePacket(decoded, decLen); err != nil {
+			return
 		}
 	}
-
-	// Read errors (all fatal) take priority over various frame processing
-	// errors.
-	if rdErr != nil {
-		return rdErr
-	}
-
 	return
 }
 
+// full reports whether decoding has to wait for the reader, because decoded
+// data is pending and MaxBuffered is reached.
+func (decoder *BaseDecoder) full() bool {
+	pending := decoder.ReceiveDecodedBuffer.Len()
+	return decoder.MaxBuffered > 0 && pending > 0 && pending+decoder.ReceiveBuffer.Len() >= decoder.MaxBuffered
+}
+
 // Decode decodes a stream of data and returns the length if any.  ErrAgain is
 // a temporary failure, all other errors MUST be treated as fatal and the
 // session aborted.
 func (decoder *BaseDecoder) Decode(data []byte, frames *bytes.Buffer) (int, error) {
+	if decoder.SpanLength > 0 {
+		return 0, decoder.decodeSpan(frames)
+	}
 
 	// A length of 0 indicates that we do not know how big the next frame is
 	// going to be.
@@ -269,10 +491,31 @@ func (decoder *BaseDecoder) Decode(data []byte, frames *bytes.Buffer) (int, erro
 			return 0, err
 		}
 		lengthMask := decoder.Drbg.NextBlock()
-		decoder.logger.Debugf("length (raw): %d, length (mask): %d", length, lengthMask)
+		if !log.Hardened {
+			decoder.logger.Debugf("length (raw): %d, length (mask): %d", length, lengthMask)
+		}
 		length ^= binary.BigEndian.Uint16(lengthMask)
-		decoder.logger.Debugf("First nextLength: %d", length)
-		if MaximumSegmentLength-int(decoder.LengthLength) < int(length) || decoder.MinPayloadLength > int(length) {
+		if decoder.TypeBits {
+			decoder.NextType = uint8(length >> LengthBits)
+			length &= 1<<LengthBits - 1
+		} else if decoder.CheckBits {
+			check := length >> LengthBits
+			length &= 1<<LengthBits - 1
+			if check != lengthCheck(length) {
+				return 0, ErrLengthChecksum
+			}
+		}
+		if !log.Hardened {
+			decoder.logger.Debugf("First nextLength: %d", length)
+		}
+		if decoder.Strict {
+			if int(length) > decoder.maxFrameLength() {
+				return 0, ErrFrameTooLarge
+			} else if int(length) < decoder.MinPayloadLength || !decoder.validLength(int(length)) {
+				return 0, InvalidPacketLengthError(length)
+			}
+		}
+		if decoder.maxFrameLength() < int(length) || decoder.MinPayloadLength > int(length) || !decoder.validLength(int(length)) {
 			// Per "Plaintext Recovery Attacks Against SSH" by
 			// Martin R. Albrecht, Kenneth G. Paterson and Gaven J. Watson,
 			// there are a class of attacks againt protocols that use similar
@@ -285,12 +528,22 @@ func (decoder *BaseDecoder) Decode(data []byte, frames *bytes.Buffer) (int, erro
 			// paper.
 			decoder.logger.Debugf("Bad length")
 			decoder.NextLengthInvalid = true
-			length = uint16(csrand.IntRange(decoder.MinPayloadLength, MaximumSegmentLength-int(decoder.LengthLength)))
+			length = uint16(csrand.IntRange(decoder.MinPayloadLength, decoder.maxFrameLength()))
+			// MinPayloadLength is valid, so this terminates.
+			for !decoder.validLength(int(length)) && int(length) > decoder.MinPayloadLength {
+				length--
+			}
+		}
+		if !log.Hardened {
+			decoder.logger.Debugf("Out nextLength: %d", length)
 		}
-		decoder.logger.Debugf("Out nextLength: %d", length)
 		decoder.NextLength = length
 	}
 
+	if decoder.PartialBlockLength > 0 && !decoder.NextLengthInvalid {
+		return 0, decoder.decodePartial(frames)
+	}
+
 	if int(decoder.NextLength) > frames.Len() {
 		return 0, ErrAgain
 	}
@@ -311,6 +564,83 @@ func (decoder *BaseDecoder) Decode(data []byte, frames *bytes.Buffer) (int, erro
 	return len(decodedPayload), decoder.Cleanup()
 }
 
+// maxFrameLength is the largest valid frame length, excluding the length
+// field itself.
+func (decoder *BaseDecoder) maxFrameLength() int {
+	limit := segmentLength(decoder.SegmentLength) - decoder.LengthLength
+	if decoder.MaxFramePayloadLength > 0 && decoder.MaxFramePayloadLength < limit {
+		limit = decoder.MaxFramePayloadLength
+	}
+	return limit
+}
+
+func (decoder *BaseDecoder) validLength(length int) bool {
+	return decoder.ValidLength == nil || decoder.ValidLength(length)
+}
+
+// decodePartial feeds the whole blocks of the current frame that are
+// available to DecodePartial.  Frames with a random (invalid) length never get
+// here, so no garbage is handed out before the error.
+func (decoder *BaseDecoder) decodePartial(frames *bytes.Buffer) error {
+	remaining := int(decoder.NextLength) - decoder.partialOffset
+	pieceLen := remaining
+	final := true
+	if frames.Len() < remaining {
+		pieceLen = frames.Len() - frames.Len()%decoder.PartialBlockLength
+		final = false
+		if pieceLen == 0 {
+			return ErrAgain
+		}
+	}
+
+	piece := frames.Next(pieceLen)
+	if err := decoder.DecodePartial(piece, decoder.partialOffset, final); err != nil {
+		return err
+	}
+	if !final {
+		decoder.partialOffset += pieceLen
+		return errPartial
+	}
+
+	// Clean up and prepare for the next frame.
+	decoder.NextLength = 0
+	decoder.partialOffset = 0
+	if err := decoder.Cleanup(); err != nil {
+		return err
+	}
+	return errPartial
+}
+
+// decodeSpan feeds the whole blocks of the current span that are available to
+// DecodeSpan.
+func (decoder *BaseDecoder) decodeSpan(frames *bytes.Buffer) error {
+	blockLen := decoder.PartialBlockLength
+	if blockLen <= 0 {
+		blockLen = 1
+	}
+	remaining := decoder.SpanLength - decoder.spanOffset
+	pieceLen := remaining
+	final := true
+	if frames.Len() < remaining {
+		pieceLen = frames.Len() - frames.Len()%blockLen
+		final = false
+		if pieceLen == 0 {
+			return ErrAgain
+		}
+	}
+
+	if err := decoder.DecodeSpan(frames.Next(pieceLen), decoder.spanOffset, final); err != nil {
+		return err
+	}
+	if final {
+		decoder.SpanLength = 0
+		decoder.spanOffset = 0
+	} else {
+		decoder.spanOffset += pieceLen
+	}
+	return errPartial
+}
+
 // GenDrbg creates a *drbg.HashDrbg with some safety checks
 func GenDrbg(key []byte) *drbg.HashDrbg {
 	if len(key) != drbg.SeedLength {
@@ -0,0 +1,164 @@
+package fte
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	f "github.com/v2fly/riverrun/common/framing"
+)
+
+// Presets registered as codecs by this package.  Both languages are closed
+// under concatenation, so the whole stream stays in the language.
+const (
+	// CodecPrintable writes printable ASCII.
+	CodecPrintable = "fte-printable"
+	// CodecBase64 writes the base64 alphabet, as in a base64 body.
+	CodecBase64 = "fte-base64"
+)
+
+func init() {
+	for _, preset := range []struct {
+		name   string
+		expr   string
+		length int
+	}{
+		{CodecPrintable, `[\x20-\x7e]*`, 32},
+		{CodecBase64, `[A-Za-z0-9+/]*`, 32},
+	} {
+		if err := Register(preset.name, preset.expr, preset.length); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register compiles expr and registers a codec for it as name, see
+// framing.RegisterCodec.  Frames are cut into blocks that fit words of length
+// wire bytes, a trailing partial block uses a shorter word, so the language
+// must have words of most lengths below length.
+func Register(name, expr string, length int) error {
+	l, err := NewLanguage(expr)
+	if err != nil {
+		return err
+	}
+	c, err := NewCodec(l, length)
+	if err != nil {
+		return err
+	}
+	f.RegisterCodec(name, func(f.CodecParams) (f.Codec, error) {
+		return c, nil
+	})
+	return nil
+}
+
+// Codec encodes blocks of bytes as words of a Language.  Blocks are masked
+// with the keystream before ranking, so the words are spread over the
+// language.  A Codec keeps no per-connection state.
+type Codec struct {
+	lang *Language
+	// blockLen bytes encode to words of wordLen[blockLen] bytes, a trailing
+	// partial block of r bytes to a word of wordLen[r].
+	blockLen int
+	wordLen  []int
+	// space[r] is 256^r.
+	space []*big.Int
+}
+
+// NewCodec returns a Codec writing words of length wire bytes.
+func NewCodec(l *Language, length int) (*Codec, error) {
+	total := l.Count(length)
+	blockLen := (total.BitLen() - 1) / 8
+	if blockLen < 1 {
+		return nil, fmt.Errorf("fte: %q has too few words of length %d", l, length)
+	}
+	c := &Codec{lang: l, blockLen: blockLen, wordLen: make([]int, blockLen+1), space: make([]*big.Int, blockLen+1)}
+	for r := 0; r <= blockLen; r++ {
+		c.space[r] = new(big.Int).Lsh(big.NewInt(1), uint(8*r))
+	}
+	// Partial blocks use the shortest words that fit, which must grow
+	// strictly with r for the lengths to be told apart.
+	c.wordLen[blockLen] = length
+	for r := 1; r < blockLen; r++ {
+		n := c.wordLen[r-1] + 1
+		for n < length && l.Count(n).Cmp(c.space[r]) < 0 {
+			n++
+		}
+		if n >= length {
+			return nil, fmt.Errorf("fte: %q lacks words short enough for %d byte blocks", l, r)
+		}
+		c.wordLen[r] = n
+	}
+	return c, nil
+}
+
+func (c *Codec) ExpandedLen(n int) int {
+	return n/c.blockLen*c.wordLen[c.blockLen] + c.wordLen[n%c.blockLen]
+}
+
+func (c *Codec) CompressedLen(n int) int {
+	length := c.wordLen[c.blockLen]
+	res := n / length * c.blockLen
+	for r := c.blockLen - 1; r > 0; r-- {
+		if c.wordLen[r] <= n%length {
+			return res + r
+		}
+	}
+	return res
+}
+
+func (c *Codec) BlockLen() int {
+	return c.wordLen[c.blockLen]
+}
+
+func (c *Codec) Expand(dst, src []byte, stream cipher.Stream) error {
+	if len(dst) != c.ExpandedLen(len(src)) {
+		return fmt.Errorf("fte: expanding %d bytes into %d", len(src), len(dst))
+	}
+	block := make([]byte, c.blockLen)
+	var rank, spare big.Int
+	for len(src) > 0 {
+		r := min(len(src), c.blockLen)
+		stream.XORKeyStream(block[:r], src[:r])
+		rank.SetBytes(block[:r])
+		// Add a random multiple of the block space, so that all words
+		// are used rather than the first 256^r.
+		word := dst[:c.wordLen[r]]
+		spare.Sub(c.lang.Count(len(word)), &rank)
+		spare.Sub(&spare, big.NewInt(1))
+		spare.Quo(&spare, c.space[r])
+		if spare.Sign() > 0 {
+			j, err := rand.Int(rand.Reader, spare.Add(&spare, big.NewInt(1)))
+			if err != nil {
+				return err
+			}
+			rank.Add(&rank, j.Mul(j, c.space[r]))
+		}
+		if err := c.lang.Unrank(&rank, word); err != nil {
+			return err
+		}
+		src, dst = src[r:], dst[len(word):]
+	}
+	return nil
+}
+
+// Compress decodes src.  Like ctstretch, it does not fail on garbage: words
+// outside the language decode as zeros, and are caught by the frame checks.
+func (c *Codec) Compress(dst, src []byte, stream cipher.Stream) error {
+	if c.ExpandedLen(len(dst)) != len(src) {
+		return fmt.Errorf("fte: compressing %d bytes into %d", len(src), len(dst))
+	}
+	block := make([]byte, c.blockLen)
+	for len(dst) > 0 {
+		r := min(len(dst), c.blockLen)
+		rank, err := c.lang.Rank(src[:c.wordLen[r]])
+		if err != nil {
+			rank = new(big.Int)
+		}
+		rank.Mod(rank, c.space[r])
+		rank.FillBytes(block[:r])
+		stream.XORKeyStream(dst[:r], block[:r])
+		src, dst = src[c.wordLen[r]:], dst[r:]
+	}
+	return nil
+}
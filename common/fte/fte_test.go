@@ -0,0 +1,79 @@
+package fte
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"math/big"
+	"math/rand"
+	"regexp"
+	"testing"
+)
+
+func TestRankUnrank(t *testing.T) {
+	l, err := NewLanguage(`(ab|c)*x?[0-9]*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`^(?:(ab|c)*x?[0-9]*)$`)
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 2, 5, 17, 40} {
+		count := l.Count(n)
+		word := make([]byte, n)
+		for i := 0; i < 50; i++ {
+			rank := new(big.Int).Rand(rng, count)
+			if err := l.Unrank(rank, word); err != nil {
+				t.Fatal(err)
+			}
+			if !re.Match(word) {
+				t.Fatalf("Unrank(%d) = %q, not in language", rank, word)
+			}
+			got, err := l.Rank(word)
+			if err != nil || got.Cmp(rank) != 0 {
+				t.Fatalf("Rank(%q) = %v, %v, want %d", word, got, err, rank)
+			}
+		}
+		if err := l.Unrank(count, word); err != ErrRankOutOfRange {
+			t.Fatalf("Unrank(count) = %v, want ErrRankOutOfRange", err)
+		}
+	}
+	if _, err := l.Rank([]byte("abx1a")); err != ErrNotInLanguage {
+		t.Fatalf("Rank of foreign word: %v, want ErrNotInLanguage", err)
+	}
+	if _, err := NewLanguage(`^a*$`); err == nil {
+		t.Fatal("anchors accepted")
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	l, _ := NewLanguage(`[A-Za-z0-9+/]*`)
+	c, err := NewCodec(l, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(make([]byte, 16))
+	iv := make([]byte, aes.BlockSize)
+	enc, dec := cipher.NewCTR(block, iv), cipher.NewCTR(block, iv)
+	re := regexp.MustCompile(`^[A-Za-z0-9+/]*$`)
+	for n := 0; n < 100; n++ {
+		src := make([]byte, n)
+		rand.Read(src)
+		wire := make([]byte, c.ExpandedLen(n))
+		if err := c.Expand(wire, src, enc); err != nil {
+			t.Fatal(err)
+		}
+		if !re.Match(wire) {
+			t.Fatalf("length %d: %q not base64", n, wire)
+		}
+		if c.CompressedLen(len(wire)) != n {
+			t.Fatalf("CompressedLen(%d) = %d, want %d", len(wire), c.CompressedLen(len(wire)), n)
+		}
+		got := make([]byte, n)
+		if err := c.Compress(got, wire, dec); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Fatalf("length %d: round trip mismatch", n)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package fte implements format-transforming encoding: a codec whose output
+// consists of words of a regular language, e.g. printable ASCII or base64, for
+// carriers that block high-entropy streams.
+//
+// A Language numbers its words of a given length, so that a block of bytes,
+// read as a number, maps to exactly one word and back (ranking and unranking,
+// as in Bellare et al., "Format-Transforming Encryption").  The regular
+// expression is compiled to a DFA over bytes, and the words of length n
+// accepted from each state are counted ahead, which makes both directions
+// linear in the word length.
+package fte
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxStates bounds the size of the DFA built from an expression.
+const maxStates = 4096
+
+var (
+	// ErrNotInLanguage is the error returned by Rank for words the language
+	// does not accept.
+	ErrNotInLanguage = errors.New("fte: word not in language")
+	// ErrRankOutOfRange is the error returned by Unrank for numbers not
+	// below the word count.
+	ErrRankOutOfRange = errors.New("fte: rank out of range")
+)
+
+// transition is an edge of the DFA taken by count consecutive bytes starting
+// at first.
+type transition struct {
+	first  int
+	count  int
+	target int
+}
+
+// Language is a regular language over bytes.  Bytes are matched as the runes
+// of the same value, so expressions should stick to ASCII.  Words must match
+// the expression as a whole, anchors and other assertions are not supported.
+type Language struct {
+	expr   string
+	start  int
+	accept []bool
+	// next[q][b] is the state after reading b in state q, -1 if the word
+	// can no longer be accepted.
+	next  [][256]int
+	trans [][]transition
+
+	// counts[n][q] is the number of accepted words of length n from q.
+	// Rows are immutable once added.
+	lock   sync.Mutex
+	counts [][]*big.Int
+}
+
+// NewLanguage compiles expr, in the RE2 syntax of package regexp.
+func NewLanguage(expr string) (*Language, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	l := &Language{expr: expr}
+	if err = l.build(prog); err != nil {
+		return nil, err
+	}
+	zero := make([]*big.Int, len(l.accept))
+	for q, ok := range l.accept {
+		zero[q] = big.NewInt(0)
+		if ok {
+			zero[q].SetInt64(1)
+		}
+	}
+	l.counts = [][]*big.Int{zero}
+	return l, nil
+}
+
+// String returns the expression l was compiled from.
+func (l *Language) String() string {
+	return l.expr
+}
+
+// build runs the subset construction over the instructions of prog.
+func (l *Language) build(prog *syntax.Prog) error {
+	var closure func(pc uint32, set map[uint32]bool) error
+	closure = func(pc uint32, set map[uint32]bool) error {
+		if set[pc] {
+			return nil
+		}
+		set[pc] = true
+		inst := &prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			if err := closure(inst.Out, set); err != nil {
+				return err
+			}
+			return closure(inst.Arg, set)
+		case syntax.InstCapture, syntax.InstNop:
+			return closure(inst.Out, set)
+		case syntax.InstEmptyWidth:
+			return fmt.Errorf("fte: assertions are not supported in %q", l.expr)
+		}
+		return nil
+	}
+	key := func(set map[uint32]bool) string {
+		pcs := make([]int, 0, len(set))
+		for pc := range set {
+			pcs = append(pcs, int(pc))
+		}
+		sort.Ints(pcs)
+		var b strings.Builder
+		for _, pc := range pcs {
+			b.WriteString(strconv.Itoa(pc))
+			b.WriteByte(',')
+		}
+		return b.String()
+	}
+
+	start := make(map[uint32]bool)
+	if err := closure(uint32(prog.Start), start); err != nil {
+		return err
+	}
+	ids := map[string]int{key(start): 0}
+	sets := []map[uint32]bool{start}
+	for q := 0; q < len(sets); q++ {
+		var next [256]int
+		accept := false
+		for pc := range sets[q] {
+			if prog.Inst[pc].Op == syntax.InstMatch {
+				accept = true
+			}
+		}
+		for b := 0; b < 256; b++ {
+			set := make(map[uint32]bool)
+			for pc := range sets[q] {
+				inst := &prog.Inst[pc]
+				switch inst.Op {
+				case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+					if inst.MatchRune(rune(b)) {
+						if err := closure(inst.Out, set); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if len(set) == 0 {
+				next[b] = -1
+				continue
+			}
+			k := key(set)
+			id, ok := ids[k]
+			if !ok {
+				if len(sets) == maxStates {
+					return fmt.Errorf("fte: %q needs more than %d states", l.expr, maxStates)
+				}
+				id = len(sets)
+				ids[k] = id
+				sets = append(sets, set)
+			}
+			next[b] = id
+		}
+		l.next = append(l.next, next)
+		l.accept = append(l.accept, accept)
+	}
+
+	l.trans = make([][]transition, len(l.next))
+	for q, next := range l.next {
+		for b := 0; b < 256; b++ {
+			if next[b] < 0 {
+				continue
+			}
+			if ts := l.trans[q]; len(ts) > 0 && ts[len(ts)-1].target == next[b] && ts[len(ts)-1].first+ts[len(ts)-1].count == b {
+				ts[len(ts)-1].count++
+			} else {
+				l.trans[q] = append(ts, transition{first: b, count: 1, target: next[b]})
+			}
+		}
+	}
+	return nil
+}
+
+// table returns the counts of words up to length n from every state,
+// extending them as needed.
+func (l *Language) table(n int) [][]*big.Int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for len(l.counts) <= n {
+		prev := l.counts[len(l.counts)-1]
+		cur := make([]*big.Int, len(prev))
+		var term big.Int
+		for q, ts := range l.trans {
+			cur[q] = new(big.Int)
+			for _, t := range ts {
+				term.SetInt64(int64(t.count))
+				term.Mul(&term, prev[t.target])
+				cur[q].Add(cur[q], &term)
+			}
+		}
+		l.counts = append(l.counts, cur)
+	}
+	return l.counts[:n+1]
+}
+
+// Count returns the number of words of length n.
+func (l *Language) Count(n int) *big.Int {
+	return new(big.Int).Set(l.table(n)[n][l.start])
+}
+
+// Rank returns the position of word among the words of its length, in
+// lexicographic order.
+func (l *Language) Rank(word []byte) (*big.Int, error) {
+	counts := l.table(len(word))
+	rank := new(big.Int)
+	var term big.Int
+	q := l.start
+	for i, c := range word {
+		rest := counts[len(word)-i-1]
+		for _, t := range l.trans[q] {
+			if t.first+t.count <= int(c) {
+				term.SetInt64(int64(t.count))
+			} else if t.first < int(c) {
+				term.SetInt64(int64(int(c) - t.first))
+			} else {
+				break
+			}
+			term.Mul(&term, rest[t.target])
+			rank.Add(rank, &term)
+		}
+		if q = l.next[q][c]; q < 0 {
+			return nil, ErrNotInLanguage
+		}
+	}
+	if !l.accept[q] {
+		return nil, ErrNotInLanguage
+	}
+	return rank, nil
+}
+
+// Unrank writes the word of length len(word) at position rank into word.
+func (l *Language) Unrank(rank *big.Int, word []byte) error {
+	counts := l.table(len(word))
+	if rank.Sign() < 0 || rank.Cmp(counts[len(word)][l.start]) >= 0 {
+		return ErrRankOutOfRange
+	}
+	r := new(big.Int).Set(rank)
+	var span, quo, rem big.Int
+	q := l.start
+	for i := range word {
+		rest := counts[len(word)-i-1]
+		for _, t := range l.trans[q] {
+			c := rest[t.target]
+			if c.Sign() == 0 {
+				continue
+			}
+			span.SetInt64(int64(t.count))
+			span.Mul(&span, c)
+			if r.Cmp(&span) >= 0 {
+				r.Sub(r, &span)
+				continue
+			}
+			quo.QuoRem(r, c, &rem)
+			word[i] = byte(t.first + int(quo.Int64()))
+			r.Set(&rem)
+			q = t.target
+			break
+		}
+	}
+	return nil
+}
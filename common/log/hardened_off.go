@@ -0,0 +1,7 @@
+//go:build !riverrun_hardened
+
+package log
+
+// Hardened is set in builds with the riverrun_hardened tag, which compile out
+// the debug logging of the data path and force Config.Hardened on.
+const Hardened = false
@@ -29,7 +29,89 @@
 // standard log package.
 package log // import "github.com/RACECAR-GU/obfsX/common/log"
 
+import (
+	"fmt"
+	stdlog "log"
+)
+
 type Logger interface {
 	Infof(format string, a ...interface{})
 	Debugf(format string, a ...interface{})
 }
+
+// NopLogger is a Logger that discards everything.
+type NopLogger struct{}
+
+func (NopLogger) Infof(format string, a ...interface{})  {}
+func (NopLogger) Debugf(format string, a ...interface{}) {}
+
+// StdLogger is a Logger writing to the standard library's default logger.
+// Debugf output is dropped unless Debug is set.
+type StdLogger struct {
+	Debug bool
+}
+
+func (l StdLogger) Infof(format string, a ...interface{}) {
+	stdlog.Printf(format, a...)
+}
+
+func (l StdLogger) Debugf(format string, a ...interface{}) {
+	if l.Debug {
+		stdlog.Printf(format, a...)
+	}
+}
+
+// Quiet wraps a Logger, dropping Debugf output.  Riverrun connections in
+// hardened mode log through it, and leave out frame sizes and traffic
+// parameters from Infof as well.
+type Quiet struct {
+	Logger
+}
+
+func (Quiet) Debugf(format string, a ...interface{}) {}
+
+// IsQuiet reports whether l drops debug output for hardened mode.
+func IsQuiet(l Logger) bool {
+	_, ok := l.(Quiet)
+	return Hardened || ok
+}
+
+// Prefixed wraps a Logger, starting every line with Prefix.
+type Prefixed struct {
+	Logger
+	Prefix string
+}
+
+func (l Prefixed) Infof(format string, a ...interface{}) {
+	l.Logger.Infof("%s"+format, append([]interface{}{l.Prefix}, a...)...)
+}
+
+func (l Prefixed) Debugf(format string, a ...interface{}) {
+	l.Logger.Debugf("%s"+format, append([]interface{}{l.Prefix}, a...)...)
+}
+
+// WithPrefix returns l starting every line with prefix.  A Quiet l stays
+// Quiet, a NopLogger is returned as is.
+func WithPrefix(l Logger, prefix string) Logger {
+	switch l := l.(type) {
+	case NopLogger:
+		return l
+	case Quiet:
+		return Quiet{Prefixed{l.Logger, prefix}}
+	}
+	return Prefixed{l, prefix}
+}
+
+// NewLogger returns the Logger for a level name: "none", "info" (or empty)
+// or "debug".
+func NewLogger(level string) (Logger, error) {
+	switch level {
+	case "none":
+		return NopLogger{}, nil
+	case "", "info":
+		return StdLogger{}, nil
+	case "debug":
+		return StdLogger{Debug: true}, nil
+	}
+	return nil, fmt.Errorf("log: unknown level %q", level)
+}
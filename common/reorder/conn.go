@@ -0,0 +1,86 @@
+package reorder
+
+import (
+	"net"
+	"sync"
+)
+
+// maxDatagram is the size of the largest datagram Conn reads.
+const maxDatagram = 64 * 1024
+
+// Conn carries a byte stream over a datagram conn, e.g. a connected UDP
+// socket, that may deliver datagrams out of order.  Every Write goes out as
+// one stamped datagram, and Read returns the bytes of the datagrams in the
+// order they were sent.  Datagrams given up on leave a hole in the stream,
+// which the layer above is expected to detect, so loss must be repaired
+// below, e.g. with package fec.
+type Conn struct {
+	net.Conn
+
+	writeLock sync.Mutex
+	seq       Sequencer
+
+	readLock sync.Mutex
+	buf      *Buffer
+	packet   []byte
+	// ready holds the bodies made deliverable but not read yet.
+	ready [][]byte
+}
+
+// NewConn returns a Conn over conn reordering up to window datagrams.
+func NewConn(conn net.Conn, window int) (*Conn, error) {
+	buf, err := NewBuffer(window)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, buf: buf, packet: make([]byte, maxDatagram)}, nil
+}
+
+// Write sends b as one datagram, which must fit the MTU of the carrier.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err := c.Conn.Write(c.seq.Stamp(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read reads the stream, waiting for the datagrams due next.  Datagrams too
+// short to carry a sequence number are dropped.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for len(c.ready) == 0 {
+		n, err := c.Conn.Read(c.packet)
+		if n > 0 {
+			frames, _ := c.buf.Add(c.packet[:n])
+			for _, f := range frames {
+				if len(f) > 0 {
+					c.ready = append(c.ready, f)
+				}
+			}
+		}
+		if len(c.ready) == 0 && err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.ready[0])
+	if c.ready[0] = c.ready[0][n:]; len(c.ready[0]) == 0 {
+		c.ready = c.ready[1:]
+	}
+	return n, nil
+}
+
+// MTU returns the largest Write that fits one datagram of the carrier, if it
+// has an MTU method, or 0.
+func (c *Conn) MTU() int {
+	carrier, ok := c.Conn.(interface{ MTU() int })
+	if !ok {
+		return 0
+	}
+	if mtu := carrier.MTU(); mtu > HeaderLength {
+		return mtu - HeaderLength
+	}
+	return 0
+}
@@ -0,0 +1,173 @@
+// Package reorder numbers frames so that a carrier may deliver them slightly
+// out of order, e.g. datagrams, or the frames fec rebuilds late.
+//
+// A Sequencer prefixes every frame with a 4 byte sequence number, a Buffer
+// holds frames that arrive early and hands them out in order.  A frame that
+// does not show up within the window is given up on, so loss stalls the
+// stream for at most a window of frames instead of failing it.  Sequence
+// numbers wrap around, and are compared with serial number arithmetic.  Conn
+// puts both to work on a datagram conn.
+package reorder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// HeaderLength is the length of the sequence number prefix.
+	HeaderLength = 4
+
+	// DefaultWindow is the window of a Buffer made with a window of zero.
+	DefaultWindow = 32
+	// MaxWindow bounds the window, far below the sequence number space so
+	// that stale and early frames are told apart.
+	MaxWindow = 1 << 16
+)
+
+// ErrShortFrame is the error returned by Buffer.Add for frames without a
+// sequence number.
+var ErrShortFrame = errors.New("reorder: frame shorter than the header")
+
+// Sequencer numbers outgoing frames.
+type Sequencer struct {
+	next uint32
+}
+
+// Stamp returns frame behind the next sequence number.
+func (s *Sequencer) Stamp(frame []byte) []byte {
+	out := make([]byte, HeaderLength+len(frame))
+	binary.BigEndian.PutUint32(out, s.next)
+	copy(out[HeaderLength:], frame)
+	s.next++
+	return out
+}
+
+// Stats counts what a Buffer did besides delivering frames in order.
+type Stats struct {
+	// Reordered is the number of frames that arrived early and waited.
+	Reordered uint64
+	// Dropped is the number of frames that arrived after being given up on,
+	// or twice.
+	Dropped uint64
+	// Skipped is the number of frames given up on.
+	Skipped uint64
+}
+
+// Buffer puts numbered frames back in order.
+type Buffer struct {
+	window  int
+	next    uint32
+	pending map[uint32][]byte
+	stats   Stats
+}
+
+// NewBuffer returns a Buffer holding up to window frames ahead of the next
+// one due.
+func NewBuffer(window int) (*Buffer, error) {
+	if window == 0 {
+		window = DefaultWindow
+	}
+	if window < 0 || window > MaxWindow {
+		return nil, fmt.Errorf("reorder: invalid window %d", window)
+	}
+	return &Buffer{window: window, pending: make(map[uint32][]byte)}, nil
+}
+
+// Add processes a stamped frame and returns the frames it made deliverable,
+// in order and without their headers.
+func (b *Buffer) Add(frame []byte) ([][]byte, error) {
+	if len(frame) < HeaderLength {
+		return nil, ErrShortFrame
+	}
+	seq := binary.BigEndian.Uint32(frame)
+	body := append([]byte(nil), frame[HeaderLength:]...)
+
+	ahead := int64(int32(seq - b.next))
+	if ahead < 0 {
+		b.stats.Dropped++
+		return nil, nil
+	}
+	if _, ok := b.pending[seq]; ok {
+		b.stats.Dropped++
+		return nil, nil
+	}
+
+	var frames [][]byte
+	if ahead >= int64(b.window) {
+		// Give up on the frames that keep seq out of the window, in one
+		// step whatever the gap: only the pending ones are visited.
+		next := seq - uint32(b.window) + 1
+		frames = b.release(next)
+		b.stats.Skipped += uint64(next-b.next) - uint64(len(frames))
+		b.next = next
+	}
+	if seq != b.next {
+		b.pending[seq] = body
+		b.stats.Reordered++
+		return append(frames, b.drain()...), nil
+	}
+	b.next++
+	frames = append(frames, body)
+	return append(frames, b.drain()...), nil
+}
+
+// release removes the pending frames before next and returns them in order.
+func (b *Buffer) release(next uint32) [][]byte {
+	gap := next - b.next
+	var seqs []uint32
+	for seq := range b.pending {
+		if seq-b.next < gap {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i]-b.next < seqs[j]-b.next })
+	frames := make([][]byte, 0, len(seqs))
+	for _, seq := range seqs {
+		frames = append(frames, b.pending[seq])
+		delete(b.pending, seq)
+	}
+	return frames
+}
+
+// drain returns the pending frames that are now due.
+func (b *Buffer) drain() [][]byte {
+	var frames [][]byte
+	for {
+		f, ok := b.pending[b.next]
+		if !ok {
+			return frames
+		}
+		delete(b.pending, b.next)
+		frames = append(frames, f)
+		b.next++
+	}
+}
+
+// Skip gives up on all missing frames, e.g. when the sender went idle and
+// nothing will push the window along, and returns the frames held.
+func (b *Buffer) Skip() [][]byte {
+	var frames [][]byte
+	for len(b.pending) > 0 {
+		if f, ok := b.pending[b.next]; ok {
+			delete(b.pending, b.next)
+			frames = append(frames, f)
+		} else {
+			b.stats.Skipped++
+		}
+		b.next++
+	}
+	return frames
+}
+
+// Pending returns the number of frames waiting for an earlier one.
+func (b *Buffer) Pending() int {
+	return len(b.pending)
+}
+
+// Stats returns the counters of b.
+func (b *Buffer) Stats() Stats {
+	return b.stats
+}
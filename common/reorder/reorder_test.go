@@ -0,0 +1,145 @@
+package reorder
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestReorder(t *testing.T) {
+	const window = 8
+	buf, err := NewBuffer(window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Start close to the wrap around.
+	s := &Sequencer{next: 1<<32 - 50}
+	buf.next = s.next
+
+	var stamped [][]byte
+	for i := 0; i < 200; i++ {
+		stamped = append(stamped, s.Stamp([]byte(fmt.Sprint(i))))
+	}
+	// Shuffle within runs shorter than the window, lose frame 100 and
+	// repeat frame 10.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i+window/2 <= len(stamped); i += window / 2 {
+		run := stamped[i : i+window/2]
+		rng.Shuffle(len(run), func(a, b int) { run[a], run[b] = run[b], run[a] })
+	}
+	var sent [][]byte
+	for _, f := range stamped {
+		if string(f[HeaderLength:]) == "100" {
+			continue
+		}
+		sent = append(sent, f)
+		if string(f[HeaderLength:]) == "10" {
+			sent = append(sent, f)
+		}
+	}
+
+	var got []string
+	for _, f := range sent {
+		out, err := buf.Add(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range out {
+			got = append(got, string(frame))
+		}
+	}
+	for _, frame := range buf.Skip() {
+		got = append(got, string(frame))
+	}
+
+	var want []string
+	for i := 0; i < 200; i++ {
+		if i != 100 {
+			want = append(want, fmt.Sprint(i))
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v", got)
+	}
+	if st := buf.Stats(); st.Skipped != 1 || st.Dropped != 1 || st.Reordered == 0 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestFarAhead(t *testing.T) {
+	buf, err := NewBuffer(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Sequencer{}
+	early := s.Stamp([]byte("early"))
+	s.Stamp(nil)
+	buf.Add(s.Stamp([]byte("held")))
+	// A frame half the sequence space ahead gives up on everything before
+	// its window in one step.
+	s.next = 1<<31 - 1
+	out, err := buf.Add(s.Stamp([]byte("far")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%q", out) != `["held"]` {
+		t.Fatalf("got %q", out)
+	}
+	if st := buf.Stats(); st.Skipped != 1<<31-4-1 {
+		t.Fatalf("skipped %d", st.Skipped)
+	}
+	if out, _ = buf.Add(early); len(out) != 0 {
+		t.Fatalf("stale frame delivered: %q", out)
+	}
+}
+
+// swapConn delivers the first two datagrams written to it the other way
+// round.
+type swapConn struct {
+	net.Conn
+	held []byte
+	n    int
+}
+
+func (c *swapConn) Write(b []byte) (int, error) {
+	c.n++
+	switch c.n {
+	case 1:
+		c.held = append([]byte(nil), b...)
+		return len(b), nil
+	case 2:
+		if _, err := c.Conn.Write(b); err != nil {
+			return 0, err
+		}
+		b = c.held
+	}
+	return c.Conn.Write(b)
+}
+
+func TestConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	w, err := NewConn(&swapConn{Conn: a}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewConn(b, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for _, s := range []string{"one ", "two ", "three"} {
+			w.Write([]byte(s))
+		}
+	}()
+	got := make([]byte, len("one two three"))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "one two three" {
+		t.Fatalf("got %q", got)
+	}
+}
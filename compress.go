@@ -0,0 +1,115 @@
+package riverrun
+
+import (
+	"bytes"
+
+	"github.com/golang/snappy"
+
+	f "github.com/v2fly/riverrun/common/framing"
+)
+
+// Compression selects how payload is compressed before it is expanded.
+type Compression int
+
+const (
+	// CompressionNone sends payload as is.
+	CompressionNone Compression = iota
+	// CompressionSnappy compresses each frame with the snappy block format.
+	CompressionSnappy
+)
+
+const (
+	// compressInputMax bounds the payload packed into one compressed frame,
+	// and so what a compressed frame may decode to.
+	compressInputMax = 16 * 1024
+	// compressInputMin is the smallest payload worth compressing.
+	compressInputMin = 64
+	// compressSkipFrames is the number of frames sent uncompressed once a
+	// frame turned out incompressible, so that encrypted or already
+	// compressed streams are not compressed in vain.
+	compressSkipFrames = 16
+)
+
+// chopCompressed is like Chop for payload, but packs each frame with as much
+// compressed payload as fits, falling back to plain frames where compression
+// does not pay off.
+func (encoder *riverrunEncoder) chopCompressed(b []byte) (frameBuf bytes.Buffer, n int, err error) {
+	for len(b) > 0 {
+		start := n
+		pktType := uint8(PacketTypePayload)
+		payload := b
+		if len(payload) > encoder.MaxPacketPayloadLength {
+			payload = payload[:encoder.MaxPacketPayloadLength]
+		}
+		if encoder.skipFrames > 0 {
+			encoder.skipFrames--
+		} else if len(b) >= compressInputMin {
+			if out, in, ok := encoder.compressFrame(b); ok {
+				pktType = PacketTypeCompressed
+				payload = out
+				b = b[in:]
+				n += in
+			} else {
+				encoder.skipFrames = compressSkipFrames
+			}
+		}
+		if pktType == PacketTypePayload {
+			b = b[len(payload):]
+			n += len(payload)
+		}
+
+		err = encoder.MakePacket(&frameBuf, encoder.ChopPayload(pktType, payload))
+		if err != nil {
+			return frameBuf, 0, err
+		}
+		if pktType == PacketTypeCompressed {
+			encoder.payloadLens[len(encoder.payloadLens)-1] = n - start
+		}
+	}
+	return
+}
+
+// compressFrame compresses the longest prefix of b that still fits a frame
+// once compressed, and returns it along with the prefix length.  ok is false if
+// that saves less than an eighth of the prefix.
+func (encoder *riverrunEncoder) compressFrame(b []byte) (out []byte, in int, ok bool) {
+	if encoder.compressBuf == nil {
+		encoder.compressBuf = make([]byte, snappy.MaxEncodedLen(compressInputMax))
+	}
+	in = len(b)
+	if in > compressInputMax {
+		in = compressInputMax
+	}
+	for {
+		out = snappy.Encode(encoder.compressBuf, b[:in])
+		if len(out) <= encoder.MaxPacketPayloadLength {
+			return out, in, len(out) < in-in/8
+		}
+		// Shrink the input to the ratio seen so far.
+		next := in * encoder.MaxPacketPayloadLength / len(out)
+		if next >= in {
+			next = in - 1
+		}
+		if next <= encoder.MaxPacketPayloadLength {
+			return nil, 0, false
+		}
+		in = next
+	}
+}
+
+// decompress releases the payload of a PacketTypeCompressed body.
+func (decoder *riverrunDecoder) decompress(body []byte) error {
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return err
+	}
+	if n > compressInputMax {
+		return f.InvalidPayloadLengthError(n)
+	}
+	out, err := snappy.Decode(nil, body)
+	if err != nil {
+		return err
+	}
+	decoder.ReceiveDecodedBuffer.Write(out)
+	return nil
+}
@@ -0,0 +1,42 @@
+package riverrun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 2000)
+	noise := make([]byte, 50000)
+	rand.Read(noise)
+
+	for _, msg := range [][]byte{text, noise, append(noise[:1000:1000], text...), text[:10]} {
+		client, server := newTestPair(t, &Config{Compression: CompressionSnappy}, nil)
+		go client.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("payload of length %d mismatch", len(msg))
+		}
+	}
+}
+
+func TestCompressionShrinksText(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 2000)
+	wire := func(config *Config) uint64 {
+		client, server := newTestPair(t, config, nil)
+		go client.Write(text)
+		if _, err := io.ReadFull(server, make([]byte, len(text))); err != nil {
+			t.Fatal(err)
+		}
+		return client.Snapshot().WireBytesOut
+	}
+	plain, compressed := wire(nil), wire(&Config{Compression: CompressionSnappy})
+	if compressed*4 > plain {
+		t.Fatalf("compressed to %d wire bytes, want well below %d", compressed, plain)
+	}
+}
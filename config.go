@@ -0,0 +1,425 @@
+package riverrun
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	f "github.com/v2fly/riverrun/common/framing"
+	"github.com/v2fly/riverrun/common/log"
+	"github.com/v2fly/riverrun/common/reorder"
+)
+
+// SelfTestMode selects what happens when the entropy self-test runs.
+type SelfTestMode int
+
+const (
+	// SelfTestOff skips the entropy self-test.
+	SelfTestOff SelfTestMode = iota
+	// SelfTestLog logs an out-of-window result but keeps the connection.
+	SelfTestLog
+	// SelfTestFail makes NewConnConfig fail on an out-of-window result.
+	SelfTestFail
+)
+
+const (
+	// DefaultMinEntropy and DefaultMaxEntropy bound the byte entropy, in bits
+	// per byte, expected from the bias range chosen in NewConn.  The bias of
+	// .1-.3 ideally yields 3.75-7.05 bits, the window leaves some slack for
+	// sampling noise.
+	DefaultMinEntropy = 3.5
+	DefaultMaxEntropy = 7.5
+
+	// DefaultSelfTestProbeSize is the number of bytes expanded by the
+	// entropy self-test.
+	DefaultSelfTestProbeSize = 4096
+
+	// DefaultKeystreamLookahead is the keystream generated ahead of use,
+	// in bytes.  Expanding a full frame draws about 180 KiB.
+	DefaultKeystreamLookahead = 16 * 1024
+
+	// DefaultMaxBufferedBytes caps the received bytes a connection holds,
+	// undecoded or decoded but not read yet.
+	DefaultMaxBufferedBytes = 2 * f.ConsumeReadSize
+)
+
+// Config holds the optional settings of a Conn.  The zero value matches the
+// behaviour of NewConn.
+type Config struct {
+	// Logger receives the connection's log output.  If nil, it is discarded.
+	Logger log.Logger
+
+	// EntropySelfTest expands a random probe buffer once the tables are
+	// ready and checks that the resulting byte entropy lies within
+	// [MinEntropy, MaxEntropy].
+	EntropySelfTest SelfTestMode
+	// MinEntropy and MaxEntropy are the target entropy window in bits per
+	// byte.  Zero selects DefaultMinEntropy and DefaultMaxEntropy.
+	MinEntropy float64
+	MaxEntropy float64
+	// AdaptiveBias measures the byte entropy of every AdaptiveWindow wire
+	// bytes written and, while it lies outside [MinEntropy, MaxEntropy],
+	// moves the write direction to tables of a corrected bias, announced to
+	// the peer with an extended Renegotiate frame.  Both sides generate the
+	// new tables in the Write and Read that carry the switch, which stalls
+	// the flow for a moment, so retunes are at least ten seconds apart and
+	// stay within the bias range of Shape, and a peer retuning faster fails
+	// the Read with ErrRetuneTooSoon.  It only applies to the built-in
+	// codec, and the peer must understand the extended frame.
+	AdaptiveBias bool
+	// AdaptiveWindow is the measurement window of AdaptiveBias in bytes.
+	// Zero selects DefaultAdaptiveWindow.
+	AdaptiveWindow int
+	// SelfTestProbeSize is the size of the probe buffer.  Zero selects
+	// DefaultSelfTestProbeSize.
+	SelfTestProbeSize int
+
+	// Shape is the model the traffic parameters are drawn from.
+	Shape Shape
+
+	// Scheduler creates the write scheduler of each connection.  If nil,
+	// ImmediateScheduler is used.
+	Scheduler SchedulerFactory
+
+	// PadOnFlush makes Conn.Flush write a padding frame of a sampled chunk
+	// length, e.g. to cover the end of a message.  The peer must understand
+	// padding frames, or set IgnoreUnknownPacketTypes.
+	PadOnFlush bool
+	// TrafficHint is the initial hint of every connection, see
+	// Conn.SetTrafficHint.
+	TrafficHint TrafficHint
+
+	// Personalization is mixed into everything derived from the seed, so
+	// that unrelated deployments sharing a copied seed still differ.  Both
+	// peers must use the same string, e.g. the server hostname.
+	Personalization string
+
+	// TableDir, if set, is a directory of memory-mapped table files shared
+	// by all processes using it.  Tables missing from it are generated and
+	// stored there.
+	TableDir string
+
+	// TableProgress, if set, is called with the fraction of the tables of
+	// a connection generated so far, from the goroutine generating them.
+	// Tables found in the cache or TableDir report 1 right away.  See
+	// NewConnContext and DeriveParamsContext to abort the generation.
+	TableProgress func(fraction float64)
+
+	// Hooks receives wire-level events.  If nil, events are dropped.
+	Hooks Hooks
+
+	// Tracer, if set, receives spans of the handshake, table generation,
+	// reads and writes, see package riverrun/otel.
+	Tracer Tracer
+
+	// Hardened keeps traffic metadata out of every record, for audited
+	// deployments and research settings: debug output is dropped, frame
+	// sizes and traffic parameters are left out of the log, and Hooks,
+	// Tracer and KeyLog, which record frames, are refused.  Builds with the
+	// riverrun_hardened tag force it on, and compile out the debug logging
+	// of the data path altogether.
+	Hardened bool
+
+	// StrictFrames makes Read fail with ErrFrameTooLarge as soon as the peer
+	// declares a frame longer than the negotiated maximum, instead of
+	// masking the error by consuming a random amount of data first.
+	StrictFrames bool
+	// MaxFrameLength is the size of the largest frame, length field
+	// included, e.g. smaller for carriers with a small MTU.  Zero selects
+	// framing.MaximumSegmentLength.  Frames are limited to 64 KiB by the
+	// length field.  Both peers must use the same value, a reader with a
+	// smaller one rejects the writer's large frames.
+	MaxFrameLength int
+	// ReorderWindow, if set, carries the stream over a datagram carrier
+	// that may deliver datagrams out of order, e.g. connected UDP: every
+	// chunk goes out as one datagram behind a sequence number, see
+	// reorder.Conn, and up to that many early ones wait for those due
+	// first.  Lost datagrams fail the frames they carried.  Both peers
+	// must set it, and chunks should fit the MTU, see Carrier.
+	ReorderWindow int
+	// MaxBufferedBytes caps the received bytes held by the connection,
+	// undecoded or decoded but not read yet.  Once reached, nothing more is
+	// read from the carrier until the application reads.  Frames are
+	// decoded as they arrive, so the cap need not hold a whole one, but a
+	// frame that has to be buffered in full and does not fit fails the
+	// Read with ErrBufferLimit.  Zero selects DefaultMaxBufferedBytes, a
+	// negative value removes the cap.
+	MaxBufferedBytes int
+	// IgnoreUnknownPacketTypes drops received packets of types neither
+	// built in nor registered with RegisterPacketType, instead of failing
+	// the Read, so that peers can add extensions without breaking older
+	// versions.
+	IgnoreUnknownPacketTypes bool
+	// CloseOnFrameError closes the connection when Read rejects a frame.
+	CloseOnFrameError bool
+	// KeyCommitment appends a tag committing to the seed to the salt, so
+	// that a peer using another seed fails with ErrKeyCommitment before
+	// any frame, and a listener serving several seeds can tell them apart,
+	// see Params.MatchesClient.  Both peers must set it.
+	KeyCommitment bool
+	// FrameHeader selects the layout of the length word of the frames
+	// written.  Past FrameHeaderLength it is announced to the peer in a
+	// frame behind the salt, in the original layout, and the peer reads
+	// the frames following the way announced, whatever its own
+	// FrameHeader.  Frames of peers announcing nothing are read in the
+	// original layout, but peers predating the announcement fail it.
+	FrameHeader FrameHeader
+	// RekeyAfter, if set, renegotiates the shaping parameters once that
+	// many payload bytes were written since the last renegotiation of
+	// either peer, see Conn.NextRekeyIn.
+	RekeyAfter int64
+	// AutoMSS grows the chunk lengths while the payload written holds
+	// AutoMSSRate for a few seconds, by renegotiating to a later epoch whose
+	// lengths are larger in this direction and no smaller in the other.
+	// This cuts the writes and frame overhead of bulk transfers, while the
+	// lengths stay those of some epoch.
+	AutoMSS bool
+	// AutoMSSRate is the rate of AutoMSS in bytes per second.  Zero selects
+	// DefaultAutoMSSRate.
+	AutoMSSRate int64
+	// BlackholeStall, if set, takes carrier writes blocking that long, a
+	// few in a row, for large segments lost to a path MTU blackhole, and
+	// renegotiates to an epoch with shorter chunks in this direction.
+	// AutoMSS then stays below them.  Hooks.OnBlackhole reports the
+	// change.
+	BlackholeStall time.Duration
+	// OnRekey, if set, is called whenever the connection switches to new
+	// parameters, e.g. to correlate throughput dips with renegotiations.
+	// It is called from the Read or Write carrying the switch.
+	OnRekey func(rr *Conn, event RekeyEvent)
+	// EchoInterval, if set, sends an echo at that interval to keep
+	// Conn.RTT current.  The peer must support echoes, or set
+	// IgnoreUnknownPacketTypes.
+	EchoInterval time.Duration
+
+	// ReadIdleTimeout, if set, closes the connection once nothing has been
+	// read from the carrier for that long.  Riverrun sends nothing on its
+	// own, so it must exceed the quiet periods of the application.
+	ReadIdleTimeout time.Duration
+	// WriteTimeout, if set, closes the connection when a carrier write
+	// takes longer, as the peer stopped reading.  A carrier write failing
+	// closes the connection regardless, unless it ran into a deadline.
+	WriteTimeout time.Duration
+	// OnClose, if set, is called once the connection is closed, by Close or
+	// by one of the checks above, with the reason.  It is called from the
+	// goroutine closing the connection.
+	OnClose func(rr *Conn, reason CloseReason)
+	// DecodeStorm, if set, watches client connections for systematic
+	// decode failures, see StormDetector.
+	DecodeStorm *StormDetector
+
+	// Quota, if set, accounts the wire bytes of the connection, e.g. with
+	// a TransferQuota shared by all connections of a user.
+	Quota Quota
+
+	// Compression compresses written payload before expansion.  Compressed
+	// frames are always understood on the reading side, so peers need not
+	// agree on it.  Frame lengths reveal how well the payload compressed,
+	// so do not enable it for streams mixing secrets with attacker
+	// controlled data.
+	Compression Compression
+
+	// KeyExchange runs a key exchange over the first frames, and switches
+	// to its keys, so that traffic cannot be decrypted with the seed once
+	// a connection is done.  Both peers must set it.  What either side
+	// writes before its keys switched remains keyed by the seed.  The
+	// client's public key goes out with its first write, so that is about
+	// a round trip from there on, and all the server writes before it,
+	// e.g. the greeting of a server speaking first.
+	KeyExchange KeyExchange
+
+	// AuthToken, if set, is sent by a client in the frame after the salt
+	// and any key exchange message, for servers on a Listener with an
+	// Authority.  Servers without one ignore it, but must know
+	// PacketTypeAuth.  It is issued by TokenAuthority.Issue.
+	AuthToken []byte
+	// OnSeedRotation, if set, receives the seed rotations the peer
+	// announces with Conn.AnnounceSeed, e.g. to store the new seed for the
+	// dials after rotation.Start.  It is called from Read.  Announcements
+	// are ignored without it.
+	OnSeedRotation func(rr *Conn, rotation SeedRotation)
+
+	// EncodeWorkers, if above 1, expands large writes on that many
+	// goroutines.  It trades CPU of other cores for the throughput of a
+	// single connection, and does not apply to compressed writes.
+	EncodeWorkers int
+	// SpanThreshold, if set, sends writes of at least that many bytes as
+	// spans: a PacketTypeSpan frame declaring up to MaxSpanLength bytes,
+	// followed by them expanded without frame headers, which saves the
+	// header of every frame on bulk transfers.  The carrier writes are
+	// still cut to sampled lengths.  Peers older than spans fail on them.
+	SpanThreshold int
+
+	// KeystreamLookahead is the amount of keystream, in bytes, generated
+	// ahead of use for each direction.  Zero selects
+	// DefaultKeystreamLookahead, a negative value generates it on demand.
+	KeystreamLookahead int
+
+	// DisableLengthShaping writes every frame as a carrier write of its own
+	// instead of re-chunking the stream to sampled lengths, so that packet
+	// captures show clean frame boundaries.  It is meant for debugging and
+	// makes the traffic easy to recognize.
+	DisableLengthShaping bool
+
+	// ConstantTimeLookups inverts expanded blocks by scanning the whole
+	// table instead of a map lookup, so that the cache footprint of reading
+	// does not depend on the data.  It is meant for high-assurance
+	// deployments on shared hardware and costs a lot of read throughput.
+	// Writing still indexes the tables by plaintext.
+	ConstantTimeLookups bool
+
+	// LowMemory inverts expanded blocks by binary search over a sorted copy
+	// of the tables instead of a map, for devices short of memory.  It
+	// takes a fraction of the memory per key and costs some read
+	// throughput.  ConstantTimeLookups, which needs no inversion at all,
+	// takes precedence.
+	LowMemory bool
+
+	// Codec names the codec expanding frames, one registered with
+	// framing.RegisterCodec.  Empty or CodecCtstretch selects the built-in
+	// tables, which ConstantTimeLookups, LowMemory, EncodeWorkers and the
+	// table records of KeyLog apply to.  Both peers must use the same codec.
+	Codec string
+
+	// KeyLog, if set, receives the table parameters, keys and frame
+	// boundaries of every connection, so that analysis tools can decode
+	// packet captures in a lab.  It defeats all protection of the traffic.
+	//
+	// The log has one record per line, in the spirit of SSLKEYLOGFILE.
+	// <conn> is the Conn.TraceID and <dir> is c2s or s2c.  Byte
+	// strings are hex, offsets count the wire bytes of the direction.  The
+	// salt takes the first bytes of a direction, frames follow it back to
+	// back.  With KeyExchange, the frames from <offset> on use the keys of
+	// the REKEY record.
+	//
+	//	RIVERRUN_TABLE <conn> <dir> <table key> <table iv> <bias> <bits8> <bits16>
+	//	RIVERRUN_KEYS <conn> <dir> <salt> <drbg key> <ctr key> <ctr iv>
+	//	RIVERRUN_REKEY <conn> <dir> <offset> <drbg key> <ctr key> <ctr iv>
+	//	RIVERRUN_FRAME <conn> <dir> <offset> <length>
+	KeyLog io.Writer
+}
+
+// withDefaults returns a copy of config with unset fields filled in.
+func (config *Config) withDefaults() *Config {
+	res := new(Config)
+	if config != nil {
+		*res = *config
+	}
+	if res.Logger == nil {
+		res.Logger = log.NopLogger{}
+	}
+	if log.Hardened {
+		res.Hardened = true
+	}
+	if _, quiet := res.Logger.(log.Quiet); res.Hardened && !quiet {
+		res.Logger = log.Quiet{Logger: res.Logger}
+	}
+	if res.MinEntropy == 0 {
+		res.MinEntropy = DefaultMinEntropy
+	}
+	if res.MaxEntropy == 0 {
+		res.MaxEntropy = DefaultMaxEntropy
+	}
+	if res.MaxFrameLength == 0 {
+		res.MaxFrameLength = f.MaximumSegmentLength
+	}
+	if res.AutoMSSRate == 0 {
+		res.AutoMSSRate = DefaultAutoMSSRate
+	}
+	if res.AdaptiveWindow == 0 {
+		res.AdaptiveWindow = DefaultAdaptiveWindow
+	}
+	if res.SelfTestProbeSize == 0 {
+		res.SelfTestProbeSize = DefaultSelfTestProbeSize
+	}
+	if res.MaxBufferedBytes == 0 {
+		res.MaxBufferedBytes = DefaultMaxBufferedBytes
+	}
+	if res.KeystreamLookahead == 0 {
+		res.KeystreamLookahead = DefaultKeystreamLookahead
+	}
+	res.Shape = res.Shape.withDefaults()
+	if res.Hooks == nil {
+		res.Hooks = NopHooks{}
+	}
+	if res.Scheduler == nil {
+		res.Scheduler = ImmediateScheduler()
+	}
+	return res
+}
+
+func (config *Config) validate() error {
+	if config.Hardened && (config.KeyLog != nil || config.Hooks != Hooks(NopHooks{}) || config.Tracer != nil) {
+		return fmt.Errorf("riverrun: Hooks, Tracer and KeyLog are refused in hardened mode")
+	}
+	if config.MinEntropy < 0 || config.MaxEntropy > 8 || config.MinEntropy > config.MaxEntropy {
+		return fmt.Errorf("riverrun: invalid entropy window [%f, %f]", config.MinEntropy, config.MaxEntropy)
+	}
+	if err := config.Shape.validate(); err != nil {
+		return err
+	}
+	if config.Compression < CompressionNone || config.Compression > CompressionSnappy {
+		return fmt.Errorf("riverrun: invalid compression: %d", config.Compression)
+	}
+	if config.KeyExchange < KeyExchangeNone || config.KeyExchange > KeyExchangeX25519Kyber768 {
+		return fmt.Errorf("riverrun: invalid key exchange: %d", config.KeyExchange)
+	}
+	if config.FrameHeader < FrameHeaderLength || config.FrameHeader > FrameHeaderChecked {
+		return fmt.Errorf("riverrun: invalid frame header: %d", config.FrameHeader)
+	}
+	if config.EncodeWorkers < 0 {
+		return fmt.Errorf("riverrun: invalid encode workers: %d", config.EncodeWorkers)
+	}
+	if err := config.TrafficHint.validate(); err != nil {
+		return err
+	}
+	if config.DecodeStorm != nil {
+		if err := config.DecodeStorm.validate(); err != nil {
+			return err
+		}
+	}
+	if config.ReorderWindow < 0 || config.ReorderWindow > reorder.MaxWindow {
+		return fmt.Errorf("riverrun: invalid reorder window: %d", config.ReorderWindow)
+	}
+	if config.SpanThreshold < 0 {
+		return fmt.Errorf("riverrun: invalid span threshold: %d", config.SpanThreshold)
+	}
+	if config.RekeyAfter < 0 {
+		return fmt.Errorf("riverrun: invalid rekey threshold: %d", config.RekeyAfter)
+	}
+	if config.EchoInterval < 0 {
+		return fmt.Errorf("riverrun: invalid echo interval: %s", config.EchoInterval)
+	}
+	if config.ReadIdleTimeout < 0 || config.WriteTimeout < 0 {
+		return fmt.Errorf("riverrun: invalid dead-peer timeouts: %s, %s", config.ReadIdleTimeout, config.WriteTimeout)
+	}
+	if config.BlackholeStall < 0 {
+		return fmt.Errorf("riverrun: invalid blackhole stall: %s", config.BlackholeStall)
+	}
+	if len(config.AuthToken) > 1+MaxClientIDLength+authTagLength {
+		return fmt.Errorf("riverrun: invalid auth token length: %d", len(config.AuthToken))
+	}
+	if config.AutoMSSRate < 0 {
+		return fmt.Errorf("riverrun: invalid auto MSS rate: %d", config.AutoMSSRate)
+	}
+	if config.AdaptiveWindow < 0 {
+		return fmt.Errorf("riverrun: invalid adaptive window: %d", config.AdaptiveWindow)
+	}
+	if config.SelfTestProbeSize < 0 {
+		return fmt.Errorf("riverrun: invalid self-test probe size: %d", config.SelfTestProbeSize)
+	}
+	if config.Codec != "" && config.Codec != CodecCtstretch {
+		if _, ok := f.LookupCodec(config.Codec); !ok {
+			return fmt.Errorf("riverrun: unknown codec %q", config.Codec)
+		}
+	}
+	return nil
+}
+
+// logParams logs traffic parameters, unless logger is that of a hardened
+// connection.
+func logParams(logger log.Logger, format string, a ...interface{}) {
+	if !log.IsQuiet(logger) {
+		logger.Infof(format, a...)
+	}
+}
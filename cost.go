@@ -0,0 +1,196 @@
+package riverrun
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/v2fly/riverrun/common/drbg"
+	f "github.com/v2fly/riverrun/common/framing"
+	"github.com/v2fly/riverrun/common/log"
+)
+
+const (
+	// costSampleLength is the payload coded per round of the benchmarks of
+	// EstimateCost.
+	costSampleLength = 64 * 1024
+	// costBudget is the time each benchmark of EstimateCost runs for.
+	costBudget = 20 * time.Millisecond
+	// calibrationRounds is the length of the loop timing a CPU cycle.
+	calibrationRounds = 1 << 22
+)
+
+// CostEstimate is the expected cost of a Config on this machine, see
+// EstimateCost.
+type CostEstimate struct {
+	// PayloadRate is the payload rate estimated for, in bytes per second.
+	PayloadRate float64
+	// WireRate is the resulting rate on the carrier.  It counts the codec
+	// expansion and the frame headers of payload sent in whole frames, not
+	// padding, echoes or compression.
+	WireRate float64
+	// Expansion is WireRate over PayloadRate.
+	Expansion float64
+	// EncodeCyclesPerByte and DecodeCyclesPerByte are the CPU cycles the
+	// codec takes per payload byte written and read, from benchmarks run by
+	// EstimateCost.  Cycles are timed against a loop of dependent
+	// additions, which current CPUs retire at one per cycle.
+	EncodeCyclesPerByte float64
+	DecodeCyclesPerByte float64
+	// Cores is the share of a CPU core taken by sending and receiving
+	// PayloadRate each.
+	Cores float64
+	// TableBytes is the memory held by the tables of a seed, both
+	// directions and the inversion for reading included, which all
+	// connections using the seed share.  It is zero for registered codecs.
+	TableBytes int64
+}
+
+// EstimateCost returns the expected wire rate, CPU and memory cost of
+// connections with config carrying payloadRate bytes per second each way, to
+// compare profiles on a given machine and bandwidth budget.  It runs short
+// benchmarks, for about a tenth of a second, on synthetic tables: the real
+// ones are only generated for a seed.
+func EstimateCost(config *Config, payloadRate float64) (*CostEstimate, error) {
+	if payloadRate < 0 {
+		return nil, fmt.Errorf("riverrun: invalid payload rate: %f", payloadRate)
+	}
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	var codec f.Codec
+	var tableBytes int64
+	if codecName(config.Codec) == CodecCtstretch {
+		codec, tableBytes = costCodec(config)
+	} else {
+		seed, err := drbg.SeedFromBytes(make([]byte, drbg.SeedLength))
+		if err != nil {
+			return nil, err
+		}
+		if codec, _, err = newCodecs(config.Codec, false, seed, config); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkFrameLength(config.MaxFrameLength, config.FrameHeader, codec, codec); err != nil {
+		return nil, err
+	}
+
+	lengthLength := codec.ExpandedLen(f.LengthLength)
+	payload := codec.CompressedLen(config.MaxFrameLength-lengthLength) - f.TypeLength
+	expansion := float64(lengthLength+codec.ExpandedLen(f.TypeLength+payload)) / float64(payload)
+
+	encode, decode, err := benchmarkCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	cycle := cycleTime()
+	est := &CostEstimate{
+		PayloadRate:         payloadRate,
+		WireRate:            payloadRate * expansion,
+		Expansion:           expansion,
+		EncodeCyclesPerByte: encode / cycle,
+		DecodeCyclesPerByte: decode / cycle,
+		Cores:               payloadRate * (encode + decode) / 1e9,
+		TableBytes:          tableBytes,
+	}
+	return est, nil
+}
+
+// costCodec returns a ctstretch codec with the block sizes and inversion of
+// config over synthetic tables, along with the table memory of a seed.
+func costCodec(config *Config) (f.Codec, int64) {
+	bits := uint64(config.Shape.ExpandedBlockBits)
+	tables := &tableSet{table8: make([]uint64, 256), table16: make([]uint64, 65536)}
+	// Multiplying by an odd constant is a bijection, so that the entries
+	// are distinct as ctstretch.VerifyTable wants.
+	for i := range tables.table8 {
+		tables.table8[i] = uint64(i) * 0x9e3779b97f4a7c15 & (1<<(bits/2) - 1)
+	}
+	for i := range tables.table16 {
+		tables.table16[i] = uint64(i) * 0x9e3779b97f4a7c15 & (1<<bits - 1)
+	}
+	forward := 2 * 8 * int64(len(tables.table8)+len(tables.table16))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	inv8, inv16 := tables.inversions(config.ConstantTimeLookups, config.LowMemory)
+	runtime.ReadMemStats(&after)
+	inversion := int64(after.TotalAlloc - before.TotalAlloc)
+
+	codec := &ctstretchCodec{
+		table8:              tables.table8,
+		table16:             tables.table16,
+		inv8:                inv8,
+		inv16:               inv16,
+		compressedBlockBits: 16,
+		expandedBlockBits:   bits,
+		logger:              log.NopLogger{},
+	}
+	return codec, forward + inversion
+}
+
+// benchmarkCodec returns the nanoseconds codec takes to expand and to
+// compress a payload byte.
+func benchmarkCodec(codec f.Codec) (encode, decode float64, err error) {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		return 0, 0, err
+	}
+	src := make([]byte, costSampleLength)
+	for i := range src {
+		src[i] = byte(i * 7)
+	}
+	expanded := make([]byte, codec.ExpandedLen(len(src)))
+	dst := make([]byte, len(src))
+
+	var rounds int
+	start := time.Now()
+	for rounds == 0 || time.Since(start) < costBudget {
+		stream := cipher.NewCTR(block, make([]byte, aes.BlockSize))
+		if err = codec.Expand(expanded, src, stream); err != nil {
+			return 0, 0, err
+		}
+		rounds++
+	}
+	encode = float64(time.Since(start)) / float64(rounds*len(src))
+
+	rounds = 0
+	start = time.Now()
+	for rounds == 0 || time.Since(start) < costBudget {
+		stream := cipher.NewCTR(block, make([]byte, aes.BlockSize))
+		if err = codec.Compress(dst, expanded, stream); err != nil {
+			return 0, 0, err
+		}
+		rounds++
+	}
+	decode = float64(time.Since(start)) / float64(rounds*len(src))
+	return encode, decode, nil
+}
+
+// cycleSink keeps the calibration loop from being optimized away.
+var cycleSink uint64
+
+// cycleTime returns the nanoseconds of a CPU cycle, timed by a chain of
+// dependent additions.
+func cycleTime() float64 {
+	best := time.Duration(1<<63 - 1)
+	for try := 0; try < 3; try++ {
+		x, y := uint64(try), uint64(1)
+		start := time.Now()
+		for i := 0; i < calibrationRounds; i++ {
+			x += y
+			y += x
+		}
+		if d := time.Since(start); d < best {
+			best = d
+		}
+		atomic.AddUint64(&cycleSink, x)
+	}
+	return float64(best) / (2 * calibrationRounds)
+}
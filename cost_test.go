@@ -0,0 +1,26 @@
+package riverrun
+
+import "testing"
+
+func TestEstimateCost(t *testing.T) {
+	est, err := EstimateCost(nil, 1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Expansion <= 2 || est.Expansion > 2.1 || est.WireRate != 1e6*est.Expansion {
+		t.Errorf("got expansion %f, wire rate %f", est.Expansion, est.WireRate)
+	}
+	if est.EncodeCyclesPerByte <= 0 || est.DecodeCyclesPerByte <= 0 || est.Cores <= 0 {
+		t.Errorf("got CPU cost %+v", est)
+	}
+	low, err := EstimateCost(&Config{LowMemory: true, Shape: Shape{ExpandedBlockBits: 64}}, 1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if low.Expansion <= 4 || low.TableBytes >= est.TableBytes || low.TableBytes < 1<<20 {
+		t.Errorf("LowMemory with 64 bit blocks: got %+v, default %+v", low, est)
+	}
+	if _, err := EstimateCost(nil, -1); err == nil {
+		t.Error("negative rate accepted")
+	}
+}
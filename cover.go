@@ -0,0 +1,86 @@
+package riverrun
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// coverHeaderTimeout and coverIdleTimeout bound the requests of a
+	// visitor served by Listener.DecoyHandler, like those of a web server.
+	coverHeaderTimeout = 30 * time.Second
+	coverIdleTimeout   = 2 * time.Minute
+)
+
+// nopErrorLog keeps the errors of the cover site, e.g. of an upstream that is
+// down, out of the logs of the server.
+var nopErrorLog = stdlog.New(io.Discard, "", 0)
+
+// NewCoverSite returns a reverse proxy to the website at upstream, an http or
+// https URL, for Listener.DecoyHandler: visitors of the server port that do
+// not speak riverrun are served that site as if the server hosted it.  The
+// requests reach upstream with its own Host and no forwarding headers.
+func NewCoverSite(upstream string) (http.Handler, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("riverrun: invalid cover site %q", upstream)
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+		},
+		ErrorLog: nopErrorLog,
+	}, nil
+}
+
+// serveDecoy serves conn over HTTP with handler, the captured bytes first.
+func serveDecoy(handler http.Handler, conn net.Conn, captured []byte) {
+	ln := &oneConnListener{conn: &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(captured), conn)}, done: make(chan struct{})}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: coverHeaderTimeout,
+		IdleTimeout:       coverIdleTimeout,
+		ErrorLog:          nopErrorLog,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				ln.Close()
+			}
+		},
+	}
+	srv.Serve(ln)
+}
+
+// oneConnListener hands out conn once, and then blocks until closed.
+type oneConnListener struct {
+	conn      net.Conn
+	taken     bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if !l.taken {
+		l.taken = true
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
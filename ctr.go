@@ -0,0 +1,104 @@
+package riverrun
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"sync"
+
+	"github.com/v2fly/riverrun/common/ctr"
+)
+
+// seekableCTR is a CTR stream that knows its offset into the keystream, and
+// can start further streams at any offset.
+//
+// ctstretch draws keystream 8 bytes at a time, which is slow with a plain
+// cipher.Stream.  With a lookahead, keystream is generated in bulk ahead of
+// time and XORed from that buffer instead.
+type seekableCTR struct {
+	block cipher.Block
+	// key is the AES key of block, if known, for MarshalState.
+	key    []byte
+	iv     []byte
+	offset uint64
+	stream cipher.Stream
+
+	// ahead[pos:] is keystream generated but not used yet.
+	ahead []byte
+	pos   int
+}
+
+// aheadPool recycles the lookahead buffers of short-lived streams.
+var aheadPool sync.Pool
+
+func newSeekableCTR(block cipher.Block, iv []byte, lookahead int) *seekableCTR {
+	s := &seekableCTR{
+		block:  block,
+		iv:     append([]byte(nil), iv...),
+		stream: cipher.NewCTR(block, iv),
+	}
+	s.setLookahead(lookahead)
+	return s
+}
+
+func (s *seekableCTR) setLookahead(lookahead int) {
+	if lookahead <= 0 {
+		return
+	}
+	if buf, ok := aheadPool.Get().(*[]byte); ok && cap(*buf) >= lookahead {
+		s.ahead = (*buf)[:lookahead]
+	} else {
+		s.ahead = make([]byte, lookahead)
+	}
+	s.pos = len(s.ahead)
+}
+
+// release returns the lookahead buffer to the pool.  s must not be used
+// afterwards.
+func (s *seekableCTR) release() {
+	if s.ahead != nil {
+		// Not &s.ahead, seek overwrites s with the stream taking over.
+		buf := s.ahead
+		aheadPool.Put(&buf)
+		s.ahead = nil
+	}
+}
+
+func (s *seekableCTR) XORKeyStream(dst, src []byte) {
+	s.offset += uint64(len(src))
+	if s.ahead == nil {
+		s.stream.XORKeyStream(dst, src)
+		return
+	}
+	for len(src) > 0 {
+		if s.pos == len(s.ahead) {
+			for i := range s.ahead {
+				s.ahead[i] = 0
+			}
+			s.stream.XORKeyStream(s.ahead, s.ahead)
+			s.pos = 0
+		}
+		n := subtle.XORBytes(dst, src, s.ahead[s.pos:])
+		s.pos += n
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// at returns an independent stream starting offset bytes into the keystream,
+// with the same lookahead.
+func (s *seekableCTR) at(offset uint64) *seekableCTR {
+	counter, skip := ctr.CounterAt(s.iv, s.block.BlockSize(), offset)
+	res := &seekableCTR{block: s.block, key: s.key, iv: s.iv, offset: offset - uint64(skip), stream: cipher.NewCTR(s.block, counter)}
+	res.setLookahead(len(s.ahead))
+	if skip > 0 {
+		discard := make([]byte, skip)
+		res.XORKeyStream(discard, discard)
+	}
+	return res
+}
+
+// seek moves s to offset.
+func (s *seekableCTR) seek(offset uint64) {
+	next := s.at(offset)
+	s.release()
+	*s = *next
+}
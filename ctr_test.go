@@ -0,0 +1,26 @@
+package riverrun
+
+import (
+	"crypto/aes"
+	"testing"
+)
+
+func TestSeekReleasesLookahead(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSeekableCTR(block, make([]byte, aes.BlockSize), 64)
+	s.XORKeyStream(make([]byte, 10), make([]byte, 10))
+	s.seek(100)
+	// The pool may hand out the released buffer, never the live one.
+	for i := 0; i < 4; i++ {
+		buf, ok := aheadPool.Get().(*[]byte)
+		if !ok {
+			break
+		}
+		if len(*buf) > 0 && &(*buf)[0] == &s.ahead[0] {
+			t.Fatal("pool holds the lookahead of the seeked stream")
+		}
+	}
+}
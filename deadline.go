@@ -0,0 +1,72 @@
+package riverrun
+
+import (
+	"sync"
+	"time"
+)
+
+// writeDeadline is the write deadline of a Conn as a channel that is closed
+// once the deadline passes, so that scheduler waits can select on it.  The
+// zero value has no deadline.
+type writeDeadline struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+// set moves the deadline to t, the zero time clearing it.
+func (d *writeDeadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, wait for it to close cancel.
+		<-d.cancel
+	}
+	d.timer = nil
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+
+	closed := d.expiredLocked()
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(wait, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// done returns a channel closed once the deadline passes.  It is nil, and
+// blocks forever in a select, while no deadline was ever set.
+func (d *writeDeadline) done() <-chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.cancel
+}
+
+// expired reports whether the deadline has passed.
+func (d *writeDeadline) expired() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.expiredLocked()
+}
+
+func (d *writeDeadline) expiredLocked() bool {
+	select {
+	case <-d.cancel:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,201 @@
+package riverrun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CloseReason tells why a Conn was closed.
+type CloseReason int
+
+const (
+	// CloseLocal is a call to Close.
+	CloseLocal CloseReason = iota
+	// CloseReadIdle is Config.ReadIdleTimeout passing without a read from
+	// the carrier.
+	CloseReadIdle
+	// CloseWriteFailed is a carrier write failing, or outlasting
+	// Config.WriteTimeout.
+	CloseWriteFailed
+	// CloseFrameError is a rejected frame with Config.CloseOnFrameError.
+	CloseFrameError
+	// CloseQuota is Config.Quota refusing more traffic.
+	CloseQuota
+	// CloseSilentDrop is Listener.FirstFrameTimeout passing without a
+	// valid frame from the client.
+	CloseSilentDrop
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseLocal:
+		return "closed locally"
+	case CloseReadIdle:
+		return "read idle"
+	case CloseWriteFailed:
+		return "write failed"
+	case CloseFrameError:
+		return "frame error"
+	case CloseQuota:
+		return "quota"
+	case CloseSilentDrop:
+		return "silent drop"
+	}
+	return fmt.Sprintf("CloseReason(%d)", int(r))
+}
+
+// deadPeer watches the carrier of a Conn for a vanished peer.
+type deadPeer struct {
+	readIdle     time.Duration
+	writeTimeout time.Duration
+	teardown     func(CloseReason)
+
+	// lastRead is the time of the last carrier read, in Unix nanoseconds.
+	lastRead  atomic.Int64
+	lock      sync.Mutex
+	idleTimer *time.Timer
+	stopped   bool
+}
+
+func newDeadPeer(readIdle, writeTimeout time.Duration, teardown func(CloseReason)) *deadPeer {
+	d := &deadPeer{readIdle: readIdle, writeTimeout: writeTimeout, teardown: teardown}
+	d.lastRead.Store(time.Now().UnixNano())
+	return d
+}
+
+// start arms the read idle timer.  It is called once the Conn is handed to
+// the caller, so that a failed or abandoned setup never tears down the
+// carrier.
+func (d *deadPeer) start() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.readIdle > 0 && !d.stopped {
+		d.lastRead.Store(time.Now().UnixNano())
+		d.idleTimer = time.AfterFunc(d.readIdle, d.checkIdle)
+	}
+}
+
+// checkIdle tears down the Conn if the last read is readIdle ago, or checks
+// again once it will be.
+func (d *deadPeer) checkIdle() {
+	idle := time.Since(time.Unix(0, d.lastRead.Load()))
+	if idle >= d.readIdle {
+		d.teardown(CloseReadIdle)
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.stopped {
+		d.idleTimer.Reset(d.readIdle - idle)
+	}
+}
+
+func (d *deadPeer) read(n int) {
+	if n > 0 {
+		d.lastRead.Store(time.Now().UnixNano())
+	}
+}
+
+// write runs a carrier write under the write timeout.  A failed write tears
+// the Conn down, unless it is a timeout, which comes from a deadline set by
+// the application.
+func (d *deadPeer) write(write func() (int, error)) (int, error) {
+	if d.writeTimeout > 0 {
+		timer := time.AfterFunc(d.writeTimeout, func() { d.teardown(CloseWriteFailed) })
+		defer timer.Stop()
+	}
+	n, err := write()
+	var netErr net.Error
+	if err != nil && !errors.Is(err, net.ErrClosed) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		// The scheduler may hold its lock around the write, and closing
+		// flushes it.
+		go d.teardown(CloseWriteFailed)
+	}
+	return n, err
+}
+
+func (d *deadPeer) stop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stopped = true
+	if d.idleTimer != nil {
+		d.idleTimer.Stop()
+	}
+}
+
+// abandon stops the workers of rr, which was set up after NewConnConfig gave
+// up on it, and waits for them, without closing the carrier or reporting to
+// Config.OnClose.
+func (rr *Conn) abandon() {
+	rr.workerLock.Lock()
+	rr.closed.Store(true)
+	rr.cancel()
+	rr.workerLock.Unlock()
+	rr.deadPeer.stop()
+	rr.workers.Wait()
+}
+
+// teardown closes rr on behalf of the dead-peer checks.  The carrier goes
+// first, so that writes stuck on the vanished peer return before the
+// scheduler is flushed.  A peer gone idle is told CloseCodeIdle, in case it
+// still reads.
+func (rr *Conn) teardown(reason CloseReason) {
+	if rr.closed.Load() {
+		return
+	}
+	rr.logger.Infof("riverrun: closing connection: %s", reason)
+	if reason == CloseReadIdle {
+		rr.SetWriteDeadline(time.Now().Add(closeCodeTimeout))
+		rr.tryCloseCode(CloseCodeIdle)
+	}
+	if !rr.camouflaged.Load() {
+		rr.Conn.Close()
+	}
+	rr.closeWith(reason)
+}
+
+// spawn runs f on a background worker of rr, unless rr is closed.  f must
+// return once rr.ctx is done.
+func (rr *Conn) spawn(f func()) bool {
+	rr.workerLock.Lock()
+	defer rr.workerLock.Unlock()
+	if rr.closed.Load() {
+		return false
+	}
+	rr.workers.Add(1)
+	go func() {
+		defer rr.workers.Done()
+		f()
+	}()
+	return true
+}
+
+// closeWith closes rr once, and reports reason to Config.OnClose.
+func (rr *Conn) closeWith(reason CloseReason) error {
+	err := net.ErrClosed
+	rr.closeOnce.Do(func() {
+		rr.workerLock.Lock()
+		rr.closed.Store(true)
+		rr.cancel()
+		rr.workerLock.Unlock()
+		rr.deadPeer.stop()
+		if rr.firstFrame != nil {
+			rr.firstFrame.Stop()
+		}
+		rr.wire.writeDeadline.set(time.Time{})
+		err = rr.scheduler.Close()
+		if !rr.camouflaged.Load() {
+			if cerr := rr.Conn.Close(); err == nil && reason == CloseLocal {
+				err = cerr
+			}
+		}
+		if rr.onClose != nil {
+			rr.onClose(rr, reason)
+		}
+	})
+	return err
+}
@@ -0,0 +1,145 @@
+package riverrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// DefaultRaceDelay is the default head start of an endpoint over the next one
+// in a MultiDialer.
+const DefaultRaceDelay = 300 * time.Millisecond
+
+// ErrNoEndpoints is the error returned by MultiDialer.DialContext if it has no
+// endpoints.
+var ErrNoEndpoints = errors.New("riverrun: no endpoints to dial")
+
+// Endpoint is one server a MultiDialer may connect to.
+type Endpoint struct {
+	// Network defaults to "tcp".
+	Network string
+	Address string
+	Seed    *drbg.Seed
+	// Config overrides MultiDialer.Config for this endpoint.
+	Config *Config
+}
+
+// MultiDialer connects to the first reachable of several servers, in the
+// manner of happy eyeballs: endpoints are tried in order, each with a head
+// start of Delay over the next, and the next one is tried right away if one
+// fails.  The first connection established wins, the others are abandoned.
+type MultiDialer struct {
+	Endpoints []Endpoint
+	Config    *Config
+
+	// Delay is the head start of each endpoint over the next.  Zero selects
+	// DefaultRaceDelay, a negative Delay disables racing, so that an endpoint
+	// is only tried once the one before it failed.
+	Delay time.Duration
+
+	// Dial connects to the endpoints.  It defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Socket tunes the dialed TCP conns.
+	Socket SocketOptions
+}
+
+// DialContext returns a client connection to the first endpoint reachable.
+// If all endpoints fail, the error lists the failure of each.
+func (d *MultiDialer) DialContext(ctx context.Context) (*Conn, error) {
+	if len(d.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	delay := d.Delay
+	if delay == 0 {
+		delay = DefaultRaceDelay
+	}
+	dial := d.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	results := make(chan result, len(d.Endpoints))
+	next, pending := 0, 0
+	start := func() {
+		ep := d.Endpoints[next]
+		next++
+		pending++
+		go func() {
+			conn, err := d.dialEndpoint(ctx, dial, ep)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", ep.Address, err)
+			}
+			results <- result{conn, err}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if delay > 0 {
+		ticker := time.NewTicker(delay)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	start()
+	var errs []error
+	for pending > 0 {
+		select {
+		case <-tick:
+			if next < len(d.Endpoints) {
+				start()
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(pending int) {
+					// Close the connections that lost the race.
+					for ; pending > 0; pending-- {
+						if late := <-results; late.err == nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(d.Endpoints) {
+				start()
+			}
+		}
+	}
+	return nil, fmt.Errorf("riverrun: all endpoints failed: %w", errors.Join(errs...))
+}
+
+func (d *MultiDialer) dialEndpoint(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), ep Endpoint) (*Conn, error) {
+	config := ep.Config
+	if config == nil {
+		config = d.Config
+	}
+	network := ep.Network
+	if network == "" {
+		network = "tcp"
+	}
+	conn, err := dial(ctx, network, ep.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.Socket.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rr, err := NewConnConfig(ctx, conn, false, ep.Seed, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rr, nil
+}
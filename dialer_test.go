@@ -0,0 +1,176 @@
+package riverrun
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+func TestMultiDialer(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := errors.New("refused")
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch addr {
+		case "refused":
+			return nil, refused
+		case "blackhole":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+		return client, nil
+	}
+
+	for _, tc := range []struct {
+		addrs []string
+		delay time.Duration
+	}{
+		{[]string{"refused", "ok"}, -1},
+		{[]string{"blackhole", "ok"}, time.Millisecond},
+	} {
+		d := &MultiDialer{Delay: tc.delay, Dial: dial}
+		for _, addr := range tc.addrs {
+			d.Endpoints = append(d.Endpoints, Endpoint{Address: addr, Seed: seed})
+		}
+		conn, err := d.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("%v: %s", tc.addrs, err)
+		}
+		conn.Close()
+	}
+
+	d := &MultiDialer{Dial: dial, Endpoints: []Endpoint{{Address: "refused", Seed: seed}}}
+	if _, err := d.DialContext(context.Background()); !errors.Is(err, refused) || !strings.Contains(err.Error(), "refused: ") {
+		t.Fatalf("got %v, want the endpoint error", err)
+	}
+}
+
+func TestMultiDialerProbe(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "refused" {
+			return nil, errors.New("refused")
+		}
+		client, server := net.Pipe()
+		rr, err := NewConnConfig(ctx, server, true, seed, nil)
+		if err != nil {
+			return nil, err
+		}
+		go io.Copy(io.Discard, rr)
+		t.Cleanup(func() { rr.Close() })
+		return client, nil
+	}
+
+	d := &MultiDialer{Dial: dial, Endpoints: []Endpoint{{Address: "refused", Seed: seed}, {Address: "ok", Seed: seed}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	probes := d.Probe(ctx)
+	if len(probes) != 2 || probes[0].Err == nil || probes[1].Err != nil {
+		t.Fatalf("got probes %+v", probes)
+	}
+	if res := probes[1].Result; res.RTT <= 0 || res.Goodput <= 0 || res.Bytes == 0 {
+		t.Fatalf("got result %+v", res)
+	}
+	d.Prefer(probes)
+	if d.Endpoints[0].Address != "ok" {
+		t.Fatalf("got endpoints %+v, want the healthy one first", d.Endpoints)
+	}
+}
+
+func TestSocketOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	opts := &SocketOptions{Nagle: true, SendBuffer: 64 * 1024, ReceiveBuffer: 64 * 1024, KeepAlive: -1}
+	if err := opts.Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkSocketOptions(t, conn, opts)
+	keepAlive := &SocketOptions{KeepAlive: 42 * time.Second}
+	if err := keepAlive.Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkSocketOptions(t, conn, keepAlive)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := opts.Apply(a); err != nil {
+		t.Fatalf("non-TCP conn: %s", err)
+	}
+}
+
+func TestSyscallConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, _ := drbg.SeedFromHex(testSeed)
+	rr, err := NewConn(conn, false, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	raw, err := rr.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.Control(func(uintptr) {}); err != nil {
+		t.Errorf("Control: %s", err)
+	}
+	if err := raw.Read(func(uintptr) bool { return true }); !errors.Is(err, ErrRawIO) {
+		t.Errorf("Read: got %v, want ErrRawIO", err)
+	}
+	if err := raw.Write(func(uintptr) bool { return true }); !errors.Is(err, ErrRawIO) {
+		t.Errorf("Write: got %v, want ErrRawIO", err)
+	}
+	if rr.RawCarrier() != conn {
+		t.Error("RawCarrier is not the carrier")
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	piped, err := NewConn(a, false, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer piped.Close()
+	if _, err := piped.SyscallConn(); !errors.Is(err, ErrNoSyscallConn) {
+		t.Errorf("pipe carrier: got %v, want ErrNoSyscallConn", err)
+	}
+}
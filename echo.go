@@ -0,0 +1,113 @@
+package riverrun
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"time"
+
+	f "github.com/v2fly/riverrun/common/framing"
+)
+
+const (
+	// echoLength is the size of the timestamp that starts the body of a
+	// PacketTypeEcho, the rest is padding so that echoes vary in length
+	// like payload.
+	echoLength = 8
+	// echoPaddingMax bounds the padding of an echo.
+	echoPaddingMax = 64
+)
+
+// Echo sends an echo packet, which the peer answers right away.  The reply
+// updates RTT.  Peers older than the echo fail on it, unless they set
+// Config.IgnoreUnknownPacketTypes.
+func (rr *Conn) Echo() error {
+	body := make([]byte, echoLength+rand.Intn(echoPaddingMax))
+	binary.BigEndian.PutUint64(body, uint64(time.Since(rr.created)))
+	return rr.writeControl(PacketTypeEcho, body)
+}
+
+// RTT returns the round trip time through both riverrun stacks, smoothed
+// over the echo replies received, or zero before the first one.
+func (rr *Conn) RTT() time.Duration {
+	return time.Duration(rr.rtt.Load())
+}
+
+// writeControl sends body as a single packet of type typ.  It fails like
+// Write: a deadline that passed before leaves the connection usable, a
+// failure part way fails all further writes.
+func (rr *Conn) writeControl(typ uint8, body []byte) error {
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+	if rr.writeErr != nil {
+		return rr.writeErr
+	}
+	if rr.wire.writeDeadline.expired() {
+		return os.ErrDeadlineExceeded
+	}
+	frameBuf, _, err := rr.Encoder.Chop(body, typ)
+	if err != nil {
+		rr.frameLens = rr.frameLens[:0]
+		rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
+		return err
+	}
+	if _, err = rr.writeFrames(&frameBuf); err == nil && rr.flushesWrites() {
+		err = rr.flush()
+	}
+	return err
+}
+
+// handleEcho answers an echo, and measures the round trip of a reply.
+func (rr *Conn) handleEcho(typ uint8, body []byte) error {
+	if len(body) < echoLength {
+		return f.InvalidPayloadLengthError(len(body))
+	}
+	if typ == PacketTypeEcho {
+		// Read must not wait for the write lock.  While a reply is
+		// pending, further echoes go unanswered.
+		if rr.echoPending.CompareAndSwap(false, true) {
+			body = append([]byte(nil), body...)
+			if !rr.spawn(func() {
+				defer rr.echoPending.Store(false)
+				rr.writeControl(PacketTypeEchoReply, body)
+			}) {
+				rr.echoPending.Store(false)
+			}
+		}
+		return nil
+	}
+
+	stamp := binary.BigEndian.Uint64(body)
+	if replies := rr.probeReplies.Load(); replies != nil {
+		select {
+		case *replies <- stamp:
+		default:
+		}
+	}
+	sample := time.Since(rr.created) - time.Duration(stamp)
+	if sample < 0 {
+		return nil
+	}
+	// Smoothed like the TCP SRTT, RFC 6298.
+	if rtt := time.Duration(rr.rtt.Load()); rtt != 0 {
+		sample = rtt - rtt/8 + sample/8
+	}
+	rr.rtt.Store(int64(sample))
+	return nil
+}
+
+// sendEchoes sends an echo every interval until rr is closed.
+func (rr *Conn) sendEchoes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := rr.Echo(); err != nil {
+				return
+			}
+		case <-rr.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package riverrun
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// drain reads from rr until it fails.
+func drain(rr *Conn) {
+	buf := make([]byte, 4096)
+	for {
+		if _, err := rr.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestEcho(t *testing.T) {
+	for _, config := range []*Config{nil, {EchoInterval: 20 * time.Millisecond}} {
+		client, server := newTestPair(t, config, nil)
+		go drain(client)
+		go drain(server)
+		if client.RTT() != 0 {
+			t.Fatal("RTT before any echo")
+		}
+		if config == nil {
+			go client.Echo()
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for client.RTT() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("no echo reply")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if rtt := client.RTT(); rtt < 0 || rtt > time.Second {
+			t.Fatalf("implausible RTT %s", rtt)
+		}
+	}
+}
+
+func TestEchoDeadline(t *testing.T) {
+	client, server := newTestPair(t, nil, nil)
+	defer server.Close()
+	go drain(server)
+
+	// An echo past the deadline fails like a Write, without breaking the
+	// connection.
+	client.SetWriteDeadline(aLongTimeAgo)
+	if err := client.Echo(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want os.ErrDeadlineExceeded", err)
+	}
+	client.SetWriteDeadline(time.Time{})
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("write after the echo: %v", err)
+	}
+}
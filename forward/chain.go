@@ -0,0 +1,193 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+var (
+	// ErrNoHops is the error returned by ChainDialer.DialContext without
+	// hops.
+	ErrNoHops = errors.New("forward: chain without hops")
+	// ErrSeedReuse is the error returned by ChainDialer.DialContext when two
+	// hops share a seed.
+	ErrSeedReuse = errors.New("forward: chain hops share a seed")
+)
+
+// Hop is one bridge of a ChainDialer.
+type Hop struct {
+	Address string
+	Seed    *drbg.Seed
+	// Config overrides ChainDialer.Config for this hop.
+	Config *riverrun.Config
+}
+
+// ChainDialer builds circuits through several bridges, client to bridge 1 to
+// bridge 2 and on.  It connects to the first hop, and reaches every further
+// one through the Conn to the hop before, which must be a dynamic server, see
+// NewDynamic.  The Conns nest, each hop peeling off its layer.  Every hop
+// has a seed and settings of its own, so that the layers are keyed and shaped
+// independently of each other; seeds must not repeat along a chain.
+type ChainDialer struct {
+	Hops   []Hop
+	Config *riverrun.Config
+
+	// Dial connects to the first hop.  It defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Socket tunes the TCP conn to the first hop.
+	Socket riverrun.SocketOptions
+
+	// params caches the Params derived for every hop, so that only the
+	// first circuit through a hop pays for its tables.
+	paramsLock sync.Mutex
+	params     map[paramsKey]*riverrun.Params
+}
+
+// paramsKey identifies the Params of a hop.
+type paramsKey struct {
+	seed   [drbg.SeedLength]byte
+	config *riverrun.Config
+}
+
+// DialContext returns the innermost Conn, to the last hop.  Closing it tears
+// down the whole chain.  With a target, it is sent as the target of the last
+// hop, which must then be a dynamic server too.
+func (d *ChainDialer) DialContext(ctx context.Context, target string) (*riverrun.Conn, error) {
+	layers, err := d.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rr := layers[len(layers)-1]
+	if target != "" {
+		if err = sendAddr(rr, target); err != nil {
+			rr.Close()
+			return nil, err
+		}
+	}
+	return rr, nil
+}
+
+// Probe builds a chain, probes each of its layers from the outermost in, and
+// tears it down.  The result of a hop is measured through the hops before
+// it, so that the first bad hop stands out from those before it.
+func (d *ChainDialer) Probe(ctx context.Context) ([]riverrun.ProbeResult, error) {
+	layers, err := d.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inner := layers[len(layers)-1]
+	defer inner.Close()
+	// Reading the innermost Conn reads all the others, which takes in the
+	// echo replies.
+	go io.Copy(io.Discard, inner)
+	results := make([]riverrun.ProbeResult, len(layers))
+	for i, rr := range layers {
+		if results[i], err = rr.Probe(ctx); err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Hops[i].Address, err)
+		}
+	}
+	return results, nil
+}
+
+// dial returns the Conns to every hop, each nested in the one before.
+func (d *ChainDialer) dial(ctx context.Context) ([]*riverrun.Conn, error) {
+	if len(d.Hops) == 0 {
+		return nil, ErrNoHops
+	}
+	for i, hop := range d.Hops {
+		for _, other := range d.Hops[:i] {
+			if !riverrun.SeedChanged(hop.Seed, other.Seed) {
+				return nil, fmt.Errorf("%w: %s and %s", ErrSeedReuse, other.Address, hop.Address)
+			}
+		}
+	}
+	dial := d.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	first := d.Hops[0]
+	conn, err := dial(ctx, "tcp", first.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.Socket.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rr, err := d.attach(ctx, conn, first)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %w", first.Address, err)
+	}
+	layers := []*riverrun.Conn{rr}
+	for _, hop := range d.Hops[1:] {
+		if rr, err = d.extend(ctx, rr, hop); err != nil {
+			return nil, err
+		}
+		layers = append(layers, rr)
+	}
+	return layers, nil
+}
+
+// extend asks the hop at the end of outer to connect to hop, and returns the
+// Conn to hop nested in outer.
+func (d *ChainDialer) extend(ctx context.Context, outer *riverrun.Conn, hop Hop) (*riverrun.Conn, error) {
+	if err := sendAddr(outer, hop.Address); err != nil {
+		outer.Close()
+		return nil, err
+	}
+	rr, err := d.attach(ctx, outer, hop)
+	if err != nil {
+		outer.Close()
+		return nil, fmt.Errorf("%s: %w", hop.Address, err)
+	}
+	return rr, nil
+}
+
+// attach returns a client Conn to hop over conn, deriving the Params of hop
+// on first use.
+func (d *ChainDialer) attach(ctx context.Context, conn net.Conn, hop Hop) (*riverrun.Conn, error) {
+	config := d.config(hop)
+	key := paramsKey{seed: *hop.Seed.Bytes(), config: config}
+	d.paramsLock.Lock()
+	p := d.params[key]
+	d.paramsLock.Unlock()
+	if p == nil {
+		var err error
+		if p, err = riverrun.DeriveParamsContext(ctx, hop.Seed, config); err != nil {
+			return nil, err
+		}
+		d.paramsLock.Lock()
+		if d.params == nil {
+			d.params = make(map[paramsKey]*riverrun.Params)
+		}
+		d.params[key] = p
+		d.paramsLock.Unlock()
+	}
+	return riverrun.AttachConnConfig(conn, p, false, config)
+}
+
+func (d *ChainDialer) config(hop Hop) *riverrun.Config {
+	if hop.Config != nil {
+		return hop.Config
+	}
+	return d.Config
+}
+
+// sendAddr sends addr as the target requested from a dynamic server.
+func sendAddr(rr *riverrun.Conn, addr string) error {
+	header, err := appendAddr(nil, addr)
+	if err != nil {
+		return err
+	}
+	_, err = rr.Write(header)
+	return err
+}
@@ -0,0 +1,91 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+func TestChainDialer(t *testing.T) {
+	seeds := make([]*drbg.Seed, 2)
+	for i := range seeds {
+		var err error
+		if seeds[i], err = drbg.NewSeed(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	dynamic := NewDynamic(seeds[0], nil)
+	// The hops all listen on loopback.
+	dynamic.Policy.Allow, _ = ParseNetworks("127.0.0.0/8")
+	var hops []Hop
+	for i, fw := range []*Forwarder{dynamic, New(true, echo.Addr().String(), seeds[1], nil)} {
+		defer fw.Close()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go fw.Serve(ln)
+		hops = append(hops, Hop{Address: ln.Addr().String(), Seed: seeds[i]})
+	}
+
+	// Deriving the tables of two seeds takes long under -race, so give the
+	// chain as long as the test may run.
+	deadline, ok := t.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Hour)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline.Add(-5*time.Second))
+	defer cancel()
+	d := &ChainDialer{Hops: hops}
+	rr, err := d.DialContext(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+	if _, err = rr.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(rr, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+
+	results, err := d.Probe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].RTT <= 0 || results[1].RTT <= 0 {
+		t.Fatalf("got results %+v", results)
+	}
+	if len(d.params) != 2 {
+		t.Fatalf("cached %d params, want 2", len(d.params))
+	}
+
+	d.Hops[1].Seed = seeds[0]
+	if _, err = d.DialContext(ctx, ""); !errors.Is(err, ErrSeedReuse) {
+		t.Fatalf("got %v, want ErrSeedReuse", err)
+	}
+}
@@ -0,0 +1,349 @@
+// Package forward implements a TCP port forwarder that carries the forwarded
+// connections over riverrun.
+//
+// A client Forwarder accepts plain connections and forwards them, wrapped in
+// riverrun, to a server Forwarder, which unwraps them and forwards the plain
+// stream to its target.
+//
+// Alternatively a client can act as a SOCKS5 proxy, sending the requested
+// target ahead of the stream to a dynamic server which connects to it.  A
+// transparent server instead relays each stream to the destination its
+// carrier had before a router redirected it to the server.
+package forward
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/common/log"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown or Close was called.
+var ErrServerClosed = errors.New("forward: server closed")
+
+type mode int
+
+const (
+	modeForward mode = iota
+	modeSocks
+	modeDynamic
+	modeTransparent
+)
+
+// Forwarder relays accepted connections to a target address.
+type Forwarder struct {
+	isServer bool
+	mode     mode
+	target   string
+	logger   log.Logger
+	// transparent is the method of a modeTransparent Forwarder.
+	transparent Transparent
+
+	// Dial connects to the target.  It defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Socket tunes the TCP conns carrying riverrun, the accepted ones of a
+	// server and the dialed ones of a client.
+	Socket riverrun.SocketOptions
+	// Policy restricts the targets of a dynamic server.
+	Policy Policy
+
+	lock      sync.Mutex
+	seed      *drbg.Seed
+	config    *riverrun.Config
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]*session
+	lastID    uint64
+	closed    bool
+	wg        sync.WaitGroup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New returns a Forwarder relaying to target.  Servers expect riverrun on the
+// accepted side, clients speak riverrun to the target.
+func New(isServer bool, target string, seed *drbg.Seed, config *riverrun.Config) *Forwarder {
+	return newForwarder(isServer, modeForward, target, seed, config)
+}
+
+// NewSocks returns a client Forwarder that accepts SOCKS5 CONNECT requests
+// and tunnels each of them to the dynamic server at server.
+func NewSocks(server string, seed *drbg.Seed, config *riverrun.Config) *Forwarder {
+	return newForwarder(false, modeSocks, server, seed, config)
+}
+
+// NewDynamic returns a server Forwarder that connects each tunnel to the
+// target requested by a SOCKS client Forwarder.
+func NewDynamic(seed *drbg.Seed, config *riverrun.Config) *Forwarder {
+	return newForwarder(true, modeDynamic, "", seed, config)
+}
+
+func newForwarder(isServer bool, mode mode, target string, seed *drbg.Seed, config *riverrun.Config) *Forwarder {
+	ctx, cancel := context.WithCancel(context.Background())
+	fw := &Forwarder{
+		isServer:  isServer,
+		mode:      mode,
+		target:    target,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]*session),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	fw.Dial = (&net.Dialer{}).DialContext
+	fw.Update(seed, config)
+	return fw
+}
+
+// Update replaces the seed and settings used for new connections, and
+// returns the settings that changed, see riverrun.ConfigChanges, with "Seed"
+// for the seed.  Existing connections are not affected.
+func (fw *Forwarder) Update(seed *drbg.Seed, config *riverrun.Config) []string {
+	if config == nil {
+		config = new(riverrun.Config)
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = log.NopLogger{}
+	}
+
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	var changed []string
+	if fw.config != nil {
+		changed = riverrun.ConfigChanges(fw.config, config)
+		if riverrun.SeedChanged(fw.seed, seed) {
+			changed = append([]string{"Seed"}, changed...)
+		}
+	}
+	fw.seed = seed
+	fw.config = config
+	fw.logger = logger
+	return changed
+}
+
+func (fw *Forwarder) params() (*drbg.Seed, *riverrun.Config, log.Logger) {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	return fw.seed, fw.config, fw.logger
+}
+
+// Serve accepts connections on ln until it fails or the Forwarder is shut
+// down, and relays each of them to the target.
+func (fw *Forwarder) Serve(ln net.Listener) error {
+	fw.lock.Lock()
+	if fw.closed {
+		fw.lock.Unlock()
+		return ErrServerClosed
+	}
+	fw.listeners[ln] = struct{}{}
+	fw.lock.Unlock()
+	defer func() {
+		fw.lock.Lock()
+		delete(fw.listeners, ln)
+		fw.lock.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fw.lock.Lock()
+			closed := fw.closed
+			fw.lock.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !fw.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer fw.untrack(conn)
+			fw.handle(conn, ln.Addr())
+		}()
+	}
+}
+
+func (fw *Forwarder) track(conn net.Conn) bool {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	if fw.closed {
+		return false
+	}
+	fw.lastID++
+	fw.conns[conn] = &session{id: fw.lastID, remote: conn.RemoteAddr().String(), started: time.Now()}
+	fw.wg.Add(1)
+	return true
+}
+
+// attach records the riverrun side and target of the session of accepted.
+func (fw *Forwarder) attach(accepted net.Conn, rr *riverrun.Conn, target string) {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	if s := fw.conns[accepted]; s != nil {
+		s.rr, s.target = rr, target
+	}
+}
+
+func (fw *Forwarder) untrack(conn net.Conn) {
+	fw.lock.Lock()
+	delete(fw.conns, conn)
+	fw.lock.Unlock()
+	fw.wg.Done()
+}
+
+// handle relays accepted, taken from the listener at listenAddr.
+func (fw *Forwarder) handle(accepted net.Conn, listenAddr net.Addr) {
+	defer accepted.Close()
+	seed, config, logger := fw.params()
+
+	if fw.isServer {
+		if err := fw.Socket.Apply(accepted); err != nil {
+			logger.Infof("forward: %s: %s", accepted.RemoteAddr(), err)
+			return
+		}
+		rr, err := riverrun.NewConnConfig(fw.ctx, accepted, true, seed, config)
+		if err != nil {
+			logger.Infof("forward: %s: %s", accepted.RemoteAddr(), err)
+			return
+		}
+		target := fw.target
+		switch fw.mode {
+		case modeDynamic:
+			if target, err = readAddr(rr); err != nil {
+				logger.Infof("forward: %s: reading target: %s", accepted.RemoteAddr(), err)
+				return
+			}
+		case modeTransparent:
+			if target, err = fw.originalTarget(accepted, listenAddr); err != nil {
+				logger.Infof("forward: %s: %s", accepted.RemoteAddr(), err)
+				return
+			}
+		}
+		fw.attach(accepted, rr, target)
+		var dialed net.Conn
+		if fw.mode == modeDynamic {
+			dialed, err = fw.dialPermitted(fw.ctx, target)
+		} else {
+			dialed, err = fw.Dial(fw.ctx, "tcp", target)
+		}
+		if err != nil {
+			logger.Infof("forward: dial %s: %s", target, err)
+			return
+		}
+		Relay(rr, dialed)
+		return
+	}
+
+	var header []byte
+	if fw.mode == modeSocks {
+		target, err := socksHandshake(accepted)
+		if err != nil {
+			logger.Infof("forward: %s: %s", accepted.RemoteAddr(), err)
+			return
+		}
+		if header, err = appendAddr(nil, target); err != nil {
+			socksReply(accepted, socksRepAddrNotSupported)
+			return
+		}
+	}
+
+	dialed, err := fw.Dial(fw.ctx, "tcp", fw.target)
+	if err != nil {
+		logger.Infof("forward: dial %s: %s", fw.target, err)
+		if header != nil {
+			socksReply(accepted, socksRepGeneralFailure)
+		}
+		return
+	}
+	err = fw.Socket.Apply(dialed)
+	var rr *riverrun.Conn
+	if err == nil {
+		rr, err = riverrun.NewConnConfig(fw.ctx, dialed, false, seed, config)
+	}
+	if err != nil {
+		dialed.Close()
+		logger.Infof("forward: %s: %s", fw.target, err)
+		if header != nil {
+			socksReply(accepted, socksRepGeneralFailure)
+		}
+		return
+	}
+	fw.attach(accepted, rr, fw.target)
+	if header != nil {
+		// The server connects to the target asynchronously, so success is
+		// reported as soon as the tunnel is up.
+		if _, err = rr.Write(header); err == nil {
+			err = socksReply(accepted, socksRepSucceeded)
+		}
+		if err != nil {
+			rr.Close()
+			return
+		}
+	}
+	Relay(rr, accepted)
+}
+
+// Relay copies between a and b until either direction finishes, then closes
+// both.
+func Relay(a, b net.Conn) {
+	var once sync.Once
+	done := make(chan struct{})
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		once.Do(func() { close(done) })
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// Shutdown stops accepting new connections and waits for the active ones to
+// finish.  Once ctx is done, the remaining connections are closed.
+func (fw *Forwarder) Shutdown(ctx context.Context) error {
+	fw.lock.Lock()
+	fw.closed = true
+	for ln := range fw.listeners {
+		ln.Close()
+	}
+	fw.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		fw.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		fw.cancel()
+		return nil
+	case <-ctx.Done():
+		fw.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all listeners and connections.
+func (fw *Forwarder) Close() error {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	fw.closed = true
+	fw.cancel()
+	for ln := range fw.listeners {
+		ln.Close()
+	}
+	for conn := range fw.conns {
+		conn.Close()
+	}
+	return nil
+}
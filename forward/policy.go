@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrDestinationDenied is the error returned when a dynamic server refuses a
+// target by its Policy.
+var ErrDestinationDenied = errors.New("forward: destination denied by the policy")
+
+// Policy restricts the targets a dynamic server connects to.  An address is
+// refused if it is in Deny, or if it is loopback, link-local or unspecified,
+// which would reach the server host or its link, and not in Allow.  The zero
+// value refuses just the latter.  Domain targets are resolved by the server
+// and checked by every address, then dialed by address, so that a name
+// cannot point elsewhere between the check and the dial.
+type Policy struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Permits reports whether the policy lets a dynamic server connect to ip.
+func (p *Policy) Permits(ip net.IP) bool {
+	if contains(p.Deny, ip) {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return contains(p.Allow, ip)
+	}
+	return true
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses a comma separated list of CIDR networks, or single
+// addresses, for a Policy.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("forward: invalid address %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// dialPermitted connects to target, a host and port requested of a dynamic
+// server, through an address the Policy permits.
+func (fw *Forwarder) dialPermitted(ctx context.Context, target string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	err = fmt.Errorf("%w: %s", ErrDestinationDenied, target)
+	for _, ip := range ips {
+		if !fw.Policy.Permits(ip) {
+			continue
+		}
+		var conn net.Conn
+		if conn, err = fw.Dial(ctx, "tcp", net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,56 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	allow, err := ParseNetworks("127.0.0.1, fe80::/10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := ParseNetworks("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		policy *Policy
+		ip     string
+		want   bool
+	}{
+		{&Policy{}, "198.51.100.1", true},
+		{&Policy{}, "127.0.0.1", false},
+		{&Policy{}, "::1", false},
+		{&Policy{}, "169.254.169.254", false},
+		{&Policy{}, "fe80::1", false},
+		{&Policy{}, "0.0.0.0", false},
+		{&Policy{}, "::ffff:127.0.0.1", false},
+		{&Policy{Allow: allow}, "127.0.0.1", true},
+		{&Policy{Allow: allow}, "127.0.0.2", false},
+		{&Policy{Allow: allow}, "fe80::1", true},
+		{&Policy{Deny: deny}, "192.0.2.1", false},
+		{&Policy{Allow: deny, Deny: deny}, "192.0.2.1", false},
+	} {
+		if got := tc.policy.Permits(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("%+v permits %s: got %v", *tc.policy, tc.ip, got)
+		}
+	}
+	if _, err := ParseNetworks("127.0.0.1/33"); err == nil {
+		t.Error("invalid network parsed")
+	}
+
+	// A dynamic server must not connect to the host it runs on.
+	fw := NewDynamic(nil, nil)
+	fw.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		t.Fatalf("dialed %s", addr)
+		return nil, nil
+	}
+	for _, target := range []string{"127.0.0.1:22", "localhost:22"} {
+		if _, err := fw.dialPermitted(context.Background(), target); !errors.Is(err, ErrDestinationDenied) {
+			t.Errorf("%s: got %v, want ErrDestinationDenied", target, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package forward
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/v2fly/riverrun"
+)
+
+// Session describes a connection relayed by a Forwarder, see Sessions.
+type Session struct {
+	ID uint64 `json:"id"`
+	// Remote is the address of the accepted conn.
+	Remote  string    `json:"remote"`
+	Target  string    `json:"target,omitempty"`
+	Started time.Time `json:"started"`
+	// TraceID and Stats describe the riverrun side, once it is up.
+	TraceID string          `json:"trace_id,omitempty"`
+	Stats   *riverrun.Stats `json:"stats,omitempty"`
+}
+
+// session is the state of a tracked conn.
+type session struct {
+	id      uint64
+	remote  string
+	target  string
+	started time.Time
+	// rr is nil until the riverrun side is up.
+	rr *riverrun.Conn
+}
+
+// Sessions returns the connections relayed right now, oldest first.
+func (fw *Forwarder) Sessions() []Session {
+	fw.lock.Lock()
+	res := make([]Session, 0, len(fw.conns))
+	for _, s := range fw.conns {
+		info := Session{ID: s.id, Remote: s.remote, Target: s.target, Started: s.started}
+		if s.rr != nil {
+			stats := s.rr.Snapshot()
+			info.TraceID, info.Stats = s.rr.TraceID(), &stats
+		}
+		res = append(res, info)
+	}
+	fw.lock.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// CloseSession closes the connection of the session id, telling the peer it
+// was closed for policy, and reports whether there was one.
+func (fw *Forwarder) CloseSession(id uint64) bool {
+	var conn net.Conn
+	var rr *riverrun.Conn
+	fw.lock.Lock()
+	for c, s := range fw.conns {
+		if s.id == id {
+			conn, rr = c, s.rr
+			break
+		}
+	}
+	fw.lock.Unlock()
+	if conn == nil {
+		return false
+	}
+	if rr != nil {
+		rr.CloseWithCode(riverrun.CloseCodePolicy)
+	}
+	conn.Close()
+	return true
+}
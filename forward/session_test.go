@@ -0,0 +1,77 @@
+package forward
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+func TestSessions(t *testing.T) {
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	server := New(true, echo.Addr().String(), seed, nil)
+	defer server.Close()
+	serverLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(serverLn)
+	client := New(false, serverLn.Addr().String(), seed, nil)
+	defer client.Close()
+	clientLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve(clientLn)
+
+	conn, err := net.Dial("tcp", clientLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Stats == nil || sessions[0].Stats.BytesIn != 5 || sessions[0].Target != echo.Addr().String() {
+		t.Fatalf("got sessions %+v", sessions)
+	}
+	if server.CloseSession(sessions[0].ID + 1) {
+		t.Fatal("closed a session that does not exist")
+	}
+	if !server.CloseSession(sessions[0].ID) {
+		t.Fatal("session not found")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(buf); err == nil {
+		t.Fatal("connection still open after CloseSession")
+	}
+}
@@ -0,0 +1,26 @@
+package forward
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAddrRoundTrip(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:80", "[2001:db8::1]:443", "example.com:8080"} {
+		b, err := appendAddr(nil, addr)
+		if err != nil {
+			t.Fatalf("appendAddr(%q): %v", addr, err)
+		}
+		got, err := readAddr(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("readAddr(%q): %v", addr, err)
+		}
+		if got != addr {
+			t.Errorf("round trip of %q gave %q", addr, got)
+		}
+	}
+
+	if _, err := appendAddr(nil, "example.com"); err == nil {
+		t.Error("appendAddr accepted an address without port")
+	}
+}
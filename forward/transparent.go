@@ -0,0 +1,91 @@
+package forward
+
+import (
+	"errors"
+	"net"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// ErrNoOriginalDst is returned by OriginalDestination, and ListenTProxy,
+// where the system does not support transparent proxying.
+var ErrNoOriginalDst = errors.New("forward: original destination not available")
+
+// errNotRedirected is returned by OriginalDestination, and for TProxy, for
+// connections that reached the listener directly, which would otherwise be
+// relayed to the server itself.
+var errNotRedirected = errors.New("forward: connection was not redirected")
+
+// Transparent selects how a transparent server Forwarder learns the original
+// destination of a tunnel.
+type Transparent int
+
+const (
+	// Redirect reads the destination of connections redirected by the
+	// netfilter REDIRECT or DNAT targets, with SO_ORIGINAL_DST.
+	Redirect Transparent = iota + 1
+	// TProxy takes the local address of connections accepted by a
+	// ListenTProxy listener through the netfilter TPROXY target.
+	TProxy
+)
+
+// NewTransparent returns a server Forwarder that relays each tunnel to the
+// destination its client connected to, before a router redirected the carrier
+// to the server.  Clients are plain client Forwarders, see New, that connect
+// to such destinations.
+func NewTransparent(how Transparent, seed *drbg.Seed, config *riverrun.Config) *Forwarder {
+	fw := newForwarder(true, modeTransparent, "", seed, config)
+	fw.transparent = how
+	return fw
+}
+
+// originalTarget returns the address the carrier conn, accepted on the
+// listener at listenAddr, was destined to.
+func (fw *Forwarder) originalTarget(conn net.Conn, listenAddr net.Addr) (string, error) {
+	if fw.transparent == TProxy {
+		if isListenAddr(conn.LocalAddr(), listenAddr) {
+			return "", errNotRedirected
+		}
+		return conn.LocalAddr().String(), nil
+	}
+	return OriginalDestination(conn)
+}
+
+// isListenAddr reports whether local, the local address of an accepted conn,
+// is that of the listener at listenAddr itself rather than one diverted to
+// it.
+func isListenAddr(local, listenAddr net.Addr) bool {
+	addr, ok := local.(*net.TCPAddr)
+	ln, lnOK := listenAddr.(*net.TCPAddr)
+	if !ok || !lnOK {
+		return local.String() == listenAddr.String()
+	}
+	if addr.Port != ln.Port {
+		return false
+	}
+	if !ln.IP.IsUnspecified() {
+		return addr.IP.Equal(ln.IP)
+	}
+	// A wildcard listener is reached directly on every address of the
+	// host.
+	return isLocalIP(addr.IP)
+}
+
+// isLocalIP reports whether ip is an address of the host.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// Refuse rather than risk a loop.
+		return true
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
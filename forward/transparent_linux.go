@@ -0,0 +1,86 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST.
+	soOriginalDst = 80
+	// ipv6Transparent is IPV6_TRANSPARENT, missing from package syscall.
+	ipv6Transparent = 75
+)
+
+// OriginalDestination returns the destination of a TCP connection before
+// netfilter redirected it to the local listener.
+func OriginalDestination(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", ErrNoOriginalDst
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	ipv6 := false
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		ipv6 = true
+	}
+	var addr string
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// The sockaddr_in6 fills the address of an ip6_mtuinfo.
+			var info *syscall.IPv6MTUInfo
+			if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst); sockErr == nil {
+				// Port holds the bytes in network order.
+				port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+				addr = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+			}
+			return
+		}
+		// The sockaddr_in fills the group address of an ipv6_mreq.
+		var mreq *syscall.IPv6Mreq
+		if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); sockErr == nil {
+			sa := mreq.Multiaddr
+			port := binary.BigEndian.Uint16(sa[2:4])
+			addr = net.JoinHostPort(net.IP(sa[4:8]).String(), strconv.Itoa(int(port)))
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if addr == conn.LocalAddr().String() {
+		return "", errNotRedirected
+	}
+	return addr, nil
+}
+
+// ListenTProxy listens on the TCP address with IP_TRANSPARENT set, so that it
+// accepts the connections the netfilter TPROXY target diverts to it.  It
+// needs CAP_NET_ADMIN.
+func ListenTProxy(ctx context.Context, network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if network == "tcp6" {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+			} else {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	return lc.Listen(ctx, network, address)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package forward
+
+import (
+	"context"
+	"net"
+)
+
+// OriginalDestination returns the destination of a TCP connection before
+// netfilter redirected it to the local listener.  It needs Linux.
+func OriginalDestination(conn net.Conn) (string, error) {
+	return "", ErrNoOriginalDst
+}
+
+// ListenTProxy listens on the TCP address with IP_TRANSPARENT set, so that it
+// accepts the connections the netfilter TPROXY target diverts to it.  It
+// needs Linux.
+func ListenTProxy(ctx context.Context, network, address string) (net.Listener, error) {
+	return nil, ErrNoOriginalDst
+}
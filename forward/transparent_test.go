@@ -0,0 +1,73 @@
+package forward
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestOriginalDestination(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := OriginalDestination(a); !errors.Is(err, ErrNoOriginalDst) {
+		t.Fatalf("pipe: got %v, want ErrNoOriginalDst", err)
+	}
+
+	// A direct connection has no other destination, and must not be
+	// relayed back to the server.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if addr, err := OriginalDestination(accepted); err == nil {
+		t.Fatalf("direct connection destined to %s", addr)
+	}
+}
+
+func TestTProxyLoop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	fw := NewTransparent(TProxy, nil, nil)
+	if addr, err := fw.originalTarget(accepted, ln.Addr()); !errors.Is(err, errNotRedirected) {
+		t.Fatalf("direct connection destined to %s, %v", addr, err)
+	}
+
+	wildcard := &net.TCPAddr{IP: net.IPv4zero, Port: 1080}
+	for _, tc := range []struct {
+		local *net.TCPAddr
+		loop  bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, true},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}, false},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, false},
+	} {
+		if loop := isListenAddr(tc.local, wildcard); loop != tc.loop {
+			t.Errorf("%s on %s: got loop %v", tc.local, wildcard, loop)
+		}
+	}
+}
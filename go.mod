@@ -4,5 +4,27 @@ go 1.21.7
 
 require (
 	github.com/RACECAR-GU/obfsX v0.0.0-20230217184022-1add4680bcda
+	github.com/cloudflare/circl v1.3.7
 	github.com/dchest/siphash v1.2.3
+	github.com/golang/snappy v0.0.4
+	github.com/google/gopacket v1.1.19
+	github.com/klauspost/reedsolomon v1.12.4
+	github.com/refraction-networking/utls v1.6.7
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+	go.uber.org/goleak v1.3.0
+	golang.org/x/crypto v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.6 // indirect
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/klauspost/compress v1.17.4 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
+	go.opentelemetry.io/otel/metric v1.24.0 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/sys v0.24.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
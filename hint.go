@@ -0,0 +1,85 @@
+package riverrun
+
+import "fmt"
+
+// TrafficHint tells a Conn what its application sends, so that shaping does
+// not cost latency where it matters, see Conn.SetTrafficHint.  Hints only
+// change how this side writes, the peer needs nothing.
+type TrafficHint int
+
+const (
+	// HintDefault shapes as the Config says.
+	HintDefault TrafficHint = iota
+	// HintInteractive is for small writes awaiting an answer, e.g. a
+	// terminal: every Write is flushed past the Scheduler right away, and
+	// Flush adds no padding.
+	HintInteractive
+	// HintBulk is for transfers where throughput counts: writes are held
+	// back as the Scheduler likes, Flush adds no padding and chunk lengths
+	// are drawn from the upper half of the profile, for fewer carrier
+	// writes.
+	HintBulk
+	// HintStreaming is for media sent at a steady pace: every Write is
+	// flushed right away, ending in a padding frame so that the sizes of
+	// the writes do not show through.
+	HintStreaming
+)
+
+func (h TrafficHint) String() string {
+	switch h {
+	case HintDefault:
+		return "default"
+	case HintInteractive:
+		return "interactive"
+	case HintBulk:
+		return "bulk"
+	case HintStreaming:
+		return "streaming"
+	}
+	return fmt.Sprintf("TrafficHint(%d)", int(h))
+}
+
+func (h TrafficHint) validate() error {
+	if h < HintDefault || h > HintStreaming {
+		return fmt.Errorf("riverrun: invalid traffic hint: %d", h)
+	}
+	return nil
+}
+
+// SetTrafficHint switches the shaping of the writes that follow to hint.  It
+// may be called at any time, e.g. when a session turns from a download to
+// interactive use.
+func (rr *Conn) SetTrafficHint(hint TrafficHint) error {
+	if err := hint.validate(); err != nil {
+		return err
+	}
+	rr.hint.Store(int32(hint))
+	return nil
+}
+
+// TrafficHint returns the hint set last.
+func (rr *Conn) TrafficHint() TrafficHint {
+	return TrafficHint(rr.hint.Load())
+}
+
+// flushesWrites reports whether every Write is flushed under the current
+// hint.
+func (rr *Conn) flushesWrites() bool {
+	switch rr.TrafficHint() {
+	case HintInteractive, HintStreaming:
+		return true
+	}
+	return false
+}
+
+// padsFlush reports whether a flush adds a padding frame under the current
+// hint.
+func (rr *Conn) padsFlush() bool {
+	switch rr.TrafficHint() {
+	case HintInteractive, HintBulk:
+		return false
+	case HintStreaming:
+		return true
+	}
+	return rr.padOnFlush
+}
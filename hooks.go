@@ -0,0 +1,59 @@
+package riverrun
+
+import "time"
+
+// FrameEvent describes a frame sent or received by a Conn.
+type FrameEvent struct {
+	Time time.Time
+	// TraceID is the Conn.TraceID of the connection.
+	TraceID string
+	// Type is the packet type of the frame.
+	Type uint8
+	// PayloadLength is the number of packet body bytes before expansion.
+	PayloadLength int
+	// WireLength is the size of the frame on the wire, including the
+	// expanded length field.
+	WireLength int
+}
+
+// PaddingEvent describes padding written by a Conn.
+type PaddingEvent struct {
+	Time       time.Time
+	TraceID    string
+	WireLength int
+}
+
+// RekeyEvent describes a Conn switching to new parameters.
+type RekeyEvent struct {
+	Time    time.Time
+	TraceID string
+	// Epoch is the new shaping epoch.
+	Epoch uint32
+	// Local is set if the switch was initiated by this side.
+	Local bool
+	// Bias is the new table bias of the initiator's write direction with
+	// Config.AdaptiveBias, zero if the tables stayed.
+	Bias float64
+}
+
+// Hooks receives the wire-level events of a Conn, e.g. to feed traffic
+// into a classifier.  The methods are called synchronously from the Read and
+// Write paths and should return quickly.  Sent frames are reported when they
+// are encoded, which can be earlier than when a Scheduler writes them.
+type Hooks interface {
+	OnFrameSent(FrameEvent)
+	OnFrameReceived(FrameEvent)
+	OnPadding(PaddingEvent)
+	OnRekey(RekeyEvent)
+	OnBlackhole(BlackholeEvent)
+}
+
+// NopHooks implements Hooks by ignoring every event.  It can be embedded to
+// implement only some of the methods.
+type NopHooks struct{}
+
+func (NopHooks) OnFrameSent(FrameEvent)     {}
+func (NopHooks) OnFrameReceived(FrameEvent) {}
+func (NopHooks) OnPadding(PaddingEvent)     {}
+func (NopHooks) OnRekey(RekeyEvent)         {}
+func (NopHooks) OnBlackhole(BlackholeEvent) {}
@@ -0,0 +1,115 @@
+package riverrun
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	f "github.com/v2fly/riverrun/common/framing"
+	"github.com/v2fly/riverrun/common/log"
+)
+
+// recordHooks keeps every event reported to it.
+type recordHooks struct {
+	NopHooks
+	lock     sync.Mutex
+	sent     []FrameEvent
+	received []FrameEvent
+	padding  []PaddingEvent
+	rekeys   []RekeyEvent
+}
+
+func (h *recordHooks) OnFrameSent(e FrameEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.sent = append(h.sent, e)
+}
+
+func (h *recordHooks) OnFrameReceived(e FrameEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.received = append(h.received, e)
+}
+
+func (h *recordHooks) OnPadding(e PaddingEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.padding = append(h.padding, e)
+}
+
+func (h *recordHooks) OnRekey(e RekeyEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.rekeys = append(h.rekeys, e)
+}
+
+func TestHooks(t *testing.T) {
+	if log.Hardened {
+		t.Skip("riverrun_hardened builds refuse Hooks")
+	}
+	clientHooks, serverHooks := new(recordHooks), new(recordHooks)
+	client, server := newTestPair(t, &Config{Hooks: clientHooks, PadOnFlush: true}, &Config{Hooks: serverHooks})
+
+	msg := make([]byte, 5000)
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write(msg)
+		written <- err
+	}()
+	if _, err := io.ReadFull(server, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	go drain(server)
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Renegotiate(); err != nil {
+		t.Fatal(err)
+	}
+
+	clientHooks.lock.Lock()
+	defer clientHooks.lock.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		serverHooks.lock.Lock()
+		if len(serverHooks.received) >= len(clientHooks.sent) && len(serverHooks.rekeys) > 0 {
+			break
+		}
+		serverHooks.lock.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("server did not see every frame")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	defer serverHooks.lock.Unlock()
+
+	payload := 0
+	for i, sent := range clientHooks.sent {
+		received := serverHooks.received[i]
+		if sent.TraceID != client.TraceID() || received.TraceID != server.TraceID() {
+			t.Fatalf("frame %d: trace IDs %q, %q", i, sent.TraceID, received.TraceID)
+		}
+		if sent.Type != received.Type || sent.PayloadLength != received.PayloadLength || sent.WireLength != received.WireLength {
+			t.Fatalf("frame %d: sent %+v, received %+v", i, sent, received)
+		}
+		if sent.Type == PacketTypePayload {
+			payload += sent.PayloadLength - f.TypeLength
+		}
+	}
+	if payload != len(msg) {
+		t.Errorf("payload frames carry %d bytes, want %d", payload, len(msg))
+	}
+	if len(clientHooks.padding) != 1 || clientHooks.padding[0].WireLength == 0 {
+		t.Errorf("padding events %+v", clientHooks.padding)
+	}
+	if len(clientHooks.rekeys) != 1 || !clientHooks.rekeys[0].Local || clientHooks.rekeys[0].Epoch != 1 {
+		t.Errorf("client rekeys %+v", clientHooks.rekeys)
+	}
+	if len(serverHooks.rekeys) != 1 || serverHooks.rekeys[0].Local || serverHooks.rekeys[0].Epoch != 1 {
+		t.Errorf("server rekeys %+v", serverHooks.rekeys)
+	}
+}
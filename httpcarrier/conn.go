@@ -0,0 +1,219 @@
+package httpcarrier
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pumpSize is the largest piece of body read ahead of Read.
+const pumpSize = 16 * 1024
+
+// addr is the address of one end of a tunnel.
+type addr string
+
+func (a addr) Network() string { return "http" }
+func (a addr) String() string  { return string(a) }
+
+// conn is one tunnel: a body read from, a body written to.  Bodies have no
+// deadlines, so conn reads ahead and writes in the background, and applies
+// the deadlines while waiting for those.
+type conn struct {
+	in      io.ReadCloser
+	out     io.Writer
+	flush   func() error
+	closeFn func()
+
+	local, remote net.Addr
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// buf holds body bytes read ahead, readErr the error ending the body.
+	buf     []byte
+	readErr error
+	// writeSeq numbers the writes, doneSeq is the last one finished with
+	// writeErr.
+	writeSeq, doneSeq uint64
+	writeErr          error
+	closed            bool
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+}
+
+func newConn(in io.ReadCloser, out io.Writer, flush func() error, closeFn func(), local, remote net.Addr) *conn {
+	c := &conn{in: in, out: out, flush: flush, closeFn: closeFn, local: local, remote: remote}
+	c.cond = sync.NewCond(&c.lock)
+	go c.pump()
+	return c
+}
+
+func (c *conn) pump() {
+	b := make([]byte, pumpSize)
+	for {
+		n, err := c.in.Read(b)
+		c.lock.Lock()
+		for len(c.buf) > 0 && !c.closed {
+			c.cond.Wait()
+		}
+		c.buf = append(c.buf[:0], b[:n]...)
+		if err != nil {
+			c.readErr = err
+		}
+		c.cond.Broadcast()
+		stop := c.closed || err != nil
+		c.lock.Unlock()
+		if stop {
+			return
+		}
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.buf) == 0 {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.readErr != nil:
+			return 0, c.readErr
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	if len(c.buf) == 0 {
+		c.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// Write hands b to a background write of the body and waits for it, or for
+// the deadline.  A write cut short by the deadline still completes in the
+// background, later writes queue behind it.
+func (c *conn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.doneSeq != c.writeSeq {
+		if err := c.writeState(); err != nil {
+			return 0, err
+		}
+		c.cond.Wait()
+	}
+	if err := c.writeState(); err != nil {
+		return 0, err
+	}
+	c.writeSeq++
+	seq := c.writeSeq
+	buf := append([]byte(nil), b...)
+	go func() {
+		_, err := c.out.Write(buf)
+		if err == nil && c.flush != nil {
+			err = c.flush()
+		}
+		c.lock.Lock()
+		c.doneSeq = seq
+		if err != nil && c.writeErr == nil {
+			c.writeErr = err
+		}
+		c.cond.Broadcast()
+		c.lock.Unlock()
+	}()
+	for c.doneSeq != seq {
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		if expired(c.writeDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	return len(b), nil
+}
+
+func (c *conn) writeState() error {
+	switch {
+	case c.closed:
+		return net.ErrClosed
+	case c.writeErr != nil:
+		return c.writeErr
+	case expired(c.writeDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (c *conn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	for _, t := range []*time.Timer{c.readTimer, c.writeTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	c.cond.Broadcast()
+	c.lock.Unlock()
+	c.closeFn()
+	return c.in.Close()
+}
+
+// waitWrites waits for the background write, if any.
+func (c *conn) waitWrites() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.doneSeq != c.writeSeq {
+		c.cond.Wait()
+	}
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.readDeadline, &c.readTimer, t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.writeDeadline, &c.writeTimer, t)
+	return nil
+}
+
+func (c *conn) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			c.lock.Lock()
+			c.cond.Broadcast()
+			c.lock.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
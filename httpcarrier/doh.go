@@ -0,0 +1,177 @@
+package httpcarrier
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxDNSMessage bounds the DoH responses read.
+const maxDNSMessage = 64 * 1024
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+)
+
+// ErrBadDNSMessage is the error returned for DoH responses that do not parse.
+var ErrBadDNSMessage = errors.New("httpcarrier: malformed DNS message")
+
+// DoHResolver resolves names with DNS over HTTPS (RFC 8484), out of reach of
+// the local resolver and of on-path DNS filtering.
+type DoHResolver struct {
+	// URL is the DoH endpoint, e.g. "https://1.1.1.1/dns-query".  Its host
+	// is resolved by the system, so an IP address avoids the bootstrap
+	// lookup in the clear.
+	URL string
+	// Client sends the queries, it defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// LookupHost returns the IPv4 and IPv6 addresses of host.  IP addresses are
+// returned as they are.
+func (r *DoHResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	var addrs []string
+	var errs []error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		ips, err := r.query(ctx, host, qtype)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+	}
+	if len(addrs) == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("httpcarrier: resolving %s: %w", host, errors.Join(errs...))
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *DoHResolver) query(ctx context.Context, host string, qtype uint16) ([]net.IP, error) {
+	msg, err := dnsQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	sep := "?"
+	if strings.Contains(r.URL, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL+sep+"dns="+base64.RawURLEncoding.EncodeToString(msg), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrBadStatus, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage))
+	if err != nil {
+		return nil, err
+	}
+	return dnsAnswers(body, qtype)
+}
+
+// dnsQuery builds a recursive query for host.  The ID is zero, as RFC 8484
+// recommends for cacheable GET requests.
+func dnsQuery(host string, qtype uint16) ([]byte, error) {
+	msg := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("httpcarrier: invalid host name %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, dnsClassIN), nil
+}
+
+// dnsAnswers returns the addresses of type qtype answered in msg.
+func dnsAnswers(msg []byte, qtype uint16) ([]net.IP, error) {
+	if len(msg) < 12 {
+		return nil, ErrBadDNSMessage
+	}
+	if rcode := msg[3] & 0x0f; rcode != 0 {
+		if rcode == 3 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("httpcarrier: DNS response code %d", rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		var ok bool
+		if off, ok = skipName(msg, off); !ok || off+4 > len(msg) {
+			return nil, ErrBadDNSMessage
+		}
+		off += 4
+	}
+	var ips []net.IP
+	for i := 0; i < ancount; i++ {
+		var ok bool
+		if off, ok = skipName(msg, off); !ok || off+10 > len(msg) {
+			return nil, ErrBadDNSMessage
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, ErrBadDNSMessage
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+		// CNAMEs are followed by the resolver, their targets' records
+		// come along in the answer.
+		if typ != qtype || class != dnsClassIN {
+			continue
+		}
+		if (typ == dnsTypeA && rdlen == net.IPv4len) || (typ == dnsTypeAAAA && rdlen == net.IPv6len) {
+			ips = append(ips, net.IP(append([]byte(nil), rdata...)))
+		}
+	}
+	return ips, nil
+}
+
+// skipName returns the offset past the name at off.
+func skipName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, true
+		case n&0xc0 == 0xc0:
+			return off + 2, off+2 <= len(msg)
+		case n&0xc0 != 0:
+			return 0, false
+		}
+		off += 1 + n
+	}
+	return 0, false
+}
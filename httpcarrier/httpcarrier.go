@@ -0,0 +1,269 @@
+// Package httpcarrier tunnels riverrun connections through HTTP bodies, so
+// they pass HTTP proxies that allow nothing else.  The client streams its
+// half in a POST body, the server answers with a streamed response body, as
+// chunked HTTP/1.1 or as an HTTP/2 stream.
+//
+// A Dialer's DialContext plugs into forward.Forwarder.Dial or
+// riverrun.MultiDialer.Dial, and a Server is both the http.Handler of an
+// http.Server and the net.Listener wrapped by a riverrun.Listener.
+package httpcarrier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var (
+	// ErrServerClosed is the error returned by Accept after Close.
+	ErrServerClosed = errors.New("httpcarrier: server closed")
+	// ErrBadStatus is the error returned by DialContext when the server does
+	// not answer 200.
+	ErrBadStatus = errors.New("httpcarrier: unexpected response status")
+)
+
+// Dialer opens tunnels as POST requests.
+type Dialer struct {
+	// Scheme is "http" or "https", it defaults to "http".  Over https the
+	// client negotiates HTTP/2 where the server supports it.
+	Scheme string
+	// Path is the request path, it defaults to "/".
+	Path string
+	// Host, if set, is sent as the Host header in place of the dialed
+	// address.
+	Host string
+	// Front, if set, is the host[:port] connected to, and the TLS server
+	// name, in place of the dialed address, which only goes in the Host
+	// header.  This is domain fronting: on-path observers see the front,
+	// a CDN serving both routes the request by the Host header.
+	Front string
+	// Header holds the cover headers of the request, e.g. a User-Agent and
+	// Content-Type fitting the cover story.
+	Header http.Header
+	// Client sends the requests, it defaults to http.DefaultClient, which
+	// uses the proxy of the environment.  Its Timeout must be zero, a
+	// tunnel lasts as long as its request.
+	Client *http.Client
+	// Resolver, if set, resolves the host names connected to, in place of
+	// the system resolver.  It is only used by the default Client, a
+	// Client of one's own resolves in its Transport.
+	Resolver *DoHResolver
+
+	once     sync.Once
+	resolved *http.Client
+}
+
+// client returns the Client sending the requests.
+func (d *Dialer) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	if d.Resolver == nil {
+		return http.DefaultClient
+	}
+	d.once.Do(func() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		dialer := &net.Dialer{}
+		t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			addrs, err := d.Resolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			var errs []error
+			for _, a := range addrs {
+				conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+				if err == nil {
+					return conn, nil
+				}
+				errs = append(errs, err)
+			}
+			return nil, errors.Join(errs...)
+		}
+		d.resolved = &http.Client{Transport: t}
+	})
+	return d.resolved
+}
+
+// DialContext opens a tunnel to address, a host:port.  The network is ignored,
+// ctx bounds the wait for the response headers only.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	scheme, path, client := d.Scheme, d.Path, d.client()
+	if scheme == "" {
+		scheme = "http"
+	}
+	if path == "" {
+		path = "/"
+	}
+	host := address
+	if d.Front != "" {
+		host = d.Front
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			if _, port, err := net.SplitHostPort(address); err == nil {
+				host = net.JoinHostPort(host, port)
+			}
+		}
+	}
+
+	pr, pw := io.Pipe()
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, scheme+"://"+host+path, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if d.Header != nil {
+		req.Header = d.Header.Clone()
+	}
+	switch {
+	case d.Host != "":
+		req.Host = d.Host
+	case d.Front != "":
+		req.Host = address
+	}
+	req.ContentLength = -1
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := client.Do(req)
+		done <- result{resp, err}
+	}()
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		cancel()
+		pw.Close()
+		if res = <-done; res.err == nil {
+			res.resp.Body.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if res.err != nil {
+		cancel()
+		pw.Close()
+		return nil, res.err
+	}
+	if res.resp.StatusCode != http.StatusOK {
+		res.resp.Body.Close()
+		cancel()
+		pw.Close()
+		return nil, fmt.Errorf("%w: %s", ErrBadStatus, res.resp.Status)
+	}
+	closeFn := func() {
+		pw.Close()
+		cancel()
+	}
+	return newConn(res.resp.Body, pw, nil, closeFn, addr("client"), addr(req.URL.String())), nil
+}
+
+// Server accepts tunnels from requests.  Requests that are not tunnels go to
+// Fallback, so a Server can sit in front of a cover website.
+type Server struct {
+	// Path, if set, is the only path tunnels are accepted on.
+	Path string
+	// Header holds the cover headers of the response.
+	Header http.Header
+	// Fallback serves the other requests, it defaults to http.NotFound.
+	Fallback http.Handler
+
+	once      sync.Once
+	conns     chan *conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *Server) init() {
+	s.once.Do(func() {
+		s.conns = make(chan *conn)
+		s.done = make(chan struct{})
+	})
+}
+
+// ServeHTTP turns a POST request into a tunnel, handed to Accept, and holds
+// on to the request until the tunnel is closed.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.init()
+	if r.Method != http.MethodPost || (s.Path != "" && r.URL.Path != s.Path) {
+		fallback := s.Fallback
+		if fallback == nil {
+			fallback = http.NotFoundHandler()
+		}
+		fallback.ServeHTTP(w, r)
+		return
+	}
+
+	for k, v := range s.Header {
+		w.Header()[k] = v
+	}
+	rc := http.NewResponseController(w)
+	// HTTP/1.1 servers stop reading the request once the response starts,
+	// unless told otherwise.  HTTP/2 is full duplex and reports
+	// ErrNotSupported.
+	_ = rc.EnableFullDuplex()
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	local := addr("server")
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr(a.String())
+	}
+	closed := make(chan struct{})
+	var once sync.Once
+	c := newConn(r.Body, w, rc.Flush, func() { once.Do(func() { close(closed) }) }, local, addr(r.RemoteAddr))
+	defer func() {
+		// Stops the pump on every path.  w must not be used once the
+		// handler returns.
+		c.Close()
+		c.waitWrites()
+	}()
+	select {
+	case s.conns <- c:
+	case <-s.done:
+		return
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case <-closed:
+	case <-r.Context().Done():
+	}
+}
+
+// Accept waits for the next tunnel.
+func (s *Server) Accept() (net.Conn, error) {
+	s.init()
+	select {
+	case c := <-s.conns:
+		return c, nil
+	case <-s.done:
+		return nil, ErrServerClosed
+	}
+}
+
+// Close stops Accept.  Tunnels already accepted stay open, and requests keep
+// being served by the http.Server until it is shut down.
+func (s *Server) Close() error {
+	s.init()
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+// Addr returns a placeholder, the listening address belongs to the
+// http.Server.
+func (s *Server) Addr() net.Addr {
+	return addr("server")
+}
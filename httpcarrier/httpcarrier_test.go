@@ -0,0 +1,126 @@
+package httpcarrier
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+const testSeed = "000102030405060708090a0b0c0d0e0f1011121314151617"
+
+func TestTunnel(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Path: "/upload", Header: http.Header{"Content-Type": {"application/octet-stream"}}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer srv.Close()
+	ln := &riverrun.Listener{Listener: srv, Seed: seed}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	d := &Dialer{Path: "/upload", Header: http.Header{"User-Agent": {"uploader/1.0"}}}
+	carrier, err := d.DialContext(context.Background(), "tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := riverrun.NewConn(carrier, false, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := bytes.Repeat([]byte("riverrun over http "), 4096)
+	go conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo mismatch")
+	}
+
+	carrier.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := carrier.Read(got); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline error", err)
+	}
+
+	resp, err := http.Get(ts.URL + "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET got %s, want the fallback", resp.Status)
+	}
+}
+
+func TestFrontingOverDoH(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(q) < 12 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		resp := append([]byte(nil), q...)
+		resp[2] |= 0x80
+		if name, _ := dnsQuery("front.example", dnsTypeA); bytes.Equal(q, name) {
+			resp[7] = 1
+			resp = append(resp, 0xc0, 12, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(resp)
+	}))
+	defer doh.Close()
+
+	srv := &Server{}
+	defer srv.Close()
+	hosts := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	go func() {
+		if conn, err := srv.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	d := &Dialer{Front: "front.example", Resolver: &DoHResolver{URL: doh.URL}}
+	hidden := net.JoinHostPort("hidden.example", port)
+	conn, err := d.DialContext(context.Background(), "tcp", hidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if host := <-hosts; host != hidden {
+		t.Fatalf("got Host %q, want %q", host, hidden)
+	}
+
+	if _, err := d.Resolver.LookupHost(context.Background(), "missing.example"); err == nil {
+		t.Fatal("resolved a missing host")
+	}
+}
@@ -0,0 +1,297 @@
+// Package soak runs riverrun connection pairs with randomized settings and
+// payload patterns for a while, checking that every byte arrives intact,
+// that no goroutine outlives its connection and that the heap stays
+// bounded.  It is meant for validation before a release, see
+// cmd/riverrun-soak.
+package soak
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/internal/testutil"
+)
+
+const (
+	// DefaultConcurrency is the default number of pairs running at once.
+	DefaultConcurrency = 8
+	// DefaultMaxHeap is the default bound of the heap.
+	DefaultMaxHeap = 1 << 30
+
+	// DefaultPairTimeout is the default bound of the exchange of one pair.
+	DefaultPairTimeout = 30 * time.Second
+	// settleTimeout is the time goroutines get to exit once all pairs are
+	// closed.
+	settleTimeout = 5 * time.Second
+	// maxMessage bounds the size of a single write.
+	maxMessage = 16 * 1024
+	// maxMessages bounds the writes of a pair.
+	maxMessages = 16
+)
+
+var (
+	// ErrCorrupted is the error returned when a pair echoes other bytes
+	// than it was sent.
+	ErrCorrupted = errors.New("soak: payload corrupted")
+	// ErrLeak is the error returned when goroutines outlive the pairs.
+	ErrLeak = errors.New("soak: goroutines leaked")
+	// ErrHeap is the error returned when the heap outgrows MaxHeap.
+	ErrHeap = errors.New("soak: heap exceeds the bound")
+)
+
+// Options configure Run.  The zero value runs until the context is done
+// with the defaults.
+type Options struct {
+	// Duration, if set, ends the run after that long.
+	Duration time.Duration
+	// Pairs, if set, ends the run once that many pairs completed.
+	Pairs uint64
+	// PairTimeout bounds the exchange of one pair.
+	PairTimeout time.Duration
+	// Concurrency is the number of pairs running at once.
+	Concurrency int
+	// Seed seeds the choice of settings and payloads, so that a failing run
+	// can be repeated.
+	Seed int64
+	// MaxHeap bounds the heap in bytes.
+	MaxHeap uint64
+	// Logf, if set, receives a line per failing pair.
+	Logf func(format string, a ...interface{})
+}
+
+// Report sums up a run.
+type Report struct {
+	Pairs   uint64
+	Bytes   uint64
+	MaxHeap uint64
+	// Goroutines is the number of goroutines left over, beyond those
+	// running before.
+	Goroutines int
+}
+
+// Run runs pairs until ctx is done, Duration passed or Pairs completed, and fails on the first
+// pair that corrupts or loses payload, leaked goroutines or a heap above
+// MaxHeap.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.MaxHeap == 0 {
+		opts.MaxHeap = DefaultMaxHeap
+	}
+	if opts.PairTimeout <= 0 {
+		opts.PairTimeout = DefaultPairTimeout
+	}
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+	seed, err := drbg.SeedFromHex(testutil.TestSeed)
+	if err != nil {
+		return nil, err
+	}
+	// Generate the tables ahead, so that their cache is not taken for a
+	// leak.
+	if _, err = riverrun.DeriveParams(seed); err != nil {
+		return nil, err
+	}
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		report   Report
+		heap     atomic.Uint64
+		failOnce sync.Once
+		failErr  error
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failErr = err
+			cancel()
+		})
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > heap.Load() {
+				heap.Store(stats.HeapAlloc)
+			}
+			if stats.HeapAlloc > opts.MaxHeap {
+				fail(fmt.Errorf("%w: %d bytes", ErrHeap, stats.HeapAlloc))
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		pairs, started, total atomic.Uint64
+		workers               sync.WaitGroup
+	)
+	for w := 0; w < opts.Concurrency; w++ {
+		workers.Add(1)
+		rng := rand.New(rand.NewSource(opts.Seed + int64(w)))
+		go func() {
+			defer workers.Done()
+			for ctx.Err() == nil {
+				if opts.Pairs > 0 && started.Add(1) > opts.Pairs {
+					break
+				}
+				n, err := runPair(seed, rng, opts.PairTimeout)
+				if err != nil {
+					if opts.Logf != nil {
+						opts.Logf("soak: pair failed: %s", err)
+					}
+					fail(err)
+					return
+				}
+				pairs.Add(1)
+				total.Add(uint64(n))
+			}
+		}()
+	}
+	workers.Wait()
+	// Stop the heap monitor, in case the run ended on Pairs.
+	cancel()
+	wg.Wait()
+
+	report.Pairs, report.Bytes, report.MaxHeap = pairs.Load(), total.Load(), heap.Load()
+	if failErr != nil {
+		return &report, failErr
+	}
+	deadline := time.Now().Add(settleTimeout)
+	for {
+		report.Goroutines = runtime.NumGoroutine() - baseline
+		if report.Goroutines <= 0 {
+			report.Goroutines = 0
+			return &report, nil
+		}
+		if time.Now().After(deadline) {
+			return &report, fmt.Errorf("%w: %d", ErrLeak, report.Goroutines)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// runPair sends random payload through a pair with random settings, which
+// the server echoes, and returns the number of bytes checked.
+func runPair(seed *drbg.Seed, rng *rand.Rand, timeout time.Duration) (int, error) {
+	shared := riverrun.Config{
+		MaxFrameLength: []int{0, 1400, 8192}[rng.Intn(3)],
+		KeyCommitment:  rng.Intn(2) == 0,
+	}
+	clientConfig, serverConfig := randomConfig(shared, rng), randomConfig(shared, rng)
+	var faults testutil.Faults
+	if rng.Intn(2) == 0 {
+		faults = testutil.Faults{ShortReads: true, Seed: rng.Int63()}
+	}
+	cc, cs := testutil.Pipe(faults, faults)
+	client, err := riverrun.NewConnConfig(context.Background(), cc, false, seed, clientConfig)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	server, err := riverrun.NewConnConfig(context.Background(), cs, true, seed, serverConfig)
+	if err != nil {
+		return 0, err
+	}
+	defer server.Close()
+	go io.Copy(server, server)
+
+	msgs := make([][]byte, 1+rng.Intn(maxMessages))
+	var want []byte
+	for i := range msgs {
+		msgs[i] = randomPayload(rng)
+		want = append(want, msgs[i]...)
+	}
+	writeErr := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if _, err := client.Write(msg); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+
+	client.SetReadDeadline(time.Now().Add(timeout))
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(client, got); err != nil {
+		return 0, fmt.Errorf("%s, with %+v and %+v", err, clientConfig, serverConfig)
+	}
+	if err = <-writeErr; err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(got, want) {
+		return 0, fmt.Errorf("%w, with %+v and %+v", ErrCorrupted, clientConfig, serverConfig)
+	}
+	return len(want), nil
+}
+
+// randomConfig returns shared with random settings for one side.
+func randomConfig(shared riverrun.Config, rng *rand.Rand) *riverrun.Config {
+	config := shared
+	config.Compression = riverrun.Compression(rng.Intn(2))
+	config.EncodeWorkers = []int{0, 2, 4}[rng.Intn(3)]
+	config.DisableLengthShaping = rng.Intn(4) == 0
+	config.AdaptiveBias = rng.Intn(4) == 0
+	config.StrictFrames = rng.Intn(2) == 0
+	config.ConstantTimeLookups = rng.Intn(4) == 0
+	if rng.Intn(4) == 0 {
+		config.EchoInterval = 10 * time.Millisecond
+	}
+	switch rng.Intn(4) {
+	case 0:
+		config.Scheduler = riverrun.BatchedScheduler(time.Millisecond, 16*1024)
+	case 1:
+		config.Scheduler = riverrun.PacedScheduler(64*1024*1024, 256*1024)
+	}
+	return &config
+}
+
+// randomPayload returns a message of random size and pattern: zeroes,
+// random bytes, repeated text or a mix of them.
+func randomPayload(rng *rand.Rand) []byte {
+	msg := make([]byte, 1+rng.Intn(maxMessage))
+	switch rng.Intn(4) {
+	case 0:
+	case 1:
+		rng.Read(msg)
+	case 2:
+		for i := range msg {
+			msg[i] = "riverrun soak "[i%14]
+		}
+	default:
+		for off := 0; off < len(msg); {
+			run := min(len(msg)-off, 1+rng.Intn(512))
+			if rng.Intn(2) == 0 {
+				rng.Read(msg[off : off+run])
+			}
+			off += run
+		}
+	}
+	return msg
+}
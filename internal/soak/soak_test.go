@@ -0,0 +1,27 @@
+package soak
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	// Run a fixed number of pairs rather than for a while, and let a pair
+	// take as long as the test may, so that slow builds such as -race
+	// only take longer.
+	opts := Options{Pairs: 8, Concurrency: 4, Seed: 1, Logf: t.Logf}
+	if deadline, ok := t.Deadline(); ok {
+		opts.PairTimeout = time.Until(deadline) - 10*time.Second
+	} else {
+		opts.PairTimeout = time.Hour
+	}
+	report, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Pairs != opts.Pairs {
+		t.Fatalf("%d pairs completed, want %d", report.Pairs, opts.Pairs)
+	}
+	t.Logf("%+v", *report)
+}
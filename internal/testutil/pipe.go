@@ -0,0 +1,268 @@
+// Package testutil provides an in-memory carrier with fault injection, and
+// helpers running riverrun connections over it, for testing how the decoder
+// copes with what real networks do.
+package testutil
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultBufferSize is the number of bytes a direction holds before Write
+// blocks, like a socket buffer.
+const DefaultBufferSize = 256 * 1024
+
+// ErrReset is the error returned by both ends of a reset Pipe.
+var ErrReset = errors.New("testutil: connection reset")
+
+// Faults are injected into the traffic of one end of a Pipe.  Except for
+// ShortReads, they apply to the bytes the end writes.
+type Faults struct {
+	// Latency delays every write by that long before the peer can read it.
+	Latency time.Duration
+	// PartialWrites makes Write accept a random non-empty prefix of its
+	// buffer only, returning io.ErrShortWrite.
+	PartialWrites bool
+	// ShortReads makes Read return a random non-empty prefix of what it
+	// could.
+	ShortReads bool
+	// Flips lists offsets into the written stream whose byte gets a random
+	// bit flipped.
+	Flips []int64
+	// ResetAfter, if set, resets the Pipe once that many bytes are written.
+	// The peer reads the bytes before the reset, then ErrReset.
+	ResetAfter int64
+	// Seed seeds the randomness of the faults.
+	Seed int64
+}
+
+// link is the shared state of both ends.
+type link struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	reset bool
+}
+
+// queue is one direction.
+type queue struct {
+	chunks []chunk
+	size   int
+	// closed is set once the writer closed its end.
+	closed bool
+}
+
+type chunk struct {
+	at   time.Time
+	data []byte
+}
+
+type addr string
+
+func (a addr) Network() string { return "pipe" }
+func (a addr) String() string  { return string(a) }
+
+// Conn is one end of a Pipe.
+type Conn struct {
+	link    *link
+	in, out *queue
+	faults  Faults
+	rng     *rand.Rand
+	written int64
+	closed  bool
+	name    addr
+	peer    addr
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+	// wake is armed for the next chunk in to become readable.
+	wake *time.Timer
+}
+
+// Pipe returns the two ends of a full-duplex in-memory carrier.  Unlike
+// net.Pipe, each direction buffers up to DefaultBufferSize bytes, so writes
+// do not wait for the peer to read.
+func Pipe(clientFaults, serverFaults Faults) (client, server *Conn) {
+	l := &link{}
+	l.cond = sync.NewCond(&l.lock)
+	up, down := &queue{}, &queue{}
+	client = &Conn{link: l, in: down, out: up, faults: clientFaults, rng: rand.New(rand.NewSource(clientFaults.Seed)), name: "client", peer: "server"}
+	server = &Conn{link: l, in: up, out: down, faults: serverFaults, rng: rand.New(rand.NewSource(serverFaults.Seed)), name: "server", peer: "client"}
+	return client, server
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	l := c.link
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case len(b) == 0:
+			return 0, nil
+		}
+		if len(c.in.chunks) > 0 {
+			first := &c.in.chunks[0]
+			if wait := time.Until(first.at); wait <= 0 {
+				n := len(b)
+				if c.faults.ShortReads && n > 1 {
+					n = 1 + c.rng.Intn(n)
+				}
+				n = copy(b[:n], first.data)
+				first.data = first.data[n:]
+				c.in.size -= n
+				if len(first.data) == 0 {
+					c.in.chunks = c.in.chunks[1:]
+				}
+				l.cond.Broadcast()
+				return n, nil
+			} else if c.wake == nil {
+				c.wake = time.AfterFunc(wait, func() {
+					l.lock.Lock()
+					c.wake = nil
+					l.cond.Broadcast()
+					l.lock.Unlock()
+				})
+			}
+		} else {
+			switch {
+			case l.reset:
+				return 0, ErrReset
+			case c.in.closed:
+				return 0, io.EOF
+			}
+		}
+		if expired(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		l.cond.Wait()
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	l := c.link
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limit := len(b)
+	if c.faults.PartialWrites && limit > 1 {
+		limit = 1 + c.rng.Intn(limit)
+	}
+	n := 0
+	for n < limit {
+		switch {
+		case l.reset:
+			return n, ErrReset
+		case c.closed:
+			return n, net.ErrClosed
+		case c.out.closed:
+			return n, io.ErrClosedPipe
+		case expired(c.writeDeadline):
+			return n, os.ErrDeadlineExceeded
+		}
+		room := DefaultBufferSize - c.out.size
+		if room <= 0 {
+			l.cond.Wait()
+			continue
+		}
+		data := append([]byte(nil), b[n:n+min(room, limit-n)]...)
+		reset := false
+		if c.faults.ResetAfter > 0 && c.written+int64(len(data)) >= c.faults.ResetAfter {
+			data = data[:c.faults.ResetAfter-c.written]
+			reset = true
+		}
+		for _, off := range c.faults.Flips {
+			if off >= c.written && off < c.written+int64(len(data)) {
+				data[off-c.written] ^= 1 << c.rng.Intn(8)
+			}
+		}
+		c.written += int64(len(data))
+		n += len(data)
+		if len(data) > 0 {
+			c.out.chunks = append(c.out.chunks, chunk{at: time.Now().Add(c.faults.Latency), data: data})
+			c.out.size += len(data)
+		}
+		if reset {
+			l.reset = true
+		}
+		l.cond.Broadcast()
+	}
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// Reset resets the Pipe right away.  Bytes in flight are still delivered.
+func (c *Conn) Reset() {
+	c.link.lock.Lock()
+	defer c.link.lock.Unlock()
+	c.link.reset = true
+	c.link.cond.Broadcast()
+}
+
+func (c *Conn) Close() error {
+	l := c.link
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.out.closed = true
+	// Nobody reads in anymore, release writers waiting for room.
+	c.in.chunks, c.in.size = nil, 0
+	c.in.closed = true
+	for _, t := range []*time.Timer{c.readTimer, c.writeTimer, c.wake} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	l.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.name }
+func (c *Conn) RemoteAddr() net.Addr { return c.peer }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.readDeadline, &c.readTimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.writeDeadline, &c.writeTimer, t)
+	return nil
+}
+
+func (c *Conn) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	l := c.link
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			l.lock.Lock()
+			l.cond.Broadcast()
+			l.lock.Unlock()
+		})
+	}
+	l.cond.Broadcast()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
@@ -0,0 +1,41 @@
+package testutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// TestSeed is the seed of the riverrun tests, so the tables are generated
+// once per test binary.
+const TestSeed = "000102030405060708090a0b0c0d0e0f1011121314151617"
+
+// Side configures one end of NewPair.
+type Side struct {
+	Config *riverrun.Config
+	Faults Faults
+}
+
+// NewPair returns a client and a server Conn talking over a Pipe, with the
+// carriers for injecting resets.  Everything is closed when the test ends.
+func NewPair(t testing.TB, client, server Side) (rc, rs *riverrun.Conn, cc, cs *Conn) {
+	t.Helper()
+	seed, err := drbg.SeedFromHex(TestSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, cs = Pipe(client.Faults, server.Faults)
+	if rc, err = riverrun.NewConnConfig(context.Background(), cc, false, seed, client.Config); err != nil {
+		t.Fatal(err)
+	}
+	if rs, err = riverrun.NewConnConfig(context.Background(), cs, true, seed, server.Config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rc.Close()
+		rs.Close()
+	})
+	return rc, rs, cc, cs
+}
@@ -0,0 +1,68 @@
+package testutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestPipeFaults(t *testing.T) {
+	client, server := Pipe(Faults{Latency: 20 * time.Millisecond, PartialWrites: true, Flips: []int64{3}}, Faults{ShortReads: true})
+	msg := []byte("0123456789")
+	start := time.Now()
+	var n int
+	for n < len(msg) {
+		m, err := client.Write(msg[n:])
+		if err != nil && err != io.ErrShortWrite {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("latency not applied")
+	}
+	if diff := got[3] ^ msg[3]; diff == 0 || diff&(diff-1) != 0 || !bytes.Equal(got[4:], msg[4:]) || !bytes.Equal(got[:3], msg[:3]) {
+		t.Fatalf("got %q, want one bit of byte 3 flipped", got)
+	}
+
+	client, server = Pipe(Faults{ResetAfter: 4}, Faults{})
+	if _, err := client.Write(msg); !errors.Is(err, ErrReset) {
+		t.Fatalf("write: got %v, want ErrReset", err)
+	}
+	if _, err := io.ReadFull(server, got[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Read(got); !errors.Is(err, ErrReset) {
+		t.Fatalf("read: got %v, want ErrReset", err)
+	}
+}
+
+func TestRiverrunOverFaults(t *testing.T) {
+	faults := Faults{Latency: time.Millisecond, ShortReads: true, Seed: 1}
+	client, server, _, _ := NewPair(t, Side{Faults: faults}, Side{Faults: faults})
+	msg := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(msg)
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("round trip mismatch")
+	}
+
+	// Frames carry no tag, so a flipped bit either fails the read or
+	// garbles the payload, without panicking.
+	client, server, _, _ = NewPair(t, Side{Faults: Faults{Flips: []int64{200}}}, Side{})
+	go client.Write(msg[:1000])
+	if _, err := io.ReadFull(server, got[:1000]); err == nil && bytes.Equal(got[:1000], msg[:1000]) {
+		t.Fatal("flip went unnoticed")
+	}
+}
@@ -0,0 +1,238 @@
+package riverrun
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"sync/atomic"
+
+	"github.com/cloudflare/circl/kem"
+	"github.com/cloudflare/circl/kem/hybrid"
+)
+
+// KeyExchange selects a key exchange run over the first frames of a
+// connection, on top of the keys derived from the seed and the salts.
+type KeyExchange int
+
+const (
+	// KeyExchangeNone keys all frames with the seed and the salts.
+	KeyExchangeNone KeyExchange = iota
+	// KeyExchangeX25519Kyber768 runs the hybrid of X25519 and Kyber768
+	// (ML-KEM-768), so that recorded traffic stays secret against a quantum
+	// adversary as long as either of them holds, and against anyone who
+	// learns the seed later on.
+	KeyExchangeX25519Kyber768
+)
+
+// ErrKeyExchange is the error returned by Read when the key exchange of
+// Config.KeyExchange fails, e.g. because the peer does not run it.
+var ErrKeyExchange = errors.New("riverrun: key exchange failed")
+
+// kexLabel separates the exchanged keys from the salted ones.
+const kexLabel = "riverrun kex v1"
+
+// The phases of a key exchange, the first byte of its messages.  The client
+// sends its public key right behind the salt, the server answers with the
+// ciphertext and the client confirms.  Each side switches its write keys
+// right after its last message, and its read keys right after the last
+// message of the peer.  A message spans as many PacketTypeKeyExchange frames
+// as it takes, so it is shaped like any other frames.
+const (
+	kexInit = iota
+	kexReply
+	kexConfirm
+	// kexDone follows the last message received.
+	kexDone
+)
+
+// kexHeaderLength is the size of the phase and suite bytes that start every
+// key exchange message.
+const kexHeaderLength = 2
+
+// scheme returns the KEM of k, or nil for none.
+func (k KeyExchange) scheme() kem.Scheme {
+	switch k {
+	case KeyExchangeX25519Kyber768:
+		return hybrid.Kyber768X25519()
+	default:
+		return nil
+	}
+}
+
+// keyExchange is the state of the key exchange of a Conn.  Apart from the
+// done flags, it is only used by Read and the worker sending the messages.
+type keyExchange struct {
+	suite  KeyExchange
+	scheme kem.Scheme
+	// writeKey and readKey are the seed derived keys of the directions,
+	// which the exchanged keys are derived from along with the secret.
+	writeKey, readKey []byte
+	// private is the client's key until the reply has arrived, secret the
+	// server's copy of the shared secret until the confirmation has.
+	private kem.PrivateKey
+	secret  []byte
+	// phase is the next message expected, in is what arrived of it.
+	phase int
+	in    []byte
+
+	writeDone, readDone atomic.Bool
+}
+
+// initKeyExchange sets up the key exchange of config.KeyExchange.  The client
+// queues its public key behind the salt, so it goes out with the first write.
+func (rr *Conn) initKeyExchange(suite KeyExchange, writeKey, readKey []byte, isServer bool) error {
+	kex := &keyExchange{
+		suite:    suite,
+		scheme:   suite.scheme(),
+		writeKey: writeKey,
+		readKey:  readKey,
+	}
+	rr.kex = kex
+	rr.Decoder.onKeyExchange = rr.handleKeyExchange
+	if isServer {
+		rr.Decoder.expectKeyExchange = true
+		return nil
+	}
+
+	public, private, err := kex.scheme.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	pk, err := public.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	kex.private = private
+	kex.phase = kexReply
+	frameBuf, _, err := rr.Encoder.Chop(append([]byte{kexInit, byte(suite)}, pk...), PacketTypeKeyExchange)
+	rr.frameLens = rr.frameLens[:0]
+	rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
+	if err != nil {
+		return err
+	}
+	rr.saltOut = append(rr.saltOut, frameBuf.Bytes()...)
+	return nil
+}
+
+// KeyExchanged reports whether both directions of rr switched to the keys of
+// Config.KeyExchange.  Until then, frames are keyed by the seed alone.
+func (rr *Conn) KeyExchanged() bool {
+	return rr.kex != nil && rr.kex.writeDone.Load() && rr.kex.readDone.Load()
+}
+
+// messageLength returns the size of message phase, header included.
+func (kex *keyExchange) messageLength(phase int) int {
+	switch phase {
+	case kexInit:
+		return kexHeaderLength + kex.scheme.PublicKeySize()
+	case kexReply:
+		return kexHeaderLength + kex.scheme.CiphertextSize()
+	default:
+		return kexHeaderLength
+	}
+}
+
+// handleKeyExchange collects the frames of a key exchange message, and acts
+// on it once complete.  It is called from Read.
+func (rr *Conn) handleKeyExchange(body []byte) error {
+	kex := rr.kex
+	if kex == nil || kex.phase == kexDone {
+		return ErrKeyExchange
+	}
+	kex.in = append(kex.in, body...)
+	if len(kex.in) >= kexHeaderLength && (int(kex.in[0]) != kex.phase || KeyExchange(kex.in[1]) != kex.suite) {
+		return ErrKeyExchange
+	}
+	need := kex.messageLength(kex.phase)
+	if len(kex.in) > need {
+		return ErrKeyExchange
+	} else if len(kex.in) < need {
+		return nil
+	}
+	payload := kex.in[kexHeaderLength:]
+	kex.in = nil
+
+	switch kex.phase {
+	case kexInit:
+		pk, err := kex.scheme.UnmarshalBinaryPublicKey(payload)
+		if err != nil {
+			return ErrKeyExchange
+		}
+		ct, secret, err := kex.scheme.Encapsulate(pk)
+		if err != nil {
+			return ErrKeyExchange
+		}
+		kex.secret = secret
+		kex.phase = kexConfirm
+		// Read must not wait for the write lock.
+		rr.spawn(func() {
+			rr.sendKeyExchange(append([]byte{kexReply, byte(kex.suite)}, ct...), secret)
+		})
+		return nil
+	case kexReply:
+		secret, err := kex.scheme.Decapsulate(kex.private, payload)
+		if err != nil {
+			return ErrKeyExchange
+		}
+		kex.private = nil
+		kex.phase = kexDone
+		rr.spawn(func() {
+			rr.sendKeyExchange([]byte{kexConfirm, byte(kex.suite)}, secret)
+		})
+		return rr.switchReadKeys(secret)
+	default:
+		secret := kex.secret
+		kex.secret = nil
+		kex.phase = kexDone
+		return rr.switchReadKeys(secret)
+	}
+}
+
+// sendKeyExchange writes a key exchange message, and switches the write keys
+// right behind it.
+func (rr *Conn) sendKeyExchange(msg, secret []byte) {
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+
+	frameBuf, _, err := rr.Encoder.Chop(msg, PacketTypeKeyExchange)
+	if err == nil {
+		_, err = rr.writeFrames(&frameBuf)
+	}
+	if err != nil {
+		return
+	}
+	key, stream, err := rr.exchangedKeys(rr.kex.writeKey, secret, true)
+	if err != nil {
+		rr.writeErr = err
+		return
+	}
+	rr.Encoder.setKeys(key, stream)
+	rr.kex.writeDone.Store(true)
+}
+
+// switchReadKeys switches the decoder to the exchanged keys.
+func (rr *Conn) switchReadKeys(secret []byte) error {
+	key, stream, err := rr.exchangedKeys(rr.kex.readKey, secret, false)
+	if err != nil {
+		return err
+	}
+	rr.Decoder.setKeys(key, stream)
+	rr.kex.readDone.Store(true)
+	return nil
+}
+
+// exchangedKeys derives the keys of a direction from its seed derived key and
+// the shared secret, the way the salted keys are derived from the salt.
+func (rr *Conn) exchangedKeys(key, secret []byte, write bool) ([]byte, cipher.Stream, error) {
+	var salt bytes.Buffer
+	salt.WriteString(kexLabel)
+	salt.Write(secret)
+	if rr.keyLog != nil {
+		dir, offset := rr.keyLog.readDir, rr.keyLog.readOffset
+		if write {
+			dir, offset = rr.keyLog.writeDir, rr.keyLog.writeOffset
+		}
+		rr.keyLog.rekey(dir, offset, saltedSecret(key, salt.Bytes()))
+	}
+	return saltedKeys(key, salt.Bytes(), rr.lookahead)
+}
@@ -0,0 +1,63 @@
+package riverrun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestKeyExchange(t *testing.T) {
+	config := &Config{KeyExchange: KeyExchangeX25519Kyber768}
+	client, server := newTestPair(t, config, config)
+	// The server echoes, the client keeps reading, so that the messages
+	// of the exchange never stall.
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err = server.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	msgs := [][]byte{bytes.Repeat([]byte("before "), 300), bytes.Repeat([]byte("after "), 300)}
+	echoes := make(chan []byte)
+	go func() {
+		for _, msg := range msgs {
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(client, got); err != nil {
+				close(echoes)
+				return
+			}
+			echoes <- got
+		}
+		drain(client)
+	}()
+
+	for i, msg := range msgs {
+		if _, err := client.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-echoes; !bytes.Equal(got, msg) {
+			t.Fatalf("echo %d mismatch", i)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for !client.KeyExchanged() || !server.KeyExchanged() {
+			if time.Now().After(deadline) {
+				t.Fatal("keys not exchanged")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	plain, strict := newTestPair(t, nil, config)
+	go plain.Write([]byte("no key exchange"))
+	if _, err := strict.Read(make([]byte, 64)); !errors.Is(err, ErrKeyExchange) {
+		t.Fatalf("got %v, want ErrKeyExchange", err)
+	}
+}
@@ -0,0 +1,71 @@
+package riverrun
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/v2fly/riverrun/common/csrand"
+)
+
+// keyLogLock serializes key log records of all connections.
+var keyLogLock sync.Mutex
+
+// keyLog writes the secrets and frame boundaries of one connection.
+type keyLog struct {
+	w    io.Writer
+	conn string
+
+	writeDir, readDir       string
+	writeOffset, readOffset uint64
+}
+
+// newKeyLog returns the key log of the connection traceID.
+func newKeyLog(w io.Writer, isServer bool, traceID string) *keyLog {
+	l := &keyLog{w: w, conn: traceID, writeDir: "c2s", readDir: "s2c"}
+	if isServer {
+		l.writeDir, l.readDir = l.readDir, l.writeDir
+	}
+	return l
+}
+
+// newTraceID returns a random connection id, see Conn.TraceID.
+func newTraceID() (string, error) {
+	var id [8]byte
+	if err := csrand.Bytes(id[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", id), nil
+}
+
+// TraceID returns the random id of rr, which starts its log lines and is
+// set in its hook events.  Key log records use it as <conn>.
+func (rr *Conn) TraceID() string {
+	return rr.traceID
+}
+
+func (l *keyLog) printf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	keyLogLock.Lock()
+	defer keyLogLock.Unlock()
+	io.WriteString(l.w, line)
+}
+
+func (l *keyLog) table(dir string, key, iv []byte, bias float64, bits8, bits16 uint64) {
+	l.printf("RIVERRUN_TABLE %s %s %x %x %v %d %d\n", l.conn, dir, key, iv, bias, bits8, bits16)
+}
+
+func (l *keyLog) keys(dir string, salt, secret []byte) {
+	drbgKey, ctrKey, iv := secret[:len(secret)-32], secret[len(secret)-32:len(secret)-16], secret[len(secret)-16:]
+	l.printf("RIVERRUN_KEYS %s %s %x %x %x %x\n", l.conn, dir, salt, drbgKey, ctrKey, iv)
+}
+
+func (l *keyLog) rekey(dir string, offset uint64, secret []byte) {
+	drbgKey, ctrKey, iv := secret[:len(secret)-32], secret[len(secret)-32:len(secret)-16], secret[len(secret)-16:]
+	l.printf("RIVERRUN_REKEY %s %s %d %x %x %x\n", l.conn, dir, offset, drbgKey, ctrKey, iv)
+}
+
+func (l *keyLog) frame(dir string, offset *uint64, length int) {
+	l.printf("RIVERRUN_FRAME %s %s %d %d\n", l.conn, dir, *offset, length)
+	*offset += uint64(length)
+}
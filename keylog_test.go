@@ -0,0 +1,124 @@
+package riverrun
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/v2fly/riverrun/common/log"
+)
+
+func TestKeyLog(t *testing.T) {
+	if log.Hardened {
+		t.Skip("riverrun_hardened builds refuse KeyLog")
+	}
+	var clientLog, serverLog bytes.Buffer
+	client, server := newTestPair(t, &Config{KeyLog: &clientLog}, &Config{KeyLog: &serverLog})
+	msg := make([]byte, 3000)
+	written := make(chan struct{})
+	go func() {
+		client.Write(msg)
+		close(written)
+	}()
+	if _, err := io.ReadFull(server, msg); err != nil {
+		t.Fatal(err)
+	}
+	<-written
+
+	records := func(log *bytes.Buffer, kind, dir string) [][]string {
+		var res [][]string
+		for _, line := range strings.Split(log.String(), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 2 && fields[0] == kind && fields[2] == dir {
+				res = append(res, fields[3:])
+			}
+		}
+		return res
+	}
+
+	for _, kind := range []string{"RIVERRUN_TABLE", "RIVERRUN_KEYS"} {
+		c, s := records(&clientLog, kind, "c2s"), records(&serverLog, kind, "c2s")
+		if len(c) != 1 || len(s) != 1 || strings.Join(c[0], " ") != strings.Join(s[0], " ") {
+			t.Fatalf("%s records disagree: %v, %v", kind, c, s)
+		}
+	}
+
+	// Frames tile the direction behind the salt, as seen from both ends.
+	wire := client.Snapshot().WireBytesOut
+	for _, log := range []*bytes.Buffer{&clientLog, &serverLog} {
+		offset := uint64(len(server.saltIn))
+		frames := records(log, "RIVERRUN_FRAME", "c2s")
+		for _, frame := range frames {
+			if frame[0] != strconv.FormatUint(offset, 10) {
+				t.Fatalf("frame at %s, want %d", frame[0], offset)
+			}
+			length, _ := strconv.ParseUint(frame[1], 10, 64)
+			offset += length
+		}
+		if len(frames) == 0 || offset != wire {
+			t.Fatalf("%d frames end at %d, want %d", len(frames), offset, wire)
+		}
+	}
+}
+
+// traceLog records the lines logged, and the trace IDs of the sent frames.
+type traceLog struct {
+	NopHooks
+	mu     sync.Mutex
+	lines  []string
+	frames []string
+}
+
+func (l *traceLog) Infof(format string, a ...interface{}) { l.Debugf(format, a...) }
+
+func (l *traceLog) Debugf(format string, a ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, a...))
+}
+
+func (l *traceLog) OnFrameSent(e FrameEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.frames = append(l.frames, e.TraceID)
+}
+
+func TestTraceID(t *testing.T) {
+	if log.Hardened {
+		t.Skip("riverrun_hardened builds refuse Hooks and KeyLog")
+	}
+	var keyLog bytes.Buffer
+	trace := new(traceLog)
+	client, server := newTestPair(t, &Config{Logger: trace, Hooks: trace, KeyLog: &keyLog}, nil)
+	id := client.TraceID()
+	if len(id) != 16 || id == server.TraceID() {
+		t.Fatalf("trace IDs %q, %q", id, server.TraceID())
+	}
+	go client.Write([]byte("traced"))
+	if _, err := io.ReadFull(server, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	if len(trace.lines) == 0 || len(trace.frames) == 0 {
+		t.Fatal("nothing traced")
+	}
+	for _, line := range trace.lines {
+		if !strings.HasPrefix(line, "["+id+"] ") {
+			t.Fatalf("log line %q without the trace ID", line)
+		}
+	}
+	for _, frameID := range trace.frames {
+		if frameID != id {
+			t.Fatalf("frame event of %q", frameID)
+		}
+	}
+	if !strings.Contains(keyLog.String(), " "+id+" ") {
+		t.Fatal("key log records without the trace ID")
+	}
+}
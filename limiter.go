@@ -0,0 +1,83 @@
+package riverrun
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket bandwidth limit.  A Limiter may be shared by any
+// number of connections to cap their combined write rate.
+//
+// Reservations are served in arrival order, and each connection has at most
+// one chunk waiting at a time, so a shared rate is split roughly evenly
+// between the busy connections instead of going to whoever writes the most.
+type Limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter allowing bytesPerSecond on average with bursts
+// of up to burst bytes.
+func NewLimiter(bytesPerSecond float64, burst int) *Limiter {
+	return &Limiter{
+		rate:   bytesPerSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the limit.  Pending reservations keep their wait time.
+func (l *Limiter) SetRate(bytesPerSecond float64, burst int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	l.rate = bytesPerSecond
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Rate returns the current limit in bytes per second.
+func (l *Limiter) Rate() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// refund gives back n bytes worth of tokens reserved for a write that was
+// abandoned.
+func (l *Limiter) refund(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	l.tokens += float64(n)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// reserve takes n bytes worth of tokens and returns how long to wait until
+// they are actually available.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 || l.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,52 @@
+package riverrun
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(1000, 500)
+	if wait := l.reserve(500); wait != 0 {
+		t.Fatalf("burst: waited %s", wait)
+	}
+	if wait := l.reserve(1000); wait < 900*time.Millisecond || wait > time.Second {
+		t.Fatalf("1000 bytes at 1000 B/s past the burst: wait %s", wait)
+	}
+	l.SetRate(1e6, 500)
+	if l.Rate() != 1e6 {
+		t.Fatalf("Rate() = %v after SetRate", l.Rate())
+	}
+	// The debt of the earlier reservation is kept.
+	if wait := l.reserve(0); wait == 0 {
+		t.Fatal("SetRate forgave the pending reservation")
+	}
+}
+
+func TestSharedLimiter(t *testing.T) {
+	shared := NewLimiter(100*1024, 4096)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		carrier := new(chunkWriter)
+		s := LimitedScheduler(0, 0, shared)(carrier)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+			for j := 0; j < 4; j++ {
+				if err := s.Write(make([]byte, 4096)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// Each connection alone could go at the shared rate, together they
+	// share it: 28kB past the burst at 100kB/s.
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("2x16kB written in %s", elapsed)
+	}
+}
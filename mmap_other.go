@@ -0,0 +1,27 @@
+//go:build !unix
+
+package riverrun
+
+import (
+	"os"
+	"unsafe"
+)
+
+// mapFile reads the named file into memory where mmap is unavailable, so
+// tables are still loaded from disk but not shared between processes.
+func mapFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return data, nil
+	}
+	// Copy into uint64 backed storage to keep the tables aligned.
+	aligned := make([]uint64, (len(data)+7)/8)
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&aligned[0])), len(data))
+	copy(buf, data)
+	return buf, nil
+}
+
+func unmapFile(data []byte) {}
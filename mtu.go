@@ -0,0 +1,27 @@
+package riverrun
+
+// Carrier is implemented by carriers whose writes travel as single
+// datagrams, e.g. over UDP or QUIC.  MTU returns the largest write that fits
+// one datagram, or 0 while it is unknown.  It is queried for every shaped
+// chunk, so that it may follow path MTU discovery.
+type Carrier interface {
+	MTU() int
+}
+
+// carrierMTU returns the MTU of the carrier of rr, or 0 if it exposes none.
+func (rr *Conn) carrierMTU() int {
+	if rr.carrier == nil {
+		return 0
+	}
+	return rr.carrier.MTU()
+}
+
+// clampMSS returns mssMax clamped to the MTU of the carrier, so that the
+// length sampler keeps its shape below it and a shaped chunk never spans
+// two datagrams, which fragmentation would show.
+func (rr *Conn) clampMSS(mssMax int) int {
+	if mtu := rr.carrierMTU(); mtu > 0 && mssMax > mtu {
+		return mtu
+	}
+	return mssMax
+}
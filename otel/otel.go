@@ -0,0 +1,52 @@
+// Package otel records the spans of riverrun connections with OpenTelemetry.
+// It is a separate package so that programs not importing it do not link the
+// OpenTelemetry API.
+//
+//	config.Tracer = otel.NewTracer(otelapi.Tracer("riverrun"))
+package otel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/v2fly/riverrun"
+)
+
+// NewTracer returns a riverrun.Tracer starting its spans with t.
+func NewTracer(t trace.Tracer) riverrun.Tracer {
+	return tracer{t}
+}
+
+type tracer struct {
+	t trace.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, name string) (context.Context, riverrun.Span) {
+	ctx, s := t.t.Start(ctx, name)
+	return ctx, span{s}
+}
+
+type span struct {
+	s trace.Span
+}
+
+func (s span) SetString(key, value string) { s.s.SetAttributes(attribute.String(key, value)) }
+
+func (s span) SetInt(key string, value int64) { s.s.SetAttributes(attribute.Int64(key, value)) }
+
+func (s span) SetFloat(key string, value float64) {
+	s.s.SetAttributes(attribute.Float64(key, value))
+}
+
+func (s span) SetBool(key string, value bool) { s.s.SetAttributes(attribute.Bool(key, value)) }
+
+func (s span) End(err error) {
+	if err != nil {
+		s.s.RecordError(err)
+		s.s.SetStatus(codes.Error, err.Error())
+	}
+	s.s.End()
+}
@@ -0,0 +1,146 @@
+package otel
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/common/log"
+)
+
+// recorder is an in-memory trace.Tracer keeping every span it starts.
+type recorder struct {
+	embedded.Tracer
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	noop.Span
+	r      *recorder
+	name   string
+	parent string
+	attrs  map[attribute.Key]attribute.Value
+	errs   []error
+	status codes.Code
+	ended  bool
+}
+
+func (r *recorder) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s := &recordedSpan{r: r, name: name, attrs: make(map[attribute.Key]attribute.Value)}
+	if parent, ok := trace.SpanFromContext(ctx).(*recordedSpan); ok {
+		s.parent = parent.name
+	}
+	r.spans = append(r.spans, s)
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+// find returns the last ended span called name.
+func (r *recorder) find(name string) *recordedSpan {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := len(r.spans) - 1; i >= 0; i-- {
+		if s := r.spans[i]; s.name == name && s.ended {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.r.lock.Lock()
+	defer s.r.lock.Unlock()
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.r.lock.Lock()
+	defer s.r.lock.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordedSpan) SetStatus(code codes.Code, _ string) {
+	s.r.lock.Lock()
+	defer s.r.lock.Unlock()
+	s.status = code
+}
+
+func (s *recordedSpan) End(...trace.SpanEndOption) {
+	s.r.lock.Lock()
+	defer s.r.lock.Unlock()
+	s.ended = true
+}
+
+func TestTracer(t *testing.T) {
+	if log.Hardened {
+		t.Skip("riverrun_hardened builds refuse Tracer")
+	}
+	seed, err := drbg.SeedFromHex("000102030405060708090a0b0c0d0e0f1011121314151617")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSpans, serverSpans := new(recorder), new(recorder)
+	a, b := net.Pipe()
+	client, err := riverrun.NewConnConfig(context.Background(), a, false, seed, &riverrun.Config{Tracer: NewTracer(clientSpans)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := riverrun.NewConnConfig(context.Background(), b, true, seed, &riverrun.Config{Tracer: NewTracer(serverSpans)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	msg := []byte("traced payload")
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(server, make([]byte, len(msg)))
+		read <- err
+	}()
+	if _, err := client.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := serverSpans.find(riverrun.SpanHandshake)
+	if handshake == nil || handshake.attrs[riverrun.AttrTraceID].AsString() != server.TraceID() || !handshake.attrs[riverrun.AttrServer].AsBool() {
+		t.Errorf("handshake span: %+v", handshake)
+	}
+	if tables := serverSpans.find(riverrun.SpanTables); tables == nil || tables.parent != riverrun.SpanHandshake || tables.attrs[riverrun.AttrCacheHit].Type() != attribute.BOOL {
+		t.Errorf("tables span: %+v", tables)
+	}
+	write := clientSpans.find(riverrun.SpanWrite)
+	if write == nil || write.attrs[riverrun.AttrBytes].AsInt64() != int64(len(msg)) || write.attrs[riverrun.AttrExpansion].AsFloat64() <= 1 || write.status != codes.Unset {
+		t.Errorf("write span: %+v", write)
+	}
+	if r := serverSpans.find(riverrun.SpanRead); r == nil || r.attrs[riverrun.AttrWireBytes].AsInt64() <= 0 || len(r.errs) != 0 {
+		t.Errorf("read span: %+v", r)
+	}
+
+	// The Read ended by the peer closing records the error.
+	client.Close()
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Read after the peer closed succeeded")
+	}
+	r := serverSpans.find(riverrun.SpanRead)
+	if r == nil || r.status != codes.Error || len(r.errs) != 1 || r.errs[0] == nil {
+		t.Errorf("read span after close: %+v", r)
+	}
+}
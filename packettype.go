@@ -0,0 +1,93 @@
+package riverrun
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// PacketTypeExtension is the first packet type available to
+// RegisterPacketType.  The types below it are reserved for riverrun itself.
+const PacketTypeExtension = 16
+
+// ErrPacketTooLarge is the error returned by WritePacket for a body that does
+// not fit a single frame.
+var ErrPacketTooLarge = errors.New("riverrun: packet does not fit a frame")
+
+// PacketHandler handles the body of a received packet of a registered type.
+// It is called from Read, and an error fails the Read.
+type PacketHandler func(rr *Conn, body []byte) error
+
+var (
+	packetTypeLock sync.RWMutex
+	packetTypes    = make(map[uint8]PacketHandler)
+)
+
+// RegisterPacketType makes typ known to every Conn, usually from the init
+// function of the package implementing an extension: WritePacket accepts it
+// and received packets of that type go to handler.  It panics if typ is
+// reserved or already registered.
+func RegisterPacketType(typ uint8, handler PacketHandler) {
+	packetTypeLock.Lock()
+	defer packetTypeLock.Unlock()
+	if typ < PacketTypeExtension {
+		panic(fmt.Sprintf("riverrun: packet type %d is reserved", typ))
+	}
+	if _, ok := packetTypes[typ]; ok {
+		panic(fmt.Sprintf("riverrun: packet type %d registered twice", typ))
+	}
+	packetTypes[typ] = handler
+}
+
+// lookupPacketType returns the handler registered for typ.
+func lookupPacketType(typ uint8) (PacketHandler, bool) {
+	packetTypeLock.RLock()
+	defer packetTypeLock.RUnlock()
+	handler, ok := packetTypes[typ]
+	return handler, ok
+}
+
+// knownPacketType reports whether the encoder may send typ.
+func knownPacketType(typ uint8) bool {
+	if typ <= PacketTypeFrameHeader {
+		return true
+	}
+	_, ok := lookupPacketType(typ)
+	return ok
+}
+
+// WritePacket sends body as a single packet of a registered type.  Peers
+// without a handler for it fail the Read, unless they set
+// Config.IgnoreUnknownPacketTypes.
+func (rr *Conn) WritePacket(typ uint8, body []byte) error {
+	if _, ok := lookupPacketType(typ); !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownPacketType, typ)
+	}
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+	if len(body) > rr.Encoder.MaxPacketPayloadLength {
+		return ErrPacketTooLarge
+	}
+	// Chop sends nothing for an empty body.
+	var frameBuf bytes.Buffer
+	if err := rr.Encoder.MakePacket(&frameBuf, rr.Encoder.ChopPayload(typ, body)); err != nil {
+		return err
+	}
+	_, err := rr.writeFrames(&frameBuf)
+	return err
+}
+
+// handleExtension passes a packet of a type above the built-in ones to its
+// handler.
+func (rr *Conn) handleExtension(typ uint8, body []byte) error {
+	handler, ok := lookupPacketType(typ)
+	if !ok {
+		if rr.ignoreUnknown {
+			rr.logger.Debugf("riverrun: ignoring packet of unknown type %d", typ)
+			return nil
+		}
+		return ErrUnknownPacketType
+	}
+	return handler(rr, body)
+}
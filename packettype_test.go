@@ -0,0 +1,57 @@
+package riverrun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+const testPacketType = 200
+
+var testPackets = make(chan []byte, 1)
+
+func init() {
+	RegisterPacketType(testPacketType, func(rr *Conn, body []byte) error {
+		testPackets <- append([]byte(nil), body...)
+		return nil
+	})
+}
+
+func TestPacketTypes(t *testing.T) {
+	client, server := newTestPair(t, nil, nil)
+	go func() {
+		client.WritePacket(testPacketType, []byte("extension"))
+		client.Write([]byte("payload"))
+	}()
+	got := make([]byte, 7)
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if body := <-testPackets; !bytes.Equal(body, []byte("extension")) {
+		t.Fatalf("handler got %q", body)
+	}
+	if err := client.WritePacket(testPacketType+1, nil); !errors.Is(err, ErrUnknownPacketType) {
+		t.Fatalf("unregistered type: got %v", err)
+	}
+
+	// Types unknown to the reader fail it, unless it ignores them.
+	for _, ignore := range []bool{false, true} {
+		client, server := newTestPair(t, nil, &Config{IgnoreUnknownPacketTypes: ignore})
+		go func() {
+			// The encoder refuses unknown types, so bypass it.
+			var frameBuf bytes.Buffer
+			client.Encoder.MakePacket(&frameBuf, append([]byte{PacketTypeExtension - 1}, "future"...))
+			client.writeLock.Lock()
+			client.writeFrames(&frameBuf)
+			client.writeLock.Unlock()
+			client.Write([]byte("payload"))
+		}()
+		_, err := io.ReadFull(server, got)
+		if ignore && err != nil {
+			t.Fatalf("ignoring: %s", err)
+		} else if !ignore && !errors.Is(err, ErrUnknownPacketType) {
+			t.Fatalf("got %v, want ErrUnknownPacketType", err)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package riverrun
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+
+	"github.com/v2fly/riverrun/common/ctstretch"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+var (
+	// ErrInvalidParams is the error returned by Params.UnmarshalBinary for
+	// data that does not parse.
+	ErrInvalidParams = errors.New("riverrun: invalid params")
+	// ErrParamsMismatch is the error returned by AttachConnConfig when the
+	// Personalization or Codec of the config differ from those the Params
+	// were derived with.
+	ErrParamsMismatch = errors.New("riverrun: params derived for another configuration")
+)
+
+const paramsMagic = "rrparams"
+
+const paramsVersion = 1
+
+// Params holds everything a Conn derives from the seed, for both directions.
+// Deriving them, generating the tables above all, is the expensive part of
+// NewConn, while attaching them to a conn is cheap.  A Params is read-only
+// and can be attached to any number of conns, on either side; every conn
+// still salts its keys with fresh randomness.
+//
+// Params hold the seed and every key derived from it, so their serialized
+// form must be kept as secret as the seed.
+type Params struct {
+	seed            *drbg.Seed
+	personalization string
+	codec           string
+
+	compressedBlockBits uint64
+	expandedBlockBits   uint64
+	expandedBlockBits8  uint64
+
+	// c2s and s2c are the client to server and server to client
+	// directions.
+	c2s, s2c directionParams
+}
+
+// directionParams are the parameters of one direction.
+type directionParams struct {
+	tableKey []byte
+	tableIV  []byte
+	bias     float64
+	// streamIV is the IV of the unsalted keystream, which uses the c2s
+	// table key in both directions.
+	streamIV  []byte
+	drbgKey   []byte
+	mss       int
+	dev       float64
+	shapeSeed []byte
+
+	// tables is nil for a registered codec.
+	tables *tableSet
+}
+
+// DeriveParams derives the Params of seed with the default settings.
+func DeriveParams(seed *drbg.Seed) (*Params, error) {
+	return DeriveParamsConfig(seed, nil)
+}
+
+// DeriveParamsConfig is like DeriveParams, for the Personalization, Codec,
+// Shape, TableDir and TableProgress of config.  A nil config selects the
+// defaults.
+func DeriveParamsConfig(seed *drbg.Seed, config *Config) (*Params, error) {
+	return DeriveParamsContext(context.Background(), seed, config)
+}
+
+// DeriveParamsContext is like DeriveParamsConfig, but stops generating tables
+// once ctx is done, and returns its error.
+func DeriveParamsContext(ctx context.Context, seed *drbg.Seed, config *Config) (*Params, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return deriveParams(ctx, seed, config)
+}
+
+func deriveParams(ctx context.Context, seed *drbg.Seed, config *Config) (*Params, error) {
+	logger := config.Logger
+	rng, err := get_rng(seed, config.Personalization)
+	if err != nil {
+		return nil, err
+	}
+	p := &Params{seed: seed, personalization: config.Personalization, codec: config.Codec}
+	shape := &config.Shape
+	up, down := &p.c2s, &p.s2c
+
+	up.tableKey = make([]byte, 16)
+	rng.Read(up.tableKey)
+	block, err := aes.NewCipher(up.tableKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// We select the minimal expansion factors
+	// The full range is commented out
+	p.compressedBlockBits = uint64(16) // uint64((rng.Intn(2) + 1) * 8)
+
+	if p.compressedBlockBits == 8 {
+		p.expandedBlockBits = uint64((rng.Intn(6) + 3) * 8)
+		p.expandedBlockBits8 = p.expandedBlockBits
+	} else {
+		p.expandedBlockBits = uint64(shape.ExpandedBlockBits)
+		p.expandedBlockBits8 = p.expandedBlockBits / 2
+	}
+
+	up.bias = shape.bias(rng) // Targeting entropy of 4-7 based on observations
+
+	logParams(logger, "rr: Set bias to %f, compressed block bits to %d, expanded block bits to %d", up.bias, p.compressedBlockBits, p.expandedBlockBits)
+
+	// A registered codec replaces the tables, the rest is derived the
+	// same way.
+	builtin := p.builtin()
+
+	up.tableIV = make([]byte, block.BlockSize())
+	rng.Read(up.tableIV)
+	if builtin {
+		up.tables, err = getTables(ctx, tableProgress(config.TableProgress, 0), p.expandedBlockBits8, p.expandedBlockBits, up.bias, up.tableKey, block, up.tableIV, config.TableDir, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	up.streamIV = make([]byte, block.BlockSize())
+	rng.Read(up.streamIV)
+	down.streamIV = make([]byte, block.BlockSize())
+	rng.Read(down.streamIV)
+	up.drbgKey = make([]byte, drbg.SeedLength)
+	rng.Read(up.drbgKey)
+	down.drbgKey = make([]byte, drbg.SeedLength)
+	rng.Read(down.drbgKey)
+	logger.Debugf("riverrun: Loaded keys properly")
+
+	if up.mss, err = get_mss(seed, config.Personalization, shape); err != nil {
+		return nil, err
+	}
+	up.dev = shape.dev(rng)
+	up.shapeSeed = make([]byte, drbg.SeedLength)
+	rng.Read(up.shapeSeed)
+
+	// The parameters above shape the client to server direction.  The
+	// server to client direction gets its own tables and length
+	// distribution, so that the two flows do not share a signature.  The
+	// block bits are the same for both.
+	down.tableKey = make([]byte, 16)
+	rng.Read(down.tableKey)
+	downBlock, err := aes.NewCipher(down.tableKey)
+	if err != nil {
+		return nil, err
+	}
+	down.bias = shape.bias(rng)
+	down.tableIV = make([]byte, downBlock.BlockSize())
+	rng.Read(down.tableIV)
+	down.mss = shape.mss(rng)
+	down.dev = shape.dev(rng)
+	down.shapeSeed = make([]byte, drbg.SeedLength)
+	rng.Read(down.shapeSeed)
+	logParams(logger, "rr: Set downstream bias to %f", down.bias)
+	if builtin {
+		down.tables, err = getTables(ctx, tableProgress(config.TableProgress, .5), p.expandedBlockBits8, p.expandedBlockBits, down.bias, down.tableKey, downBlock, down.tableIV, config.TableDir, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// tableProgress maps the progress of the tables of one direction to the half
+// of Config.TableProgress starting at base.
+func tableProgress(progress func(fraction float64), base float64) func(fraction float64) {
+	if progress == nil {
+		return nil
+	}
+	return func(fraction float64) { progress(base + fraction/2) }
+}
+
+func (p *Params) builtin() bool {
+	return codecName(p.codec) == CodecCtstretch
+}
+
+// codecName returns the codec selected by Config.Codec.
+func codecName(codec string) string {
+	if codec == "" {
+		return CodecCtstretch
+	}
+	return codec
+}
+
+// AttachConn returns a Conn over conn with the parameters p and the default
+// settings.
+func AttachConn(conn net.Conn, p *Params, isServer bool) (*Conn, error) {
+	return AttachConnConfig(conn, p, isServer, nil)
+}
+
+// AttachConnConfig is like AttachConn, with the optional settings taken from
+// config.  Its Personalization and Codec must be those p was derived with.
+func AttachConnConfig(conn net.Conn, p *Params, isServer bool, config *Config) (*Conn, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.Personalization != p.personalization || codecName(config.Codec) != codecName(p.codec) {
+		return nil, ErrParamsMismatch
+	}
+	return attachConn(conn, p, isServer, config)
+}
+
+// MatchesClient reports whether prefix, the first bytes a client sent, starts
+// with a salt committed to the seed of p.  That needs Config.KeyCommitment on
+// the client, config is the server's otherwise.  A listener serving several
+// seeds can peek ClientPrefixLength bytes off each conn, and attach the
+// Params that match.
+func (p *Params) MatchesClient(prefix []byte, config *Config) (bool, error) {
+	rr, err := p.commitProbe(prefix, config)
+	if err != nil {
+		return false, err
+	}
+	if len(prefix) < len(rr.saltIn) {
+		return false, io.ErrUnexpectedEOF
+	}
+	switch err := rr.readSalt(); err {
+	case nil:
+		return true, nil
+	case ErrKeyCommitment:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// ClientPrefixLength returns the number of bytes MatchesClient checks.
+func (p *Params) ClientPrefixLength(config *Config) (int, error) {
+	rr, err := p.commitProbe(nil, config)
+	if err != nil {
+		return 0, err
+	}
+	return len(rr.saltIn), nil
+}
+
+// commitProbe returns a server Conn reading prefix, with nothing of config
+// that acts outside of it.
+func (p *Params) commitProbe(prefix []byte, config *Config) (*Conn, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	probe := *config
+	probe.KeyCommitment = true
+	probe.KeyLog = nil
+	probe.EntropySelfTest = SelfTestOff
+	probe.Hooks = NopHooks{}
+	probe.OnClose = nil
+	probe.Quota = nil
+	probe.ReadIdleTimeout = 0
+	probe.EchoInterval = 0
+	return attachConn(&prefixConn{r: bytes.NewReader(prefix)}, p, true, &probe)
+}
+
+// prefixConn is a conn that reads r, e.g. bytes peeked off the conn ahead of
+// it, and otherwise acts as the conn.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// MarshalBinary serializes p, tables included, e.g. for worker processes.
+func (p *Params) MarshalBinary() ([]byte, error) {
+	b := append([]byte(paramsMagic), paramsVersion)
+	b = appendString(b, p.personalization)
+	b = appendString(b, p.codec)
+	b = append(b, p.seed.Bytes()[:]...)
+	b = append(b, byte(p.compressedBlockBits), byte(p.expandedBlockBits), byte(p.expandedBlockBits8))
+	for _, d := range []*directionParams{&p.c2s, &p.s2c} {
+		b = append(b, d.tableKey...)
+		b = append(b, d.tableIV...)
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(d.bias))
+		b = append(b, d.streamIV...)
+		b = append(b, d.drbgKey...)
+		b = binary.BigEndian.AppendUint32(b, uint32(d.mss))
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(d.dev))
+		b = append(b, d.shapeSeed...)
+		if d.tables == nil {
+			b = append(b, 0)
+			continue
+		}
+		macKey := tableFileMACKey(d.tableKey)
+		b = append(b, 1)
+		b = appendBytes(b, ctstretch.MarshalTable(d.tables.table8, p.expandedBlockBits8, macKey))
+		b = appendBytes(b, ctstretch.MarshalTable(d.tables.table16, p.expandedBlockBits, macKey))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary restores p from the output of MarshalBinary.
+func (p *Params) UnmarshalBinary(data []byte) error {
+	r := paramsReader{b: data}
+	if string(r.next(len(paramsMagic))) != paramsMagic || r.byte() != paramsVersion {
+		return ErrInvalidParams
+	}
+	var q Params
+	q.personalization = r.string()
+	q.codec = r.string()
+	seed, err := drbg.SeedFromBytes(r.next(drbg.SeedLength))
+	if r.bad || err != nil {
+		return ErrInvalidParams
+	}
+	q.seed = seed
+	q.compressedBlockBits, q.expandedBlockBits, q.expandedBlockBits8 = uint64(r.byte()), uint64(r.byte()), uint64(r.byte())
+	for _, d := range []*directionParams{&q.c2s, &q.s2c} {
+		d.tableKey = r.copy(16)
+		d.tableIV = r.copy(aes.BlockSize)
+		d.bias = math.Float64frombits(r.uint64())
+		d.streamIV = r.copy(aes.BlockSize)
+		d.drbgKey = r.copy(drbg.SeedLength)
+		d.mss = int(r.uint32())
+		d.dev = math.Float64frombits(r.uint64())
+		d.shapeSeed = r.copy(drbg.SeedLength)
+		if r.byte() == 0 || r.bad {
+			continue
+		}
+		macKey := tableFileMACKey(d.tableKey)
+		table8, bits8, err := ctstretch.UnmarshalTable(r.bytes(), macKey)
+		if err != nil {
+			return err
+		}
+		table16, bits16, err := ctstretch.UnmarshalTable(r.bytes(), macKey)
+		if err != nil {
+			return err
+		}
+		if bits8 != q.expandedBlockBits8 || bits16 != q.expandedBlockBits || len(table8) != 256 || len(table16) != 65536 {
+			return ErrInvalidParams
+		}
+		d.tables = &tableSet{table8: table8, table16: table16}
+	}
+	if r.bad || len(r.b) != 0 || (q.builtin() && (q.c2s.tables == nil || q.s2c.tables == nil)) {
+		return ErrInvalidParams
+	}
+	*p = q
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendBytes(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// paramsReader reads the fields of serialized Params.  Reading past the end
+// sets bad and returns nil, or zero for the integers.  Lengths read off the
+// input are never allocated.
+type paramsReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *paramsReader) next(n int) []byte {
+	if r.bad || n < 0 || n > len(r.b) {
+		r.bad = true
+		return nil
+	}
+	res := r.b[:n]
+	r.b = r.b[n:]
+	return res
+}
+
+// fixed is next for the integers, n is at most 8.
+func (r *paramsReader) fixed(n int) []byte {
+	if res := r.next(n); !r.bad {
+		return res
+	}
+	return make([]byte, n)
+}
+
+func (r *paramsReader) copy(n int) []byte {
+	return append([]byte(nil), r.next(n)...)
+}
+
+func (r *paramsReader) byte() byte {
+	return r.fixed(1)[0]
+}
+
+func (r *paramsReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.fixed(2))
+}
+
+func (r *paramsReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.fixed(4))
+}
+
+func (r *paramsReader) uint64() uint64 {
+	return binary.BigEndian.Uint64(r.fixed(8))
+}
+
+func (r *paramsReader) string() string {
+	return string(r.next(int(r.uint16())))
+}
+
+func (r *paramsReader) bytes() []byte {
+	return r.next(int(r.uint32()))
+}
@@ -0,0 +1,164 @@
+package riverrun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+func TestParams(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := DeriveParams(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := params.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(Params)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client from the restored params talks to a server from NewConn.
+	a, b := net.Pipe()
+	client, err := AttachConn(a, restored, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := NewConnConfig(context.Background(), b, true, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	msg := []byte("derived once")
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+
+	if _, err := AttachConnConfig(a, params, false, &Config{Personalization: "other"}); !errors.Is(err, ErrParamsMismatch) {
+		t.Fatalf("got %v, want ErrParamsMismatch", err)
+	}
+	for _, bad := range [][]byte{data[:len(data)-1], append(data, 0), []byte("rrparams")} {
+		if err := new(Params).UnmarshalBinary(bad); err == nil {
+			t.Errorf("%d bytes accepted", len(bad))
+		}
+	}
+	data[len(data)-1] ^= 1
+	if err := new(Params).UnmarshalBinary(data); err == nil {
+		t.Error("corrupted table accepted")
+	}
+}
+
+func TestKeyCommitment(t *testing.T) {
+	config := &Config{KeyCommitment: true}
+	client, server := newTestPair(t, config, config)
+	go client.Write([]byte("committed"))
+	if _, err := io.ReadFull(server, make([]byte, 9)); err != nil {
+		t.Fatal(err)
+	}
+
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := DeriveParams(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	need, err := params.ClientPrefixLength(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer b.Close()
+	client, err = AttachConnConfig(a, params, false, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Write([]byte("x"))
+	prefix := make([]byte, need)
+	if _, err := io.ReadFull(b, prefix); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := params.MatchesClient(prefix, nil); !ok || err != nil {
+		t.Fatalf("own prefix: got %v, %v", ok, err)
+	}
+	if _, err := params.MatchesClient(prefix[:need-1], nil); err != io.ErrUnexpectedEOF {
+		t.Fatalf("short prefix: got %v", err)
+	}
+	prefix[0] ^= 1
+	if ok, err := params.MatchesClient(prefix, nil); ok || err != nil {
+		t.Fatalf("corrupted prefix: got %v, %v", ok, err)
+	}
+}
+
+func TestDeriveParamsContext(t *testing.T) {
+	// A fresh seed, so that the tables are not cached.
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var last float64
+	config := &Config{TableProgress: func(fraction float64) {
+		if fraction < last || fraction > 1 {
+			t.Errorf("progress went from %f to %f", last, fraction)
+		}
+		last = fraction
+		if fraction > .25 {
+			cancel()
+		}
+	}}
+	if _, err := DeriveParamsContext(ctx, seed, config); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if last > .5 {
+		t.Errorf("cancelled late, at %f", last)
+	}
+
+	last = 0
+	if _, err := DeriveParamsContext(context.Background(), seed, config); err != nil {
+		t.Fatal(err)
+	}
+	if last != 1 {
+		t.Errorf("progress ended at %f", last)
+	}
+}
+
+func TestParamsReaderTruncated(t *testing.T) {
+	// A length of 4 GiB ahead of nothing.
+	data := []byte{0xff, 0xff, 0xff, 0xff}
+	allocs := testing.AllocsPerRun(10, func() {
+		r := paramsReader{b: data}
+		if b := r.bytes(); b != nil || !r.bad {
+			t.Fatalf("got %d bytes, bad %v", len(b), r.bad)
+		}
+		if r.uint64() != 0 {
+			t.Fatal("integer past the end is not zero")
+		}
+	})
+	if allocs > 1 {
+		t.Fatalf("%v allocations per truncated read", allocs)
+	}
+	if err := new(Params).UnmarshalBinary(append([]byte(paramsMagic), paramsVersion, 0xff, 0xff)); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("got %v, want ErrInvalidParams", err)
+	}
+}
@@ -0,0 +1,119 @@
+package riverrun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	f "github.com/v2fly/riverrun/common/framing"
+)
+
+// parallelMinFrames is the smallest write worth splitting across workers.
+const parallelMinFrames = 8
+
+// shuffleCost is the keystream BitShuffle draws for a block of bits bits:
+// two 8 byte words for every bit but the last.  UniformSample draws more in
+// the rare case of a rejection, the pipeline checks for that.
+func shuffleCost(bits uint64) uint64 {
+	return (bits - 1) * 16
+}
+
+// parallelFrame is one frame of a write split across workers.
+type parallelFrame struct {
+	pkt    []byte
+	length uint16
+	offset uint64
+	cost   uint64
+
+	out  []byte
+	used uint64
+	err  error
+}
+
+// chopParallel is like Chop for payload, but expands the frames on workers
+// goroutines.  Every frame draws from its own stream, started at the
+// keystream offset the frame would have had in a serial encode, so the
+// output is the same.  This needs the keystream use to be known ahead, so
+// only the built-in codec is parallelized.
+func (encoder *riverrunEncoder) chopParallel(b []byte, workers int) (frameBuf bytes.Buffer, n int, err error) {
+	stream, ok := encoder.writeStream.(*seekableCTR)
+	codec, builtin := encoder.codec.(*ctstretchCodec)
+	maxLen := encoder.MaxPacketPayloadLength
+	nFrames := (len(b) + maxLen - 1) / maxLen
+	if !ok || !builtin || nFrames < parallelMinFrames {
+		return encoder.Chop(b, PacketTypePayload)
+	}
+
+	// Packet types, length masks and offsets are sequential and cheap.
+	frames := make([]parallelFrame, nFrames)
+	offset := stream.offset
+	for i := range frames {
+		end := (i + 1) * maxLen
+		if end > len(b) {
+			end = len(b)
+		}
+		pkt := encoder.makePayload(PacketTypePayload, b[i*maxLen:end])
+		length := encoder.MaskedHeader(uint16(len(pkt)+encoder.payloadOverhead(len(pkt))), pkt)
+		cost := codec.expandCost(f.LengthLength) + codec.expandCost(len(pkt))
+		frames[i] = parallelFrame{pkt: pkt, length: length, offset: offset, cost: cost}
+		offset += cost
+	}
+
+	next := make(chan int, nFrames)
+	for i := range frames {
+		next <- i
+	}
+	close(next)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fr := &frames[i]
+				s := stream.at(fr.offset)
+				encoder.expandFrame(fr, s)
+				s.release()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range frames {
+		if frames[i].err == nil && frames[i].used != frames[i].cost {
+			// A rejection shifted the keystream, redo the rest serially.
+			s := stream.at(frames[i].offset)
+			for j := i; j < len(frames); j++ {
+				encoder.expandFrame(&frames[j], s)
+			}
+			offset = s.offset
+			s.release()
+			break
+		}
+	}
+	for i := range frames {
+		if frames[i].err != nil {
+			return frameBuf, 0, frames[i].err
+		}
+		frameBuf.Write(frames[i].out)
+		if encoder.OnPacket != nil {
+			encoder.OnPacket(len(frames[i].out))
+		}
+		n += len(frames[i].pkt) - f.TypeLength
+	}
+	stream.seek(offset)
+	return
+}
+
+// expandFrame expands the length and packet of fr with s.
+func (encoder *riverrunEncoder) expandFrame(fr *parallelFrame, s *seekableCTR) {
+	start := s.offset
+	var lengthBytes [f.LengthLength]byte
+	binary.BigEndian.PutUint16(lengthBytes[:], fr.length)
+	fr.out = make([]byte, encoder.LengthLength+len(fr.pkt)+encoder.payloadOverhead(len(fr.pkt)))
+	fr.err = encoder.codec.Expand(fr.out[:encoder.LengthLength], lengthBytes[:], s)
+	if fr.err == nil {
+		fr.err = encoder.codec.Expand(fr.out[encoder.LengthLength:], fr.pkt, s)
+	}
+	fr.used = s.offset - start
+}
@@ -0,0 +1,84 @@
+package riverrun
+
+import (
+	"bytes"
+	"crypto/aes"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func TestSeekableCTR(t *testing.T) {
+	block, _ := aes.NewCipher(make([]byte, 16))
+	iv := bytes.Repeat([]byte{0xff}, aes.BlockSize)
+	iv[0] = 0
+	want := make([]byte, 1000)
+	newSeekableCTR(block, iv, 0).XORKeyStream(want, want)
+	for _, lookahead := range []int{0, 7, 64, 4096} {
+		s := newSeekableCTR(block, iv, lookahead)
+		// Draw in odd sizes to cross buffer boundaries.
+		got := make([]byte, len(want))
+		for i := 0; i < len(got); i += 9 {
+			end := i + 9
+			if end > len(got) {
+				end = len(got)
+			}
+			s.XORKeyStream(got[i:end], got[i:end])
+		}
+		if !bytes.Equal(got, want) || s.offset != uint64(len(want)) {
+			t.Fatalf("lookahead %d: keystream differs", lookahead)
+		}
+		for _, offset := range []uint64{0, 1, 15, 16, 17, 500, 999} {
+			got := make([]byte, 1000-offset)
+			s.at(offset).XORKeyStream(got, got)
+			if !bytes.Equal(got, want[offset:]) {
+				t.Fatalf("lookahead %d: keystream at %d differs", lookahead, offset)
+			}
+		}
+	}
+}
+
+func TestParallelRoundTrip(t *testing.T) {
+	client, server := newTestPair(t, &Config{EncodeWorkers: 4}, nil)
+	for _, l := range []int{100, 721 * parallelMinFrames, 200001} {
+		msg := make([]byte, l)
+		for i := range msg {
+			msg[i] = byte(i * 13)
+		}
+		go client.Write(msg)
+		got := make([]byte, l)
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("length %d: payload mismatch", l)
+		}
+	}
+}
+
+func BenchmarkChop(b *testing.B) {
+	msg := make([]byte, 64<<10)
+	workers := runtime.GOMAXPROCS(0)
+	if workers < 2 {
+		workers = 2
+	}
+	client, _ := newTestPair(b, nil, nil)
+
+	b.Run("serial", func(b *testing.B) {
+		b.SetBytes(int64(len(msg)))
+		for i := 0; i < b.N; i++ {
+			if _, _, err := client.Encoder.Chop(msg, PacketTypePayload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run(fmt.Sprintf("parallel-%d", workers), func(b *testing.B) {
+		b.SetBytes(int64(len(msg)))
+		for i := 0; i < b.N; i++ {
+			if _, _, err := client.Encoder.chopParallel(msg, workers); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,119 @@
+// Package connwrap adapts riverrun to proxy frameworks, e.g. gost, that chain
+// connection wrappers of the form func(net.Conn) (net.Conn, error).  The
+// framework dials or accepts the carrier itself and hands it to the wrapper
+// of its side.
+//
+// Wrappers are built from an option string in the SIP003 syntax, so the same
+// string works for the plugin and for a framework:
+//
+//	seed=<hex>;profile=<name>;personalization=<string>;codec=<name>;loglevel=<level>
+//
+// Only the seed is required.
+package connwrap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/common/log"
+	"github.com/v2fly/riverrun/plugin/sip003"
+)
+
+// Name is the name riverrun is registered under.
+const Name = "riverrun"
+
+// Wrapper turns a carrier into a tunnel connection.
+type Wrapper func(net.Conn) (net.Conn, error)
+
+// Factory builds the client and server wrappers of an option string.
+type Factory func(options string) (client, server Wrapper, err error)
+
+var (
+	lock      sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+func init() {
+	Register(Name, Parse)
+}
+
+// Register makes a wrapper factory available by name.  It panics if name is
+// already registered.
+func Register(name string, factory Factory) {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("connwrap: %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Lookup returns the factory registered as name.
+func Lookup(name string) (Factory, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	factory, ok := factories[name]
+	return factory, ok
+}
+
+// Names returns the registered names, sorted.
+func Names() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse returns the riverrun wrappers described by options.
+func Parse(options string) (client, server Wrapper, err error) {
+	opts, err := sip003.ParseOptions(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	seedHex := opts.Get("seed", "")
+	if seedHex == "" {
+		return nil, nil, fmt.Errorf("connwrap: missing seed option")
+	}
+	seed, err := drbg.SeedFromHex(seedHex)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := riverrun.LookupProfile(opts.Get("profile", ""))
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.Logger, err = log.NewLogger(opts.Get("loglevel", "none")); err != nil {
+		return nil, nil, err
+	}
+	config.Personalization = opts.Get("personalization", "")
+	if codec := opts.Get("codec", ""); codec != "" {
+		config.Codec = codec
+	}
+	client, server = New(seed, config)
+	return client, server, nil
+}
+
+// New returns the wrappers for seed and config.  A wrapper that fails to set
+// up the connection closes the carrier.
+func New(seed *drbg.Seed, config *riverrun.Config) (client, server Wrapper) {
+	wrap := func(isServer bool) Wrapper {
+		return func(conn net.Conn) (net.Conn, error) {
+			rr, err := riverrun.NewConnConfig(context.Background(), conn, isServer, seed, config)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return rr, nil
+		}
+	}
+	return wrap(false), wrap(true)
+}
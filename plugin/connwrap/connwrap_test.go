@@ -0,0 +1,52 @@
+package connwrap
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWrappers(t *testing.T) {
+	factory, ok := Lookup(Name)
+	if !ok {
+		t.Fatal("riverrun not registered")
+	}
+	client, server, err := factory("seed=000102030405060708090a0b0c0d0e0f1011121314151617;personalization=example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, err := server(b)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- conn
+	}()
+	cc, err := client(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	sc := <-done
+	if sc == nil {
+		return
+	}
+	defer sc.Close()
+
+	msg := []byte("through the chain")
+	go cc.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(sc, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+
+	if _, _, err := Parse("profile=default"); err == nil {
+		t.Error("options without a seed accepted")
+	}
+}
@@ -0,0 +1,156 @@
+// Package sip003 implements the environment variable protocol Shadowsocks
+// uses to configure plugin processes (SIP003).
+package sip003
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	envRemoteHost    = "SS_REMOTE_HOST"
+	envRemotePort    = "SS_REMOTE_PORT"
+	envLocalHost     = "SS_LOCAL_HOST"
+	envLocalPort     = "SS_LOCAL_PORT"
+	envPluginOptions = "SS_PLUGIN_OPTIONS"
+)
+
+// ErrNotPlugin is the error returned when the process was not started by a
+// SIP003 host.
+var ErrNotPlugin = errors.New("sip003: plugin environment variables not set")
+
+// Options are the parsed SS_PLUGIN_OPTIONS.  Keys given without a value (flags)
+// map to the empty string.
+type Options map[string]string
+
+// Has reports whether the option is present.
+func (opts Options) Has(key string) bool {
+	_, ok := opts[key]
+	return ok
+}
+
+// Get returns the value of the option, or def if it is absent.
+func (opts Options) Get(key, def string) string {
+	if v, ok := opts[key]; ok {
+		return v
+	}
+	return def
+}
+
+// Args holds the plugin configuration passed by the Shadowsocks host.
+//
+// On the client, Local is where the plugin listens for ss-local and Remote is
+// the server.  On the server, Remote is the public address the plugin listens
+// on and Local is where ss-server is reachable.
+type Args struct {
+	RemoteHost string
+	RemotePort string
+	LocalHost  string
+	LocalPort  string
+	Options    Options
+}
+
+// RemoteAddrs returns the remote host:port pairs.  SS_REMOTE_HOST may hold a
+// comma separated list of hosts.
+func (args *Args) RemoteAddrs() []string {
+	var addrs []string
+	for _, host := range strings.Split(args.RemoteHost, ",") {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSpace(host), args.RemotePort))
+	}
+	return addrs
+}
+
+// LocalAddr returns the local host:port pair.
+func (args *Args) LocalAddr() string {
+	return net.JoinHostPort(args.LocalHost, args.LocalPort)
+}
+
+// ParseEnv reads the plugin configuration from the process environment.
+func ParseEnv() (*Args, error) {
+	return Parse(os.Getenv)
+}
+
+// Parse reads the plugin configuration using getenv.
+func Parse(getenv func(string) string) (*Args, error) {
+	args := &Args{
+		RemoteHost: getenv(envRemoteHost),
+		RemotePort: getenv(envRemotePort),
+		LocalHost:  getenv(envLocalHost),
+		LocalPort:  getenv(envLocalPort),
+	}
+	if args.RemoteHost == "" && args.RemotePort == "" && args.LocalHost == "" && args.LocalPort == "" {
+		return nil, ErrNotPlugin
+	}
+	for name, v := range map[string]string{
+		envRemoteHost: args.RemoteHost,
+		envRemotePort: args.RemotePort,
+		envLocalHost:  args.LocalHost,
+		envLocalPort:  args.LocalPort,
+	} {
+		if v == "" {
+			return nil, fmt.Errorf("sip003: %s is not set", name)
+		}
+	}
+
+	var err error
+	if args.Options, err = ParseOptions(getenv(envPluginOptions)); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// ParseOptions parses a SIP003 option string of the form "k1=v1;k2;k3=v3".
+// A backslash escapes the following character, so "\;", "\=" and "\\" can be
+// used within keys and values.
+func ParseOptions(s string) (Options, error) {
+	opts := make(Options)
+	var key, cur strings.Builder
+	haveKey := false
+
+	flush := func() error {
+		k, v := key.String(), cur.String()
+		if !haveKey {
+			k, v = v, ""
+		}
+		key.Reset()
+		cur.Reset()
+		haveKey = false
+		if k == "" {
+			if v != "" {
+				return fmt.Errorf("sip003: option with empty key")
+			}
+			return nil
+		}
+		opts[k] = v
+		return nil
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			i++
+			if i == len(s) {
+				return nil, fmt.Errorf("sip003: trailing backslash in options")
+			}
+			cur.WriteByte(s[i])
+		case c == '=' && !haveKey:
+			key.WriteString(cur.String())
+			cur.Reset()
+			haveKey = true
+		case c == ';':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
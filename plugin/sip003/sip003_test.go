@@ -0,0 +1,58 @@
+package sip003
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Options
+	}{
+		{"", Options{}},
+		{"server", Options{"server": ""}},
+		{"seed=abcd;profile=checked;server", Options{"seed": "abcd", "profile": "checked", "server": ""}},
+		{`a=x\;y;b=c\=d;e=f\\`, Options{"a": "x;y", "b": "c=d", "e": `f\`}},
+		{"a=b=c;;", Options{"a": "b=c"}},
+	} {
+		got, err := ParseOptions(tc.in)
+		if err != nil {
+			t.Errorf("ParseOptions(%q): %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseOptions(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{`a=b\`, "=b"} {
+		if _, err := ParseOptions(in); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded", in)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	env := map[string]string{
+		"SS_REMOTE_HOST":    "0.0.0.0,::",
+		"SS_REMOTE_PORT":    "8388",
+		"SS_LOCAL_HOST":     "127.0.0.1",
+		"SS_LOCAL_PORT":     "1080",
+		"SS_PLUGIN_OPTIONS": "server",
+	}
+	args, err := Parse(func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0.0.0.0:8388", "[::]:8388"}; !reflect.DeepEqual(args.RemoteAddrs(), want) {
+		t.Errorf("RemoteAddrs() = %v, want %v", args.RemoteAddrs(), want)
+	}
+	if args.LocalAddr() != "127.0.0.1:1080" || !args.Options.Has("server") {
+		t.Errorf("unexpected args: %+v", args)
+	}
+
+	if _, err = Parse(func(string) string { return "" }); err != ErrNotPlugin {
+		t.Errorf("Parse with empty environment returned %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package riverrun
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// probeRounds is the number of echo pairs a probe sends, a small one
+	// for the round trip and a full one for the goodput.
+	probeRounds = 4
+	// probeResend is the time after which a probe echo is sent again, as a
+	// peer busy with a reply drops further echoes.
+	probeResend = time.Second
+)
+
+// ProbeResult is the health of a Conn measured by Probe.
+type ProbeResult struct {
+	// RTT is the quickest round trip of a small echo.
+	RTT time.Duration
+	// Goodput is the rate of full echoes in bytes per second, both ways
+	// counted.  A round trip at a time, it tells paths apart rather than
+	// measures their capacity.
+	Goodput float64
+	// Bytes is the echo body sent and received.
+	Bytes int
+}
+
+// Probe measures the round trip and goodput through rr with a few timed
+// echoes, small and full sized, on top of its traffic.  The replies are taken
+// in by Read, so rr must be read meanwhile, as a relay does.  The peer must
+// understand echoes, see Echo.  Probes of a Conn run one at a time.
+func (rr *Conn) Probe(ctx context.Context) (ProbeResult, error) {
+	rr.probeLock.Lock()
+	defer rr.probeLock.Unlock()
+	replies := make(chan uint64, 1)
+	rr.probeReplies.Store(&replies)
+	defer rr.probeReplies.Store(nil)
+
+	var res ProbeResult
+	var busy time.Duration
+	full := rr.Encoder.MaxPacketPayloadLength
+	for i := 0; i < probeRounds; i++ {
+		rtt, err := rr.probeEcho(ctx, replies, echoLength)
+		if err != nil {
+			return ProbeResult{}, err
+		}
+		if res.RTT == 0 || rtt < res.RTT {
+			res.RTT = rtt
+		}
+		elapsed, err := rr.probeEcho(ctx, replies, full)
+		if err != nil {
+			return ProbeResult{}, err
+		}
+		busy += elapsed
+		res.Bytes += 2 * (echoLength + full)
+	}
+	res.Goodput = float64(res.Bytes-2*probeRounds*echoLength) / busy.Seconds()
+	return res, nil
+}
+
+// probeEcho sends an echo with a body of size and returns the time to its
+// reply.
+func (rr *Conn) probeEcho(ctx context.Context, replies chan uint64, size int) (time.Duration, error) {
+	resend := time.NewTimer(probeResend)
+	defer resend.Stop()
+	for {
+		body := make([]byte, size)
+		stamp := uint64(time.Since(rr.created))
+		binary.BigEndian.PutUint64(body, stamp)
+		if err := rr.writeControl(PacketTypeEcho, body); err != nil {
+			return 0, err
+		}
+		resend.Reset(probeResend)
+	wait:
+		for {
+			select {
+			case got := <-replies:
+				if got == stamp {
+					return time.Since(rr.created) - time.Duration(stamp), nil
+				}
+			case <-resend.C:
+				break wait
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-rr.ctx.Done():
+				return 0, net.ErrClosed
+			}
+		}
+	}
+}
+
+// EndpointProbe is the probe of an endpoint by MultiDialer.Probe.
+type EndpointProbe struct {
+	Endpoint Endpoint
+	Result   ProbeResult
+	Err      error
+}
+
+// Probe connects to every endpoint in turn, probes the connection and closes
+// it.  The servers connect to their targets meanwhile, as for any client.
+func (d *MultiDialer) Probe(ctx context.Context) []EndpointProbe {
+	dial := d.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	probes := make([]EndpointProbe, len(d.Endpoints))
+	for i, ep := range d.Endpoints {
+		probes[i].Endpoint = ep
+		rr, err := d.dialEndpoint(ctx, dial, ep)
+		if err == nil {
+			probes[i].Result, err = probeIdle(ctx, rr)
+		}
+		probes[i].Err = err
+	}
+	return probes
+}
+
+// Prefer reorders the endpoints by health, those probed without error first,
+// by round trip and then goodput, in the order of probes.
+func (d *MultiDialer) Prefer(probes []EndpointProbe) {
+	probes = append([]EndpointProbe(nil), probes...)
+	sort.SliceStable(probes, func(i, j int) bool {
+		a, b := probes[i], probes[j]
+		if (a.Err == nil) != (b.Err == nil) {
+			return a.Err == nil
+		}
+		if a.Result.RTT != b.Result.RTT {
+			return a.Result.RTT < b.Result.RTT
+		}
+		return a.Result.Goodput > b.Result.Goodput
+	})
+	endpoints := make([]Endpoint, len(probes))
+	for i, p := range probes {
+		endpoints[i] = p.Endpoint
+	}
+	d.Endpoints = endpoints
+}
+
+// probeIdle probes rr, which nothing else reads, discarding what it reads
+// meanwhile, and closes it.
+func probeIdle(ctx context.Context, rr *Conn) (ProbeResult, error) {
+	defer rr.Close()
+	go io.Copy(io.Discard, rr)
+	return rr.Probe(ctx)
+}
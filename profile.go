@@ -0,0 +1,197 @@
+package riverrun
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	f "github.com/v2fly/riverrun/common/framing"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultProfile is the name of the profile matching NewConn.
+const DefaultProfile = "default"
+
+// profiles are the named Config presets selectable by name from command
+// lines and plugin options.
+var profiles = map[string]Config{
+	DefaultProfile: {},
+	"checked":      {EntropySelfTest: SelfTestFail},
+}
+
+// LookupProfile returns a copy of the named Config preset.  An empty name
+// selects DefaultProfile.
+func LookupProfile(name string) (*Config, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	config, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("riverrun: unknown profile %q", name)
+	}
+	return &config, nil
+}
+
+// ProfileNames returns the sorted names of the built-in profiles.
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ProfileVersion is the schema version of profile files written for this
+// version of riverrun.
+const ProfileVersion = 1
+
+// ErrProfileVersion is the error returned for a profile file of a missing or
+// newer schema version.
+var ErrProfileVersion = errors.New("riverrun: unsupported profile version")
+
+// profileFile is the schema of a profile file, in YAML or JSON:
+//
+//	version: 1
+//	base: default           # built-in profile the file starts from
+//	shape:
+//	  bias_min: 0.1         # table bias band, see Shape
+//	  bias_max: 0.3
+//	  block_bits: 32        # 32, 48 or 64
+//	  mss_min: 600          # chunk length model
+//	  mss_max: 1400
+//	  mss_dev_max: 4
+//	iat:
+//	  mode: paced           # none, paced or batched
+//	  rate: 1048576         # paced: bytes per second
+//	  burst: 65536          # paced: bucket size in bytes
+//	  delay: 5ms            # batched: hold time
+//	  max_bytes: 16384      # batched: bytes released at once
+//	padding:
+//	  on_flush: true        # see Config.PadOnFlush
+//
+// Omitted settings keep those of the base profile.
+type profileFile struct {
+	Version int    `yaml:"version"`
+	Base    string `yaml:"base"`
+	Shape   struct {
+		BiasMin   *float64 `yaml:"bias_min"`
+		BiasMax   *float64 `yaml:"bias_max"`
+		BlockBits *int     `yaml:"block_bits"`
+		MSSMin    *int     `yaml:"mss_min"`
+		MSSMax    *int     `yaml:"mss_max"`
+		MSSDevMax *float64 `yaml:"mss_dev_max"`
+	} `yaml:"shape"`
+	IAT struct {
+		Mode     string        `yaml:"mode"`
+		Rate     float64       `yaml:"rate"`
+		Burst    int           `yaml:"burst"`
+		Delay    time.Duration `yaml:"delay"`
+		MaxBytes int           `yaml:"max_bytes"`
+	} `yaml:"iat"`
+	Padding struct {
+		OnFlush *bool `yaml:"on_flush"`
+	} `yaml:"padding"`
+}
+
+// ParseProfile returns the Config described by a profile file, see
+// LoadProfile.
+func ParseProfile(data []byte) (*Config, error) {
+	var file profileFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("riverrun: invalid profile: %w", err)
+	}
+	if file.Version < 1 || file.Version > ProfileVersion {
+		return nil, fmt.Errorf("%w: %d", ErrProfileVersion, file.Version)
+	}
+	config, err := LookupProfile(file.Base)
+	if err != nil {
+		return nil, err
+	}
+
+	shape := &file.Shape
+	setFloat(&config.Shape.BiasMin, shape.BiasMin)
+	setFloat(&config.Shape.BiasMax, shape.BiasMax)
+	setInt(&config.Shape.ExpandedBlockBits, shape.BlockBits)
+	setInt(&config.Shape.MSSMin, shape.MSSMin)
+	setInt(&config.Shape.MSSMax, shape.MSSMax)
+	setFloat(&config.Shape.MSSDevMax, shape.MSSDevMax)
+	if scheduler, err := file.scheduler(); err != nil {
+		return nil, err
+	} else if scheduler != nil {
+		config.Scheduler = scheduler
+	}
+	if file.Padding.OnFlush != nil {
+		config.PadOnFlush = *file.Padding.OnFlush
+	}
+
+	if err := config.withDefaults().validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func setFloat(dst *float64, v *float64) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setInt(dst *int, v *int) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// scheduler returns the SchedulerFactory of the iat section, nil if it is
+// left out.
+func (file *profileFile) scheduler() (SchedulerFactory, error) {
+	iat := &file.IAT
+	switch iat.Mode {
+	case "":
+		return nil, nil
+	case "none":
+		return ImmediateScheduler(), nil
+	case "paced":
+		if iat.Rate <= 0 || iat.Burst < 0 {
+			return nil, fmt.Errorf("riverrun: invalid paced iat: rate %f, burst %d", iat.Rate, iat.Burst)
+		}
+		burst := iat.Burst
+		if burst == 0 {
+			burst = f.MaximumSegmentLength
+		}
+		return PacedScheduler(iat.Rate, burst), nil
+	case "batched":
+		if iat.Delay <= 0 || iat.MaxBytes < 0 {
+			return nil, fmt.Errorf("riverrun: invalid batched iat: delay %s, max bytes %d", iat.Delay, iat.MaxBytes)
+		}
+		maxBytes := iat.MaxBytes
+		if maxBytes == 0 {
+			maxBytes = f.MaximumSegmentLength
+		}
+		return BatchedScheduler(iat.Delay, maxBytes), nil
+	default:
+		return nil, fmt.Errorf("riverrun: unknown iat mode %q", iat.Mode)
+	}
+}
+
+// LoadProfile reads a profile file, YAML or JSON, and returns the validated
+// Config it describes.  Operators can ship tuned shaping that way instead of
+// flags.  The file has a schema version, and settings it leaves out keep
+// those of its base profile, DefaultProfile unless it names one.
+func LoadProfile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseProfile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,81 @@
+package riverrun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProfile(t *testing.T) {
+	yamlProfile := `
+version: 1
+base: checked
+shape:
+  bias_min: 0.2
+  bias_max: 0.25
+  block_bits: 48
+  mss_min: 900
+  mss_max: 1000
+iat:
+  mode: batched
+  delay: 2ms
+padding:
+  on_flush: true
+`
+	path := filepath.Join(t.TempDir(), "tuned.yaml")
+	if err := os.WriteFile(path, []byte(yamlProfile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Shape{BiasMin: .2, BiasMax: .25, ExpandedBlockBits: 48, MSSMin: 900, MSSMax: 1000}
+	if config.Shape != want || config.EntropySelfTest != SelfTestFail || !config.PadOnFlush || config.Scheduler == nil {
+		t.Fatalf("got %+v", config)
+	}
+
+	client, server := newTestPair(t, config, config)
+	if client.bias < .2 || client.bias >= .25 || client.mss_max < 900 || client.mss_max >= 1000 {
+		t.Errorf("bias %f, mss_max %d outside the profile", client.bias, client.mss_max)
+	}
+	msg := bytes.Repeat([]byte("profile "), 500)
+	go func() {
+		client.Write(msg)
+		client.Flush()
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	go drain(server)
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+
+	if config, err := ParseProfile([]byte(`{"version": 1, "iat": {"mode": "paced", "rate": 1e6}}`)); err != nil || config.Scheduler == nil {
+		t.Errorf("JSON profile: got %+v, %v", config, err)
+	}
+	for _, bad := range []string{
+		`shape: {bias_min: 0.2}`,
+		`{"version": 2}`,
+	} {
+		if _, err := ParseProfile([]byte(bad)); !errors.Is(err, ErrProfileVersion) {
+			t.Errorf("%s: got %v, want ErrProfileVersion", bad, err)
+		}
+	}
+	for _, bad := range []string{
+		"version: 1\nshape: {bias: 0.2}",
+		"version: 1\nshape: {block_bits: 40}",
+		"version: 1\nshape: {mss_min: 1000, mss_max: 900}",
+		"version: 1\niat: {mode: jittered}",
+		"version: 1\nbase: unknown",
+	} {
+		if _, err := ParseProfile([]byte(bad)); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
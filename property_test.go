@@ -0,0 +1,90 @@
+package riverrun
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/common/fte"
+)
+
+// propertySeed seeds TestRoundTripProperties.  It is fixed, so that runs
+// repeat, and can be set for exploring others, as in go test -run
+// Properties -property.seed 42.
+var propertySeed = flag.Int64("property.seed", 1, "seed of the random connection seeds and payloads of TestRoundTripProperties")
+
+// TestRoundTripProperties writes payloads of awkward sizes over connections
+// with random seeds, and so random biases and shapes, through every codec
+// and write path.  The seed of the run is logged for reproducing failures.
+func TestRoundTripProperties(t *testing.T) {
+	runs := 3
+	if testing.Short() {
+		runs = 1
+	}
+	t.Logf("random seed %d", *propertySeed)
+	rng := rand.New(rand.NewSource(*propertySeed))
+
+	for i := 0; i < runs; i++ {
+		raw := make([]byte, drbg.SeedLength)
+		rng.Read(raw)
+		seed, err := drbg.SeedFromBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, config := range []*Config{
+			{},
+			{EncodeWorkers: 3},
+			{Compression: CompressionSnappy},
+			{DisableLengthShaping: true},
+			{Codec: fte.CodecBase64},
+		} {
+			a, b := net.Pipe()
+			client, err := NewConnConfig(context.Background(), a, false, seed, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := NewConnConfig(context.Background(), b, true, seed, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			max := client.Encoder.MaxPacketPayloadLength
+			var sent []byte
+			var payloads [][]byte
+			for _, n := range []int{0, 1, 2, max - 1, max, max + 1, 2*max + 1, rng.Intn(64 * 1024)} {
+				p := make([]byte, n)
+				rng.Read(p)
+				payloads = append(payloads, p)
+				sent = append(sent, p...)
+			}
+			errs := make(chan error, 1)
+			go func() {
+				for _, p := range payloads {
+					if n, err := client.Write(p); err != nil || n != len(p) {
+						errs <- fmt.Errorf("wrote %d of %d: %v", n, len(p), err)
+						return
+					}
+				}
+				errs <- nil
+			}()
+			got := make([]byte, len(sent))
+			if _, err := io.ReadFull(server, got); err != nil {
+				t.Fatalf("run %d, %+v: %s", i, config, err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatalf("run %d, %+v: write: %v", i, config, err)
+			}
+			if !bytes.Equal(got, sent) {
+				t.Fatalf("run %d, %+v: round trip mismatch", i, config)
+			}
+			client.Close()
+			server.Close()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package riverrun
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+var (
+	// ErrQuotaExceeded is the error returned by TransferQuota once the
+	// transfer cap is used up.
+	ErrQuotaExceeded = errors.New("riverrun: transfer quota exceeded")
+	// ErrQuotaExpired is the error returned by TransferQuota after its
+	// expiry.
+	ErrQuotaExpired = errors.New("riverrun: quota expired")
+)
+
+// Quota accounts the traffic of one user, i.e. one seed, across all of its
+// connections.  Account is called with the wire bytes of every carrier read
+// and ahead of every carrier write, and concurrently from all connections
+// sharing the Quota.  An error closes the connection and is returned by the
+// Read or Write, an error for zero bytes fails NewConnConfig.
+type Quota interface {
+	Account(in, out uint64) error
+}
+
+// TransferQuota is a Quota with an optional cap on the bytes transferred in
+// both directions, and an optional expiry.  The zero value only counts.
+type TransferQuota struct {
+	// Limit caps the wire bytes read and written, zero for no cap.
+	Limit uint64
+	// Expiry, if set, is when the quota stops admitting traffic.
+	Expiry time.Time
+
+	in, out atomic.Uint64
+}
+
+func (q *TransferQuota) Account(in, out uint64) error {
+	if !q.Expiry.IsZero() && !time.Now().Before(q.Expiry) {
+		return ErrQuotaExpired
+	}
+	total := q.in.Add(in) + q.out.Add(out)
+	if q.Limit > 0 && total > q.Limit {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Usage returns the wire bytes read and written so far.
+func (q *TransferQuota) Usage() (in, out uint64) {
+	return q.in.Load(), q.out.Load()
+}
+
+// Reset clears the usage, e.g. at the start of a billing period.
+func (q *TransferQuota) Reset() {
+	q.in.Store(0)
+	q.out.Store(0)
+}
+
+// Accounts holds the TransferQuota of every seed of a multi-user server, for
+// the Config of each user's Listener.
+type Accounts struct {
+	lock   sync.Mutex
+	quotas map[[drbg.SeedLength]byte]*TransferQuota
+}
+
+// Quota returns the quota of seed, a fresh zero TransferQuota the first time.
+func (a *Accounts) Quota(seed *drbg.Seed) *TransferQuota {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.quotas == nil {
+		a.quotas = make(map[[drbg.SeedLength]byte]*TransferQuota)
+	}
+	key := *seed.Bytes()
+	q, ok := a.quotas[key]
+	if !ok {
+		q = new(TransferQuota)
+		a.quotas[key] = q
+	}
+	return q
+}
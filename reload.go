@@ -0,0 +1,77 @@
+package riverrun
+
+import (
+	"reflect"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// ConfigChanges returns the names of the settings that differ between old and
+// new, in the order of the Config fields, after filling in the defaults of
+// either.  Settings held in functions, Scheduler and the callbacks, cannot be
+// compared and count as changed unless both are unset.
+func ConfigChanges(old, new *Config) []string {
+	rawA, rawB := reflect.ValueOf(old.withRaw()).Elem(), reflect.ValueOf(new.withRaw()).Elem()
+	a, b := reflect.ValueOf(old.withDefaults()).Elem(), reflect.ValueOf(new.withDefaults()).Elem()
+	var changed []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		x, y := a.Field(i), b.Field(i)
+		if field.Type.Kind() == reflect.Func {
+			if !rawA.Field(i).IsNil() || !rawB.Field(i).IsNil() {
+				changed = append(changed, field.Name)
+			}
+		} else if !reflect.DeepEqual(x.Interface(), y.Interface()) {
+			changed = append(changed, field.Name)
+		}
+	}
+	return changed
+}
+
+// withRaw returns config, or an empty one for nil.
+func (config *Config) withRaw() *Config {
+	if config == nil {
+		return new(Config)
+	}
+	return config
+}
+
+// SeedChanged reports whether old and new are different seeds.
+func SeedChanged(old, new *drbg.Seed) bool {
+	if old == nil || new == nil {
+		return old != new
+	}
+	return *old.Bytes() != *new.Bytes()
+}
+
+// Reload replaces the seed and settings of the Listener for the connections
+// it accepts from now on, and returns the settings that changed, those of
+// ConfigChanges along with "Seed".  Connections accepted before keep theirs.
+// The tables of seed are generated first, and an invalid config leaves the
+// Listener as it was.
+func (l *Listener) Reload(seed *drbg.Seed, config *Config) ([]string, error) {
+	if _, err := DeriveParamsConfig(seed, config); err != nil {
+		return nil, err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	changed := ConfigChanges(l.Config, config)
+	if SeedChanged(l.Seed, seed) {
+		changed = append([]string{"Seed"}, changed...)
+	}
+	l.Seed, l.Config = seed, config
+	if l.failure != nil {
+		l.failure = newFailureHandler(l, seed)
+	}
+	return changed, nil
+}
+
+// settings returns the current seed and settings of the Listener.
+func (l *Listener) settings() (*drbg.Seed, *Config) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.Seed, l.Config
+}
@@ -0,0 +1,59 @@
+package riverrun
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+func TestReload(t *testing.T) {
+	if changed := ConfigChanges(nil, &Config{}); len(changed) != 0 {
+		t.Fatalf("defaults differ: %v", changed)
+	}
+
+	l := newTestListener(t, FailClose)
+	old := l.Seed
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Reload(seed, &Config{FrameHeader: -1}); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	changed, err := l.Reload(seed, &Config{StrictFrames: true, KeyCommitment: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Seed", "StrictFrames", "KeyCommitment"}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("got changes %v, want %v", changed, want)
+	}
+
+	// A client of the new seed gets through, one of the old does not.
+	for _, c := range []struct {
+		seed *drbg.Seed
+		ok   bool
+	}{{seed, true}, {old, false}} {
+		carrier, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := NewConnConfig(context.Background(), carrier, false, c.seed, &Config{KeyCommitment: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Write([]byte("hello"))
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Read(make([]byte, 16))
+		if (err == nil) != c.ok {
+			t.Fatalf("client of ok=%v seed: %v", c.ok, err)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
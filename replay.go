@@ -0,0 +1,277 @@
+package riverrun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/v2fly/riverrun/common/log"
+)
+
+const (
+	// DefaultReplayMaxAge is the default time a ReplayFilter remembers a
+	// salt.
+	DefaultReplayMaxAge = 24 * time.Hour
+	// DefaultReplaySnapshot is the default interval between the snapshots
+	// of a ReplayFilter.
+	DefaultReplaySnapshot = time.Minute
+	// DefaultReplayClockSkew is the default clock error a ReplayFilter
+	// tolerates in the times it saved.
+	DefaultReplayClockSkew = 5 * time.Minute
+
+	// Replay filter snapshots hold the salts seen and when:
+	//
+	//	magic   [8]byte "rrreplay"
+	//	version uint32
+	//	count   uint32
+	//	count times:
+	//	  salt [16]byte
+	//	  seen int64    Unix nanoseconds
+	//
+	// All integers are big-endian.
+	replayFileMagic   = "rrreplay"
+	replayFileVersion = 1
+	replayEntryLength = saltLength + 8
+)
+
+var (
+	// ErrReplay is the error returned by Read on a Listener with a
+	// ReplayFilter when the client's salt was seen before, as when a prober
+	// replays a recorded connection.
+	ErrReplay = errors.New("riverrun: replayed salt")
+	// ErrInvalidReplaySnapshot is the error returned when a replay filter
+	// snapshot is malformed.
+	ErrInvalidReplaySnapshot = errors.New("riverrun: invalid replay filter snapshot")
+)
+
+// ReplayStore keeps the snapshots of a ReplayFilter across restarts, e.g. in
+// a file or a database.
+type ReplayStore interface {
+	// Load returns the snapshot saved last, or nil if there is none.
+	Load() ([]byte, error)
+	// Save replaces the snapshot.
+	Save(snapshot []byte) error
+}
+
+// FileReplayStore is a ReplayStore keeping the snapshot in a file, which is
+// replaced atomically.
+type FileReplayStore string
+
+func (path FileReplayStore) Load() ([]byte, error) {
+	b, err := os.ReadFile(string(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (path FileReplayStore) Save(snapshot []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(string(path)), filepath.Base(string(path))+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(snapshot); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), string(path))
+}
+
+// ReplayFilter remembers the client salts a Listener has seen for MaxAge, see
+// Listener.Replay.  With a ReplayStore it is restored on start and saved
+// periodically, so that a restart does not open a replay window.  The times
+// saved are checked against the clock with ClockSkew to spare: entries from
+// the future, as after the clock was set back, are kept as if seen now, and
+// entries only expire ClockSkew after MaxAge.
+//
+// A Listener records a salt once the first frame behind it decodes, so that
+// garbage sent by probers never fills the filter.  Replays racing the first
+// frame of the recorded connection are not caught.
+//
+// A ReplayFilter is safe for concurrent use.
+type ReplayFilter struct {
+	maxAge    time.Duration
+	clockSkew time.Duration
+	store     ReplayStore
+	logger    log.Logger
+	now       func() time.Time
+
+	lock      sync.Mutex
+	seen      map[[saltLength]byte]int64
+	lastPrune time.Time
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewReplayFilter returns a filter remembering salts for maxAge, restored
+// from store if not nil, and saved to it every interval and on Close.  Zero
+// durations select the defaults.  Failed periodic saves are logged to
+// logger, which may be nil.
+func NewReplayFilter(maxAge time.Duration, store ReplayStore, interval time.Duration, logger log.Logger) (*ReplayFilter, error) {
+	return newReplayFilter(maxAge, store, interval, logger, time.Now)
+}
+
+// newReplayFilter is NewReplayFilter with the clock now.
+func newReplayFilter(maxAge time.Duration, store ReplayStore, interval time.Duration, logger log.Logger, now func() time.Time) (*ReplayFilter, error) {
+	if maxAge < 0 || interval < 0 {
+		return nil, fmt.Errorf("riverrun: invalid replay filter age %s or interval %s", maxAge, interval)
+	}
+	if maxAge == 0 {
+		maxAge = DefaultReplayMaxAge
+	}
+	if interval == 0 {
+		interval = DefaultReplaySnapshot
+	}
+	if logger == nil {
+		logger = log.NopLogger{}
+	}
+	f := &ReplayFilter{
+		maxAge:    maxAge,
+		clockSkew: DefaultReplayClockSkew,
+		store:     store,
+		logger:    logger,
+		now:       now,
+		seen:      make(map[[saltLength]byte]int64),
+	}
+	if store != nil {
+		snapshot, err := store.Load()
+		if err != nil {
+			return nil, err
+		}
+		if snapshot != nil {
+			if err = f.restore(snapshot); err != nil {
+				return nil, err
+			}
+		}
+		f.stop, f.done = make(chan struct{}), make(chan struct{})
+		go f.snapshots(interval)
+	}
+	return f, nil
+}
+
+// Check records salt and reports whether it was seen before.
+func (f *ReplayFilter) Check(salt []byte) bool {
+	return f.check(salt, true)
+}
+
+// check reports whether salt was seen before, and records it unless it was
+// or record is false.
+func (f *ReplayFilter) check(salt []byte, record bool) bool {
+	var key [saltLength]byte
+	copy(key[:], salt)
+	now := f.now()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if now.Sub(f.lastPrune) >= DefaultReplaySnapshot {
+		f.prune(now)
+	}
+	if seen, ok := f.seen[key]; ok && !f.expired(seen, now) {
+		return true
+	}
+	if record {
+		f.seen[key] = now.UnixNano()
+	}
+	return false
+}
+
+func (f *ReplayFilter) expired(seen int64, now time.Time) bool {
+	return now.Sub(time.Unix(0, seen)) >= f.maxAge+f.clockSkew
+}
+
+func (f *ReplayFilter) prune(now time.Time) {
+	for key, seen := range f.seen {
+		if f.expired(seen, now) {
+			delete(f.seen, key)
+		}
+	}
+	f.lastPrune = now
+}
+
+// Snapshot returns the state of f, as saved to the ReplayStore.
+func (f *ReplayFilter) Snapshot() []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.prune(f.now())
+	buf := make([]byte, 16, 16+replayEntryLength*len(f.seen))
+	copy(buf, replayFileMagic)
+	binary.BigEndian.PutUint32(buf[8:], replayFileVersion)
+	binary.BigEndian.PutUint32(buf[12:], uint32(len(f.seen)))
+	for key, seen := range f.seen {
+		buf = append(buf, key[:]...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(seen))
+	}
+	return buf
+}
+
+// restore adds the entries of snapshot that have not expired.
+func (f *ReplayFilter) restore(snapshot []byte) error {
+	if len(snapshot) < 16 || !bytes.Equal(snapshot[:8], []byte(replayFileMagic)) ||
+		binary.BigEndian.Uint32(snapshot[8:]) != replayFileVersion {
+		return ErrInvalidReplaySnapshot
+	}
+	count := binary.BigEndian.Uint32(snapshot[12:])
+	entries := snapshot[16:]
+	if uint64(len(entries)) != uint64(count)*replayEntryLength {
+		return ErrInvalidReplaySnapshot
+	}
+
+	now := f.now()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for ; len(entries) > 0; entries = entries[replayEntryLength:] {
+		var key [saltLength]byte
+		copy(key[:], entries)
+		seen := int64(binary.BigEndian.Uint64(entries[saltLength:]))
+		if time.Unix(0, seen).After(now.Add(f.clockSkew)) {
+			seen = now.UnixNano()
+		}
+		if !f.expired(seen, now) {
+			f.seen[key] = seen
+		}
+	}
+	return nil
+}
+
+func (f *ReplayFilter) snapshots(interval time.Duration) {
+	defer close(f.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.store.Save(f.Snapshot()); err != nil {
+				f.logger.Infof("riverrun: saving the replay filter: %s", err)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// Close stops the periodic snapshots and saves a last one.  Closing again
+// does nothing.
+func (f *ReplayFilter) Close() (err error) {
+	if f.store == nil {
+		return nil
+	}
+	f.closeOnce.Do(func() {
+		close(f.stop)
+		<-f.done
+		err = f.store.Save(f.Snapshot())
+	})
+	return err
+}
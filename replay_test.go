@@ -0,0 +1,110 @@
+package riverrun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+func TestReplayFilter(t *testing.T) {
+	store := FileReplayStore(filepath.Join(t.TempDir(), "replay"))
+	var clock atomic.Int64
+	now := time.Now()
+	clock.Store(now.UnixNano())
+	f, err := newReplayFilter(time.Hour, store, 0, nil, func() time.Time { return time.Unix(0, clock.Load()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := bytes.Repeat([]byte{1}, saltLength)
+	if f.Check(salt) {
+		t.Fatal("fresh salt reported as replayed")
+	}
+	if !f.Check(salt) {
+		t.Fatal("replayed salt not detected")
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	// After a restart with the clock set back, the salt is still known.
+	back := now.Add(-2 * time.Hour)
+	clock.Store(back.UnixNano())
+	f, err = newReplayFilter(time.Hour, store, 0, nil, func() time.Time { return time.Unix(0, clock.Load()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !f.Check(salt) {
+		t.Fatal("replayed salt not detected after restart")
+	}
+	// The entry from the future counts as seen on restore, so it expires
+	// MaxAge after, not MaxAge after the time saved.
+	clock.Store(back.Add(time.Hour + DefaultReplayClockSkew).UnixNano())
+	if f.Check(salt) {
+		t.Fatal("salt from the future not expired after MaxAge")
+	}
+
+	bad := &ReplayFilter{seen: map[[saltLength]byte]int64{}, now: time.Now}
+	if bad.restore([]byte("rrreplay")) != ErrInvalidReplaySnapshot {
+		t.Fatal("short snapshot accepted")
+	}
+}
+
+func TestReplayedConnection(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewReplayFilter(time.Hour, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &recordConn{}
+	client, err := NewConnConfig(context.Background(), record, false, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// read runs a server filtered by f on the bytes a client sent.
+	read := func(sent []byte) error {
+		a, b := net.Pipe()
+		server, err := NewConnConfig(context.Background(), b, true, seed, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		server.replay = f
+		go func() {
+			a.Write(sent)
+			a.Close()
+		}()
+		_, err = server.Read(make([]byte, 16))
+		return err
+	}
+
+	garbage := make([]byte, record.written.Len())
+	if err = read(garbage); err == nil {
+		t.Fatal("garbage accepted")
+	}
+	if len(f.seen) != 0 {
+		t.Fatal("salt of garbage recorded")
+	}
+	if err = read(record.written.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err = read(record.written.Bytes()); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replay: got %v, want ErrReplay", err)
+	}
+}
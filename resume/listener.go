@@ -0,0 +1,241 @@
+package resume
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrListenerClosed is the error returned by Accept once the Listener is
+// closed.
+var ErrListenerClosed = errors.New("resume: listener closed")
+
+// Listener accepts sessions over the carriers accepted by an underlying
+// listener, e.g. a riverrun.Listener.  Carriers resuming a session are
+// attached to it and never returned by Accept.
+//
+// Once a carrier sent its hello, it waits in one of two queues for one of
+// Config.Workers: carriers resuming a session are served first, so that
+// established sessions survive a flood of new ones.  Carriers finding their
+// queue full, or new sessions finding the accept backlog full, are turned
+// away as busy, and so are carriers past the ResumeQueue plus FreshQueue
+// already reading their hello.  ln should run its own handshakes off its
+// accept loop, as riverrun.Listener does, so that slow ones do not hold up
+// the queues.
+type Listener struct {
+	ln     net.Listener
+	config *Config
+
+	lock     sync.Mutex
+	sessions map[[idLength]byte]*Conn
+
+	// hellos holds a token per carrier reading its hello, backlog one per
+	// new session handshaking or waiting for Accept.
+	hellos, backlog         chan struct{}
+	resumeQueue, freshQueue chan *pendingCarrier
+	shed                    atomic.Uint64
+
+	accepted chan *Conn
+	done     chan struct{}
+	once     sync.Once
+	err      error
+}
+
+// pendingCarrier is a carrier that sent its hello.
+type pendingCarrier struct {
+	carrier      net.Conn
+	id           [idLength]byte
+	peerReceived uint64
+}
+
+// NewListener returns a Listener accepting sessions over the connections
+// accepted by ln.
+func NewListener(ln net.Listener, config *Config) *Listener {
+	config = config.withDefaults()
+	l := &Listener{
+		ln:          ln,
+		config:      config,
+		sessions:    make(map[[idLength]byte]*Conn),
+		hellos:      make(chan struct{}, config.ResumeQueue+config.FreshQueue),
+		backlog:     make(chan struct{}, config.AcceptBacklog),
+		resumeQueue: make(chan *pendingCarrier, config.ResumeQueue),
+		freshQueue:  make(chan *pendingCarrier, config.FreshQueue),
+		accepted:    make(chan *Conn, config.AcceptBacklog),
+		done:        make(chan struct{}),
+	}
+	go l.serve()
+	for i := 0; i < config.Workers; i++ {
+		go l.work()
+	}
+	return l
+}
+
+func (l *Listener) serve() {
+	for {
+		carrier, err := l.ln.Accept()
+		if err != nil {
+			l.shutdown(err)
+			return
+		}
+		select {
+		case l.hellos <- struct{}{}:
+			go l.queue(carrier)
+		default:
+			carrier.SetDeadline(time.Now().Add(handshakeTimeout))
+			l.reject(carrier, statusBusy)
+		}
+	}
+}
+
+// queue reads the hello of carrier and queues it for a worker.
+func (l *Listener) queue(carrier net.Conn) {
+	defer func() { <-l.hellos }()
+	carrier.SetDeadline(time.Now().Add(handshakeTimeout))
+	var hello [helloLength]byte
+	if _, err := io.ReadFull(carrier, hello[:]); err != nil || hello[0] != version {
+		carrier.Close()
+		return
+	}
+	p := &pendingCarrier{carrier: carrier, peerReceived: binary.BigEndian.Uint64(hello[1+idLength:])}
+	copy(p.id[:], hello[1:])
+
+	l.lock.Lock()
+	_, resumed := l.sessions[p.id]
+	l.lock.Unlock()
+	queue := l.freshQueue
+	if resumed {
+		queue = l.resumeQueue
+	} else if len(l.backlog) == cap(l.backlog) {
+		l.reject(carrier, statusBusy)
+		return
+	}
+	select {
+	case queue <- p:
+	default:
+		l.reject(carrier, statusBusy)
+	}
+}
+
+// work runs the handshakes of queued carriers, resuming ones first.
+func (l *Listener) work() {
+	for {
+		var p *pendingCarrier
+		select {
+		case p = <-l.resumeQueue:
+		default:
+			select {
+			case p = <-l.resumeQueue:
+			case p = <-l.freshQueue:
+			case <-l.done:
+				return
+			}
+		}
+		l.handshake(p)
+	}
+}
+
+// reject answers carrier with status and closes it.
+func (l *Listener) reject(carrier net.Conn, status byte) {
+	if status == statusBusy {
+		l.shed.Add(1)
+	}
+	var reply [replyLength]byte
+	reply[0] = status
+	carrier.Write(reply[:])
+	carrier.Close()
+}
+
+// Shed returns the number of carriers turned away as busy.
+func (l *Listener) Shed() uint64 {
+	return l.shed.Load()
+}
+
+func (l *Listener) shutdown(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *Listener) handshake(p *pendingCarrier) {
+	carrier, id, peerReceived := p.carrier, p.id, p.peerReceived
+	l.lock.Lock()
+	c, resumed := l.sessions[id]
+	if !resumed && peerReceived == 0 {
+		select {
+		case l.backlog <- struct{}{}:
+		default:
+			// The backlog filled up since the carrier was queued.
+			l.lock.Unlock()
+			l.reject(carrier, statusBusy)
+			return
+		}
+		c = newConn(l.config)
+		c.id = id
+		c.onClose = func() { l.remove(id, c) }
+		l.sessions[id] = c
+	}
+	l.lock.Unlock()
+
+	if c == nil {
+		l.reject(carrier, statusUnknown)
+		return
+	}
+	var reply [replyLength]byte
+	if resumed {
+		binary.BigEndian.PutUint64(reply[1:], c.takeover())
+	}
+	if _, err := carrier.Write(reply[:]); err != nil {
+		carrier.Close()
+		if !resumed {
+			c.Close()
+			<-l.backlog
+		}
+		return
+	}
+	carrier.SetDeadline(time.Time{})
+	err := c.attach(carrier, peerReceived)
+	switch {
+	case resumed:
+	case err != nil:
+		<-l.backlog
+	default:
+		// Never blocks, accepted holds as many as backlog.
+		l.accepted <- c
+	}
+}
+
+func (l *Listener) remove(id [idLength]byte, c *Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.sessions[id] == c {
+		delete(l.sessions, id)
+	}
+}
+
+// Accept waits for the next new session.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepted:
+		<-l.backlog
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close closes the underlying listener.  Sessions already accepted stay up,
+// but can no longer be resumed.
+func (l *Listener) Close() error {
+	l.shutdown(ErrListenerClosed)
+	return l.ln.Close()
+}
+
+// Addr returns the address of the underlying listener.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
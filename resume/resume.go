@@ -0,0 +1,731 @@
+// Package resume keeps a logical byte stream alive across drops of the
+// connection carrying it, typically a riverrun Conn.
+//
+// Both peers keep what they wrote in a replay buffer until the other side
+// acknowledges it.  When the carrier fails, the client dials a new one and
+// names its session, both sides tell each other how much of the stream they
+// received, and resend the rest from their replay buffers.  Applications see
+// an uninterrupted net.Conn, unless the client fails to reconnect within
+// Config.ReconnectTimeout.
+//
+// Sessions are named by their id alone, never by the address of the carrier,
+// so a client that moved to another network, say from Wi-Fi to LTE, resumes
+// from its new address.  Only the new carrier's riverrun handshake is paid,
+// the tables are cached.  A client that learns of the move calls
+// Conn.Migrate, rather than waiting for the old carrier to fail.
+//
+// On a fresh carrier the client sends a hello, which the server answers:
+//
+//	hello: version uint8, session id [16]byte, received uint64
+//	reply: status uint8, received uint64
+//
+// Records follow in both directions, a type byte and a 2 byte length ahead of
+// the body: data, the number of stream bytes consumed as acknowledgement, or
+// an orderly close.  All integers are big-endian.
+package resume
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/v2fly/riverrun/common/csrand"
+	"github.com/v2fly/riverrun/common/log"
+)
+
+const (
+	// DefaultBufferSize is the default size of the replay buffer.
+	DefaultBufferSize = 1024 * 1024
+	// DefaultReconnectTimeout is the default time a client keeps trying to
+	// reconnect a session.
+	DefaultReconnectTimeout = time.Minute
+	// DefaultSessionTimeout is the default time a server keeps a session
+	// without carrier.
+	DefaultSessionTimeout = 2 * time.Minute
+	// DefaultWorkers, DefaultResumeQueue, DefaultFreshQueue and
+	// DefaultAcceptBacklog are the defaults of the Listener queues.
+	DefaultWorkers       = 16
+	DefaultResumeQueue   = 256
+	DefaultFreshQueue    = 64
+	DefaultAcceptBacklog = 64
+
+	version      = 1
+	idLength     = 16
+	helloLength  = 1 + idLength + 8
+	replyLength  = 1 + 8
+	headerLength = 3
+
+	recordData  = 0
+	recordAck   = 1
+	recordClose = 2
+
+	statusOK      = 0
+	statusUnknown = 1
+	statusBusy    = 2
+
+	maxRecordData    = 16 * 1024
+	handshakeTimeout = 10 * time.Second
+	// Consumed bytes are acknowledged once ackThreshold accumulated, or
+	// after ackDelay.
+	ackThreshold = 16 * 1024
+	ackDelay     = 50 * time.Millisecond
+
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+var (
+	// ErrSessionLost is the error returned once a session could not be
+	// resumed in time.
+	ErrSessionLost = errors.New("resume: session lost")
+	// ErrUnknownSession is the error returned when the server no longer
+	// knows the session.
+	ErrUnknownSession = errors.New("resume: unknown session")
+	// ErrProtocol is the error returned when the peer violates the protocol.
+	ErrProtocol = errors.New("resume: protocol error")
+	// ErrBusy is the error returned when the server sheds load.  Clients
+	// keep retrying to resume a session.
+	ErrBusy = errors.New("resume: server busy")
+	// ErrNotClient is the error returned by Migrate on the server end of
+	// a session.
+	ErrNotClient = errors.New("resume: only clients migrate sessions")
+)
+
+// Config holds the settings of sessions.  The zero value selects the
+// defaults.
+type Config struct {
+	// BufferSize bounds the bytes written but not acknowledged, and so the
+	// peer's backlog of bytes received but not read.  Writes block while it
+	// is full.
+	BufferSize int
+	// ReconnectTimeout is the time a client keeps trying to reconnect once
+	// its carrier failed.
+	ReconnectTimeout time.Duration
+	// SessionTimeout is the time a server waits for a client to resume a
+	// session once its carrier failed.
+	SessionTimeout time.Duration
+
+	// Workers is the number of carriers a Listener handshakes at once.
+	Workers int
+	// ResumeQueue and FreshQueue bound the carriers waiting for a worker
+	// that resume a session and that start one.  AcceptBacklog bounds the
+	// new sessions waiting for Accept.  Past them carriers are turned away
+	// with ErrBusy; FreshQueue defaults to fewer, so that fresh sessions
+	// are shed first.
+	ResumeQueue, FreshQueue int
+	AcceptBacklog           int
+
+	Logger log.Logger
+}
+
+func (config *Config) withDefaults() *Config {
+	res := new(Config)
+	if config != nil {
+		*res = *config
+	}
+	if res.BufferSize <= 0 {
+		res.BufferSize = DefaultBufferSize
+	}
+	if res.ReconnectTimeout <= 0 {
+		res.ReconnectTimeout = DefaultReconnectTimeout
+	}
+	if res.SessionTimeout <= 0 {
+		res.SessionTimeout = DefaultSessionTimeout
+	}
+	if res.Workers <= 0 {
+		res.Workers = DefaultWorkers
+	}
+	if res.ResumeQueue <= 0 {
+		res.ResumeQueue = DefaultResumeQueue
+	}
+	if res.FreshQueue <= 0 {
+		res.FreshQueue = DefaultFreshQueue
+	}
+	if res.AcceptBacklog <= 0 {
+		res.AcceptBacklog = DefaultAcceptBacklog
+	}
+	if res.Logger == nil {
+		res.Logger = log.NopLogger{}
+	}
+	return res
+}
+
+// Conn is one end of a resumable session.
+type Conn struct {
+	config *Config
+	id     [idLength]byte
+	// redial returns a new carrier, on clients only.
+	redial func(ctx context.Context) (net.Conn, error)
+	// onClose is called once the session is over, on servers only.
+	onClose func()
+
+	// writeLock serializes the writes to the carrier.  It is taken before
+	// lock.
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	carrier net.Conn
+	// readerDone is closed once the reader of carrier returned.
+	readerDone    chan struct{}
+	local, remote net.Addr
+
+	// replay holds the stream bytes [acked, sent).
+	sent, acked uint64
+	replay      []byte
+
+	// received counts the stream bytes received, consumed those read by the
+	// application and ackSent those acknowledged.
+	received, consumed, ackSent uint64
+	readBuf                     bytes.Buffer
+	ackTimer                    *time.Timer
+
+	closed, peerClosed bool
+	err                error
+	detachTimer        *time.Timer
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+}
+
+func newConn(config *Config) *Conn {
+	c := &Conn{config: config}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+// Dial starts a session over the carrier returned by dial, which is called
+// again whenever the carrier has to be replaced.
+func Dial(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), config *Config) (*Conn, error) {
+	c := newConn(config.withDefaults())
+	c.redial = dial
+	if err := csrand.Bytes(c.id[:]); err != nil {
+		return nil, err
+	}
+	carrier, peerReceived, err := c.clientHandshake(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.attach(carrier, peerReceived); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) clientHandshake(ctx context.Context) (net.Conn, uint64, error) {
+	carrier, err := c.redial(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	deadline := time.Now().Add(handshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	carrier.SetDeadline(deadline)
+
+	c.lock.Lock()
+	received := c.received
+	c.lock.Unlock()
+	var hello [helloLength]byte
+	hello[0] = version
+	copy(hello[1:], c.id[:])
+	binary.BigEndian.PutUint64(hello[1+idLength:], received)
+	var reply [replyLength]byte
+	if _, err = carrier.Write(hello[:]); err == nil {
+		_, err = io.ReadFull(carrier, reply[:])
+	}
+	if err == nil {
+		switch reply[0] {
+		case statusOK:
+		case statusBusy:
+			err = ErrBusy
+		default:
+			err = ErrUnknownSession
+		}
+	}
+	if err != nil {
+		carrier.Close()
+		return nil, 0, err
+	}
+	carrier.SetDeadline(time.Time{})
+	return carrier, binary.BigEndian.Uint64(reply[1:]), nil
+}
+
+// attach makes carrier the carrier of c, and resends what the peer did not
+// receive yet.
+func (c *Conn) attach(carrier net.Conn, peerReceived uint64) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.lock.Lock()
+	if c.closed || c.err != nil {
+		c.lock.Unlock()
+		carrier.Close()
+		return net.ErrClosed
+	}
+	if peerReceived < c.acked || peerReceived > c.sent {
+		c.lock.Unlock()
+		carrier.Close()
+		c.fail(fmt.Errorf("%w: peer resumes at %d outside [%d, %d]", ErrProtocol, peerReceived, c.acked, c.sent))
+		return ErrProtocol
+	}
+	c.trim(peerReceived)
+	pending := append([]byte(nil), c.replay...)
+	c.carrier = carrier
+	c.local, c.remote = carrier.LocalAddr(), carrier.RemoteAddr()
+	c.readerDone = make(chan struct{})
+	if c.detachTimer != nil {
+		c.detachTimer.Stop()
+		c.detachTimer = nil
+	}
+	go c.readLoop(carrier, c.readerDone)
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	for len(pending) > 0 {
+		n := min(len(pending), maxRecordData)
+		if err := writeRecord(carrier, recordData, pending[:n]); err != nil {
+			// The reader notices and detaches.
+			carrier.Close()
+			break
+		}
+		pending = pending[n:]
+	}
+	return nil
+}
+
+// Migrate moves the session of a client to a new carrier right away, e.g.
+// once the network changed and the old carrier is likely dead without having
+// failed yet.  The old carrier is dropped first, then the session is resumed
+// over a new one as after a drop.  If that fails, the session keeps
+// reconnecting as after a drop, and the error is returned.  While the session
+// is already reconnecting, Migrate leaves it to that and returns nil.
+func (c *Conn) Migrate(ctx context.Context) error {
+	if c.redial == nil {
+		return ErrNotClient
+	}
+	c.lock.Lock()
+	if c.closed || c.err != nil || c.peerClosed {
+		err := c.writeErr()
+		c.lock.Unlock()
+		return err
+	}
+	carrier, done := c.carrier, c.readerDone
+	// Cleared first, so that the reader does not take the close for a
+	// drop.
+	c.carrier = nil
+	c.lock.Unlock()
+	if carrier == nil {
+		return nil
+	}
+	carrier.Close()
+	// Nothing more may arrive on the old carrier once the hello tells
+	// the server what was received.
+	<-done
+
+	newCarrier, peerReceived, err := c.clientHandshake(ctx)
+	if err == nil {
+		err = c.attach(newCarrier, peerReceived)
+	}
+	if err != nil && !c.isDone() {
+		c.config.Logger.Infof("resume: migrating failed: %s", err)
+		go c.reconnect()
+	}
+	return err
+}
+
+// takeover detaches the current carrier of c, if any, in favour of one
+// resuming the session, and returns the stream bytes received.
+func (c *Conn) takeover() uint64 {
+	c.lock.Lock()
+	carrier, done := c.carrier, c.readerDone
+	c.carrier = nil
+	c.lock.Unlock()
+	if carrier != nil {
+		carrier.Close()
+		<-done
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.received
+}
+
+// trim drops the acknowledged bytes up to offset from the replay buffer.
+func (c *Conn) trim(offset uint64) {
+	if offset <= c.acked {
+		return
+	}
+	c.replay = append(c.replay[:0], c.replay[offset-c.acked:]...)
+	c.acked = offset
+	c.cond.Broadcast()
+}
+
+func (c *Conn) readLoop(carrier net.Conn, done chan struct{}) {
+	defer close(done)
+	r := bufio.NewReader(carrier)
+	var header [headerLength]byte
+	body := make([]byte, maxRecordData)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			c.detach(carrier, err)
+			return
+		}
+		n := int(binary.BigEndian.Uint16(header[1:]))
+		if n > maxRecordData {
+			c.detach(carrier, ErrProtocol)
+			return
+		}
+		if _, err := io.ReadFull(r, body[:n]); err != nil {
+			c.detach(carrier, err)
+			return
+		}
+
+		c.lock.Lock()
+		if c.carrier != carrier {
+			c.lock.Unlock()
+			return
+		}
+		switch header[0] {
+		case recordData:
+			// The peer may only be BufferSize ahead of what was read.
+			if c.received+uint64(n)-c.consumed > uint64(c.config.BufferSize) {
+				c.lock.Unlock()
+				c.detach(carrier, fmt.Errorf("%w: peer sent past the buffer size", ErrProtocol))
+				return
+			}
+			c.readBuf.Write(body[:n])
+			c.received += uint64(n)
+			c.cond.Broadcast()
+			c.lock.Unlock()
+		case recordAck:
+			var offset uint64
+			if n == 8 {
+				offset = binary.BigEndian.Uint64(body)
+			}
+			if n != 8 || offset > c.sent {
+				c.lock.Unlock()
+				c.detach(carrier, ErrProtocol)
+				return
+			}
+			// Acknowledgements may lag a resumption, which already
+			// acknowledged more.
+			c.trim(offset)
+			c.lock.Unlock()
+		case recordClose:
+			c.peerClosed = true
+			c.carrier = nil
+			c.cond.Broadcast()
+			c.lock.Unlock()
+			carrier.Close()
+			c.finish()
+			return
+		default:
+			c.lock.Unlock()
+			c.detach(carrier, ErrProtocol)
+			return
+		}
+	}
+}
+
+// detach drops carrier after it failed with err, and starts recovering the
+// session.
+func (c *Conn) detach(carrier net.Conn, err error) {
+	carrier.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.carrier != carrier {
+		return
+	}
+	c.carrier = nil
+	if c.closed || c.peerClosed || c.err != nil {
+		return
+	}
+	if errors.Is(err, ErrProtocol) {
+		c.setErr(err)
+		return
+	}
+	c.config.Logger.Infof("resume: carrier failed: %s", err)
+	if c.redial != nil {
+		go c.reconnect()
+	} else {
+		c.detachTimer = time.AfterFunc(c.config.SessionTimeout, func() {
+			c.fail(ErrSessionLost)
+		})
+	}
+}
+
+// reconnect replaces the carrier of a client, retrying with backoff until
+// ReconnectTimeout passed.
+func (c *Conn) reconnect() {
+	deadline := time.Now().Add(c.config.ReconnectTimeout)
+	backoff := minBackoff
+	for {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		carrier, peerReceived, err := c.clientHandshake(ctx)
+		cancel()
+		if err == nil {
+			if err = c.attach(carrier, peerReceived); err == nil {
+				c.config.Logger.Debugf("resume: session resumed")
+				return
+			}
+		}
+		if c.isDone() {
+			return
+		}
+		if errors.Is(err, ErrUnknownSession) || time.Now().Add(backoff).After(deadline) {
+			c.fail(fmt.Errorf("%w: %s", ErrSessionLost, err))
+			return
+		}
+		c.config.Logger.Debugf("resume: reconnect failed: %s", err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (c *Conn) isDone() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed || c.err != nil
+}
+
+// setErr ends the session with err.  c.lock must be held.
+func (c *Conn) setErr(err error) {
+	if c.closed || c.err != nil {
+		return
+	}
+	c.err = err
+	if c.carrier != nil {
+		c.carrier.Close()
+		c.carrier = nil
+	}
+	c.cond.Broadcast()
+	go c.finish()
+}
+
+func (c *Conn) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.setErr(err)
+}
+
+func (c *Conn) finish() {
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+// Read reads from the stream.  It only fails once the session is over.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	for c.readBuf.Len() == 0 {
+		if err := c.readErr(); err != nil {
+			c.lock.Unlock()
+			return 0, err
+		}
+		c.cond.Wait()
+	}
+	n, _ := c.readBuf.Read(b)
+	c.consumed += uint64(n)
+	due := c.consumed-c.ackSent >= ackThreshold
+	if !due && c.ackTimer == nil {
+		c.ackTimer = time.AfterFunc(ackDelay, c.sendAck)
+	}
+	c.lock.Unlock()
+	if due {
+		c.sendAck()
+	}
+	return n, nil
+}
+
+func (c *Conn) readErr() error {
+	switch {
+	case c.closed:
+		return net.ErrClosed
+	case c.peerClosed:
+		return io.EOF
+	case c.err != nil:
+		return c.err
+	case expired(c.readDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (c *Conn) sendAck() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.lock.Lock()
+	if c.ackTimer != nil {
+		c.ackTimer.Stop()
+		c.ackTimer = nil
+	}
+	carrier, offset := c.carrier, c.consumed
+	if carrier == nil || offset == c.ackSent {
+		c.lock.Unlock()
+		return
+	}
+	c.ackSent = offset
+	c.lock.Unlock()
+	var body [8]byte
+	binary.BigEndian.PutUint64(body[:], offset)
+	if err := writeRecord(carrier, recordAck, body[:]); err != nil {
+		carrier.Close()
+	}
+}
+
+// Write writes to the stream.  Bytes are buffered while the carrier is being
+// replaced, so Write only blocks while the replay buffer is full.
+func (c *Conn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		c.lock.Lock()
+		for {
+			if err = c.writeErr(); err != nil {
+				c.lock.Unlock()
+				return
+			}
+			if len(c.replay) < c.config.BufferSize {
+				break
+			}
+			c.cond.Wait()
+		}
+		c.lock.Unlock()
+
+		c.writeLock.Lock()
+		c.lock.Lock()
+		room := c.config.BufferSize - len(c.replay)
+		if err = c.writeErr(); err != nil || room <= 0 {
+			c.lock.Unlock()
+			c.writeLock.Unlock()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		chunk := min(len(b), room, maxRecordData)
+		c.replay = append(c.replay, b[:chunk]...)
+		c.sent += uint64(chunk)
+		carrier := c.carrier
+		c.lock.Unlock()
+		if carrier != nil {
+			if werr := writeRecord(carrier, recordData, b[:chunk]); werr != nil {
+				// The bytes are in the replay buffer, the reader
+				// notices and detaches.
+				carrier.Close()
+			}
+		}
+		c.writeLock.Unlock()
+		n += chunk
+		b = b[chunk:]
+	}
+	return
+}
+
+func (c *Conn) writeErr() error {
+	switch {
+	case c.closed:
+		return net.ErrClosed
+	case c.err != nil:
+		return c.err
+	case c.peerClosed:
+		return io.ErrClosedPipe
+	case expired(c.writeDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Close ends the session, telling the peer if a carrier is up.  Bytes the peer
+// did not receive yet are lost.
+func (c *Conn) Close() error {
+	c.writeLock.Lock()
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		c.writeLock.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	carrier := c.carrier
+	c.carrier = nil
+	for _, t := range []*time.Timer{c.ackTimer, c.detachTimer, c.readTimer, c.writeTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	c.cond.Broadcast()
+	c.lock.Unlock()
+	if carrier != nil {
+		writeRecord(carrier, recordClose, nil)
+		carrier.Close()
+	}
+	c.writeLock.Unlock()
+	c.finish()
+	return nil
+}
+
+// LocalAddr returns the local address of the latest carrier.
+func (c *Conn) LocalAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.local
+}
+
+// RemoteAddr returns the remote address of the latest carrier.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.readDeadline, &c.readTimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.writeDeadline, &c.writeTimer, t)
+	return nil
+}
+
+func (c *Conn) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			c.lock.Lock()
+			c.cond.Broadcast()
+			c.lock.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func writeRecord(w io.Writer, typ byte, body []byte) error {
+	buf := make([]byte, headerLength+len(body))
+	buf[0] = typ
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(body)))
+	copy(buf[headerLength:], body)
+	_, err := w.Write(buf)
+	return err
+}
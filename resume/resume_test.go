@@ -0,0 +1,294 @@
+package resume
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dropper dials carriers and lets the test break the latest one.
+type dropper struct {
+	addr string
+	lock sync.Mutex
+	last net.Conn
+}
+
+func (d *dropper) dial(ctx context.Context) (net.Conn, error) {
+	d.lock.Lock()
+	addr := d.addr
+	d.lock.Unlock()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err == nil {
+		d.lock.Lock()
+		d.last = conn
+		d.lock.Unlock()
+	}
+	return conn, err
+}
+
+// redirect makes the next dials go to addr.
+func (d *dropper) redirect(addr string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.addr = addr
+}
+
+func (d *dropper) drop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.last != nil {
+		d.last.Close()
+	}
+}
+
+func newTestSession(t *testing.T, config *Config) (*Conn, net.Conn, *dropper) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(ln, config)
+	t.Cleanup(func() { l.Close() })
+	d := &dropper{addr: ln.Addr().String()}
+	client, err := Dial(context.Background(), d.dial, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server, d
+}
+
+func TestResumeAcrossDrops(t *testing.T) {
+	client, server, d := newTestSession(t, &Config{BufferSize: 64 * 1024})
+	go io.Copy(server, server)
+
+	msg := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(msg)
+	go func() {
+		for off := 0; off < len(msg); off += 32 * 1024 {
+			client.Write(msg[off : off+32*1024])
+			if off%(512*1024) == 0 {
+				d.drop()
+			}
+		}
+	}()
+
+	client.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("stream corrupted across drops")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	client, server, _ := newTestSession(t, &Config{BufferSize: 64 * 1024})
+	go io.Copy(server, server)
+
+	msg := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(msg)
+	locals := make(chan net.Addr, 4)
+	go func() {
+		for off := 0; off < len(msg); off += 32 * 1024 {
+			client.Write(msg[off : off+32*1024])
+			if off%(256*1024) == 0 {
+				if err := client.Migrate(context.Background()); err != nil {
+					t.Error(err)
+				}
+				locals <- client.LocalAddr()
+			}
+		}
+		close(locals)
+	}()
+
+	client.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("stream corrupted across migrations")
+	}
+	// Every migration resumes from another address.
+	seen := make(map[string]bool)
+	for addr := range locals {
+		if seen[addr.String()] {
+			t.Fatalf("session still at %s", addr)
+		}
+		seen[addr.String()] = true
+	}
+}
+
+func TestCloseEndsSession(t *testing.T) {
+	client, server, _ := newTestSession(t, nil)
+	client.Write([]byte("bye"))
+	client.Close()
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "bye" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestSessionLost(t *testing.T) {
+	client, _, d := newTestSession(t, &Config{ReconnectTimeout: 200 * time.Millisecond})
+	d.redirect("127.0.0.1:1")
+	d.drop()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, ErrSessionLost) {
+		t.Fatalf("got %v, want ErrSessionLost", err)
+	}
+}
+
+func TestBufferOverrun(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(ln, &Config{BufferSize: 1024})
+	defer l.Close()
+	peer, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	hello := make([]byte, helloLength)
+	hello[0], hello[1] = version, 1
+	if _, err = peer.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(peer, make([]byte, replyLength)); err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// The peer sends more than may be unacknowledged.
+	if err = writeRecord(peer, recordData, make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err = io.Copy(io.Discard, server); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("got %v, want ErrProtocol", err)
+	}
+}
+
+func TestListenerSheds(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Workers: 1, FreshQueue: 1, AcceptBacklog: 1}
+	l := NewListener(ln, config)
+	defer l.Close()
+	d := &dropper{addr: ln.Addr().String()}
+
+	// The first session fills the accept backlog, the second is shed.
+	first, err := Dial(context.Background(), d.dial, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := Dial(context.Background(), d.dial, config); !errors.Is(err, ErrBusy) {
+		t.Fatalf("got %v, want ErrBusy", err)
+	}
+	if n := l.Shed(); n != 1 {
+		t.Fatalf("%d carriers shed, want 1", n)
+	}
+
+	// Resuming does not need the backlog.
+	d.drop()
+	go first.Write([]byte("resumed"))
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, 7)
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "resumed" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+// pipeListener accepts the server ends of pipes handed to dial.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.UnixAddr{Name: "pipe", Net: "unix"} }
+
+func TestListenerBacklogRace(t *testing.T) {
+	pl := newPipeListener()
+	l := NewListener(pl, &Config{Workers: 1, FreshQueue: 2, AcceptBacklog: 1})
+	defer l.Close()
+
+	// The worker holds on to an unknown session until its reply is read,
+	// while two new ones are queued with the backlog empty.
+	var carriers [3]net.Conn
+	for i := range carriers {
+		carriers[i] = pl.dial()
+		defer carriers[i].Close()
+		hello := make([]byte, helloLength)
+		hello[0], hello[1] = version, byte(i)
+		if i == 0 {
+			hello[helloLength-1] = 1
+		}
+		if _, err := carriers[i].Write(hello); err != nil {
+			t.Fatal(err)
+		}
+		for len(l.hellos) != 0 || len(l.freshQueue) != i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i, want := range []byte{statusUnknown, statusOK, statusBusy} {
+		reply := make([]byte, replyLength)
+		carriers[i].SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(carriers[i], reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[0] != want {
+			t.Fatalf("session %d got status %d, want %d", i, reply[0], want)
+		}
+	}
+}
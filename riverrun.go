@@ -2,180 +2,701 @@ package riverrun
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/v2fly/riverrun/common/ctstretch"
 	"github.com/v2fly/riverrun/common/drbg"
 	f "github.com/v2fly/riverrun/common/framing"
 	"github.com/v2fly/riverrun/common/log"
+	"github.com/v2fly/riverrun/common/reorder"
 )
 
 const (
 	PacketTypePayload = iota
+	PacketTypeRenegotiate
+	PacketTypeCompressed
+	// PacketTypeEcho asks the peer to send the body back in a
+	// PacketTypeEchoReply, see Conn.Echo.
+	PacketTypeEcho
+	PacketTypeEchoReply
+	// PacketTypePadding carries nothing, see Config.PadOnFlush.
+	PacketTypePadding
+	// PacketTypeKeyExchange carries a message of Config.KeyExchange.
+	PacketTypeKeyExchange
+	// PacketTypeAuth carries the Config.AuthToken of a client.
+	PacketTypeAuth
+	// PacketTypeSeedRotation carries a sealed SeedRotation.
+	PacketTypeSeedRotation
+	// PacketTypeClose carries the sealed CloseCode of Conn.CloseWithCode.
+	PacketTypeClose
+	// PacketTypeSpan declares a span of payload following it without
+	// frame headers, see Config.SpanThreshold.
+	PacketTypeSpan
+	// PacketTypeFrameHeader announces the FrameHeader of the frames
+	// following it, see Config.FrameHeader.
+	PacketTypeFrameHeader
 )
 
+// FrameHeader selects the layout of the length word heading every frame.
+type FrameHeader int
+
+const (
+	// FrameHeaderLength is the original length word, the frame length
+	// alone.
+	FrameHeaderLength FrameHeader = iota
+	// FrameHeaderTyped carries the packet type above the low
+	// framing.LengthBits bits of the length, masked and expanded with it,
+	// so that the decoder tells payload from control frames before the
+	// body.  Frames are then limited to 2 KiB.
+	FrameHeaderTyped
+	// FrameHeaderChecked carries a checksum of the length above the low
+	// framing.LengthBits bits, masked and expanded with it, so that a
+	// corrupted length field fails the frame with ErrLengthChecksum right
+	// away, instead of desynchronizing the stream until a tag mismatch.
+	// Frames are then limited to 2 KiB.
+	FrameHeaderChecked
+)
+
+// ErrLengthChecksum is the error returned by Read with FrameHeaderChecked
+// when the checksum of a length field does not match.
+var ErrLengthChecksum = f.ErrLengthChecksum
+
+// ErrHeaderType is the error returned by Read with FrameHeaderTyped when the
+// packet type of a frame differs from the one its length word declared, and
+// when the peer announces an unknown layout or announces one twice.
+var ErrHeaderType = errors.New("riverrun: frame header type mismatch")
+
+// renegotiateLength is the size of a PacketTypeRenegotiate body, the
+// big-endian shaping epoch.  A retune of Config.AdaptiveBias appends the
+// bias, see retuneLength.
+const renegotiateLength = 4
+
+// ErrUnknownPacketType is the error returned when the decoder encounters a
+// packet type it does not understand.
+var ErrUnknownPacketType = errors.New("riverrun: unknown packet type")
+
+// ErrFrameTooLarge is the error returned by Read with Config.StrictFrames
+// when the peer declares a frame longer than the negotiated maximum.
+var ErrFrameTooLarge = f.ErrFrameTooLarge
+
+// ErrBufferLimit is the error returned by Read when a frame that has to be
+// buffered in full does not fit Config.MaxBufferedBytes.
+var ErrBufferLimit = f.ErrBufferLimit
+
 // Implements the net.Conn interface
 type Conn struct {
 	// Embeds a net.Conn and inherits its members.
 	net.Conn
 
-	logger log.Logger
-
-	bias    float64
-	mss_max int
-	mss_dev float64
+	logger  log.Logger
+	traceID string
+
+	bias float64
+	// readBias is the bias the peer last retuned to, zero before.
+	// biasEpoch and readBiasEpoch are the epochs of the last retunes of
+	// either direction, which the tables are derived for, zero before.
+	readBias                 float64
+	biasEpoch, readBiasEpoch uint32
+	// readRetuned is the time the peer last retuned, see retuneInterval.
+	readRetuned time.Time
+	// tables is set for the built-in codec, tuner with Config.AdaptiveBias.
+	tables *tableParams
+	tuner  *biasTuner
+	// readTables are the tables of the built-in codec reading, storm the
+	// Config.DecodeStorm of a client, which counts a connection once.
+	readTables   *tableSet
+	storm        *StormDetector
+	stormCounted atomic.Bool
+	// mssTuner is set with Config.AutoMSS, stalls with
+	// Config.BlackholeStall.  mssCeiling, if set, is the chunk length
+	// AutoMSS does not grow beyond once stalls shrank the chunks.
+	mssTuner   *mssTuner
+	stalls     *stallDetector
+	mssCeiling int
+	// carrier is the carrier if it is a Carrier, whose MTU clamps the
+	// chunk lengths.
+	carrier Carrier
+
+	// shapeLock guards the length sampler parameters, which can be replaced
+	// by either peer through Renegotiate.
+	shapeLock  sync.Mutex
+	shapeSeed  []byte
+	shapeEpoch uint32
+	mss_max    int
+	mss_dev    float64
+	// rekeyIn counts down the payload bytes left before the automatic
+	// renegotiation of Config.RekeyAfter.
+	rekeyAfter int64
+	rekeyIn    atomic.Int64
+	onRekey    func(*Conn, RekeyEvent)
+
+	writeLock sync.Mutex
+	scheduler Scheduler
+	// lengthRand samples the chunk lengths.  It is derived from the salted
+	// key of the write direction, lengthKey, so that connections are not
+	// correlated.  lengthDrbg is its source.
+	lengthRand *rand.Rand
+	lengthKey  []byte
+	lengthDrbg *drbg.HashDrbg
+	// frameLens holds the wire lengths of the frames chopped but not
+	// written yet, the encoder's payloadLens their payload lengths.  With
+	// wholeFrames, for disabled length shaping, every frame is a chunk.
+	frameLens   []int
+	wholeFrames bool
+	// writeErr fails every write once a write failed part way through its
+	// frames.
+	writeErr error
+
+	stats connStats
+	wire  *wireConn
+	hooks Hooks
+
+	closeOnFrameError bool
+	ignoreUnknown     bool
+	padOnFlush        bool
+	// hint is the TrafficHint of SetTrafficHint.
+	hint atomic.Int32
+
+	deadPeer  *deadPeer
+	onClose   func(*Conn, CloseReason)
+	closeOnce sync.Once
+	closed    atomic.Bool
+	// peerClose is the close frame received, which Read returns in place
+	// of the error of the carrier.
+	peerClose *CloseError
+
+	// ctx is cancelled once rr is closed, for the background workers
+	// started by spawn.  Close waits for them.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	workerLock sync.Mutex
+	workers    sync.WaitGroup
+
+	// created is the time echoes are stamped relative to, rtt the smoothed
+	// round trip time in nanoseconds.  probeReplies takes the stamps of the
+	// echo replies while Probe runs.
+	created      time.Time
+	rtt          atomic.Int64
+	echoPending  atomic.Bool
+	probeLock    sync.Mutex
+	probeReplies atomic.Pointer[chan uint64]
+
+	// firstFrame is the silent drop timer of Listener.FirstFrameTimeout,
+	// firstFrameDone is set once it either fired or was disarmed.
+	firstFrame     *time.Timer
+	firstFrameDone atomic.Bool
+
+	// failure is the camouflage run on rejected frames, if any.  Once it
+	// took over the underlying conn, camouflaged is set and Read returns
+	// failErr.
+	failure     *failureHandler
+	camouflaged atomic.Bool
+	failErr     error
+
+	// saltOut is the expanded salt of the write direction until it is sent.
+	// readKey is the unsalted key of the read direction until the peer's
+	// salt, collected in saltIn, has arrived.
+	saltOut   []byte
+	saltIn    []byte
+	saltInLen int
+	readKey   []byte
+	lookahead int
+	keyLog    *keyLog
+	// keyCommitment appends commitTagLength bytes to the salt, see
+	// Config.KeyCommitment.
+	keyCommitment bool
+	// replay refuses salts seen before, see Listener.Replay.
+	replay *ReplayFilter
+	// kex is the key exchange of Config.KeyExchange, if any.
+	kex *keyExchange
+	// clientID is set once a token authorized the client, see ClientID.
+	clientID atomic.Pointer[string]
 
 	Encoder *riverrunEncoder
 	Decoder *riverrunDecoder
 }
 
-func get_rng(seed *drbg.Seed) (*rand.Rand, error) {
-	xdrbg, err := drbg.NewHashDrbg(seed)
+func get_rng(seed *drbg.Seed, personalization string) (*rand.Rand, error) {
+	xdrbg, err := drbg.NewHashDrbgPersonalized(seed, []byte(personalization))
 	if err != nil {
 		return nil, err
 	}
 	return rand.New(xdrbg), nil
 }
 
-func get_mss(seed *drbg.Seed) (int, error) {
-	rng, err := get_rng(seed)
+func get_mss(seed *drbg.Seed, personalization string, shape *Shape) (int, error) {
+	rng, err := get_rng(seed, personalization)
 	if err != nil {
 		return 0, err
 	}
-	return int(rng.Float64()*float64(800)) + 600, nil
+	return shape.mss(rng), nil
 }
 
+// HandshakeTimeoutError is the error returned by NewConnContext when the
+// context is done before the connection is ready.
+type HandshakeTimeoutError struct {
+	Err error
+}
+
+func (e *HandshakeTimeoutError) Error() string {
+	return fmt.Sprintf("riverrun: handshake aborted: %s", e.Err)
+}
+
+func (e *HandshakeTimeoutError) Unwrap() error { return e.Err }
+
+// Timeout implements net.Error.
+func (e *HandshakeTimeoutError) Timeout() bool { return true }
+
+// Temporary implements net.Error.  Retrying the same handshake on the same
+// conn does not help, so it is not temporary.
+func (e *HandshakeTimeoutError) Temporary() bool { return false }
+
+// aLongTimeAgo is used to unblock pending IO on the underlying conn.
+var aLongTimeAgo = time.Unix(1, 0)
+
 func NewConn(conn net.Conn, isServer bool, seed *drbg.Seed, logger log.Logger) (*Conn, error) {
+	return NewConnContext(context.Background(), conn, isServer, seed, logger)
+}
 
-	rng, err := get_rng(seed)
+// NewConnContext is like NewConn, but gives up once ctx is done.  Table
+// generation stops as well, and any blocked IO on conn is interrupted by a
+// deadline in the past, which is cleared again before NewConnContext returns,
+// so that conn is left usable.  The caller remains responsible for closing
+// conn.
+func NewConnContext(ctx context.Context, conn net.Conn, isServer bool, seed *drbg.Seed, logger log.Logger) (*Conn, error) {
+	return NewConnConfig(ctx, conn, isServer, seed, &Config{Logger: logger})
+}
 
-	key := make([]byte, 16)
-	rng.Read(key)
-	block, err := aes.NewCipher(key)
-	if err != nil {
+// NewConnConfig is like NewConnContext, with the optional settings taken from
+// config.  A nil config selects the defaults.
+func NewConnConfig(ctx context.Context, conn net.Conn, isServer bool, seed *drbg.Seed, config *Config) (*Conn, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
 		return nil, err
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, &HandshakeTimeoutError{Err: err}
+	}
+	ctx, span := startSpan(withTracer(ctx, config.Tracer), SpanHandshake)
+	span.SetBool(AttrServer, isServer)
 
-	// We select the minimal expansion factors
-	// The full range is commented out
-	compressedBlockBits := uint64(16) // uint64((rng.Intn(2) + 1) * 8)
-
-	var expandedBlockBits uint64
-	var expandedBlockBits8 uint64
-	if compressedBlockBits == 8 {
-		expandedBlockBits = uint64((rng.Intn(6) + 3) * 8)
-		expandedBlockBits8 = expandedBlockBits
-	} else {
-		expandedBlockBits = 32 // uint64((rng.Intn(3) + 2) * 16)
-		expandedBlockBits8 = expandedBlockBits / 2
+	type result struct {
+		rr  *Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rr, err := newConn(ctx, conn, isServer, seed, config)
+		done <- result{rr, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err == nil {
+			span.SetString(AttrTraceID, res.rr.traceID)
+		}
+		span.End(res.err)
+		return res.rr, res.err
+	case <-ctx.Done():
+		conn.SetDeadline(aLongTimeAgo)
+		// The generation of the tables stops with ctx, and the deadline
+		// ends any IO, so the handshake returns soon.  Wait for it, so
+		// that nothing uses conn once the deadline is cleared.
+		if res := <-done; res.err == nil {
+			res.rr.abandon()
+		}
+		conn.SetDeadline(time.Time{})
+		err := &HandshakeTimeoutError{Err: ctx.Err()}
+		span.End(err)
+		return nil, err
 	}
+}
 
-	bias := rng.Float64()*.2 + .1 // Targeting entropy of 4-7 based on observations
+func newConn(ctx context.Context, conn net.Conn, isServer bool, seed *drbg.Seed, config *Config) (*Conn, error) {
+	traceID, err := newTraceID()
+	if err != nil {
+		return nil, err
+	}
+	// The parameters are logged along with the connection.
+	derive := *config
+	derive.Logger = traceLogger(config.Logger, traceID)
+	p, err := deriveParams(ctx, seed, &derive)
+	if err != nil {
+		return nil, err
+	}
+	return attachConnTrace(conn, p, isServer, config, traceID)
+}
 
-	logger.Infof("rr: Set bias to %f, compressed block bits to %d, expanded block bits to %d", bias, compressedBlockBits, expandedBlockBits)
+// traceLogger returns logger starting every line with traceID.
+func traceLogger(logger log.Logger, traceID string) log.Logger {
+	return log.WithPrefix(logger, "["+traceID+"] ")
+}
 
-	iv := make([]byte, block.BlockSize())
-	rng.Read(iv)
-	table8, table16, err := getTables(expandedBlockBits8, expandedBlockBits, bias, key, block, iv, logger)
+// attachConn sets up a Conn over conn from the derived parameters.
+func attachConn(conn net.Conn, p *Params, isServer bool, config *Config) (*Conn, error) {
+	traceID, err := newTraceID()
 	if err != nil {
 		return nil, err
 	}
+	return attachConnTrace(conn, p, isServer, config, traceID)
+}
 
-	var readStream, writeStream cipher.Stream
-	rng.Read(iv)
-	stream := cipher.NewCTR(block, iv)
-	readKey := make([]byte, drbg.SeedLength)
-	writeKey := make([]byte, drbg.SeedLength)
-	logger.Debugf("riverrun: r/w keys made")
-
+// attachConnTrace is attachConn for the connection traceID.
+func attachConnTrace(conn net.Conn, p *Params, isServer bool, config *Config, traceID string) (*Conn, error) {
+	var err error
+	logger := traceLogger(config.Logger, traceID)
+	if config.Quota != nil {
+		if err := config.Quota.Account(0, 0); err != nil {
+			return nil, err
+		}
+	}
+	builtin := p.builtin()
+	up, down := &p.c2s, &p.s2c
+	write, read := up, down
 	if isServer {
-		readStream = stream
-		rng.Read(iv)
-		writeStream = cipher.NewCTR(block, iv)
-		rng.Read(readKey)
-		rng.Read(writeKey)
-	} else {
-		writeStream = stream
-		rng.Read(iv)
-		readStream = cipher.NewCTR(block, iv)
-		rng.Read(writeKey)
-		rng.Read(readKey)
+		write, read = down, up
+	}
+
+	var keyLog *keyLog
+	if config.KeyLog != nil {
+		keyLog = newKeyLog(config.KeyLog, isServer, traceID)
+		if builtin {
+			keyLog.table("c2s", up.tableKey, up.tableIV, up.bias, p.expandedBlockBits8, p.expandedBlockBits)
+			keyLog.table("s2c", down.tableKey, down.tableIV, down.bias, p.expandedBlockBits8, p.expandedBlockBits)
+		}
 	}
-	logger.Debugf("riverrun: Loaded keys properly")
+
+	// Both unsalted keystreams use the key of the c2s tables.
+	block, err := aes.NewCipher(up.tableKey)
+	if err != nil {
+		return nil, err
+	}
+	writeStream := newSeekableCTR(block, write.streamIV, 0)
+	readStream := newSeekableCTR(block, read.streamIV, 0)
+	writeKey := append([]byte(nil), write.drbgKey...)
+	readKey := append([]byte(nil), read.drbgKey...)
+
 	rr := new(Conn)
 	rr.Conn = conn
+	carrier := conn
+	if config.ReorderWindow > 0 {
+		if carrier, err = reorder.NewConn(conn, config.ReorderWindow); err != nil {
+			return nil, err
+		}
+	}
+	rr.carrier, _ = carrier.(Carrier)
+	rr.traceID = traceID
 	rr.logger = logger
-	rr.bias = bias
-	rr.mss_max, err = get_mss(seed)
-	if err != nil {
+	rr.hooks = config.Hooks
+	rr.closeOnFrameError = config.CloseOnFrameError
+	rr.ignoreUnknown = config.IgnoreUnknownPacketTypes
+	rr.padOnFlush = config.PadOnFlush
+	rr.hint.Store(int32(config.TrafficHint))
+	rr.lookahead = config.KeystreamLookahead
+	rr.keyCommitment = config.KeyCommitment
+	rr.keyLog = keyLog
+	rr.onClose = config.OnClose
+	if !isServer {
+		rr.storm = config.DecodeStorm
+	}
+	rr.onRekey = config.OnRekey
+	rr.rekeyAfter = config.RekeyAfter
+	rr.rekeyIn.Store(config.RekeyAfter)
+	rr.created = time.Now()
+	rr.ctx, rr.cancel = context.WithCancel(withTracer(context.Background(), config.Tracer))
+	rr.deadPeer = newDeadPeer(config.ReadIdleTimeout, config.WriteTimeout, rr.teardown)
+	rr.wire = &wireConn{Conn: carrier, stats: &rr.stats, deadPeer: rr.deadPeer, quota: config.Quota, teardown: rr.teardown}
+	if config.BlackholeStall > 0 {
+		rr.stalls = &stallDetector{stall: config.BlackholeStall}
+		rr.wire.stalls = rr.stalls
+	}
+	rr.scheduler = config.Scheduler(rr.wire)
+
+	var writeCodec, readCodec f.Codec
+	if builtin {
+		writeCodec = &ctstretchCodec{
+			table8:              write.tables.table8,
+			table16:             write.tables.table16,
+			compressedBlockBits: p.compressedBlockBits,
+			expandedBlockBits:   p.expandedBlockBits,
+			logger:              logger,
+		}
+		readTables := read.tables
+		rr.readTables = readTables
+		rc := &ctstretchCodec{
+			table8:              readTables.table8,
+			table16:             readTables.table16,
+			compressedBlockBits: p.compressedBlockBits,
+			expandedBlockBits:   p.expandedBlockBits,
+			logger:              logger,
+		}
+		rc.inv8, rc.inv16 = readTables.inversions(config.ConstantTimeLookups, config.LowMemory)
+		readCodec = rc
+
+		rr.tables = &tableParams{
+			bits8:        p.expandedBlockBits8,
+			bits:         p.expandedBlockBits,
+			compressed:   p.compressedBlockBits,
+			tableDir:     config.TableDir,
+			constantTime: config.ConstantTimeLookups,
+			lowMemory:    config.LowMemory,
+			biasMin:      math.Max(minAdaptiveBias, config.Shape.BiasMin),
+			biasMax:      math.Min(maxAdaptiveBias, config.Shape.BiasMax),
+			writeKey:     write.tableKey,
+			writeIV:      write.tableIV,
+			readKey:      read.tableKey,
+			readIV:       read.tableIV,
+		}
+		if config.AdaptiveBias {
+			rr.tuner = &biasTuner{window: config.AdaptiveWindow, min: config.MinEntropy, max: config.MaxEntropy}
+		}
+	} else if writeCodec, readCodec, err = newCodecs(config.Codec, isServer, p.seed, config); err != nil {
 		return nil, err
 	}
-	rr.mss_dev = rng.Float64() * 4
-	logger.Infof("Set mss_max to %v, mss_dev to %v", rr.mss_max, rr.mss_dev)
+
+	rr.bias, rr.mss_max, rr.mss_dev, rr.shapeSeed = write.bias, write.mss, write.dev, write.shapeSeed
+	if config.AutoMSS {
+		rr.mssTuner = &mssTuner{rate: config.AutoMSSRate, interval: autoMSSInterval, readSeed: read.shapeSeed, readMSS: read.mss}
+	}
+	logParams(logger, "Set mss_max to %v, mss_dev to %v", rr.mss_max, rr.mss_dev)
+	if config.EntropySelfTest != SelfTestOff {
+		if err = entropySelfTest(writeCodec, config); err != nil {
+			return nil, err
+		}
+	}
+
 	// Encoder
-	rr.Encoder = newRiverrunEncoder(writeKey, writeStream, table8, table16, compressedBlockBits, expandedBlockBits, logger)
+	if err = checkFrameLength(config.MaxFrameLength, config.FrameHeader, writeCodec, readCodec); err != nil {
+		return nil, err
+	}
+	rr.Encoder = newRiverrunEncoder(writeKey, writeStream, writeCodec, config.MaxFrameLength, logger)
+	rr.Encoder.stats = &rr.stats
+	rr.Encoder.hooks = config.Hooks
+	rr.Encoder.traceID = traceID
+	rr.Encoder.compression = config.Compression
+	rr.Encoder.workers = config.EncodeWorkers
+	rr.Encoder.spanThreshold = config.SpanThreshold
+	rr.wholeFrames = config.DisableLengthShaping
+	rr.Encoder.OnPacket = rr.onPacket
+	if err = rr.initSalt(writeKey); err != nil {
+		return nil, err
+	}
 	logger.Debugf("riverrun: Encoder initialized")
 	// Decoder
-	rr.Decoder = newRiverrunDecoder(readKey, readStream, ctstretch.InvertTable(table8), ctstretch.InvertTable(table16), compressedBlockBits, expandedBlockBits, logger)
+	rr.Decoder = newRiverrunDecoder(readKey, readStream, readCodec, config.MaxFrameLength, logger)
+	rr.Decoder.onRenegotiate = rr.handleRenegotiate
+	rr.Decoder.onExtension = rr.handleExtension
+	rr.Decoder.onEcho = rr.handleEcho
+	rr.Decoder.stats = &rr.stats
+	rr.Decoder.hooks = config.Hooks
+	rr.Decoder.traceID = traceID
+	rr.Decoder.Strict = config.StrictFrames
+	if config.MaxBufferedBytes > 0 {
+		rr.Decoder.MaxBuffered = config.MaxBufferedBytes
+	}
+	if rr.keyLog != nil {
+		rr.Decoder.onFrame = func(wireLen int) {
+			rr.keyLog.frame(rr.keyLog.readDir, &rr.keyLog.readOffset, wireLen)
+		}
+	}
+	if config.KeyExchange != KeyExchangeNone {
+		if err = rr.initKeyExchange(config.KeyExchange, writeKey, readKey, isServer); err != nil {
+			return nil, err
+		}
+	}
+	rr.Decoder.onPeerClose = rr.handlePeerClose
+	if onRotation := config.OnSeedRotation; onRotation != nil {
+		rr.Decoder.onRotation = func(body []byte) error { return rr.handleSeedRotation(onRotation, body) }
+	}
+	if len(config.AuthToken) > 0 && !isServer {
+		if err = rr.queueAuth(config.AuthToken); err != nil {
+			return nil, err
+		}
+	}
+	if config.FrameHeader != FrameHeaderLength {
+		if err = rr.queueFrameHeader(config.FrameHeader); err != nil {
+			return nil, err
+		}
+	}
+	rr.readKey = readKey
+	rr.saltIn = make([]byte, readCodec.ExpandedLen(rr.saltBlobLength()))
+	if interval := config.EchoInterval; interval > 0 {
+		rr.spawn(func() { rr.sendEchoes(interval) })
+	}
+	rr.deadPeer.start()
 	logger.Debugf("riverrun: Initialized")
 	return rr, nil
 }
 
-var cache8 map[string][]uint64
-var cache16 map[string][]uint64
+// checkFrameLength checks that frames of length bytes carry a payload byte,
+// and that their length fits the length field, with both codecs.
+func checkFrameLength(length int, header FrameHeader, codecs ...f.Codec) error {
+	limit := math.MaxUint16
+	if header == FrameHeaderTyped || header == FrameHeaderChecked {
+		limit = 1<<f.LengthBits - 1
+	}
+	for _, codec := range codecs {
+		lengthLength := codec.ExpandedLen(f.LengthLength)
+		if length < lengthLength+codec.ExpandedLen(f.TypeLength+1) || length-lengthLength > limit {
+			return fmt.Errorf("riverrun: invalid max frame length: %d", length)
+		}
+	}
+	return nil
+}
+
+// tableSet holds the forward and inverted tables derived from one key.  A
+// tableSet is shared read-only by every connection using that key.
+type tableSet struct {
+	table8  []uint64
+	table16 []uint64
+
+	// The inversions are built on first use, as the tables of the write
+	// direction need none.
+	mapOnce           sync.Once
+	revTable8         map[uint64]uint64
+	revTable16        map[uint64]uint64
+	sortedOnce        sync.Once
+	sorted8, sorted16 *ctstretch.SortedInversion
+}
+
+// inversions returns the inversions reading uses, see
+// Config.ConstantTimeLookups and Config.LowMemory.
+func (t *tableSet) inversions(constantTime, lowMemory bool) (inv8, inv16 ctstretch.Inversion) {
+	switch {
+	case constantTime:
+		return ctstretch.ScanInversion(t.table8), ctstretch.ScanInversion(t.table16)
+	case lowMemory:
+		t.sortedOnce.Do(func() {
+			t.sorted8, t.sorted16 = ctstretch.NewSortedInversion(t.table8), ctstretch.NewSortedInversion(t.table16)
+		})
+		return t.sorted8, t.sorted16
+	default:
+		t.mapOnce.Do(func() {
+			t.revTable8, t.revTable16 = ctstretch.InvertTable(t.table8), ctstretch.InvertTable(t.table16)
+		})
+		return ctstretch.MapInversion(t.revTable8), ctstretch.MapInversion(t.revTable16)
+	}
+}
+
+var cache = make(map[string]*tableSet)
 var mutex = &sync.Mutex{}
 
-func getTables(expandedBlockBits8 uint64, expandedBlockBits uint64, bias float64, key []byte, block cipher.Block, iv []byte, logger log.Logger) ([]uint64, []uint64, error) {
+// TableCacheStats describes the tables cached by the process, shared by every
+// Conn and Params using the same keys.
+type TableCacheStats struct {
+	// Entries counts the cached table sets, TableBytes the size of their
+	// forward tables, whether in memory or mapped from a TableDir.
+	Entries    int   `json:"entries"`
+	TableBytes int64 `json:"table_bytes"`
+}
 
+// TableCache returns the current occupancy of the table cache.
+func TableCache() TableCacheStats {
 	mutex.Lock()
-	if cache8 == nil {
-		cache8 = make(map[string][]uint64)
+	defer mutex.Unlock()
+	stats := TableCacheStats{Entries: len(cache)}
+	for _, t := range cache {
+		stats.TableBytes += 8 * int64(len(t.table8)+len(t.table16))
 	}
-	if cache16 == nil {
-		cache16 = make(map[string][]uint64)
-	}
-	mutex.Unlock()
+	return stats
+}
 
+// getTables returns the tables of key, from the cache or the table files if
+// possible.  Generating them stops with the error of ctx once it is done, and
+// reports the fraction complete to progress, if not nil.
+func getTables(ctx context.Context, progress func(fraction float64), expandedBlockBits8 uint64, expandedBlockBits uint64, bias float64, key []byte, block cipher.Block, iv []byte, tableDir string, logger log.Logger) (tables *tableSet, err error) {
+	_, span := startSpan(ctx, SpanTables)
+	generated := false
+	defer func() {
+		span.SetBool(AttrCacheHit, !generated)
+		span.End(err)
+	}()
+
+	// Tables are cached by fingerprint, as the same key is used with
+	// other biases and block sizes.
+	fingerprint := tableFingerprint(expandedBlockBits8, expandedBlockBits, bias, key, iv)
 	mutex.Lock()
-	table8, ok := cache8[string(key)]
+	tables, ok := cache[string(fingerprint[:])]
 	mutex.Unlock()
 	if ok {
-		mutex.Lock()
-		table16, ok := cache16[string(key)]
-		mutex.Unlock()
-		if ok {
-			logger.Debugf("riverrun: using cached tables")
-			return table8, table16, nil
+		logger.Debugf("riverrun: using cached tables")
+		if progress != nil {
+			progress(1)
 		}
+		return tables, nil
 	}
 
-	logger.Debugf("riverrun: Generating fresh tables")
-	stream := cipher.NewCTR(block, iv)
-
-	table8, err := ctstretch.SampleBiasedStrings(expandedBlockBits8, 256, bias, stream)
-	if err != nil {
-		return nil, nil, err
+	var table8, table16 []uint64
+	var macKey []byte
+	if tableDir != "" {
+		macKey = tableFileMACKey(key)
+		table8, table16, err = loadTableFile(tableDir, fingerprint, macKey, expandedBlockBits8, expandedBlockBits)
+		if err == nil {
+			logger.Debugf("riverrun: using mapped tables")
+		} else if !os.IsNotExist(err) {
+			logger.Infof("riverrun: ignoring table file: %s", err)
+		}
+		if table8 != nil && progress != nil {
+			progress(1)
+		}
 	}
-	logger.Debugf("riverrun: table8 prepped")
-	table16, err := ctstretch.SampleBiasedStrings(expandedBlockBits, 65536, bias, stream)
-	if err != nil {
-		return nil, nil, err
+
+	if table8 == nil {
+		generated = true
+		logger.Debugf("riverrun: Generating fresh tables")
+		stream := cipher.NewCTR(block, iv)
+
+		// Both tables count towards progress by their entries.
+		step := func(base uint64) func(done uint64) error {
+			return func(done uint64) error {
+				if progress != nil {
+					progress(float64(base+done) / (256 + 65536))
+				}
+				return ctx.Err()
+			}
+		}
+		table8, err = ctstretch.SampleBiasedStringsFunc(expandedBlockBits8, 256, bias, stream, step(0))
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("riverrun: table8 prepped")
+		table16, err = ctstretch.SampleBiasedStringsFunc(expandedBlockBits, 65536, bias, stream, step(256))
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("riverrun: table16 prepped")
+
+		if tableDir != "" {
+			err = storeTableFile(tableDir, fingerprint, macKey, expandedBlockBits8, expandedBlockBits, table8, table16)
+			if err != nil {
+				logger.Infof("riverrun: failed to store table file: %s", err)
+			} else if mapped8, mapped16, err := loadTableFile(tableDir, fingerprint, macKey, expandedBlockBits8, expandedBlockBits); err == nil {
+				// Drop the private copy in favour of the shared one.
+				table8, table16 = mapped8, mapped16
+			}
+		}
 	}
-	logger.Debugf("riverrun: table16 prepped")
+
+	tables = &tableSet{table8: table8, table16: table16}
 
 	mutex.Lock()
-	cache8[string(key)] = table8
-	cache16[string(key)] = table16
+	cache[string(fingerprint[:])] = tables
 	mutex.Unlock()
 
-	return table8, table16, nil
+	return tables, nil
 }
 
 type riverrunEncoder struct {
@@ -184,39 +705,50 @@ type riverrunEncoder struct {
 	logger log.Logger
 
 	writeStream cipher.Stream
-
-	table8  []uint64
-	table16 []uint64
-
-	compressedBlockBits uint64
-	expandedBlockBits   uint64
+	codec       f.Codec
+	// drbgKey is the key of Drbg, for Seek.
+	drbgKey []byte
+
+	stats   *connStats
+	hooks   Hooks
+	traceID string
+
+	compression Compression
+	workers     int
+	// spanThreshold is Config.SpanThreshold.
+	spanThreshold int
+	skipFrames    int
+	compressBuf   []byte
+
+	// payloadLens holds the payload carried by each frame chopped, in the
+	// order of Conn.frameLens.
+	payloadLens []int
 }
 
 func (encoder *riverrunEncoder) payloadOverhead(payloadLen int) int {
-	return int(ctstretch.ExpandedNBytes(uint64(payloadLen), encoder.compressedBlockBits, encoder.expandedBlockBits)) - payloadLen
+	return encoder.codec.ExpandedLen(payloadLen) - payloadLen
 }
 func (decoder *riverrunDecoder) payloadOverhead(payloadLen int) int {
-	return int(ctstretch.ExpandedNBytes(uint64(payloadLen), decoder.compressedBlockBits, decoder.expandedBlockBits)) - payloadLen
+	return decoder.codec.ExpandedLen(payloadLen) - payloadLen
 }
 
-func newRiverrunEncoder(key []byte, writeStream cipher.Stream, table8, table16 []uint64, compressedBlockBits, expandedBlockBits uint64, logger log.Logger) *riverrunEncoder {
+// newRiverrunEncoder returns an encoder of frames up to segmentLength bytes,
+// length field included.
+func newRiverrunEncoder(key []byte, writeStream cipher.Stream, codec f.Codec, segmentLength int, logger log.Logger) *riverrunEncoder {
 	encoder := new(riverrunEncoder)
 	encoder.logger = logger
 
-	encoder.Drbg = f.GenDrbg(key[:])
-	encoder.MaxPacketPayloadLength = int(ctstretch.CompressedNBytes_floor(f.MaximumSegmentLength-ctstretch.ExpandedNBytes(uint64(f.LengthLength), compressedBlockBits, expandedBlockBits), expandedBlockBits, compressedBlockBits))
-	encoder.LengthLength = int(ctstretch.ExpandedNBytes(uint64(f.LengthLength), compressedBlockBits, expandedBlockBits))
+	encoder.setKeys(key, writeStream)
+	encoder.SegmentLength = segmentLength
+	encoder.MaxPacketPayloadLength = codec.CompressedLen(segmentLength-codec.ExpandedLen(f.LengthLength)) - f.TypeLength
+	encoder.LengthLength = codec.ExpandedLen(f.LengthLength)
 	encoder.PayloadOverhead = encoder.payloadOverhead
 
 	encoder.Encode = encoder.encode
 	encoder.ProcessLength = encoder.processLength
 	encoder.ChopPayload = encoder.makePayload
 
-	encoder.writeStream = writeStream
-	encoder.table8 = table8
-	encoder.table16 = table16
-	encoder.compressedBlockBits = compressedBlockBits
-	encoder.expandedBlockBits = expandedBlockBits
+	encoder.codec = codec
 
 	encoder.Type = "rr"
 
@@ -227,52 +759,105 @@ func (encoder *riverrunEncoder) processLength(length uint16) ([]byte, error) {
 	lengthBytes := make([]byte, f.LengthLength)
 	binary.BigEndian.PutUint16(lengthBytes[:], length)
 	lengthBytesEncoded := make([]byte, encoder.LengthLength)
-	err := ctstretch.ExpandBytes(lengthBytes[:], lengthBytesEncoded, encoder.compressedBlockBits, encoder.expandedBlockBits, encoder.table16, encoder.table8, encoder.writeStream, rand.Int(), encoder.logger)
+	err := encoder.expandBytes(lengthBytes[:], lengthBytesEncoded)
 	return lengthBytesEncoded, err
 }
 
+func (encoder *riverrunEncoder) expandBytes(raw, res []byte) error {
+	return encoder.codec.Expand(res, raw, encoder.writeStream)
+}
+
 func (encoder *riverrunEncoder) encode(frame, payload []byte) (n int, err error) {
-	tb := rand.Int()
-	expandedNBytes := int(ctstretch.ExpandedNBytes(uint64(len(payload)), encoder.compressedBlockBits, encoder.expandedBlockBits))
+	expandedNBytes := encoder.codec.ExpandedLen(len(payload))
 	frameLen := encoder.LengthLength + expandedNBytes
-	encoder.logger.Debugf("Encoding frame of length %d, with payload of length %d. TB: %d", frameLen, expandedNBytes, tb)
-	err = ctstretch.ExpandBytes(payload[:], frame, encoder.compressedBlockBits, encoder.expandedBlockBits, encoder.table16, encoder.table8, encoder.writeStream, tb, encoder.logger)
+	if !log.Hardened {
+		encoder.logger.Debugf("Encoding frame of length %d, with payload of length %d", frameLen, expandedNBytes)
+	}
+	err = encoder.codec.Expand(frame[:expandedNBytes], payload, encoder.writeStream)
 	if err != nil {
 		return 0, err
 	}
 	return expandedNBytes, err
 }
 func (encoder *riverrunEncoder) makePayload(pktType uint8, payload []byte) []byte {
-	if pktType != PacketTypePayload {
-		panic(fmt.Sprintf("BUG: pktType was not packetTypePayload for Riverrun"))
+	if !knownPacketType(pktType) {
+		panic(fmt.Sprintf("BUG: unsupported pktType %d for Riverrun", pktType))
+	}
+	pkt := make([]byte, f.TypeLength+len(payload))
+	pkt[0] = pktType
+	if pktType == PacketTypePayload {
+		encoder.payloadLens = append(encoder.payloadLens, len(payload))
+	} else {
+		// chopCompressed fills in the input of compressed frames.
+		encoder.payloadLens = append(encoder.payloadLens, 0)
 	}
-	return payload[:]
+	encoder.stats.framesOut.Add(1)
+	encoder.hooks.OnFrameSent(FrameEvent{
+		Time:          time.Now(),
+		TraceID:       encoder.traceID,
+		Type:          pktType,
+		PayloadLength: len(pkt),
+		WireLength:    encoder.LengthLength + len(pkt) + encoder.payloadOverhead(len(pkt)),
+	})
+	copy(pkt[f.TypeLength:], payload)
+	return pkt
 }
 
 type riverrunDecoder struct {
 	f.BaseDecoder
 
 	readStream cipher.Stream
-
-	revTable8  map[uint64]uint64
-	revTable16 map[uint64]uint64
-
-	compressedBlockBits uint64
-	expandedBlockBits   uint64
+	codec      f.Codec
+	// drbgKey is the key of Drbg, for Seek.
+	drbgKey []byte
+
+	onRenegotiate func(body []byte) error
+	onExtension   func(typ uint8, body []byte) error
+	onEcho        func(typ uint8, body []byte) error
+	onKeyExchange func(body []byte) error
+	onAuth        func(token []byte) error
+	onRotation    func(body []byte) error
+	onPeerClose   func(body []byte) error
+	onFrame       func(wireLen int)
+	// onFirstFrame, if set, is called once the first frame is received.
+	onFirstFrame func()
+	stats        *connStats
+	hooks        Hooks
+	traceID      string
+	// expectKeyExchange is set until the first frame, which must then be a
+	// PacketTypeKeyExchange.
+	expectKeyExchange bool
+	// expectAuth is set until a token was accepted, see Listener.Authority.
+	expectAuth bool
+	// header is the layout the peer announced, FrameHeaderLength until it
+	// did.
+	header FrameHeader
+
+	// partialType and partialBody hold the packet type and, for control
+	// packets, the body of the frame being decoded piecewise.
+	partialType   uint8
+	partialBody   []byte
+	partialLength int
 
 	logger log.Logger
 }
 
-func newRiverrunDecoder(key []byte, readStream cipher.Stream, revTable8, revTable16 map[uint64]uint64, compressedBlockBits, expandedBlockBits uint64, logger log.Logger) *riverrunDecoder {
+// newRiverrunDecoder returns a decoder of frames up to segmentLength bytes,
+// length field included.
+func newRiverrunDecoder(key []byte, readStream cipher.Stream, codec f.Codec, segmentLength int, logger log.Logger) *riverrunDecoder {
 	decoder := new(riverrunDecoder)
 	decoder.logger = logger
 	decoder.BaseDecoder.SetLogger(logger)
 
-	decoder.Drbg = f.GenDrbg(key[:])
-	decoder.LengthLength = int(ctstretch.ExpandedNBytes(uint64(f.LengthLength), compressedBlockBits, expandedBlockBits))
-	decoder.MinPayloadLength = int(ctstretch.ExpandedNBytes(uint64(1), compressedBlockBits, expandedBlockBits))
-	decoder.PacketOverhead = 0 // f.LengthLength
-	decoder.MaxFramePayloadLength = f.MaximumSegmentLength - decoder.LengthLength
+	decoder.setKeys(key, readStream)
+	decoder.LengthLength = codec.ExpandedLen(f.LengthLength)
+	decoder.MinPayloadLength = codec.ExpandedLen(1)
+	decoder.PacketOverhead = f.TypeLength
+	decoder.SegmentLength = segmentLength
+	decoder.MaxFramePayloadLength = segmentLength - decoder.LengthLength
+	decoder.ValidLength = func(length int) bool {
+		return codec.ExpandedLen(codec.CompressedLen(length)) == length
+	}
 
 	// NextLength is set programatically
 	// NextLengthInvalid is set programatically
@@ -283,14 +868,13 @@ func newRiverrunDecoder(key []byte, readStream cipher.Stream, revTable8, revTabl
 	decoder.DecodePayload = decoder.decodePayload
 	decoder.ParsePacket = decoder.parsePacket
 	decoder.Cleanup = decoder.cleanup
+	decoder.PartialBlockLength = codec.BlockLen()
+	decoder.DecodePartial = decoder.decodePartial
+	decoder.DecodeSpan = decoder.decodeSpan
 
 	decoder.InitBuffers()
 
-	decoder.readStream = readStream
-	decoder.revTable8 = revTable8
-	decoder.revTable16 = revTable16
-	decoder.compressedBlockBits = compressedBlockBits
-	decoder.expandedBlockBits = expandedBlockBits
+	decoder.codec = codec
 
 	return decoder
 }
@@ -309,13 +893,59 @@ func (decoder *riverrunDecoder) decodeLength(lengthBytes []byte) (uint16, error)
 }
 
 func (decoder *riverrunDecoder) parsePacket(decoded []byte, decLen int) error {
-	/*
-		originalNBytes := binary.BigEndian.Uint16(decoded[:f.LengthLength]) // TODO: Ensure this is encoded
-		if int(originalNBytes) > decLen-decoder.PacketOverhead {
-			return f.InvalidPayloadLengthError(int(originalNBytes))
+	decoder.frameReceived(decoded[0], decLen)
+	if err := decoder.checkKeyExchange(decoded[0]); err != nil {
+		return err
+	}
+	if err := decoder.checkAuth(decoded[0]); err != nil {
+		return err
+	}
+	if err := decoder.checkHeaderType(decoded[0]); err != nil {
+		return err
+	}
+	body := decoded[decoder.PacketOverhead:decLen]
+	switch decoded[0] {
+	case PacketTypePayload:
+		decoder.ReceiveDecodedBuffer.Write(body)
+	case PacketTypeRenegotiate:
+		if decoder.onRenegotiate == nil {
+			return ErrUnknownPacketType
 		}
-	*/
-	decoder.ReceiveDecodedBuffer.Write(decoded[decoder.PacketOverhead:decLen])
+		return decoder.onRenegotiate(body)
+	case PacketTypeCompressed:
+		return decoder.decompress(body)
+	case PacketTypePadding:
+	case PacketTypeEcho, PacketTypeEchoReply:
+		if decoder.onEcho == nil {
+			return ErrUnknownPacketType
+		}
+		return decoder.onEcho(decoded[0], body)
+	case PacketTypeKeyExchange:
+		if decoder.onKeyExchange == nil {
+			return ErrUnknownPacketType
+		}
+		return decoder.onKeyExchange(body)
+	case PacketTypeAuth:
+		// Servers without an Authority take no notice of tokens.
+		if decoder.onAuth != nil {
+			return decoder.onAuth(body)
+		}
+	case PacketTypeSeedRotation:
+		if decoder.onRotation != nil {
+			return decoder.onRotation(body)
+		}
+	case PacketTypeClose:
+		return decoder.onPeerClose(body)
+	case PacketTypeSpan:
+		return decoder.startSpan(body)
+	case PacketTypeFrameHeader:
+		return decoder.setFrameHeader(body)
+	default:
+		if decoder.onExtension == nil {
+			return ErrUnknownPacketType
+		}
+		return decoder.onExtension(decoded[0], body)
+	}
 	return nil
 }
 
@@ -327,43 +957,465 @@ func (decoder *riverrunDecoder) decodePayload(frames *bytes.Buffer) ([]byte, err
 		return nil, err
 	}
 
-	compressedNBytes := ctstretch.CompressedNBytes(uint64(frameLen), decoder.expandedBlockBits, decoder.compressedBlockBits)
+	compressedNBytes := decoder.codec.CompressedLen(frameLen)
 	decodedPayload := make([]byte, compressedNBytes)
 	err = decoder.compressBytes(frame[:frameLen], decodedPayload[:compressedNBytes])
 	if err != nil {
-		decoder.logger.Debugf("Max payload length is %d", int(ctstretch.CompressedNBytes_floor(f.MaximumSegmentLength-ctstretch.ExpandedNBytes(uint64(f.LengthLength), decoder.compressedBlockBits, decoder.expandedBlockBits), decoder.expandedBlockBits, decoder.compressedBlockBits)))
-		decoder.logger.Debugf("CompressedNBytes: %d", compressedNBytes)
-		decoder.logger.Debugf("Got payload of len %d", frameLen)
+		if !log.Hardened {
+			decoder.logger.Debugf("Max payload length is %d", decoder.codec.CompressedLen(decoder.MaxFramePayloadLength))
+			decoder.logger.Debugf("CompressedNBytes: %d", compressedNBytes)
+			decoder.logger.Debugf("Got payload of len %d", frameLen)
+		}
 		return nil, err
 	}
 
 	return decodedPayload[:], nil
 }
 
+func (decoder *riverrunDecoder) frameReceived(pktType uint8, decLen int) {
+	wireLen := decoder.LengthLength + decLen + decoder.payloadOverhead(decLen)
+	decoder.stats.framesIn.Add(1)
+	decoder.hooks.OnFrameReceived(FrameEvent{
+		Time:          time.Now(),
+		TraceID:       decoder.traceID,
+		Type:          pktType,
+		PayloadLength: decLen,
+		WireLength:    wireLen,
+	})
+	if decoder.onFrame != nil {
+		decoder.onFrame(wireLen)
+	}
+	if decoder.onFirstFrame != nil {
+		decoder.onFirstFrame()
+		decoder.onFirstFrame = nil
+	}
+}
+
+// decodePartial decodes a piece of a frame as it arrives.  Payload is released
+// to Read right away, control packets are collected until the frame is
+// complete.
+func (decoder *riverrunDecoder) decodePartial(piece []byte, offset int, final bool) error {
+	decoded := make([]byte, decoder.codec.CompressedLen(len(piece)))
+	if err := decoder.compressBytes(piece, decoded); err != nil {
+		return err
+	}
+	if offset == 0 {
+		decoder.partialType = decoded[0]
+		decoder.partialBody = decoder.partialBody[:0]
+		decoder.partialLength = 0
+		decoded = decoded[f.TypeLength:]
+		if decoder.expectKeyExchange && decoder.partialType != PacketTypeKeyExchange {
+			return ErrKeyExchange
+		}
+		if err := decoder.checkAuth(decoder.partialType); err != nil {
+			return err
+		}
+		if err := decoder.checkHeaderType(decoder.partialType); err != nil {
+			return err
+		}
+	}
+
+	if decoder.partialType == PacketTypePayload {
+		decoder.ReceiveDecodedBuffer.Write(decoded)
+		decoder.partialLength += len(decoded)
+		if final {
+			decoder.frameReceived(PacketTypePayload, f.TypeLength+decoder.partialLength)
+		}
+		return nil
+	}
+
+	decoder.partialBody = append(decoder.partialBody, decoded...)
+	if !final {
+		return nil
+	}
+	pkt := append([]byte{decoder.partialType}, decoder.partialBody...)
+	return decoder.parsePacket(pkt, len(pkt))
+}
+
+// checkKeyExchange fails the first frame unless it is a key exchange
+// message, when one is expected.
+func (decoder *riverrunDecoder) checkKeyExchange(pktType uint8) error {
+	if !decoder.expectKeyExchange {
+		return nil
+	}
+	decoder.expectKeyExchange = false
+	if pktType != PacketTypeKeyExchange {
+		return ErrKeyExchange
+	}
+	return nil
+}
+
+// bits returns the framing TypeBits and CheckBits of header.
+func (header FrameHeader) bits() (typed, checked bool) {
+	return header == FrameHeaderTyped, header == FrameHeaderChecked
+}
+
+// queueFrameHeader queues the announcement of header behind the salt, and
+// switches the encoder to header for the frames following it.
+func (rr *Conn) queueFrameHeader(header FrameHeader) error {
+	frameBuf, _, err := rr.Encoder.Chop([]byte{byte(header)}, PacketTypeFrameHeader)
+	rr.frameLens = rr.frameLens[:0]
+	rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
+	if err != nil {
+		return err
+	}
+	rr.saltOut = append(rr.saltOut, frameBuf.Bytes()...)
+	rr.Encoder.TypeBits, rr.Encoder.CheckBits = header.bits()
+	return nil
+}
+
+// setFrameHeader switches the decoder to the layout the peer announced for
+// the frames following.
+func (decoder *riverrunDecoder) setFrameHeader(body []byte) error {
+	if decoder.header != FrameHeaderLength || len(body) != 1 ||
+		FrameHeader(body[0]) <= FrameHeaderLength || FrameHeader(body[0]) > FrameHeaderChecked {
+		return ErrHeaderType
+	}
+	decoder.header = FrameHeader(body[0])
+	decoder.TypeBits, decoder.CheckBits = decoder.header.bits()
+	return nil
+}
+
+// checkHeaderType fails a frame whose typed length word declared another
+// packet type.
+func (decoder *riverrunDecoder) checkHeaderType(pktType uint8) error {
+	if decoder.TypeBits && decoder.NextType != f.HeaderType(pktType) {
+		return ErrHeaderType
+	}
+	return nil
+}
+
 func (decoder *riverrunDecoder) compressBytes(raw, res []byte) error {
-	return ctstretch.CompressBytes(raw, res, decoder.expandedBlockBits, decoder.compressedBlockBits, decoder.revTable16, decoder.revTable8, decoder.readStream, rand.Int(), decoder.logger)
+	return decoder.codec.Compress(res, raw, decoder.readStream)
 }
 
+// nextLength samples the length of the next chunk written.  It must be called
+// with writeLock held.
 func (rr *Conn) nextLength() int {
-	noise := rand.NormFloat64() * rr.mss_dev
-	if noise < 0 {
-		noise = noise * -1
+	rr.shapeLock.Lock()
+	mssMax, mssDev := rr.mss_max, rr.mss_dev
+	rr.shapeLock.Unlock()
+	mssMax = rr.clampMSS(mssMax)
+	bulk := rr.TrafficHint() == HintBulk
+
+	for {
+		noise := rr.lengthRand.NormFloat64() * mssDev
+		if noise < 0 {
+			noise = noise * -1
+		}
+		if bulk {
+			noise /= 2
+		}
+		if int(noise) < mssMax {
+			return mssMax - int(noise)
+		}
 	}
-	if int(noise) >= rr.mss_max {
-		return rr.nextLength()
+}
+
+// deriveShape returns the length sampler parameters of the write direction
+// for a shaping epoch.  Both peers know the shapeSeed of either direction, so
+// any epoch maps to the same parameters on both sides without further
+// negotiation.
+func (rr *Conn) deriveShape(epoch uint32) (int, float64, error) {
+	return shapeAt(rr.shapeSeed, epoch)
+}
+
+// shapeAt returns the length sampler parameters of the direction of
+// shapeSeed for a shaping epoch.
+func shapeAt(shapeSeed []byte, epoch uint32) (int, float64, error) {
+	seed, err := drbg.SeedFromBytes(shapeSeed)
+	if err != nil {
+		return 0, 0, err
 	}
-	return rr.mss_max - int(noise)
+	raw := seed.Bytes()
+	var epochBytes [renegotiateLength]byte
+	binary.BigEndian.PutUint32(epochBytes[:], epoch)
+	for i, b := range epochBytes {
+		raw[drbg.SeedLength-renegotiateLength+i] ^= b
+	}
+	// The shape seed is personalized already.
+	rng, err := get_rng(seed, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	mssMax := int(rng.Float64()*float64(800)) + 600
+	mssDev := rng.Float64() * 4
+	return mssMax, mssDev, nil
+}
+
+// setShape switches to the parameters of epoch if it is newer than the
+// current one, and reports whether it did.  A non-zero bias is that of a
+// direction retuned along with it, which is reported even for an older epoch.
+func (rr *Conn) setShape(epoch uint32, local bool, bias float64) (bool, error) {
+	mssMax, mssDev, err := rr.deriveShape(epoch)
+	if err != nil {
+		return false, err
+	}
+
+	rr.shapeLock.Lock()
+	newer := epoch > rr.shapeEpoch
+	if newer {
+		rr.shapeEpoch = epoch
+		rr.mss_max = mssMax
+		rr.mss_dev = mssDev
+		rr.rekeyIn.Store(rr.rekeyAfter)
+	}
+	rr.shapeLock.Unlock()
+	if !newer && bias == 0 {
+		return false, nil
+	}
+
+	if newer {
+		logParams(rr.logger, "riverrun: Shaping epoch %d, set mss_max to %v, mss_dev to %v", epoch, mssMax, mssDev)
+	}
+	event := RekeyEvent{Time: time.Now(), TraceID: rr.traceID, Epoch: epoch, Local: local, Bias: bias}
+	rr.hooks.OnRekey(event)
+	if rr.onRekey != nil {
+		rr.onRekey(rr, event)
+	}
+	return newer, nil
+}
+
+// NextRekeyIn returns the payload bytes left to write before the automatic
+// renegotiation of Config.RekeyAfter, or -1 without one.
+func (rr *Conn) NextRekeyIn() int64 {
+	if rr.rekeyAfter == 0 {
+		return -1
+	}
+	if n := rr.rekeyIn.Load(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Renegotiate moves both peers to a freshly derived set of length sampler
+// parameters.  The new parameters apply to local writes immediately and to
+// the peer's writes once it has read the control frame.
+func (rr *Conn) Renegotiate() error {
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+	return rr.renegotiate()
+}
+
+// renegotiate is Renegotiate with the write lock held.
+func (rr *Conn) renegotiate() error {
+	rr.shapeLock.Lock()
+	epoch := rr.shapeEpoch + 1
+	rr.shapeLock.Unlock()
+	return rr.renegotiateTo(epoch)
+}
+
+// renegotiateTo switches both peers to epoch, which must be newer than the
+// current one.  It must be called with the write lock held.
+func (rr *Conn) renegotiateTo(epoch uint32) error {
+	var body [renegotiateLength]byte
+	binary.BigEndian.PutUint32(body[:], epoch)
+	frameBuf, _, err := rr.Encoder.Chop(body[:], PacketTypeRenegotiate)
+	if err != nil {
+		return err
+	}
+	// Switch before the frame hits the wire so that nothing written after it
+	// uses the old parameters.
+	if _, err = rr.setShape(epoch, true, 0); err != nil {
+		return err
+	}
+	_, err = rr.writeFrames(&frameBuf)
+	return err
+}
+
+func (rr *Conn) handleRenegotiate(body []byte) error {
+	var bias float64
+	switch len(body) {
+	case renegotiateLength:
+	case retuneLength:
+		if err := rr.applyBias(body); err != nil {
+			return err
+		}
+		bias = rr.readBias
+	default:
+		return f.InvalidPayloadLengthError(len(body))
+	}
+	_, err := rr.setShape(binary.BigEndian.Uint32(body), false, bias)
+	return err
 }
 
+// Write sends b as payload frames.  Once a Write fails part way, e.g. when
+// the write deadline interrupts a pacing scheduler, n counts the payload of
+// the frames that reached the scheduler in full.  The rest of the frames are
+// lost and the peer could not decode what follows, so, as with crypto/tls,
+// all further writes fail with the same error.  Only a deadline that passed
+// before the Write leaves the connection usable.  Writing nothing is a no-op
+// apart from reporting such an error, not even the salt goes out.
 func (rr *Conn) Write(b []byte) (n int, err error) {
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+	return rr.write(b)
+}
+
+// WriteVectors sends the payload of bufs, in order, as if it were one Write:
+// small buffers share frames and the whole burst is shaped at once, instead
+// of paying frame overhead and a carrier write each.  n is the total payload
+// sent, see Write for its meaning on failure.
+func (rr *Conn) WriteVectors(bufs [][]byte) (n int, err error) {
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+	if len(bufs) == 1 {
+		return rr.write(bufs[0])
+	}
+	return rr.write(bytes.Join(bufs, nil))
+}
+
+// write is Write with writeLock held.
+func (rr *Conn) write(b []byte) (n int, err error) {
+	if rr.writeErr != nil {
+		return 0, rr.writeErr
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if rr.wire.writeDeadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	_, span := startSpan(rr.ctx, SpanWrite)
+	var wireLen int
+	defer func() {
+		span.SetInt(AttrBytes, int64(n))
+		span.SetInt(AttrWireBytes, int64(wireLen))
+		if n > 0 {
+			span.SetFloat(AttrExpansion, float64(wireLen)/float64(n))
+		}
+		span.End(err)
+	}()
+	if rr.tuner != nil && rr.tuner.step != 0 {
+		if err = rr.retune(); err != nil {
+			return
+		}
+	}
+	if rr.stalls != nil && rr.stalls.due.Swap(false) {
+		if err = rr.shrinkShape(); err != nil {
+			return
+		}
+	}
 
-	// XXX: n could be more accurate
 	var frameBuf bytes.Buffer
-	frameBuf, n, err = rr.Encoder.Chop(b, PacketTypePayload)
+	switch {
+	case rr.Encoder.compression == CompressionSnappy:
+		frameBuf, n, err = rr.Encoder.chopCompressed(b)
+	case rr.Encoder.spanThreshold > 0 && len(b) >= rr.Encoder.spanThreshold:
+		frameBuf, n, err = rr.Encoder.chopSpans(b)
+	case rr.Encoder.workers > 1:
+		frameBuf, n, err = rr.Encoder.chopParallel(b, rr.Encoder.workers)
+	default:
+		frameBuf, n, err = rr.Encoder.Chop(b, PacketTypePayload)
+	}
 	if err != nil {
+		rr.frameLens = rr.frameLens[:0]
+		rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
 		return
 	}
 
+	var sent int
+	wireLen = frameBuf.Len()
+	if sent, err = rr.writeFrames(&frameBuf); err != nil {
+		n = rr.committed(sent)
+	}
+	rr.stats.bytesOut.Add(uint64(n))
+	if err == nil && rr.rekeyAfter > 0 && rr.rekeyIn.Add(-int64(n)) <= 0 {
+		err = rr.renegotiate()
+	}
+	if err == nil && rr.mssTuner != nil && rr.mssTuner.observe(n, time.Now()) {
+		err = rr.growShape()
+	}
+	if err == nil && rr.flushesWrites() {
+		err = rr.flush()
+	}
+
+	//log.Debugf("Riverrun: %d expanded to %d ->", n, lowerConnN)
+	return
+}
+
+// Flush writes out the chunks held back by the Scheduler, e.g. a
+// BatchedScheduler, and returns once they reached the carrier.  With
+// Config.PadOnFlush it first adds a padding frame of a sampled chunk length,
+// unless a TrafficHint says otherwise.
+func (rr *Conn) Flush() error {
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+	return rr.flush()
+}
+
+// flush is Flush with writeLock held.
+func (rr *Conn) flush() error {
+	if rr.writeErr != nil {
+		return rr.writeErr
+	}
+	if rr.padsFlush() {
+		if err := rr.writePadding(); err != nil {
+			return err
+		}
+	}
+	return rr.scheduler.Flush()
+}
+
+// writePadding writes a padding frame as long as a sampled chunk.
+func (rr *Conn) writePadding() error {
+	bodyLen := rr.Encoder.codec.CompressedLen(rr.nextLength()-rr.Encoder.LengthLength) - f.TypeLength
+	if bodyLen < 1 {
+		bodyLen = 1
+	} else if bodyLen > rr.Encoder.MaxPacketPayloadLength {
+		bodyLen = rr.Encoder.MaxPacketPayloadLength
+	}
+	frameBuf, _, err := rr.Encoder.Chop(make([]byte, bodyLen), PacketTypePadding)
+	if err != nil {
+		return err
+	}
+	wireLen := frameBuf.Len()
+	if _, err = rr.writeFrames(&frameBuf); err != nil {
+		return err
+	}
+	rr.stats.paddingBytes.Add(uint64(wireLen))
+	rr.hooks.OnPadding(PaddingEvent{Time: time.Now(), TraceID: rr.traceID, WireLength: wireLen})
+	return nil
+}
+
+// SetDeadline sets the read and write deadlines of the carrier.  The write
+// deadline also interrupts the waits of a pacing scheduler.
+func (rr *Conn) SetDeadline(t time.Time) error {
+	rr.wire.writeDeadline.set(t)
+	return rr.Conn.SetDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the carrier, which also
+// interrupts the waits of a pacing scheduler.  See Write for the outcome of
+// a Write it interrupts.
+func (rr *Conn) SetWriteDeadline(t time.Time) error {
+	rr.wire.writeDeadline.set(t)
+	return rr.Conn.SetWriteDeadline(t)
+}
+
+// writeFrames writes out the frames in frameBuf, and returns how many of
+// them reached the scheduler in full.  An error fails all further writes.
+func (rr *Conn) writeFrames(frameBuf *bytes.Buffer) (sent int, err error) {
+	if rr.writeErr != nil {
+		return 0, rr.writeErr
+	}
+	defer func() {
+		if err != nil {
+			rr.writeErr = err
+		}
+		rr.frameLens = rr.frameLens[:0]
+		rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
+	}()
+	if rr.wholeFrames {
+		return rr.writeWholeFrames(frameBuf)
+	}
+	// written counts the frame bytes written, negative while the salt is
+	// not out yet.
+	var written int
+	if salt := rr.takeSalt(); salt != nil {
+		frameBuf = bytes.NewBuffer(append(salt, frameBuf.Bytes()...))
+		written = -len(salt)
+	}
 	// We do obfuscation here - experimental results found the
 	//	constant near MSS sizes were detectable
 	for {
@@ -378,23 +1430,138 @@ func (rr *Conn) Write(b []byte) (n int, err error) {
 			return
 		}
 
-		rr.logger.Debugf("Next length: %v", s)
+		if !log.Hardened {
+			rr.logger.Debugf("Next length: %v", s)
+		}
 
-		_, err = rr.Conn.Write(toWire[:s])
+		err = rr.writeChunk(toWire[:s])
 		if err != nil {
 			return
 		}
+		written += s
+		for sent < len(rr.frameLens) && rr.frameLens[sent] <= written {
+			written -= rr.frameLens[sent]
+			sent++
+		}
 	}
+}
 
-	//log.Debugf("Riverrun: %d expanded to %d ->", n, lowerConnN)
-	// TODO: What does spec say about returned numbers?
-	//	 Should they be bytes written, or the raw bytes before expansion expanded?
-	// Idea: Bytes written (raw), Bytes written (processed), err - raw bytes is equivalent to old n
+// committed returns the payload carried by the first sent frames of the last
+// write.
+func (rr *Conn) committed(sent int) (n int) {
+	for _, payloadLen := range rr.Encoder.payloadLens[:sent] {
+		n += payloadLen
+	}
+	return
+}
+
+// writeChunk hands a chunk of wire bytes to the scheduler.
+func (rr *Conn) writeChunk(b []byte) error {
+	if rr.tuner != nil {
+		rr.tuner.observe(b)
+	}
+	return rr.scheduler.Write(b)
+}
+
+// onPacket tracks the frames chopped by the encoder.
+func (rr *Conn) onPacket(frameLen int) {
+	rr.frameLens = append(rr.frameLens, frameLen)
+	if rr.keyLog != nil {
+		rr.keyLog.frame(rr.keyLog.writeDir, &rr.keyLog.writeOffset, frameLen)
+	}
+}
+
+// writeWholeFrames writes the salt and every frame as a chunk of its own.
+func (rr *Conn) writeWholeFrames(frameBuf *bytes.Buffer) (sent int, err error) {
+	if salt := rr.takeSalt(); salt != nil {
+		if err = rr.writeChunk(salt); err != nil {
+			return
+		}
+	}
+	for _, frameLen := range rr.frameLens {
+		if err = rr.writeChunk(frameBuf.Next(frameLen)); err != nil {
+			return
+		}
+		sent++
+	}
+	return
 }
 
+// Read returns the payload decoded so far, up to len(b) bytes, and blocks
+// only while there is none.  Payload that does not fit b stays buffered for
+// the next Read, so any buffer size works; MaxDecodedFrameSize tells the
+// size that takes a whole frame in one call.  An empty b returns right away.
+// A timeout, e.g. of a read deadline, keeps what was received of the salt and
+// of the frame it stopped in, down to single bytes of the length field, and
+// the next Read resumes from there.
 func (rr *Conn) Read(b []byte) (int, error) {
 	//originalLen := len(b)
-	n, err := rr.Decoder.Read(b, rr.Conn)
+	if rr.camouflaged.Load() {
+		return 0, rr.failErr
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	_, span := startSpan(rr.ctx, SpanRead)
+	wireIn := rr.stats.wireBytesIn.Load()
+	var n int
+	var err error
+	if rr.readKey != nil {
+		err = rr.readSalt()
+	}
+	if err == nil {
+		n, err = rr.Decoder.Read(b, rr.wire)
+	}
+	if err != nil && rr.peerClose != nil {
+		err = rr.peerClose
+	}
+	rr.stats.bytesIn.Add(uint64(n))
+	span.SetInt(AttrBytes, int64(n))
+	span.SetInt(AttrWireBytes, int64(rr.stats.wireBytesIn.Load()-wireIn))
+	span.End(err)
 	//log.Debugf("Riverrun: %d compressed to %d <-", originalLen, n)
+	if err != nil && isFrameError(err) {
+		rr.decodeFailed(err)
+	}
+	if err != nil && rr.failure == nil && (errors.Is(err, ErrKeyExchange) || errors.Is(err, ErrRetuneTooSoon)) {
+		// Read must not wait for the write lock.
+		rr.spawn(func() { rr.tryCloseCode(CloseCodeRekeyFailure) })
+	}
+	if err != nil && rr.failure != nil && isFrameError(err) {
+		rr.camouflage(err)
+	} else if err != nil && rr.closeOnFrameError && isFrameError(err) {
+		rr.logger.Infof("riverrun: closing after bad frame: %s", err)
+		rr.closeWith(CloseFrameError)
+	}
 	return n, err
 }
+
+// MaxDecodedFrameSize returns the most payload a single received frame can
+// decode to, a compressed frame included.
+func (rr *Conn) MaxDecodedFrameSize() int {
+	n := rr.Decoder.codec.CompressedLen(rr.Decoder.MaxFramePayloadLength) - f.TypeLength
+	if n < compressInputMax {
+		n = compressInputMax
+	}
+	return n
+}
+
+// isFrameError reports whether err is a rejected frame, as opposed to an
+// error of the carrier.
+func isFrameError(err error) bool {
+	var lengthErr f.InvalidPacketLengthError
+	return errors.Is(err, f.ErrFrameTooLarge) || errors.Is(err, f.ErrTagMismatch) || errors.Is(err, ErrKeyCommitment) ||
+		errors.Is(err, ErrUnknownPacketType) || errors.Is(err, ErrBufferLimit) || errors.Is(err, ErrKeyExchange) || errors.Is(err, ErrUnauthorized) ||
+		errors.Is(err, ErrSeedRotation) || errors.Is(err, ErrReplay) || errors.Is(err, ErrCloseCode) || errors.Is(err, ErrHeaderType) ||
+		errors.Is(err, ErrSpanLength) || errors.Is(err, ErrLengthChecksum) || errors.Is(err, ErrRetuneTooSoon) ||
+		errors.As(err, &lengthErr)
+}
+
+// Close flushes the write scheduler and closes the underlying conn, unless
+// the failure camouflage has taken it over.  It returns once the background
+// workers of rr are done.  Closing again returns net.ErrClosed.
+func (rr *Conn) Close() error {
+	err := rr.closeWith(CloseLocal)
+	rr.workers.Wait()
+	return err
+}
@@ -0,0 +1,1614 @@
+package riverrun
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/v2fly/riverrun/common/ctstretch"
+	"github.com/v2fly/riverrun/common/drbg"
+	f "github.com/v2fly/riverrun/common/framing"
+	"github.com/v2fly/riverrun/common/log"
+	"go.uber.org/goleak"
+)
+
+// testSeed is shared by all tests so the tables are only generated once.
+const testSeed = "000102030405060708090a0b0c0d0e0f1011121314151617"
+
+// newTestPair returns a client and a server Conn connected over a net.Pipe.
+func newTestPair(t testing.TB, clientConfig, serverConfig *Config) (*Conn, *Conn) {
+	t.Helper()
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	client, err := NewConnConfig(context.Background(), a, false, seed, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewConnConfig(context.Background(), b, true, seed, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// writeLength sends a bare length field declaring length to the peer of rr,
+// bypassing the checks of the encoder.
+func writeLength(rr *Conn, length uint16) {
+	mask := rr.Encoder.Drbg.NextBlock()
+	encoded, err := rr.Encoder.ProcessLength(length ^ binary.BigEndian.Uint16(mask))
+	if err != nil {
+		panic(err)
+	}
+	go rr.Conn.Write(append(rr.takeSalt(), encoded...))
+}
+
+func TestRoundTrip(t *testing.T) {
+	client, server := newTestPair(t, nil, nil)
+	for _, l := range []int{1, 2, 721, 722, 1443, 5000, 70000} {
+		msg := make([]byte, l)
+		for i := range msg {
+			msg[i] = byte(i * 7)
+		}
+		go client.Write(msg)
+		got := make([]byte, l)
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatalf("length %d: %s", l, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("length %d: payload mismatch", l)
+		}
+	}
+}
+
+func TestWriteVectors(t *testing.T) {
+	client, server := newTestPair(t, nil, nil)
+	var bufs [][]byte
+	var msg []byte
+	for i := 0; i < 8; i++ {
+		buf := bytes.Repeat([]byte{byte('a' + i)}, 10)
+		bufs = append(bufs, buf)
+		msg = append(msg, buf...)
+	}
+	written := make(chan int, 1)
+	go func() {
+		n, _ := client.WriteVectors(bufs)
+		written <- n
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+	if n := <-written; n != len(msg) {
+		t.Fatalf("WriteVectors: %d bytes, want %d", n, len(msg))
+	}
+	if frames := client.Snapshot().FramesOut; frames != 1 {
+		t.Errorf("%d frames for %d buffers, want 1", frames, len(bufs))
+	}
+}
+
+func TestConstantTimeLookups(t *testing.T) {
+	client, server := newTestPair(t, &Config{ConstantTimeLookups: true}, &Config{ConstantTimeLookups: true})
+	msg := []byte("constant time")
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+}
+
+func TestLowMemory(t *testing.T) {
+	client, server := newTestPair(t, nil, &Config{LowMemory: true})
+	msg := bytes.Repeat([]byte("low memory "), 200)
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+	if inv := server.Decoder.codec.(*ctstretchCodec).inv16; inv == nil {
+		t.Fatal("no inversion")
+	} else if _, ok := inv.(*ctstretch.SortedInversion); !ok {
+		t.Fatalf("inversion %T, want sorted", inv)
+	}
+}
+
+func TestStrictFrameTooLarge(t *testing.T) {
+	client, server := newTestPair(t, nil, &Config{StrictFrames: true})
+	writeLength(client, f.MaximumSegmentLength)
+	_, err := server.Read(make([]byte, 16))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestStrictFrameTooShort(t *testing.T) {
+	client, server := newTestPair(t, nil, &Config{StrictFrames: true})
+	writeLength(client, 1)
+	_, err := server.Read(make([]byte, 16))
+	var lengthErr f.InvalidPacketLengthError
+	if !errors.As(err, &lengthErr) || lengthErr != 1 {
+		t.Fatalf("got %v, want InvalidPacketLengthError(1)", err)
+	}
+}
+
+func TestStrictAcceptsMaximum(t *testing.T) {
+	client, server := newTestPair(t, nil, &Config{StrictFrames: true})
+	msg := make([]byte, client.Encoder.MaxPacketPayloadLength)
+	go client.Write(msg)
+	if _, err := io.ReadFull(server, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxFrameLength(t *testing.T) {
+	for _, length := range []int{64, 600, 16 * 1024} {
+		config := &Config{MaxFrameLength: length, StrictFrames: true}
+		client, server := newTestPair(t, config, config)
+		msg := make([]byte, 3*client.Encoder.MaxPacketPayloadLength+1)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+		go client.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatalf("length %d: %s", length, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("length %d: payload mismatch", length)
+		}
+	}
+
+	client, server := newTestPair(t, &Config{MaxFrameLength: 4000}, &Config{StrictFrames: true})
+	go client.Write(make([]byte, client.Encoder.MaxPacketPayloadLength))
+	if _, err := server.Read(make([]byte, 16)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+
+	seed, _ := drbg.SeedFromHex(testSeed)
+	a, _ := net.Pipe()
+	defer a.Close()
+	for _, length := range []int{-1, 7, 70000} {
+		if _, err := NewConnConfig(context.Background(), a, false, seed, &Config{MaxFrameLength: length}); err == nil {
+			t.Errorf("length %d accepted", length)
+		}
+	}
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	client, server := newTestPair(t, nil, &Config{MaxBufferedBytes: 3 * f.MaximumSegmentLength})
+	msg := make([]byte, 200000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	for n := 0; n < len(msg); {
+		m, err := server.Read(got[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if held := server.Decoder.ReceiveBuffer.Len() + server.Decoder.ReceiveDecodedBuffer.Len(); held > 4*f.MaximumSegmentLength {
+			t.Fatalf("%d bytes held", held)
+		}
+		n += m
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+
+	client, server = newTestPair(t, nil, &Config{MaxBufferedBytes: 1000})
+	// Without piecewise decoding, frames have to fit.
+	server.Decoder.PartialBlockLength = 0
+	go client.Write(make([]byte, client.Encoder.MaxPacketPayloadLength))
+	if _, err := server.Read(make([]byte, 16)); !errors.Is(err, ErrBufferLimit) {
+		t.Fatalf("got %v, want ErrBufferLimit", err)
+	}
+}
+
+func TestNonStrictMasksLength(t *testing.T) {
+	client, server := newTestPair(t, nil, nil)
+	writeLength(client, f.MaximumSegmentLength)
+	go client.Conn.Write(make([]byte, f.MaximumSegmentLength))
+	_, err := server.Read(make([]byte, 16))
+	if err == nil || errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want a masked decoding error", err)
+	}
+}
+
+func TestCloseOnFrameError(t *testing.T) {
+	client, server := newTestPair(t, nil, &Config{StrictFrames: true, CloseOnFrameError: true})
+	writeLength(client, f.MaximumSegmentLength)
+	if _, err := server.Read(make([]byte, 16)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+	if _, err := client.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("client read after close: got %v, want EOF", err)
+	}
+}
+
+func TestSaltSeparatesConnections(t *testing.T) {
+	wire := func() []byte {
+		client, server := newTestPair(t, nil, nil)
+		msg := make([]byte, 100)
+		go func() {
+			client.Write(msg)
+			client.Close()
+		}()
+		var buf bytes.Buffer
+		io.Copy(&buf, server.Conn)
+		return buf.Bytes()
+	}
+	a, b := wire(), wire()
+	if len(a) != len(b) {
+		t.Fatalf("wire lengths %d and %d differ", len(a), len(b))
+	}
+	// Expanded bytes are biased, so allow the odd collision but not a
+	// shared keystream.
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	if same > len(a)/2 {
+		t.Fatalf("%d of %d wire bytes identical across connections", same, len(a))
+	}
+}
+
+func TestDirectionalParameters(t *testing.T) {
+	client, server := newTestPair(t, nil, nil)
+	if client.bias == server.bias {
+		t.Errorf("both directions use bias %f", client.bias)
+	}
+	if client.mss_max == server.mss_max && client.mss_dev == server.mss_dev {
+		t.Errorf("both directions use mss_max %d, mss_dev %f", client.mss_max, client.mss_dev)
+	}
+	clientTable, serverTable := client.Encoder.codec.(*ctstretchCodec).table16, server.Encoder.codec.(*ctstretchCodec).table16
+	if clientTable[0] == serverTable[0] && clientTable[1] == serverTable[1] {
+		t.Error("both directions use the same tables")
+	}
+}
+
+func TestLengthSamplerPerConnection(t *testing.T) {
+	sample := func(rr *Conn) []int {
+		rr.writeLock.Lock()
+		defer rr.writeLock.Unlock()
+		lengths := make([]int, 32)
+		for i := range lengths {
+			lengths[i] = rr.nextLength()
+		}
+		return lengths
+	}
+	a, _ := newTestPair(t, nil, nil)
+	b, _ := newTestPair(t, nil, nil)
+	// Equal parameters, so only the samplers could tell them apart.
+	b.mss_max, b.mss_dev = a.mss_max, a.mss_dev
+	if fmt.Sprint(sample(a)) == fmt.Sprint(sample(b)) {
+		t.Fatal("connections sharing a seed sample the same lengths")
+	}
+}
+
+func TestPersonalization(t *testing.T) {
+	config := &Config{Personalization: "bridge.example.com"}
+	plain, _ := newTestPair(t, nil, nil)
+	client, server := newTestPair(t, config, config)
+	if client.bias == plain.bias && client.mss_max == plain.mss_max {
+		t.Errorf("personalization left bias %f and mss_max %d unchanged", client.bias, client.mss_max)
+	}
+	msg := []byte("personalized")
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+}
+
+// recordScheduler records the length of every chunk written.
+type recordScheduler struct {
+	Scheduler
+	lengths *[]int
+}
+
+func (s recordScheduler) Write(chunk []byte) error {
+	*s.lengths = append(*s.lengths, len(chunk))
+	return s.Scheduler.Write(chunk)
+}
+
+func TestDisableLengthShaping(t *testing.T) {
+	var lengths []int
+	client, server := newTestPair(t, &Config{
+		DisableLengthShaping: true,
+		Scheduler: func(carrier io.Writer) Scheduler {
+			return recordScheduler{ImmediateScheduler()(carrier), &lengths}
+		},
+	}, nil)
+	maxLen := client.Encoder.MaxPacketPayloadLength
+	msg := make([]byte, 2*maxLen+100)
+	go client.Write(msg)
+	if _, err := io.ReadFull(server, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := func(n int) int {
+		return client.Encoder.LengthLength + 2*(f.TypeLength+n)
+	}
+	want := []int{len(server.saltIn), frame(maxLen), frame(maxLen), frame(100)}
+	if len(lengths) != len(want) {
+		t.Fatalf("got chunks %v, want %v", lengths, want)
+	}
+	for i := range want {
+		if lengths[i] != want[i] {
+			t.Fatalf("got chunks %v, want %v", lengths, want)
+		}
+	}
+}
+
+func TestDeadPeer(t *testing.T) {
+	reasons := make(chan CloseReason, 4)
+	onClose := func(rr *Conn, reason CloseReason) { reasons <- reason }
+
+	client, _ := newTestPair(t, &Config{ReadIdleTimeout: 50 * time.Millisecond, OnClose: onClose}, nil)
+	if r := <-reasons; r != CloseReadIdle {
+		t.Fatalf("got %s, want %s", r, CloseReadIdle)
+	}
+	if _, err := client.Read(make([]byte, 16)); err == nil {
+		t.Fatal("read from a torn down connection")
+	}
+	if err := client.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("second Close: got %v, want net.ErrClosed", err)
+	}
+
+	// The server never reads, so the pipe write blocks.
+	client, _ = newTestPair(t, &Config{WriteTimeout: 50 * time.Millisecond, OnClose: onClose}, nil)
+	if _, err := client.Write([]byte("hello")); err == nil {
+		t.Fatal("write to a vanished peer succeeded")
+	}
+	if r := <-reasons; r != CloseWriteFailed {
+		t.Fatalf("got %s, want %s", r, CloseWriteFailed)
+	}
+	select {
+	case r := <-reasons:
+		t.Fatalf("OnClose called again with %s", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// A setup failing after the dead-peer checks were set up leaves the
+	// carrier alone.
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer b.Close()
+	bad := &Config{ReadIdleTimeout: 10 * time.Millisecond, OnClose: onClose, FrameHeader: FrameHeaderTyped, MaxFrameLength: 4000}
+	if _, err = NewConnConfig(context.Background(), a, false, seed, bad); err == nil {
+		t.Fatal("setup with an oversized typed frame succeeded")
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case r := <-reasons:
+		t.Fatalf("OnClose called for a failed setup with %s", r)
+	default:
+	}
+	go b.Read(make([]byte, 1))
+	if _, err = a.Write([]byte{0}); err != nil {
+		t.Fatalf("carrier closed by a failed setup: %v", err)
+	}
+}
+
+func TestFrameHeaderTyped(t *testing.T) {
+	typed := &Config{FrameHeader: FrameHeaderTyped, PadOnFlush: true}
+	// Servers read the layout the client announced, whatever their own.
+	for _, tc := range []struct {
+		client, server *Config
+		want           FrameHeader
+	}{
+		{typed, typed, FrameHeaderTyped},
+		{typed, nil, FrameHeaderTyped},
+		{nil, typed, FrameHeaderLength},
+	} {
+		client, server := newTestPair(t, tc.client, tc.server)
+		go func() {
+			client.Write([]byte("hello"))
+			client.Flush()
+			client.Write([]byte(" world"))
+		}()
+		buf := make([]byte, 16)
+		var got []byte
+		for len(got) < len("hello world") {
+			n, err := server.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, buf[:n]...)
+		}
+		if string(got) != "hello world" {
+			t.Fatalf("got %q", got)
+		}
+		if server.Decoder.header != tc.want {
+			t.Fatalf("server reads layout %d, want %d", server.Decoder.header, tc.want)
+		}
+	}
+}
+
+func TestFrameHeaderChecked(t *testing.T) {
+	checked := &Config{FrameHeader: FrameHeaderChecked}
+	client, server := newTestPair(t, checked, checked)
+	go client.Write([]byte("hello"))
+	buf := make([]byte, 16)
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+
+	// A flipped bit of the length fails before any of the body is read.
+	client, server = newTestPair(t, checked, checked)
+	word := client.Encoder.MaskedHeader(100, nil) ^ 1<<3
+	encoded, err := client.Encoder.ProcessLength(word)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Conn.Write(append(client.takeSalt(), encoded...))
+	if _, err := server.Read(buf); !errors.Is(err, ErrLengthChecksum) {
+		t.Fatalf("got %v, want ErrLengthChecksum", err)
+	}
+}
+
+func TestCloseWithCode(t *testing.T) {
+	client, server := newTestPair(t, nil, nil)
+	done := make(chan error, 1)
+	go func() {
+		if _, err := client.Write([]byte("bye")); err != nil {
+			done <- err
+			return
+		}
+		done <- client.CloseWithCode(CloseCodePolicy)
+	}()
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "bye" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	for err == nil {
+		_, err = server.Read(buf)
+	}
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseCodePolicy || !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v, want a CloseError with %s", err, CloseCodePolicy)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseCodeIdle(t *testing.T) {
+	client, server := newTestPair(t, nil, &Config{ReadIdleTimeout: 50 * time.Millisecond})
+	go server.Write([]byte("hi"))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	// The client never writes, so the server times it out.
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for err == nil {
+		_, err = client.Read(buf)
+	}
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseCodeIdle {
+		t.Fatalf("got %v, want a CloseError with %s", err, CloseCodeIdle)
+	}
+}
+
+func TestTransferQuota(t *testing.T) {
+	quota := &TransferQuota{Limit: 64 * 1024}
+	client, server := newTestPair(t, nil, &Config{Quota: quota})
+	go func() {
+		for {
+			if _, err := client.Write(make([]byte, 4096)); err != nil {
+				return
+			}
+		}
+	}()
+	var err error
+	for err == nil {
+		_, err = server.Read(make([]byte, 4096))
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("got %v, want ErrQuotaExceeded", err)
+	}
+	if in, _ := quota.Usage(); in <= quota.Limit {
+		t.Fatalf("stopped at %d bytes in, below the limit", in)
+	}
+
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accounts Accounts
+	expired := accounts.Quota(seed)
+	expired.Expiry = time.Now()
+	a, _ := net.Pipe()
+	defer a.Close()
+	if _, err := NewConnConfig(context.Background(), a, true, seed, &Config{Quota: accounts.Quota(seed)}); !errors.Is(err, ErrQuotaExpired) {
+		t.Fatalf("got %v, want ErrQuotaExpired", err)
+	}
+}
+
+func TestAdaptiveBias(t *testing.T) {
+	// No real traffic reaches 7.9 bits per byte, so every window asks for
+	// a higher bias.
+	config := &Config{AdaptiveBias: true, AdaptiveWindow: 4096, MinEntropy: 7.9, MaxEntropy: 8}
+	client, server := newTestPair(t, config, nil)
+	initial := client.bias
+	msg := make([]byte, 4096)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	for i := 0; i < 3; i++ {
+		go client.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatalf("write %d: %s", i, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("write %d: payload mismatch", i)
+		}
+	}
+	if client.bias <= initial {
+		t.Fatalf("bias %f not raised from %f", client.bias, initial)
+	}
+	if server.readBias != client.bias {
+		t.Fatalf("server reads with bias %f, client writes with %f", server.readBias, client.bias)
+	}
+}
+
+func TestRetuneLimits(t *testing.T) {
+	_, server := newTestPair(t, nil, nil)
+	retune := func(epoch uint32, bias float64) error {
+		var body [retuneLength]byte
+		binary.BigEndian.PutUint32(body[:], epoch)
+		binary.BigEndian.PutUint64(body[renegotiateLength:], math.Float64bits(bias))
+		return server.applyBias(body[:])
+	}
+	// The default Shape caps the bias at .3.
+	var lengthErr f.InvalidPacketLengthError
+	if err := retune(1, .4); !errors.As(err, &lengthErr) {
+		t.Fatalf("bias above the Shape: got %v", err)
+	}
+	if err := retune(1, .2); err != nil {
+		t.Fatal(err)
+	}
+	if err := retune(2, .22); !errors.Is(err, ErrRetuneTooSoon) {
+		t.Fatalf("got %v, want ErrRetuneTooSoon", err)
+	}
+}
+
+// recordLogger keeps the log lines of a Conn.
+type recordLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Infof(format string, a ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, a...))
+}
+
+func (l *recordLogger) Debugf(format string, a ...interface{}) {
+	l.Infof(format, a...)
+}
+
+func TestAutoMSS(t *testing.T) {
+	rekeyed := make(chan RekeyEvent, 1)
+	client, server := newTestPair(t, &Config{AutoMSS: true, AutoMSSRate: 1}, &Config{
+		OnRekey: func(_ *Conn, event RekeyEvent) { rekeyed <- event },
+	})
+	client.mssTuner.interval = 20 * time.Millisecond
+	go drain(server)
+
+	before := client.mss_max
+	for i := 0; ; i++ {
+		if _, err := client.Write([]byte("bulk")); err != nil {
+			t.Fatal(err)
+		}
+		client.shapeLock.Lock()
+		epoch, after := client.shapeEpoch, client.mss_max
+		client.shapeLock.Unlock()
+		if epoch != 0 {
+			if after <= before {
+				t.Fatalf("mss_max went from %d to %d", before, after)
+			}
+			if event := <-rekeyed; event.Epoch != epoch || event.Local {
+				t.Fatalf("peer event %+v, want epoch %d", event, epoch)
+			}
+			return
+		}
+		if i == 100 {
+			t.Fatal("mss_max never grew")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type blackholeHooks struct {
+	NopHooks
+	events chan BlackholeEvent
+}
+
+func (h blackholeHooks) OnBlackhole(event BlackholeEvent) { h.events <- event }
+
+func TestBlackholeStall(t *testing.T) {
+	if log.Hardened {
+		t.Skip("riverrun_hardened builds refuse Hooks")
+	}
+	hooks := blackholeHooks{events: make(chan BlackholeEvent, 1)}
+	client, server := newTestPair(t, &Config{BlackholeStall: 5 * time.Millisecond, Hooks: hooks}, nil)
+	// A slow reader stalls every carrier write of the client.
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			time.Sleep(10 * time.Millisecond)
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	before := client.mss_max
+	for i := 0; i < 10; i++ {
+		if _, err := client.Write([]byte("stalled")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case event := <-hooks.events:
+			if event.OldMSS != before || event.NewMSS >= before || event.Epoch == 0 {
+				t.Fatalf("event %+v, mss_max was %d", event, before)
+			}
+			return
+		default:
+		}
+	}
+	t.Fatal("no blackhole reported")
+}
+
+func TestHardened(t *testing.T) {
+	logger := new(recordLogger)
+	client, server := newTestPair(t, &Config{Hardened: true, Logger: logger}, nil)
+	go client.Write(make([]byte, 5000))
+	if _, err := io.ReadFull(server, make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		client.Renegotiate()
+		client.Write([]byte("x"))
+	}()
+	if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	logger.lock.Lock()
+	for _, line := range logger.lines {
+		if strings.Contains(line, "mss") || strings.Contains(line, "bias") || strings.Contains(line, "ength") {
+			t.Errorf("hardened connection logged %q", line)
+		}
+	}
+	logger.lock.Unlock()
+
+	seed, _ := drbg.SeedFromHex(testSeed)
+	a, _ := net.Pipe()
+	defer a.Close()
+	if _, err := NewConnConfig(context.Background(), a, false, seed, &Config{Hardened: true, KeyLog: io.Discard}); err == nil {
+		t.Error("KeyLog accepted in hardened mode")
+	}
+}
+
+func TestHardenedBuild(t *testing.T) {
+	if !log.Hardened {
+		t.Skip("needs the riverrun_hardened build tag")
+	}
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := net.Pipe()
+	defer a.Close()
+	// The tag forces hardened mode without Config.Hardened.
+	for name, config := range map[string]*Config{
+		"Hooks":  {Hooks: new(recordHooks)},
+		"Tracer": {Tracer: new(recordingTracer)},
+		"KeyLog": {KeyLog: io.Discard},
+	} {
+		if _, err := NewConnConfig(context.Background(), a, false, seed, config); err == nil {
+			t.Errorf("%s accepted in a hardened build", name)
+		}
+	}
+
+	logger := new(recordLogger)
+	config := (&Config{Logger: logger}).withDefaults()
+	if _, quiet := config.Logger.(log.Quiet); !config.Hardened || !quiet {
+		t.Fatalf("defaults: Hardened %v, Logger %T", config.Hardened, config.Logger)
+	}
+	client, server := newTestPair(t, &Config{Logger: logger}, nil)
+	go client.Write([]byte("hello"))
+	if _, err := io.ReadFull(server, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	for _, line := range logger.lines {
+		if strings.Contains(line, "Initialized") || strings.Contains(line, "cached tables") {
+			t.Errorf("debug output %q reached the logger", line)
+		}
+	}
+}
+
+func TestRenegotiate(t *testing.T) {
+	serverEvents := make(chan RekeyEvent, 2)
+	client, server := newTestPair(t, nil, &Config{
+		OnRekey: func(_ *Conn, e RekeyEvent) { serverEvents <- e },
+	})
+	for epoch := uint32(1); epoch <= 2; epoch++ {
+		go func() {
+			client.Renegotiate()
+			client.Write([]byte("x"))
+		}()
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(server, buf); err != nil || buf[0] != 'x' {
+			t.Fatalf("epoch %d: got %q, %v", epoch, buf, err)
+		}
+		if e := <-serverEvents; e.Local || e.Epoch != epoch {
+			t.Fatalf("server event %+v, want epoch %d", e, epoch)
+		}
+		// Both sides derive the parameters of the epoch from their shape
+		// seed.
+		for _, rr := range []*Conn{client, server} {
+			mssMax, mssDev, err := shapeAt(rr.shapeSeed, epoch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr.shapeLock.Lock()
+			if rr.shapeEpoch != epoch || rr.mss_max != mssMax || rr.mss_dev != mssDev {
+				t.Errorf("epoch %d: shape %d, %d, %v, want %d, %v", epoch, rr.shapeEpoch, rr.mss_max, rr.mss_dev, mssMax, mssDev)
+			}
+			rr.shapeLock.Unlock()
+		}
+	}
+
+	// A stale epoch changes nothing, a malformed body is refused.
+	var body [renegotiateLength]byte
+	binary.BigEndian.PutUint32(body[:], 1)
+	if err := server.handleRenegotiate(body[:]); err != nil || server.shapeEpoch != 2 {
+		t.Fatalf("stale epoch: got epoch %d, %v", server.shapeEpoch, err)
+	}
+	if err := server.handleRenegotiate(body[:3]); err != f.InvalidPayloadLengthError(3) {
+		t.Fatalf("short body: got %v", err)
+	}
+}
+
+func TestRekeyAfter(t *testing.T) {
+	var clientEvents []RekeyEvent
+	serverEvents := make(chan RekeyEvent, 1)
+	client, server := newTestPair(t, &Config{
+		RekeyAfter: 1000,
+		OnRekey:    func(_ *Conn, e RekeyEvent) { clientEvents = append(clientEvents, e) },
+	}, &Config{
+		OnRekey: func(_ *Conn, e RekeyEvent) { serverEvents <- e },
+	})
+	if n := server.NextRekeyIn(); n != -1 {
+		t.Errorf("NextRekeyIn without RekeyAfter: got %d, want -1", n)
+	}
+	go drain(server)
+
+	if _, err := client.Write(make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.NextRekeyIn(); n != 400 {
+		t.Fatalf("NextRekeyIn after 600 bytes: got %d, want 400", n)
+	}
+	if _, err := client.Write(make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.NextRekeyIn(); n != 1000 {
+		t.Fatalf("NextRekeyIn after the rekey: got %d, want 1000", n)
+	}
+	if len(clientEvents) != 1 || !clientEvents[0].Local || clientEvents[0].Epoch != 1 {
+		t.Errorf("client events: %+v", clientEvents)
+	}
+	if e := <-serverEvents; e.Local || e.Epoch != 1 {
+		t.Errorf("server event: %+v", e)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	client, server := newTestPair(t, &Config{
+		Scheduler:  BatchedScheduler(time.Hour, 1<<20),
+		PadOnFlush: true,
+	}, nil)
+	if n, err := client.Write(nil); n != 0 || err != nil {
+		t.Fatalf("empty write: got %d, %v", n, err)
+	}
+	bw := bufio.NewWriter(client)
+	bw.WriteString("hello")
+	if err := bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if wire := client.Snapshot().WireBytesOut; wire != 0 {
+		t.Fatalf("%d wire bytes out before Flush", wire)
+	}
+
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(server, buf)
+		got <- string(buf)
+		drain(server)
+	}()
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-got; msg != "hello" {
+		t.Fatalf("got %q, want hello", msg)
+	}
+	if stats := client.Snapshot(); stats.PaddingBytes == 0 || stats.WireBytesOut == 0 {
+		t.Fatalf("stats after Flush: %+v", stats)
+	}
+}
+
+func TestPartialFrame(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, b1 := net.Pipe()
+	a2, b2 := net.Pipe()
+	defer b1.Close()
+	defer a2.Close()
+	client, err := NewConnConfig(context.Background(), a1, false, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := NewConnConfig(context.Background(), b2, true, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	msg := make([]byte, 1000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write(msg)
+		written <- err
+	}()
+	// Only part of the first frame reaches the server, yet the payload of
+	// its complete blocks is readable.
+	head := make([]byte, 200)
+	if _, err := io.ReadFull(b1, head); err != nil {
+		t.Fatal(err)
+	}
+	go a2.Write(head)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(msg))
+	n, err := server.Read(buf)
+	if err != nil || n == 0 || !bytes.Equal(buf[:n], msg[:n]) {
+		t.Fatalf("partial frame: got %d bytes, %v", n, err)
+	}
+	if n >= 100 {
+		t.Fatalf("%d payload bytes out of 200 wire bytes", n)
+	}
+
+	go io.Copy(a2, b1)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(server, buf[n:]); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatalf("rest of the frame: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSmallReads(t *testing.T) {
+	client, server := newTestPair(t, nil, nil)
+	if max := server.MaxDecodedFrameSize(); max < client.Encoder.MaxPacketPayloadLength {
+		t.Fatalf("MaxDecodedFrameSize %d below the frame payload %d", max, client.Encoder.MaxPacketPayloadLength)
+	}
+	if n, err := server.Read(nil); n != 0 || err != nil {
+		t.Fatalf("empty read: %d, %v", n, err)
+	}
+	msg := make([]byte, 3*client.Encoder.MaxPacketPayloadLength+5)
+	for i := range msg {
+		msg[i] = byte(i * 13)
+	}
+	go client.Write(msg)
+	got := make([]byte, 0, len(msg))
+	var b [1]byte
+	for len(got) < len(msg) {
+		n, err := server.Read(b[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("1-byte read returned %d", n)
+		}
+		got = append(got, b[0])
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+}
+
+func TestPacingDeadline(t *testing.T) {
+	client, server := newTestPair(t, &Config{Scheduler: PacedScheduler(4*1024, 4096)}, nil)
+	received := make(chan int, 1)
+	go func() {
+		total := 0
+		buf := make([]byte, 4096)
+		for {
+			n, err := server.Read(buf)
+			total += n
+			if err != nil {
+				received <- total
+				return
+			}
+		}
+	}()
+
+	// A deadline that passed already fails the Write without harm.
+	client.SetWriteDeadline(aLongTimeAgo)
+	if n, err := client.Write([]byte("early")); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %d, %v, want os.ErrDeadlineExceeded", n, err)
+	}
+	client.SetWriteDeadline(time.Time{})
+	if _, err := client.Write([]byte("early")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deadline leaves time to chop msg even under the race detector,
+	// but not to pace all of it out.
+	msg := make([]byte, 16*1024)
+	start := time.Now()
+	client.SetWriteDeadline(start.Add(time.Second))
+	n, err := client.Write(msg)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want os.ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("write returned after %s", elapsed)
+	}
+	if n == 0 || n >= len(msg) {
+		t.Fatalf("%d of %d bytes committed", n, len(msg))
+	}
+	client.SetWriteDeadline(time.Time{})
+	if _, err := client.Write([]byte("late")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write after the failure: got %v", err)
+	}
+	client.Close()
+	if total := <-received; total < len("early")+n {
+		t.Fatalf("peer got %d bytes, %d were committed", total, len("early")+n)
+	}
+}
+
+func TestCloseStopsWorkers(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := DeriveParams(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		EchoInterval: time.Millisecond,
+		Scheduler:    BatchedScheduler(time.Millisecond, 4096),
+	}
+	for i := 0; i < 10000; i++ {
+		a, b := net.Pipe()
+		client, err := AttachConnConfig(a, params, false, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := AttachConnConfig(b, params, true, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Both peers keep reading, so that batched flushes never stall.
+		go drain(client)
+		if i%100 == 0 {
+			go client.Write([]byte("ping"))
+			if _, err := io.ReadFull(server, make([]byte, 4)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		go drain(server)
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSpans(t *testing.T) {
+	client, server := newTestPair(t, &Config{SpanThreshold: 4096}, nil)
+	msg := make([]byte, 64*1024+3)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	go func() {
+		if _, err := client.Write(msg); err != nil {
+			t.Error(err)
+		}
+		if _, err := client.Write([]byte("after the span")); err != nil {
+			t.Error(err)
+		}
+	}()
+	got := make([]byte, len(msg)+len("after the span"))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(msg)], msg) || string(got[len(msg):]) != "after the span" {
+		t.Fatal("payload mismatch")
+	}
+	// The descriptor and the frame after the span.
+	if frames := client.Snapshot().FramesOut; frames != 2 {
+		t.Errorf("sent %d frames, want 2", frames)
+	}
+}
+
+func TestTrafficHint(t *testing.T) {
+	client, server := newTestPair(t, &Config{
+		Scheduler:  BatchedScheduler(time.Hour, 1<<20),
+		PadOnFlush: true,
+	}, nil)
+	if err := client.SetTrafficHint(TrafficHint(42)); err == nil {
+		t.Fatal("invalid hint accepted")
+	}
+	if err := client.SetTrafficHint(HintInteractive); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(server, buf)
+		got <- string(buf)
+		drain(server)
+	}()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-got; msg != "hello" {
+		t.Fatalf("got %q, want hello", msg)
+	}
+	if padding := client.Snapshot().PaddingBytes; padding != 0 {
+		t.Errorf("%d padding bytes, want none for interactive writes", padding)
+	}
+
+	// Streaming flushes and pads every Write, even without PadOnFlush.
+	streaming, streamingPeer := newTestPair(t, &Config{
+		Scheduler:   BatchedScheduler(time.Hour, 1<<20),
+		TrafficHint: HintStreaming,
+	}, nil)
+	reads := make(chan string)
+	go func() {
+		buf := make([]byte, 5)
+		for {
+			if _, err := io.ReadFull(streamingPeer, buf); err != nil {
+				close(reads)
+				return
+			}
+			reads <- string(buf)
+		}
+	}()
+	var padding uint64
+	for i := 0; i < 2; i++ {
+		written := make(chan error, 1)
+		go func() {
+			_, err := streaming.Write([]byte("hello"))
+			written <- err
+		}()
+		if msg := <-reads; msg != "hello" {
+			t.Fatalf("streaming write %d: got %q", i, msg)
+		}
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+		if p := streaming.Snapshot().PaddingBytes; p <= padding {
+			t.Fatalf("streaming write %d not padded", i)
+		} else {
+			padding = p
+		}
+	}
+
+	// Bulk holds writes back, never pads, and samples chunk lengths closer
+	// to mss_max.
+	bulk, bulkPeer := newTestPair(t, &Config{
+		Scheduler:   BatchedScheduler(time.Hour, 1<<20),
+		PadOnFlush:  true,
+		TrafficHint: HintBulk,
+	}, nil)
+	go drain(bulkPeer)
+	if _, err := bulk.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bulk.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if padding := bulk.Snapshot().PaddingBytes; padding != 0 {
+		t.Errorf("%d padding bytes, want none for bulk writes", padding)
+	}
+	bulk.writeLock.Lock()
+	defer bulk.writeLock.Unlock()
+	bulk.shapeLock.Lock()
+	bulk.mss_dev = 50
+	bulk.shapeLock.Unlock()
+	spread := func() (sum int) {
+		for i := 0; i < 10000; i++ {
+			sum += bulk.mss_max - bulk.nextLength()
+		}
+		return sum
+	}
+	narrow := spread()
+	bulk.hint.Store(int32(HintDefault))
+	if normal := spread(); narrow*3 > normal*2 {
+		t.Errorf("bulk spread %d, default %d", narrow, normal)
+	}
+}
+
+// shortWriter writes at most limit bytes per call, without an error, as some
+// carriers do.
+type shortWriter struct {
+	net.Conn
+	limit int
+}
+
+func (c *shortWriter) Write(b []byte) (int, error) {
+	if len(b) > c.limit {
+		b = b[:c.limit]
+	}
+	return c.Conn.Write(b)
+}
+
+// mtuConn is a Carrier recording its largest write.
+type mtuConn struct {
+	net.Conn
+	mtu     int
+	largest atomic.Int64
+}
+
+func (c *mtuConn) MTU() int { return c.mtu }
+
+func (c *mtuConn) Write(b []byte) (int, error) {
+	if n := int64(len(b)); n > c.largest.Load() {
+		c.largest.Store(n)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestCarrierMTU(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	carrier := &mtuConn{Conn: a, mtu: 300}
+	client, err := NewConn(carrier, false, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := NewConn(b, true, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	msg := make([]byte, 10000)
+	go client.Write(msg)
+	if _, err = io.ReadFull(server, msg); err != nil {
+		t.Fatal(err)
+	}
+	if largest := carrier.largest.Load(); largest > 300 {
+		t.Fatalf("largest write %d exceeds the MTU", largest)
+	}
+}
+
+// swapConn writes its first two writes the other way round.
+type swapConn struct {
+	net.Conn
+	held []byte
+	n    int
+}
+
+func (c *swapConn) Write(b []byte) (int, error) {
+	c.n++
+	switch c.n {
+	case 1:
+		c.held = append([]byte(nil), b...)
+		return len(b), nil
+	case 2:
+		if _, err := c.Conn.Write(b); err != nil {
+			return 0, err
+		}
+		b = c.held
+	}
+	return c.Conn.Write(b)
+}
+
+func TestReorderWindow(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{ReorderWindow: 8}
+	a, b := net.Pipe()
+	client, err := NewConnConfig(context.Background(), &swapConn{Conn: a}, false, seed, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := NewConnConfig(context.Background(), b, true, seed, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	msg := make([]byte, 10000)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write(msg)
+		written <- err
+	}()
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShortCarrierWrites(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	client, err := NewConn(&shortWriter{Conn: a, limit: 7}, false, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := NewConn(b, true, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	msg := make([]byte, 20000)
+	for i := range msg {
+		msg[i] = byte(i * 13)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write(msg)
+		written <- err
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload mismatch")
+	}
+	// The client counts the last chunk once its Write returns.
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if out, in := client.Snapshot().WireBytesOut, server.Snapshot().WireBytesIn; out != in {
+		t.Errorf("client wrote %d wire bytes, server read %d", out, in)
+	}
+}
+
+// recordConn keeps what is written to it.
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+// stallConn returns reads in the given chunks, and a timeout for every nil
+// chunk, like a carrier whose peer stalls past a read deadline.
+type stallConn struct {
+	net.Conn
+	chunks [][]byte
+}
+
+func (c *stallConn) Read(b []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	chunk := c.chunks[0]
+	if chunk == nil {
+		c.chunks = c.chunks[1:]
+		return 0, os.ErrDeadlineExceeded
+	}
+	n := copy(b, chunk)
+	if c.chunks[0] = chunk[n:]; len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestReadResumesAfterTimeout(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	rec := &recordConn{Conn: a}
+	client, err := NewConn(rec, false, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	wire := rec.written.Bytes()
+
+	probe, err := NewConn(b, true, seed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saltLen, lengthLen := len(probe.saltIn), probe.Decoder.LengthLength
+	for k := 0; k <= lengthLen; k++ {
+		cut := saltLen + k
+		conn := &stallConn{Conn: b, chunks: [][]byte{wire[:cut], nil, wire[cut:]}}
+		server, err := NewConn(conn, true, seed, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		if _, err := server.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("stall after %d length bytes: got %v, want a timeout", k, err)
+		}
+		n, err := server.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Fatalf("resume after %d length bytes: got %q, %v", k, buf[:n], err)
+		}
+	}
+}
+
+func TestDecodeStorm(t *testing.T) {
+	storms := make(chan *Conn, 1)
+	storm := NewStormDetector(2, time.Minute)
+	storm.OnStorm = func(rr *Conn) { storms <- rr }
+	for i := 0; i < 2; i++ {
+		client, server := newTestPair(t, &Config{StrictFrames: true, DecodeStorm: storm}, nil)
+		go drain(server)
+		writeLength(server, f.MaximumSegmentLength)
+		if _, err := client.Read(make([]byte, 16)); err == nil {
+			t.Fatal("bad frame accepted")
+		}
+		if i == 0 && storm.Storms() != 0 {
+			t.Fatal("storm after one connection")
+		}
+	}
+	var rr *Conn
+	select {
+	case rr = <-storms:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnStorm not called")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, cached := range cache {
+		if cached == rr.readTables {
+			t.Fatal("tables still cached after the storm")
+		}
+	}
+}
+
+func TestTableSetCache(t *testing.T) {
+	first, _ := newTestPair(t, nil, nil)
+	second, _ := newTestPair(t, nil, nil)
+	tables := first.readTables
+	if tables == nil || second.readTables != tables {
+		t.Fatal("connections of one seed do not share their tables")
+	}
+	// The inversions are cached along with the tables, and invert them.
+	if tables.revTable8 == nil || len(tables.revTable16) != len(tables.table16) {
+		t.Fatal("inverted tables not cached")
+	}
+	for i, v := range tables.table8 {
+		if got, ok := tables.revTable8[v]; !ok || got != uint64(i) {
+			t.Fatalf("revTable8[%#x] = %d, %v, want %d", v, got, ok, i)
+		}
+	}
+	inv8, _ := tables.inversions(false, false)
+	if reflect.ValueOf(inv8).Pointer() != reflect.ValueOf(tables.revTable8).Pointer() {
+		t.Error("inversions rebuilt the cached map")
+	}
+	lowMemory, _ := newTestPair(t, &Config{LowMemory: true}, nil)
+	if lowMemory.readTables != tables || tables.sorted8 == nil {
+		t.Error("LowMemory did not add the sorted inversion to the cached tables")
+	}
+}
+
+// frameCounter counts the frames sent, as metrics would.
+type frameCounter struct {
+	NopHooks
+	sent atomic.Int64
+}
+
+func (h *frameCounter) OnFrameSent(FrameEvent) { h.sent.Add(1) }
+
+func TestWrap(t *testing.T) {
+	if log.Hardened {
+		t.Skip("riverrun_hardened builds refuse Hooks")
+	}
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	hooks := new(frameCounter)
+	client, err := WrapClient(a, seed, WithProfile(DefaultProfile), WithHooks(hooks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := WrapServer(b, seed, WithConfig(&Config{StrictFrames: true}), WithContext(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write([]byte("hello"))
+		written <- err
+	}()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("client.Write: %v", err)
+	}
+	if hooks.sent.Load() == 0 {
+		t.Error("hooks saw no frames")
+	}
+	if _, err := WrapClient(a, seed, WithProfile("no such profile")); err == nil {
+		t.Error("unknown profile accepted")
+	}
+}
+
+// deadlineCarrier counts the bytes written to it, and has a write deadline
+// closing its channel.
+type deadlineCarrier struct {
+	written int
+	passed  chan struct{}
+}
+
+func (c *deadlineCarrier) Write(b []byte) (int, error) {
+	c.written += len(b)
+	return len(b), nil
+}
+
+func (c *deadlineCarrier) deadline() <-chan struct{} { return c.passed }
+
+func TestSchedulerDeadline(t *testing.T) {
+	for name, factory := range map[string]SchedulerFactory{
+		"immediate": ImmediateScheduler(),
+		"batched":   BatchedScheduler(time.Hour, 1),
+		"paced":     PacedScheduler(1, 1),
+	} {
+		carrier := &deadlineCarrier{passed: make(chan struct{})}
+		close(carrier.passed)
+		s := factory(carrier)
+		if err := s.Write(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%s: got %v, want os.ErrDeadlineExceeded", name, err)
+		}
+		s.Close()
+		if carrier.written != 0 {
+			t.Errorf("%s: %d bytes written past the deadline", name, carrier.written)
+		}
+	}
+}
+
+func TestLimiterRefund(t *testing.T) {
+	shared := NewLimiter(1000, 1000)
+	carrier := &deadlineCarrier{passed: make(chan struct{})}
+	s := LimitedScheduler(0, 0, shared)(carrier)
+	defer s.Close()
+	if err := s.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { close(carrier.passed) })
+	if err := s.Write(make([]byte, 1000)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want os.ErrDeadlineExceeded", err)
+	}
+	// The aborted chunk must not hold up the connections sharing the
+	// limit.
+	if wait := shared.reserve(0); wait != 0 {
+		t.Fatalf("the aborted chunk still holds the limiter for %s", wait)
+	}
+}
+
+func TestNewConnContext(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewConnContext(ctx, a, false, seed, nil)
+	var timeout *HandshakeTimeoutError
+	if !errors.As(err, &timeout) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want a HandshakeTimeoutError for context.Canceled", err)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() || netErr.Temporary() {
+		t.Fatalf("%v is not a permanent timeout", err)
+	}
+
+	// A fresh seed takes longer than the context to generate tables for.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err = NewConnContext(ctx, a, false, seed, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	// The conn must still be usable for the caller.
+	go a.Write([]byte("hello"))
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(b, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("conn after the abort: got %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,213 @@
+package riverrun
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/v2fly/riverrun/common/csrand"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// DefaultRotationPeekTimeout is the time a Listener amid a seed rotation
+// waits for the salt of a client, unless FirstFrameTimeout is set.
+const DefaultRotationPeekTimeout = 30 * time.Second
+
+const (
+	rotationLabel = "riverrun seed rotation"
+	// rotationLength is the size of a sealed announcement: the seed and the
+	// two times in Unix nanoseconds.
+	rotationLength = drbg.SeedLength + 16
+)
+
+// ErrSeedRotation is the error returned by Read for an announcement that does
+// not open.
+var ErrSeedRotation = errors.New("riverrun: invalid seed rotation")
+
+// SeedRotation announces the seed that replaces the current one, see
+// Conn.AnnounceSeed and Listener.SetRotation.  Clients switch to Seed at
+// Start, the server accepts the old seed until End.
+type SeedRotation struct {
+	Seed  *drbg.Seed
+	Start time.Time
+	End   time.Time
+}
+
+func (r *SeedRotation) validate() error {
+	if r.Seed == nil || r.End.Before(r.Start) {
+		return fmt.Errorf("riverrun: invalid seed rotation window [%s, %s]", r.Start, r.End)
+	}
+	return nil
+}
+
+// sealingAEAD returns the cipher sealing the control packets of label keyed
+// by the length mask key of a direction, so that only the peer of this
+// session opens them.
+func sealingAEAD(key []byte, label string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AnnounceSeed sends rotation to the peer, sealed under the keys of this
+// session, for its Config.OnSeedRotation.  Servers do so to migrate their
+// clients to a new seed without handing it out of band.  Before the first
+// Write the announcement is queued behind the salt.
+func (rr *Conn) AnnounceSeed(rotation SeedRotation) error {
+	if err := rotation.validate(); err != nil {
+		return err
+	}
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+
+	aead, err := sealingAEAD(rr.Encoder.drbgKey, rotationLabel)
+	if err != nil {
+		return err
+	}
+	plain := make([]byte, rotationLength)
+	copy(plain, rotation.Seed.Bytes()[:])
+	binary.BigEndian.PutUint64(plain[drbg.SeedLength:], uint64(rotation.Start.UnixNano()))
+	binary.BigEndian.PutUint64(plain[drbg.SeedLength+8:], uint64(rotation.End.UnixNano()))
+	nonce := make([]byte, aead.NonceSize())
+	if err = csrand.Bytes(nonce); err != nil {
+		return err
+	}
+	frameBuf, _, err := rr.Encoder.Chop(aead.Seal(nonce, nonce, plain, nil), PacketTypeSeedRotation)
+	if err != nil {
+		rr.frameLens = rr.frameLens[:0]
+		rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
+		return err
+	}
+	if rr.saltOut != nil {
+		rr.saltOut = append(rr.saltOut, frameBuf.Bytes()...)
+		rr.frameLens = rr.frameLens[:0]
+		rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
+		return nil
+	}
+	_, err = rr.writeFrames(&frameBuf)
+	return err
+}
+
+// handleSeedRotation opens an announcement for Config.OnSeedRotation.
+func (rr *Conn) handleSeedRotation(onRotation func(*Conn, SeedRotation), body []byte) error {
+	aead, err := sealingAEAD(rr.Decoder.drbgKey, rotationLabel)
+	if err != nil {
+		return err
+	}
+	if len(body) < aead.NonceSize() {
+		return ErrSeedRotation
+	}
+	plain, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], nil)
+	if err != nil || len(plain) != rotationLength {
+		return ErrSeedRotation
+	}
+	seed, err := drbg.SeedFromBytes(plain[:drbg.SeedLength])
+	if err != nil {
+		return ErrSeedRotation
+	}
+	onRotation(rr, SeedRotation{
+		Seed:  seed,
+		Start: time.Unix(0, int64(binary.BigEndian.Uint64(plain[drbg.SeedLength:]))),
+		End:   time.Unix(0, int64(binary.BigEndian.Uint64(plain[drbg.SeedLength+8:]))),
+	})
+	return nil
+}
+
+// listenerRotation is the rotation of a Listener along with the Params of its
+// seed, which tell the clients using it apart.
+type listenerRotation struct {
+	SeedRotation
+	params    *Params
+	prefixLen int
+}
+
+// SetRotation starts migrating the Listener to rotation.Seed: until
+// rotation.End it accepts clients of either seed, telling them apart by the
+// committed salt, which needs Config.KeyCommitment on both ends, and
+// announces the rotation to the clients of the old seed.  Past End only the
+// new seed is accepted.  The tables of the new seed are generated first.
+//
+// Amid a rotation, Accept reads the salt of every connection on a goroutine
+// of its own, for FirstFrameTimeout or DefaultRotationPeekTimeout at most, so
+// that clients slow to send do not hold up the others.
+func (l *Listener) SetRotation(rotation SeedRotation) error {
+	if err := rotation.validate(); err != nil {
+		return err
+	}
+	_, config := l.settings()
+	if config == nil || !config.KeyCommitment {
+		return fmt.Errorf("riverrun: a seed rotation needs Config.KeyCommitment")
+	}
+	params, err := DeriveParamsConfig(rotation.Seed, config)
+	if err != nil {
+		return err
+	}
+	prefixLen, err := params.ClientPrefixLength(config)
+	if err != nil {
+		return err
+	}
+	l.rotation.Store(&listenerRotation{SeedRotation: rotation, params: params, prefixLen: prefixLen})
+	return nil
+}
+
+// classify attaches conn with the seed its client uses amid r.  It returns a
+// nil Conn without an error for conns it disposed of itself.
+func (l *Listener) classify(conn net.Conn, r *listenerRotation) (*Conn, error) {
+	current, config := l.settings()
+	seed, announce := r.Seed, false
+	if time.Now().Before(r.End) {
+		timeout := l.FirstFrameTimeout
+		if timeout <= 0 {
+			timeout = DefaultRotationPeekTimeout
+		}
+		prefix := make([]byte, r.prefixLen)
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := io.ReadFull(conn, prefix)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil && n == 0 {
+			l.failSilent(conn)
+			return nil, nil
+		}
+		// Short or unmatched prefixes go to the old seed, whose Read
+		// rejects them as any invalid client.
+		if match, _ := r.params.MatchesClient(prefix[:n], config); !match {
+			seed, announce = current, true
+		}
+		conn = &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(prefix[:n]), conn)}
+	}
+	rr, err := l.setup(conn, seed)
+	if err == nil && announce {
+		if err = rr.AnnounceSeed(r.SeedRotation); err != nil {
+			rr.Close()
+			return nil, err
+		}
+	}
+	return rr, err
+}
+
+// failSilent disposes of conn, whose client sent nothing before the peek
+// timed out or it closed, the way its Conn would have been: dropped as
+// by FirstFrameTimeout if set, else handed to the failure policy.
+func (l *Listener) failSilent(conn net.Conn) {
+	if l.FirstFrameTimeout > 0 {
+		l.silentDrops.Add(1)
+		conn.Close()
+		return
+	}
+	l.lock.RLock()
+	failure := l.failure
+	l.lock.RUnlock()
+	failure.run(conn, nil)
+}
@@ -0,0 +1,153 @@
+package riverrun
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+func TestSeedRotation(t *testing.T) {
+	oldSeed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSeed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen("tcp", "127.0.0.1:0", oldSeed, &Config{KeyCommitment: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	start := time.Now().Add(time.Hour).Round(0)
+	if err = l.SetRotation(SeedRotation{Seed: newSeed, Start: start, End: start.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	rotations := make(chan SeedRotation, 2)
+	dial := func(seed *drbg.Seed, msg string) *Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr, err := NewConnConfig(context.Background(), conn, false, seed, &Config{
+			KeyCommitment:  true,
+			OnSeedRotation: func(_ *Conn, r SeedRotation) { rotations <- r },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { rr.Close() })
+		if _, err = rr.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	// accept reads msg off the next server conn and answers it.
+	accept := func(msg string) {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		got := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, got); err != nil || string(got) != msg {
+			t.Fatalf("read %q, %v, want %q", got, err, msg)
+		}
+		conn.Write([]byte("ok"))
+	}
+
+	for _, c := range []struct {
+		seed *drbg.Seed
+		msg  string
+	}{{oldSeed, "old seed"}, {newSeed, "new seed"}} {
+		client := dial(c.seed, c.msg)
+		accept(c.msg)
+		if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case r := <-rotations:
+		if *r.Seed.Bytes() != *newSeed.Bytes() || !r.Start.Equal(start) || !r.End.Equal(start.Add(time.Hour)) {
+			t.Fatalf("announced %+v", r)
+		}
+	default:
+		t.Fatal("no rotation announced")
+	}
+	if len(rotations) != 0 {
+		t.Error("rotation announced to a client of the new seed")
+	}
+}
+
+func TestRotationFailures(t *testing.T) {
+	oldSeed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSeed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	// The expired quota fails the setup of every client.
+	quota := &TransferQuota{Expiry: time.Now().Add(-time.Hour)}
+	l, err := Listen("tcp", "127.0.0.1:0", oldSeed, &Config{KeyCommitment: true, Quota: quota})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Failure, l.Decoy = FailDecoy, decoy.Addr().String()
+	start := time.Now().Add(time.Hour)
+	if err = l.SetRotation(SeedRotation{Seed: newSeed, Start: start, End: start.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if conn != nil {
+			err = errors.New("got a conn along with the error")
+		}
+		accepted <- err
+	}()
+
+	// A prober sending nothing goes to the decoy.
+	prober, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prober.Close()
+	prober.(*net.TCPConn).CloseWrite()
+	decoy.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	backend, err := decoy.Accept()
+	if err != nil {
+		t.Fatalf("silent prober not handed to the decoy: %v", err)
+	}
+	backend.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := NewConnConfig(context.Background(), conn, false, newSeed, &Config{KeyCommitment: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-accepted; !errors.Is(err, ErrQuotaExpired) {
+		t.Fatalf("Accept: got %v, want ErrQuotaExpired", err)
+	}
+}
@@ -0,0 +1,184 @@
+package riverrun
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"math/rand"
+
+	"github.com/v2fly/riverrun/common/csrand"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// saltLength is the size of the random salt each side sends, expanded, ahead
+// of its first frame.  The frame keys of a direction are derived from the seed
+// and the salt of its sender, so connections sharing a seed do not share
+// keystreams.  No round trip is needed: the salt goes out with the first
+// Write, and is read before the first frame.
+const saltLength = 16
+
+// saltLabel separates the salted key derivation from other uses of the keys.
+const saltLabel = "riverrun salt v1"
+
+// lengthLabel separates the chunk length sampler from the length mask DRBG
+// sharing its key.
+const lengthLabel = "riverrun length v1"
+
+// commitTagLength is the size of the key commitment that follows the salt
+// with Config.KeyCommitment.
+const commitTagLength = 8
+
+// commitLabel separates the key commitment from other uses of the keys.
+const commitLabel = "riverrun commit v1"
+
+// ErrKeyCommitment is the error returned by Read when the key commitment of
+// the peer does not match, i.e. the peer uses another seed.
+var ErrKeyCommitment = errors.New("riverrun: key commitment mismatch")
+
+// commitTag commits to the seed derived key of a direction, and the salt.
+// Unlike frames, which a wrong seed decodes to garbage, it tells seeds
+// apart with certainty but for a 2^-64 chance.
+func commitTag(key, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(commitLabel))
+	mac.Write(salt)
+	return mac.Sum(nil)[:commitTagLength]
+}
+
+// saltBlobLength is the size of the salt before expansion, along with the key
+// commitment if any.
+func (rr *Conn) saltBlobLength() int {
+	if rr.keyCommitment {
+		return saltLength + commitTagLength
+	}
+	return saltLength
+}
+
+// saltedSecret is the key material of one direction: the length mask DRBG
+// key, followed by the AES key and IV of the shuffling stream.
+func saltedSecret(key, salt []byte) []byte {
+	mac := hmac.New(sha512.New, key)
+	mac.Write([]byte(saltLabel))
+	mac.Write(salt)
+	return mac.Sum(nil)[:drbg.SeedLength+16+aes.BlockSize]
+}
+
+// saltedKeys derives the length mask DRBG key and the shuffling stream of one
+// direction from its seed derived key and the salt.
+func saltedKeys(key, salt []byte, lookahead int) ([]byte, cipher.Stream, error) {
+	sum := saltedSecret(key, salt)
+	drbgKey := sum[:drbg.SeedLength]
+	block, err := aes.NewCipher(sum[drbg.SeedLength : drbg.SeedLength+16])
+	if err != nil {
+		return nil, nil, err
+	}
+	iv := sum[drbg.SeedLength+16 : drbg.SeedLength+16+aes.BlockSize]
+	stream := newSeekableCTR(block, iv, lookahead)
+	stream.key = sum[drbg.SeedLength : drbg.SeedLength+16]
+	return drbgKey, stream, nil
+}
+
+// initSalt picks the salt of the write direction and switches the encoder to
+// the salted keys.  The salt itself is expanded with the unsalted stream.
+func (rr *Conn) initSalt(writeKey []byte) error {
+	salt := make([]byte, saltLength)
+	if err := csrand.Bytes(salt); err != nil {
+		return err
+	}
+	blob := salt
+	if rr.keyCommitment {
+		blob = append(salt, commitTag(writeKey, salt)...)
+	}
+	rr.saltOut = make([]byte, rr.Encoder.codec.ExpandedLen(len(blob)))
+	if err := rr.Encoder.expandBytes(blob, rr.saltOut); err != nil {
+		return err
+	}
+
+	key, stream, err := saltedKeys(writeKey, salt, rr.lookahead)
+	if err != nil {
+		return err
+	}
+	if rr.keyLog != nil {
+		rr.keyLog.keys(rr.keyLog.writeDir, salt, saltedSecret(writeKey, salt))
+		rr.keyLog.writeOffset = uint64(len(rr.saltOut))
+	}
+	if err = rr.setLengthKey(key, 0); err != nil {
+		return err
+	}
+	rr.Encoder.setKeys(key, stream)
+	return nil
+}
+
+// setLengthKey seeds the chunk length sampler with key, skipping the first
+// blocks drawn.
+func (rr *Conn) setLengthKey(key []byte, blocks uint64) error {
+	lengthSeed, err := drbg.SeedFromBytes(key)
+	if err != nil {
+		return err
+	}
+	lengthDrbg, err := drbg.NewHashDrbgPersonalized(lengthSeed, []byte(lengthLabel))
+	if err != nil {
+		return err
+	}
+	lengthDrbg.Skip(blocks)
+	rr.lengthKey = append([]byte(nil), key...)
+	rr.lengthDrbg = lengthDrbg
+	rr.lengthRand = rand.New(lengthDrbg)
+	return nil
+}
+
+// takeSalt returns the expanded salt if it has not been sent yet.  It must be
+// called with writeLock held.
+func (rr *Conn) takeSalt() []byte {
+	salt := rr.saltOut
+	rr.saltOut = nil
+	return salt
+}
+
+// readSalt reads the peer's salt and switches the decoder to the salted keys.
+// A salt read cut short by a deadline is resumed by the next call.
+func (rr *Conn) readSalt() error {
+	for rr.saltInLen < len(rr.saltIn) {
+		n, err := rr.wire.Read(rr.saltIn[rr.saltInLen:])
+		rr.saltInLen += n
+		if err != nil {
+			return err
+		}
+	}
+
+	blob := make([]byte, rr.saltBlobLength())
+	if err := rr.Decoder.compressBytes(rr.saltIn, blob); err != nil {
+		return err
+	}
+	salt := blob[:saltLength]
+	if rr.keyCommitment && !hmac.Equal(blob[saltLength:], commitTag(rr.readKey, salt)) {
+		return ErrKeyCommitment
+	}
+	if rr.replay != nil {
+		if rr.replay.check(salt, false) {
+			return ErrReplay
+		}
+		replay, first := rr.replay, rr.Decoder.onFirstFrame
+		salt := append([]byte(nil), salt...)
+		rr.Decoder.onFirstFrame = func() {
+			replay.check(salt, true)
+			if first != nil {
+				first()
+			}
+		}
+	}
+	key, stream, err := saltedKeys(rr.readKey, salt, rr.lookahead)
+	if err != nil {
+		return err
+	}
+	if rr.keyLog != nil {
+		rr.keyLog.keys(rr.keyLog.readDir, salt, saltedSecret(rr.readKey, salt))
+		rr.keyLog.readOffset = uint64(len(rr.saltIn))
+	}
+	rr.Decoder.setKeys(key, stream)
+	rr.readKey = nil
+	return nil
+}
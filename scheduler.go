@@ -0,0 +1,248 @@
+package riverrun
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Scheduler decides when the shaped chunks produced by Conn.Write reach the
+// carrier.  Write is only called with the connection's write lock held, but
+// Flush and Close may be called concurrently with it.
+type Scheduler interface {
+	// Write hands one shaped chunk to the scheduler.  The scheduler takes
+	// ownership of chunk.
+	Write(chunk []byte) error
+	// Flush writes out any chunks held back.
+	Flush() error
+	// Close flushes and releases the scheduler, interrupting pending waits.
+	Close() error
+}
+
+// SchedulerFactory creates the Scheduler for the carrier of one connection.
+type SchedulerFactory func(carrier io.Writer) Scheduler
+
+// deadliner is implemented by the carrier riverrun passes to a
+// SchedulerFactory: deadline returns a channel closed once the write deadline
+// of the connection passes.
+type deadliner interface {
+	deadline() <-chan struct{}
+}
+
+// carrierDeadline returns the deadline method of carrier, or nil for
+// carriers without a deadline.
+func carrierDeadline(carrier io.Writer) func() <-chan struct{} {
+	if d, ok := carrier.(deadliner); ok {
+		return d.deadline
+	}
+	return nil
+}
+
+// deadlinePassed reports whether the channel returned by deadline is closed.
+func deadlinePassed(deadline func() <-chan struct{}) bool {
+	if deadline == nil {
+		return false
+	}
+	select {
+	case <-deadline():
+		return true
+	default:
+		return false
+	}
+}
+
+// ImmediateScheduler writes every chunk to the carrier as soon as it is
+// produced.  This is the default.  Once the write deadline of the connection
+// passed, Write fails with os.ErrDeadlineExceeded.
+func ImmediateScheduler() SchedulerFactory {
+	return func(carrier io.Writer) Scheduler {
+		return &immediateScheduler{carrier: carrier, deadline: carrierDeadline(carrier)}
+	}
+}
+
+type immediateScheduler struct {
+	carrier  io.Writer
+	deadline func() <-chan struct{}
+}
+
+func (s *immediateScheduler) Write(chunk []byte) error {
+	if deadlinePassed(s.deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	_, err := s.carrier.Write(chunk)
+	return err
+}
+
+func (s *immediateScheduler) Flush() error { return nil }
+func (s *immediateScheduler) Close() error { return nil }
+
+// PacedScheduler limits the write rate to bytesPerSecond with a token bucket
+// holding up to burst bytes.  Chunks are delayed, never dropped.
+func PacedScheduler(bytesPerSecond float64, burst int) SchedulerFactory {
+	return LimitedScheduler(bytesPerSecond, burst)
+}
+
+// LimitedScheduler paces each connection to bytesPerSecond with bursts of up
+// to burst bytes, and additionally against every shared Limiter, e.g. a
+// server wide one.  A zero bytesPerSecond disables the per-connection limit.
+// The write deadline of the connection ends a wait with
+// os.ErrDeadlineExceeded, and gives the tokens of the chunk back.
+func LimitedScheduler(bytesPerSecond float64, burst int, shared ...*Limiter) SchedulerFactory {
+	return func(carrier io.Writer) Scheduler {
+		s := &pacedScheduler{
+			carrier:  carrier,
+			deadline: carrierDeadline(carrier),
+			closed:   make(chan struct{}),
+		}
+		if bytesPerSecond > 0 {
+			s.limiters = append(s.limiters, NewLimiter(bytesPerSecond, burst))
+		}
+		s.limiters = append(s.limiters, shared...)
+		return s
+	}
+}
+
+type pacedScheduler struct {
+	carrier  io.Writer
+	limiters []*Limiter
+	deadline func() <-chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (s *pacedScheduler) Write(chunk []byte) error {
+	var wait time.Duration
+	for _, l := range s.limiters {
+		if w := l.reserve(len(chunk)); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		var deadline <-chan struct{}
+		if s.deadline != nil {
+			deadline = s.deadline()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-deadline:
+			timer.Stop()
+			s.refund(len(chunk))
+			return os.ErrDeadlineExceeded
+		case <-s.closed:
+			timer.Stop()
+			s.refund(len(chunk))
+			return net.ErrClosed
+		}
+	}
+	_, err := s.carrier.Write(chunk)
+	return err
+}
+
+// refund gives back the tokens reserved for a chunk that was not written.
+func (s *pacedScheduler) refund(n int) {
+	for _, l := range s.limiters {
+		l.refund(n)
+	}
+}
+
+func (s *pacedScheduler) Flush() error { return nil }
+
+func (s *pacedScheduler) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+// BatchedScheduler holds chunks back and releases them together, either
+// delay after the first held chunk or once maxBytes are pending.  Chunks keep
+// their boundaries, every chunk is still a separate carrier write.  Errors
+// from a background release are returned by the next call.  Once the write
+// deadline of the connection passed, Write fails with os.ErrDeadlineExceeded
+// and holds nothing more back.
+func BatchedScheduler(delay time.Duration, maxBytes int) SchedulerFactory {
+	return func(carrier io.Writer) Scheduler {
+		return &batchedScheduler{
+			carrier:  carrier,
+			deadline: carrierDeadline(carrier),
+			delay:    delay,
+			maxBytes: maxBytes,
+		}
+	}
+}
+
+type batchedScheduler struct {
+	carrier  io.Writer
+	deadline func() <-chan struct{}
+	delay    time.Duration
+	maxBytes int
+
+	lock    sync.Mutex
+	pending [][]byte
+	size    int
+	timer   *time.Timer
+	err     error
+	closed  bool
+}
+
+func (s *batchedScheduler) Write(chunk []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.closed {
+		return net.ErrClosed
+	}
+	if deadlinePassed(s.deadline) {
+		return os.ErrDeadlineExceeded
+	}
+
+	s.pending = append(s.pending, chunk)
+	s.size += len(chunk)
+	if s.size >= s.maxBytes {
+		return s.flushLocked()
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.delay, func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			s.timer = nil
+			s.flushLocked()
+		})
+	}
+	return nil
+}
+
+func (s *batchedScheduler) flushLocked() error {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	for len(s.pending) > 0 && s.err == nil {
+		_, s.err = s.carrier.Write(s.pending[0])
+		s.pending = s.pending[1:]
+	}
+	s.pending = nil
+	s.size = 0
+	return s.err
+}
+
+func (s *batchedScheduler) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flushLocked()
+}
+
+func (s *batchedScheduler) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	err := s.flushLocked()
+	s.closed = true
+	return err
+}
@@ -0,0 +1,130 @@
+package riverrun
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunkWriter records every Write as a separate chunk.
+type chunkWriter struct {
+	lock   sync.Mutex
+	chunks []string
+	err    error
+}
+
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.chunks = append(w.chunks, string(b))
+	return len(b), nil
+}
+
+func (w *chunkWriter) written() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.chunks...)
+}
+
+func TestBatchedScheduler(t *testing.T) {
+	carrier := new(chunkWriter)
+	s := BatchedScheduler(time.Hour, 6)(carrier)
+	for _, chunk := range []string{"a", "bc"} {
+		if err := s.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := carrier.written(); len(got) != 0 {
+		t.Fatalf("released %q before the delay", got)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := carrier.written(); len(got) != 2 || got[0] != "a" || got[1] != "bc" {
+		t.Fatalf("flushed %q, want the chunks in order", got)
+	}
+
+	// Reaching maxBytes releases the batch at once.
+	s.Write([]byte("def"))
+	if err := s.Write([]byte("ghi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := carrier.written(); len(got) != 4 || got[3] != "ghi" {
+		t.Fatalf("got %q after maxBytes", got)
+	}
+
+	// A carrier error is returned by the next call.
+	carrier.err = io.ErrClosedPipe
+	s.Write([]byte("j"))
+	if err := s.Flush(); err != io.ErrClosedPipe {
+		t.Fatalf("Flush: got %v, want the carrier error", err)
+	}
+	if err := s.Write([]byte("k")); err != io.ErrClosedPipe {
+		t.Fatalf("Write: got %v, want the carrier error", err)
+	}
+
+	carrier = new(chunkWriter)
+	s = BatchedScheduler(10*time.Millisecond, 1<<20)(carrier)
+	s.Write([]byte("late"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(carrier.written()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("chunk not released after the delay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.Write([]byte("closing"))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := carrier.written(); len(got) != 2 || got[1] != "closing" {
+		t.Fatalf("Close flushed %q", got)
+	}
+	if err := s.Write([]byte("closed")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Write after Close: got %v, want net.ErrClosed", err)
+	}
+}
+
+func TestPacedScheduler(t *testing.T) {
+	carrier := new(chunkWriter)
+	s := PacedScheduler(100*1024, 4096)(carrier)
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		if err := s.Write(make([]byte, 4096)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The burst covers the first chunk, the other 28kB go at 100kB/s.
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("32kB written in %s", elapsed)
+	}
+	if got := carrier.written(); len(got) != 8 {
+		t.Fatalf("%d chunks written, want 8", len(got))
+	}
+
+	// Close interrupts a pending wait.
+	time.AfterFunc(50*time.Millisecond, func() { s.Close() })
+	start = time.Now()
+	if err := s.Write(make([]byte, 100*1024)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v, want net.ErrClosed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Close interrupted the wait after %s", elapsed)
+	}
+}
+
+func TestImmediateScheduler(t *testing.T) {
+	carrier := new(chunkWriter)
+	s := ImmediateScheduler()(carrier)
+	s.Write([]byte("a"))
+	s.Write([]byte("b"))
+	if got := carrier.written(); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package riverrun
+
+import (
+	"crypto/cipher"
+	"errors"
+
+	"github.com/v2fly/riverrun/common/drbg"
+	f "github.com/v2fly/riverrun/common/framing"
+)
+
+// ErrNotSeekable is the error returned by Seek when the keystream of a
+// direction can not be moved.
+var ErrNotSeekable = errors.New("riverrun: keystream not seekable")
+
+// StreamOffset is a position in the keystreams of one direction: the length
+// mask blocks drawn, one per frame, and the bytes of CTR keystream used.
+// Both only count from the last key switch, i.e. the salt or the key
+// exchange.
+type StreamOffset struct {
+	Frames    uint64
+	Keystream uint64
+}
+
+// setKeys switches the encoder to the length mask key and stream.
+func (encoder *riverrunEncoder) setKeys(key []byte, stream cipher.Stream) {
+	encoder.drbgKey = append([]byte(nil), key...)
+	encoder.Drbg = f.GenDrbg(key)
+	encoder.writeStream = stream
+}
+
+// Offset returns the position of the encoder in its keystreams.
+func (encoder *riverrunEncoder) Offset() StreamOffset {
+	return streamOffset(encoder.Drbg.Blocks(), encoder.writeStream)
+}
+
+// Seek moves the encoder to offset, e.g. to the Offset of the peer's decoder
+// when an application moves a Conn onto another carrier, so that the frames
+// written next decode without replaying everything sent before.
+// UnmarshalState seeks this way.  The resume package does not, each of its
+// carriers is a Conn of its own.  The keystream jumps in constant time, the
+// length masks are drawn again.  Seek must not run concurrently with Write.
+func (encoder *riverrunEncoder) Seek(offset StreamOffset) error {
+	drbg, err := seekStreams(encoder.drbgKey, encoder.writeStream, offset)
+	if err != nil {
+		return err
+	}
+	encoder.Drbg = drbg
+	return nil
+}
+
+// setKeys switches the decoder to the length mask key and stream.
+func (decoder *riverrunDecoder) setKeys(key []byte, stream cipher.Stream) {
+	decoder.drbgKey = append([]byte(nil), key...)
+	decoder.Drbg = f.GenDrbg(key)
+	decoder.readStream = stream
+}
+
+// Offset returns the position of the decoder in its keystreams, which is at
+// a frame boundary between Reads.
+func (decoder *riverrunDecoder) Offset() StreamOffset {
+	return streamOffset(decoder.Drbg.Blocks(), decoder.readStream)
+}
+
+// Seek moves the decoder to offset, the Offset of the peer's encoder when it
+// wrote the next frame to arrive.  The frames received but not decoded yet
+// are dropped, the payload decoded is kept.  Seek must not run concurrently
+// with Read.
+func (decoder *riverrunDecoder) Seek(offset StreamOffset) error {
+	drbg, err := seekStreams(decoder.drbgKey, decoder.readStream, offset)
+	if err != nil {
+		return err
+	}
+	decoder.Drbg = drbg
+	decoder.ResetFrames()
+	decoder.partialType = 0
+	decoder.partialBody = nil
+	decoder.partialLength = 0
+	return nil
+}
+
+func streamOffset(frames uint64, stream cipher.Stream) StreamOffset {
+	res := StreamOffset{Frames: frames}
+	if s, ok := stream.(*seekableCTR); ok {
+		res.Keystream = s.offset
+	}
+	return res
+}
+
+// seekStreams moves stream to offset.Keystream and returns the length mask
+// DRBG of key moved to offset.Frames.
+func seekStreams(key []byte, stream cipher.Stream, offset StreamOffset) (*drbg.HashDrbg, error) {
+	s, ok := stream.(*seekableCTR)
+	if !ok {
+		return nil, ErrNotSeekable
+	}
+	res := f.GenDrbg(key)
+	res.Skip(offset.Frames)
+	s.seek(offset.Keystream)
+	return res, nil
+}
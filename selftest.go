@@ -0,0 +1,63 @@
+package riverrun
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"github.com/v2fly/riverrun/analysis"
+	"github.com/v2fly/riverrun/common/csrand"
+	f "github.com/v2fly/riverrun/common/framing"
+)
+
+// EntropyOutOfRangeError is the error returned by the entropy self-test when
+// the expanded probe falls outside of the configured window.
+type EntropyOutOfRangeError struct {
+	Entropy  float64
+	Min, Max float64
+}
+
+func (e *EntropyOutOfRangeError) Error() string {
+	return fmt.Sprintf("riverrun: self-test entropy %f outside of [%f, %f]", e.Entropy, e.Min, e.Max)
+}
+
+// entropySelfTest expands a random probe with the connection's codec and
+// checks the byte entropy of the result.  It uses its own keystream so the
+// connection's streams are left untouched.
+func entropySelfTest(codec f.Codec, config *Config) error {
+	key := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	probe := make([]byte, config.SelfTestProbeSize)
+	for _, b := range [][]byte{key, iv, probe} {
+		if err := csrand.Bytes(b); err != nil {
+			return err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	expanded := make([]byte, codec.ExpandedLen(len(probe)))
+	err = codec.Expand(expanded, probe, cipher.NewCTR(block, iv))
+	if err != nil {
+		return err
+	}
+
+	var counts [256]uint64
+	for _, b := range expanded {
+		counts[b]++
+	}
+	entropy := analysis.Entropy(counts[:])
+	logParams(config.Logger, "riverrun: Self-test entropy %f", entropy)
+	if entropy >= config.MinEntropy && entropy <= config.MaxEntropy {
+		return nil
+	}
+
+	err = &EntropyOutOfRangeError{Entropy: entropy, Min: config.MinEntropy, Max: config.MaxEntropy}
+	if config.EntropySelfTest == SelfTestFail {
+		return err
+	}
+	config.Logger.Infof("%s", err)
+	return nil
+}
@@ -0,0 +1,53 @@
+package riverrun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+func TestEntropySelfTest(t *testing.T) {
+	client, server := newTestPair(t, &Config{EntropySelfTest: SelfTestFail}, nil)
+	go client.Write([]byte("hello"))
+	if _, err := server.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	// No expansion reaches a full 8 bits per byte.
+	strict := &Config{EntropySelfTest: SelfTestFail, MinEntropy: 7.9999, MaxEntropy: 8}
+	var rangeErr *EntropyOutOfRangeError
+	if _, err := NewConnConfig(context.Background(), a, false, seed, strict); !errors.As(err, &rangeErr) {
+		t.Fatalf("got %v, want EntropyOutOfRangeError", err)
+	}
+	if rangeErr.Min != strict.MinEntropy || rangeErr.Entropy >= strict.MinEntropy {
+		t.Errorf("error %+v", rangeErr)
+	}
+
+	logger := new(recordLogger)
+	logged := &Config{EntropySelfTest: SelfTestLog, MinEntropy: 7.9999, MaxEntropy: 8, Logger: logger}
+	rr, err := NewConnConfig(context.Background(), b, true, seed, logged)
+	if err != nil {
+		t.Fatalf("SelfTestLog: %v", err)
+	}
+	defer rr.Close()
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	found := false
+	for _, line := range logger.lines {
+		found = found || strings.Contains(line, "outside of")
+	}
+	if !found {
+		t.Errorf("out-of-window result not logged: %q", logger.lines)
+	}
+}
@@ -0,0 +1,100 @@
+package riverrun
+
+import (
+	"fmt"
+	"math/rand"
+
+	f "github.com/v2fly/riverrun/common/framing"
+)
+
+const (
+	// DefaultBiasMin and DefaultBiasMax bound the table bias drawn for each
+	// direction.
+	DefaultBiasMin = .1
+	DefaultBiasMax = .3
+
+	// DefaultExpandedBlockBits is the size every 16-bit block expands to.
+	DefaultExpandedBlockBits = 32
+
+	// DefaultMSSMin and DefaultMSSMax bound the chunk length drawn for each
+	// direction, DefaultMSSDevMax the deviation of the lengths below it.
+	DefaultMSSMin    = 600
+	DefaultMSSMax    = 1400
+	DefaultMSSDevMax = 4
+)
+
+// Shape is the model the traffic parameters of a seed are drawn from.  It
+// only applies where the parameters are derived, by NewConnConfig and
+// DeriveParamsConfig, and both peers must use the same one.  Zero fields
+// select the defaults.
+type Shape struct {
+	// BiasMin and BiasMax bound the table bias of either direction, the
+	// share of set bits in the expanded blocks, which sets the byte
+	// entropy on the wire.
+	BiasMin float64
+	BiasMax float64
+	// ExpandedBlockBits is the size of an expanded 16-bit block, one of
+	// 32, 48 and 64.  Larger blocks cost bandwidth and make the tables
+	// slower to generate.
+	ExpandedBlockBits int
+	// MSSMin and MSSMax bound the chunk length of either direction, and
+	// MSSDevMax the standard deviation of the lengths sampled below it.
+	MSSMin    int
+	MSSMax    int
+	MSSDevMax float64
+}
+
+// withDefaults returns s with unset fields filled in.
+func (s Shape) withDefaults() Shape {
+	if s.BiasMin == 0 && s.BiasMax == 0 {
+		s.BiasMin, s.BiasMax = DefaultBiasMin, DefaultBiasMax
+	}
+	if s.ExpandedBlockBits == 0 {
+		s.ExpandedBlockBits = DefaultExpandedBlockBits
+	}
+	if s.MSSMin == 0 && s.MSSMax == 0 {
+		s.MSSMin, s.MSSMax = DefaultMSSMin, DefaultMSSMax
+	}
+	if s.MSSDevMax == 0 {
+		s.MSSDevMax = DefaultMSSDevMax
+	}
+	return s
+}
+
+func (s *Shape) validate() error {
+	if s.BiasMin <= 0 || s.BiasMax >= 1 || s.BiasMin > s.BiasMax {
+		return fmt.Errorf("riverrun: invalid bias range [%f, %f]", s.BiasMin, s.BiasMax)
+	}
+	switch s.ExpandedBlockBits {
+	case 32, 48, 64:
+	default:
+		return fmt.Errorf("riverrun: invalid expanded block bits: %d", s.ExpandedBlockBits)
+	}
+	if s.MSSMin <= 0 || s.MSSMax > f.MaximumSegmentLength || s.MSSMin > s.MSSMax {
+		return fmt.Errorf("riverrun: invalid mss range [%d, %d]", s.MSSMin, s.MSSMax)
+	}
+	if s.MSSDevMax < 0 {
+		return fmt.Errorf("riverrun: invalid mss deviation: %f", s.MSSDevMax)
+	}
+	return nil
+}
+
+// bias draws a table bias.
+func (s *Shape) bias(rng *rand.Rand) float64 {
+	if s.BiasMin == DefaultBiasMin && s.BiasMax == DefaultBiasMax {
+		// The width as a literal, as DefaultBiasMax-DefaultBiasMin is
+		// off by a rounding error and would change the tables.
+		return rng.Float64()*.2 + .1
+	}
+	return rng.Float64()*(s.BiasMax-s.BiasMin) + s.BiasMin
+}
+
+// mss draws a chunk length.
+func (s *Shape) mss(rng *rand.Rand) int {
+	return int(rng.Float64()*float64(s.MSSMax-s.MSSMin)) + s.MSSMin
+}
+
+// dev draws the deviation of the chunk lengths.
+func (s *Shape) dev(rng *rand.Rand) float64 {
+	return rng.Float64() * s.MSSDevMax
+}
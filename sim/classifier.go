@@ -0,0 +1,175 @@
+// Package sim models the passive classifiers a censor runs against fully
+// encrypted traffic, and scores riverrun's wire output against them.  The
+// classifiers are reference implementations of those in the measurement
+// studies behind riverrun's bias targets, simple enough to serve as
+// regression checks on indistinguishability rather than as a faithful copy of
+// any deployed system.
+package sim
+
+import (
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/v2fly/riverrun/analysis"
+)
+
+const (
+	// MinExemptPopCount and MaxExemptPopCount bound the mean set bits per
+	// byte of a first packet that looks random: first packets at or beneath
+	// the one, or at or above the other, are let through.
+	MinExemptPopCount = 3.4
+	MaxExemptPopCount = 4.6
+
+	// printableRun is the run of printable bytes that exempts a first
+	// packet, printablePrefix the printable prefix that does.
+	printableRun    = 20
+	printablePrefix = 6
+)
+
+// Packet is a single read or write seen on the wire.
+type Packet struct {
+	// Time is when the packet was seen, relative to the start of the flow.
+	Time time.Duration
+	Data []byte
+}
+
+// Flow is the traffic flowing one way on a connection.
+type Flow struct {
+	Packets []Packet
+}
+
+// Classifier scores a flow in [0, 1], where 1 means it was certainly flagged.
+type Classifier interface {
+	Name() string
+	Score(flow *Flow) float64
+}
+
+// EntropyClassifier flags flows whose first packet looks uniformly random:
+// a mean popcount between MinExemptPopCount and MaxExemptPopCount, less than
+// half printable bytes, no printable prefix and no long printable run.
+type EntropyClassifier struct{}
+
+func (EntropyClassifier) Name() string { return "entropy" }
+
+func (EntropyClassifier) Score(flow *Flow) float64 {
+	if len(flow.Packets) == 0 || len(flow.Packets[0].Data) == 0 {
+		return 0
+	}
+	first := flow.Packets[0].Data
+	var ones, printable, run, longest int
+	for _, b := range first {
+		ones += bits.OnesCount8(b)
+		if b >= 0x20 && b <= 0x7e {
+			printable++
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	popCount := float64(ones) / float64(len(first))
+	prefix := len(first) >= printablePrefix
+	for _, b := range first[:min(printablePrefix, len(first))] {
+		prefix = prefix && b >= 0x20 && b <= 0x7e
+	}
+	if popCount <= MinExemptPopCount || popCount >= MaxExemptPopCount || prefix ||
+		printable*2 > len(first) || longest > printableRun {
+		return 0
+	}
+	return 1
+}
+
+// LengthClassifier flags flows by their packet lengths.  With a Target, the
+// score is the total variation distance of the length histograms; without
+// one, it is the share of packets in the most common bucket, which catches
+// the constant, MSS-sized lengths of naive tunnels.
+type LengthClassifier struct {
+	Target *analysis.Histogram
+	// BucketWidth is the histogram bucket width in bytes, unless Target
+	// sets it.  Zero selects analysis.DefaultLengthBucket.
+	BucketWidth float64
+}
+
+func (LengthClassifier) Name() string { return "length" }
+
+func (c LengthClassifier) Score(flow *Flow) float64 {
+	width := c.BucketWidth
+	if c.Target != nil {
+		width = c.Target.BucketWidth
+	} else if width == 0 {
+		width = analysis.DefaultLengthBucket
+	}
+	h := analysis.NewHistogram(width)
+	for _, p := range flow.Packets {
+		h.Add(float64(len(p.Data)))
+	}
+	if c.Target != nil {
+		d, _ := analysis.TotalVariation(h, c.Target)
+		return d
+	}
+	return modeShare(h)
+}
+
+// TimingClassifier flags flows by the gaps between their packets.  With a
+// Target, the score is the Kolmogorov-Smirnov statistic of the gap
+// histograms, in microseconds; without one, it is how regular the gaps are,
+// one minus their coefficient of variation, clamped to [0, 1].
+type TimingClassifier struct {
+	Target *analysis.Histogram
+}
+
+func (TimingClassifier) Name() string { return "timing" }
+
+func (c TimingClassifier) Score(flow *Flow) float64 {
+	if len(flow.Packets) < 3 {
+		return 0
+	}
+	gaps := make([]float64, 0, len(flow.Packets)-1)
+	for i := 1; i < len(flow.Packets); i++ {
+		gaps = append(gaps, float64((flow.Packets[i].Time - flow.Packets[i-1].Time).Microseconds()))
+	}
+	if c.Target != nil {
+		h := analysis.NewHistogram(c.Target.BucketWidth)
+		for _, g := range gaps {
+			h.Add(g)
+		}
+		d, _ := analysis.KolmogorovSmirnov(h, c.Target)
+		return d
+	}
+	var mean, variance float64
+	for _, g := range gaps {
+		mean += g
+	}
+	mean /= float64(len(gaps))
+	if mean == 0 {
+		return 1
+	}
+	for _, g := range gaps {
+		variance += (g - mean) * (g - mean)
+	}
+	cv := math.Sqrt(variance/float64(len(gaps))) / mean
+	return math.Max(0, 1-cv)
+}
+
+// modeShare returns the share of the samples of h in its fullest bucket.
+func modeShare(h *analysis.Histogram) float64 {
+	total := h.Total()
+	if total == 0 {
+		return 0
+	}
+	var most uint64
+	for _, c := range h.Counts {
+		if c > most {
+			most = c
+		}
+	}
+	return float64(most) / float64(total)
+}
+
+// DefaultClassifiers returns the reference classifiers without targets.
+func DefaultClassifiers() []Classifier {
+	return []Classifier{EntropyClassifier{}, LengthClassifier{}, TimingClassifier{}}
+}
@@ -0,0 +1,156 @@
+package sim
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// DefaultWorkloadWrites is the number of writes of DefaultWorkload.
+const DefaultWorkloadWrites = 64
+
+// Harness runs generated traffic over a riverrun connection and scores what
+// the client puts on the wire.
+type Harness struct {
+	// ClientConfig and ServerConfig configure the two ends, nil selects
+	// the defaults.
+	ClientConfig *riverrun.Config
+	ServerConfig *riverrun.Config
+	// Seed is the shared seed, nil draws a new one.
+	Seed *drbg.Seed
+	// Workload writes the application traffic of the client, nil selects
+	// DefaultWorkload.
+	Workload func(w io.Writer) error
+	// Classifiers score the flow, nil selects DefaultClassifiers.
+	Classifiers []Classifier
+}
+
+// Report is the outcome of a Harness run.
+type Report struct {
+	// Packets and Bytes count the carrier writes of the client.
+	Packets int
+	Bytes   int
+	// Scores maps the name of each classifier to its score.
+	Scores map[string]float64
+	// Flow is the captured client traffic.
+	Flow *Flow
+	// TraceID is the trace ID of the client, see riverrun.Conn.TraceID.
+	TraceID string
+}
+
+// DefaultWorkload writes DefaultWorkloadWrites buffers of 1 to 4096 bytes,
+// the same on every run.
+func DefaultWorkload(w io.Writer) error {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < DefaultWorkloadWrites; i++ {
+		if _, err := w.Write(make([]byte, 1+rng.Intn(4096))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run runs the workload and returns the scores of the client flow.
+func (h *Harness) Run(ctx context.Context) (*Report, error) {
+	a, b := net.Pipe()
+	report, _, _, err := h.run(ctx, a, b)
+	return report, err
+}
+
+// run runs the workload over the carriers a of the client and b of the
+// server, and returns the captured writes of either.
+func (h *Harness) run(ctx context.Context, a, b net.Conn) (*Report, *captureConn, *captureConn, error) {
+	seed := h.Seed
+	if seed == nil {
+		var err error
+		if seed, err = drbg.NewSeed(); err != nil {
+			a.Close()
+			b.Close()
+			return nil, nil, nil, err
+		}
+	}
+	workload := h.Workload
+	if workload == nil {
+		workload = DefaultWorkload
+	}
+	classifiers := h.Classifiers
+	if classifiers == nil {
+		classifiers = DefaultClassifiers()
+	}
+
+	start := time.Now()
+	clientWire := &captureConn{Conn: a, start: start}
+	serverWire := &captureConn{Conn: b, start: start}
+	client, err := riverrun.NewConnConfig(ctx, clientWire, false, seed, h.ClientConfig)
+	if err != nil {
+		a.Close()
+		b.Close()
+		return nil, nil, nil, err
+	}
+	server, err := riverrun.NewConnConfig(ctx, serverWire, true, seed, h.ServerConfig)
+	if err != nil {
+		client.Close()
+		b.Close()
+		return nil, nil, nil, err
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(io.Discard, server)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(io.Discard, client)
+	}()
+	err = workload(client)
+	if cerr := client.Close(); err == nil {
+		err = cerr
+	}
+	server.Close()
+	wg.Wait()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	flow := clientWire.flow()
+	report := &Report{Packets: len(flow.Packets), Scores: make(map[string]float64), Flow: flow, TraceID: client.TraceID()}
+	for _, p := range flow.Packets {
+		report.Bytes += len(p.Data)
+	}
+	for _, c := range classifiers {
+		report.Scores[c.Name()] = c.Score(flow)
+	}
+	return report, clientWire, serverWire, nil
+}
+
+// captureConn records the writes to a carrier.
+type captureConn struct {
+	net.Conn
+	start time.Time
+
+	lock    sync.Mutex
+	packets []Packet
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.lock.Lock()
+		c.packets = append(c.packets, Packet{Time: time.Since(c.start), Data: append([]byte(nil), b[:n]...)})
+		c.lock.Unlock()
+	}
+	return n, err
+}
+
+func (c *captureConn) flow() *Flow {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return &Flow{Packets: append([]Packet(nil), c.packets...)}
+}
@@ -0,0 +1,101 @@
+package riverrun
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrRawIO is the error returned by the Read and Write of the syscall.RawConn
+// of a Conn, as bytes passing the carrier directly would bypass the codec.
+var ErrRawIO = errors.New("riverrun: raw carrier I/O bypasses the codec")
+
+// ErrNoSyscallConn is the error returned by Conn.SyscallConn when the carrier
+// is not a syscall.Conn.
+var ErrNoSyscallConn = errors.New("riverrun: carrier is not a syscall.Conn")
+
+// SocketOptions tune the TCP carrier of a connection.  The zero value keeps
+// the settings of the Go runtime.  Options are skipped for carriers other
+// than TCP.
+type SocketOptions struct {
+	// Nagle re-enables Nagle's algorithm, which Go disables on every TCP
+	// conn.  Disabled, each shaped chunk leaves as soon as it is written,
+	// instead of being merged with the next one into an unshaped segment.
+	Nagle bool
+	// SendBuffer and ReceiveBuffer set SO_SNDBUF and SO_RCVBUF, in bytes.
+	// Zero keeps the system default.
+	SendBuffer    int
+	ReceiveBuffer int
+	// KeepAlive is the TCP keepalive period.  Zero keeps the default of the
+	// dialer or listener, a negative value disables keepalives.
+	KeepAlive time.Duration
+}
+
+// Apply sets the options on conn if it is a TCP conn.
+func (o *SocketOptions) Apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.Nagle {
+		if err := tcp.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if o.ReceiveBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	switch {
+	case o.KeepAlive < 0:
+		return tcp.SetKeepAlive(false)
+	case o.KeepAlive > 0:
+		if err := tcp.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return tcp.SetKeepAlivePeriod(o.KeepAlive)
+	}
+	return nil
+}
+
+// SyscallConn returns the raw conn of the carrier for socket options.  Only
+// Control is passed through: Read and Write fail with ErrRawIO, so
+// frameworks that splice or sendfile through a syscall.Conn fall back to
+// Read and Write instead of bypassing the codec.
+func (rr *Conn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := rr.Conn.(syscall.Conn)
+	if !ok {
+		return nil, ErrNoSyscallConn
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	return controlOnly{raw}, nil
+}
+
+// RawCarrier returns the carrier of rr.  Bytes read from or written to it
+// bypass the codec and break the connection, it is meant for socket level
+// access only.
+func (rr *Conn) RawCarrier() net.Conn {
+	return rr.Conn
+}
+
+// controlOnly is a syscall.RawConn refusing raw I/O.
+type controlOnly struct {
+	raw syscall.RawConn
+}
+
+func (c controlOnly) Control(f func(fd uintptr)) error {
+	return c.raw.Control(f)
+}
+
+func (controlOnly) Read(func(fd uintptr) bool) error  { return ErrRawIO }
+func (controlOnly) Write(func(fd uintptr) bool) error { return ErrRawIO }
@@ -0,0 +1,51 @@
+package riverrun
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// checkSocketOptions reads the options of opts back from conn.
+func checkSocketOptions(t *testing.T, conn net.Conn, opts *SocketOptions) {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(level, opt int) int {
+		var value int
+		var sockErr error
+		if err := raw.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if sockErr != nil {
+			t.Fatal(sockErr)
+		}
+		return value
+	}
+	if noDelay := get(syscall.IPPROTO_TCP, syscall.TCP_NODELAY); opts.Nagle && noDelay != 0 {
+		t.Error("Nagle's algorithm still disabled")
+	}
+	// Linux doubles the buffer sizes for its bookkeeping.
+	if n := get(syscall.SOL_SOCKET, syscall.SO_SNDBUF); opts.SendBuffer > 0 && (n < opts.SendBuffer || n > 2*opts.SendBuffer) {
+		t.Errorf("SO_SNDBUF %d, want %d", n, opts.SendBuffer)
+	}
+	if n := get(syscall.SOL_SOCKET, syscall.SO_RCVBUF); opts.ReceiveBuffer > 0 && (n < opts.ReceiveBuffer || n > 2*opts.ReceiveBuffer) {
+		t.Errorf("SO_RCVBUF %d, want %d", n, opts.ReceiveBuffer)
+	}
+	keepAlive := get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0
+	switch {
+	case opts.KeepAlive < 0 && keepAlive:
+		t.Error("keepalives still enabled")
+	case opts.KeepAlive > 0:
+		if !keepAlive {
+			t.Error("keepalives disabled")
+		}
+		if idle := get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != int(opts.KeepAlive.Seconds()) {
+			t.Errorf("TCP_KEEPIDLE %ds, want %s", idle, opts.KeepAlive)
+		}
+	}
+}
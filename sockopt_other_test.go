@@ -0,0 +1,12 @@
+//go:build !linux
+
+package riverrun
+
+import (
+	"net"
+	"testing"
+)
+
+// checkSocketOptions reads the options of opts back from conn where the
+// test knows how to.
+func checkSocketOptions(t *testing.T, conn net.Conn, opts *SocketOptions) {}
@@ -0,0 +1,74 @@
+package riverrun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// MaxSpanLength is the most payload a span carries, longer writes are
+	// sent as several spans.
+	MaxSpanLength = 1 << 20
+	// spanDescriptorLength is the size of a PacketTypeSpan body, the
+	// big-endian payload length of the span.
+	spanDescriptorLength = 4
+)
+
+// ErrSpanLength is the error returned by Read for a span declaring no payload
+// or more than MaxSpanLength bytes.
+var ErrSpanLength = errors.New("riverrun: invalid span length")
+
+// chopSpans encodes b as spans: for each, a descriptor frame and then the
+// payload expanded in one piece.  Each span counts as a frame for the
+// accounting of partial writes.
+func (encoder *riverrunEncoder) chopSpans(b []byte) (frameBuf bytes.Buffer, n int, err error) {
+	for len(b) > 0 {
+		payload := b[:min(len(b), MaxSpanLength)]
+		desc := make([]byte, spanDescriptorLength)
+		binary.BigEndian.PutUint32(desc, uint32(len(payload)))
+		if err = encoder.MakePacket(&frameBuf, encoder.ChopPayload(PacketTypeSpan, desc)); err != nil {
+			return frameBuf, 0, err
+		}
+		wire := make([]byte, encoder.codec.ExpandedLen(len(payload)))
+		if err = encoder.expandBytes(payload, wire); err != nil {
+			return frameBuf, 0, err
+		}
+		frameBuf.Write(wire)
+		encoder.payloadLens = append(encoder.payloadLens, len(payload))
+		if encoder.OnPacket != nil {
+			encoder.OnPacket(len(wire))
+		}
+		n += len(payload)
+		b = b[len(payload):]
+	}
+	return
+}
+
+// startSpan parses a span descriptor, so that the span that follows is
+// handed to decodeSpan.
+func (decoder *riverrunDecoder) startSpan(body []byte) error {
+	if len(body) != spanDescriptorLength {
+		return ErrSpanLength
+	}
+	length := binary.BigEndian.Uint32(body)
+	if length == 0 || length > MaxSpanLength {
+		return ErrSpanLength
+	}
+	decoder.SpanLength = decoder.codec.ExpandedLen(int(length))
+	return nil
+}
+
+// decodeSpan decodes a piece of a span as it arrives, and releases the
+// payload to Read right away.
+func (decoder *riverrunDecoder) decodeSpan(piece []byte, offset int, final bool) error {
+	decoded := make([]byte, decoder.codec.CompressedLen(len(piece)))
+	if err := decoder.compressBytes(piece, decoded); err != nil {
+		return err
+	}
+	decoder.ReceiveDecodedBuffer.Write(decoded)
+	if final && decoder.onFrame != nil {
+		decoder.onFrame(offset + len(piece))
+	}
+	return nil
+}
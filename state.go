@@ -0,0 +1,250 @@
+package riverrun
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/v2fly/riverrun/common/csrand"
+	f "github.com/v2fly/riverrun/common/framing"
+)
+
+const (
+	stateMagic   = "rrconnst"
+	stateVersion = 1
+	// stateLabel is the additional data of a sealed state.
+	stateLabel = "riverrun conn state v1"
+)
+
+var (
+	// ErrInvalidState is the error returned by UnmarshalState for a state
+	// that does not open under the key or does not parse.
+	ErrInvalidState = errors.New("riverrun: invalid conn state")
+	// ErrStateBusy is the error returned by MarshalState amid a handshake or
+	// after a failure, and by UnmarshalState on a Conn that was used.
+	ErrStateBusy = errors.New("riverrun: conn state not at rest")
+)
+
+// MarshalState returns the codec state of rr sealed under key, an AES key:
+// the salted keys and keystream offsets of both directions, the chunk length
+// sampler, the shaping parameters, the retuned biases of Config.AdaptiveBias
+// and the frames received but not read yet.
+// A supervisor hands it along with the carrier to a new process, e.g. amid
+// an upgrade, which picks the tunnel up with UnmarshalState.  rr must be done
+// with its handshake and have no Read or Write running, and must not be read
+// or written afterwards.
+func (rr *Conn) MarshalState(key []byte) ([]byte, error) {
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+	rr.shapeLock.Lock()
+	defer rr.shapeLock.Unlock()
+
+	write, writeOK := rr.Encoder.writeStream.(*seekableCTR)
+	read, readOK := rr.Decoder.readStream.(*seekableCTR)
+	kexBusy := rr.kex != nil && !rr.KeyExchanged()
+	if rr.closed.Load() || rr.camouflaged.Load() || rr.writeErr != nil || rr.saltOut != nil || rr.readKey != nil ||
+		kexBusy || rr.Decoder.expectAuth || rr.Decoder.expectKeyExchange ||
+		!writeOK || !readOK || write.key == nil || read.key == nil {
+		return nil, ErrStateBusy
+	}
+
+	b := append([]byte(stateMagic), stateVersion)
+	writeOffset := rr.Encoder.Offset()
+	b = appendBytes(b, rr.Encoder.drbgKey)
+	b = appendBytes(b, write.key)
+	b = appendBytes(b, write.iv)
+	b = binary.BigEndian.AppendUint64(b, writeOffset.Frames)
+	b = binary.BigEndian.AppendUint64(b, writeOffset.Keystream)
+	b = appendBytes(b, rr.lengthKey)
+	b = binary.BigEndian.AppendUint64(b, rr.lengthDrbg.Blocks())
+	readOffset := rr.Decoder.Offset()
+	b = appendBytes(b, rr.Decoder.drbgKey)
+	b = appendBytes(b, read.key)
+	b = appendBytes(b, read.iv)
+	b = binary.BigEndian.AppendUint64(b, readOffset.Frames)
+	b = binary.BigEndian.AppendUint64(b, readOffset.Keystream)
+
+	b = binary.BigEndian.AppendUint64(b, math.Float64bits(rr.bias))
+	b = binary.BigEndian.AppendUint64(b, math.Float64bits(rr.readBias))
+	b = binary.BigEndian.AppendUint32(b, rr.biasEpoch)
+	b = binary.BigEndian.AppendUint32(b, rr.readBiasEpoch)
+	b = appendBytes(b, rr.shapeSeed)
+	b = binary.BigEndian.AppendUint32(b, rr.shapeEpoch)
+	b = binary.BigEndian.AppendUint32(b, uint32(rr.mss_max))
+	b = binary.BigEndian.AppendUint64(b, math.Float64bits(rr.mss_dev))
+	b = binary.BigEndian.AppendUint64(b, uint64(rr.rekeyIn.Load()))
+	if id := rr.clientID.Load(); id != nil {
+		b = append(b, 1)
+		b = appendBytes(b, []byte(*id))
+	} else {
+		b = append(b, 0)
+	}
+
+	frame := rr.Decoder.FrameState()
+	b = binary.BigEndian.AppendUint16(b, frame.NextLength)
+	b = append(b, boolByte(frame.NextLengthInvalid), frame.NextType)
+	b = binary.BigEndian.AppendUint32(b, uint32(frame.PartialOffset))
+	b = binary.BigEndian.AppendUint32(b, uint32(frame.SpanLength))
+	b = binary.BigEndian.AppendUint32(b, uint32(frame.SpanOffset))
+	b = append(b, byte(rr.Decoder.header), rr.Decoder.partialType)
+	b = appendBytes(b, rr.Decoder.partialBody)
+	b = binary.BigEndian.AppendUint32(b, uint32(rr.Decoder.partialLength))
+	b = appendBytes(b, rr.Decoder.ReceiveBuffer.Bytes())
+	b = appendBytes(b, rr.Decoder.ReceiveDecodedBuffer.Bytes())
+
+	aead, err := stateAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if err = csrand.Bytes(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, b, []byte(stateLabel)), nil
+}
+
+// UnmarshalState makes rr, fresh from NewConnConfig over the carrier handed
+// over, with the seed, Config and role of the Conn that MarshalState was
+// called on, carry on where that one stopped.  The salt and handshake
+// messages rr queued are dropped, and the exchanged keys of the state are
+// used instead.
+func (rr *Conn) UnmarshalState(key, state []byte) error {
+	aead, err := stateAEAD(key)
+	if err != nil {
+		return err
+	}
+	if len(state) < aead.NonceSize() {
+		return ErrInvalidState
+	}
+	plain, err := aead.Open(nil, state[:aead.NonceSize()], state[aead.NonceSize():], []byte(stateLabel))
+	if err != nil {
+		return ErrInvalidState
+	}
+	r := paramsReader{b: plain}
+	if string(r.next(len(stateMagic))) != stateMagic || r.byte() != stateVersion {
+		return ErrInvalidState
+	}
+
+	rr.writeLock.Lock()
+	defer rr.writeLock.Unlock()
+	rr.shapeLock.Lock()
+	defer rr.shapeLock.Unlock()
+	if rr.saltOut == nil || rr.readKey == nil {
+		return ErrStateBusy
+	}
+
+	writeKey, writeStream := r.bytes(), rr.stateStream(&r)
+	writeOffset := StreamOffset{Frames: r.uint64(), Keystream: r.uint64()}
+	lengthKey, lengthBlocks := r.bytes(), r.uint64()
+	readKey, readStream := r.bytes(), rr.stateStream(&r)
+	readOffset := StreamOffset{Frames: r.uint64(), Keystream: r.uint64()}
+	bias := math.Float64frombits(r.uint64())
+	readBias := math.Float64frombits(r.uint64())
+	biasEpoch, readBiasEpoch := r.uint32(), r.uint32()
+	shapeSeed := append([]byte(nil), r.bytes()...)
+	shapeEpoch := r.uint32()
+	mss := int(r.uint32())
+	dev := math.Float64frombits(r.uint64())
+	rekeyIn := int64(r.uint64())
+	var clientID *string
+	if r.byte() == 1 {
+		id := string(r.bytes())
+		clientID = &id
+	}
+	frame := f.FrameState{NextLength: r.uint16(), NextLengthInvalid: r.byte() == 1, NextType: r.byte(), PartialOffset: int(r.uint32()),
+		SpanLength: int(r.uint32()), SpanOffset: int(r.uint32())}
+	header := FrameHeader(r.byte())
+	partialType, partialBody, partialLength := r.byte(), append([]byte(nil), r.bytes()...), int(r.uint32())
+	received, decoded := r.bytes(), r.bytes()
+	if r.bad || len(r.b) != 0 || writeStream == nil || readStream == nil || len(shapeSeed) == 0 || header > FrameHeaderChecked ||
+		(biasEpoch != 0 || readBiasEpoch != 0) && rr.tables == nil {
+		return ErrInvalidState
+	}
+	// The tables of retuned directions are those of their bias and epoch,
+	// not the initial ones of rr.
+	var writeCodec, readCodec f.Codec
+	if biasEpoch != 0 {
+		if writeCodec, err = rr.biasCodec(rr.tables.writeKey, rr.tables.writeIV, biasEpoch, bias, false); err != nil {
+			return err
+		}
+	}
+	if readBiasEpoch != 0 {
+		if readCodec, err = rr.biasCodec(rr.tables.readKey, rr.tables.readIV, readBiasEpoch, readBias, true); err != nil {
+			return err
+		}
+	}
+
+	rr.Encoder.setKeys(writeKey, writeStream)
+	if err = rr.Encoder.Seek(writeOffset); err != nil {
+		return err
+	}
+	if err = rr.setLengthKey(lengthKey, lengthBlocks); err != nil {
+		return ErrInvalidState
+	}
+	rr.Decoder.setKeys(readKey, readStream)
+	if err = rr.Decoder.Seek(readOffset); err != nil {
+		return err
+	}
+	rr.Decoder.SetFrameState(frame)
+	// The encoder switched to the layout of Config.FrameHeader, which the
+	// handed over Conn announced long ago.
+	rr.Decoder.header = header
+	rr.Decoder.TypeBits, rr.Decoder.CheckBits = header.bits()
+	rr.Decoder.partialType, rr.Decoder.partialBody, rr.Decoder.partialLength = partialType, partialBody, partialLength
+	rr.Decoder.ReceiveBuffer.Write(received)
+	rr.Decoder.ReceiveDecodedBuffer.Reset()
+	rr.Decoder.ReceiveDecodedBuffer.Write(decoded)
+
+	rr.bias, rr.readBias, rr.shapeSeed, rr.shapeEpoch, rr.mss_max, rr.mss_dev = bias, readBias, shapeSeed, shapeEpoch, mss, dev
+	rr.biasEpoch, rr.readBiasEpoch = biasEpoch, readBiasEpoch
+	if writeCodec != nil {
+		rr.Encoder.codec = writeCodec
+	}
+	if readCodec != nil {
+		rr.Decoder.codec = readCodec
+	}
+	rr.rekeyIn.Store(rekeyIn)
+	if clientID != nil {
+		rr.clientID.Store(clientID)
+	}
+	rr.saltOut, rr.readKey = nil, nil
+	rr.frameLens = rr.frameLens[:0]
+	rr.Encoder.payloadLens = rr.Encoder.payloadLens[:0]
+	rr.Decoder.expectAuth, rr.Decoder.expectKeyExchange = false, false
+	if kex := rr.kex; kex != nil {
+		kex.private, kex.secret, kex.in = nil, nil, nil
+		kex.phase = kexDone
+		kex.writeDone.Store(true)
+		kex.readDone.Store(true)
+	}
+	return nil
+}
+
+// stateStream returns the stream of the key and IV read off r, or nil.
+func (rr *Conn) stateStream(r *paramsReader) *seekableCTR {
+	key, iv := r.bytes(), r.bytes()
+	block, err := aes.NewCipher(key)
+	if err != nil || len(iv) != block.BlockSize() {
+		return nil
+	}
+	s := newSeekableCTR(block, iv, rr.lookahead)
+	s.key = append([]byte(nil), key...)
+	return s
+}
+
+func stateAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
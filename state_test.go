@@ -0,0 +1,91 @@
+package riverrun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+// roundTripMsg writes msg on from and reads it back on to, waiting for the
+// Write to return.
+func roundTripMsg(t *testing.T, from, to *Conn, msg string) {
+	t.Helper()
+	written := make(chan error, 1)
+	go func() {
+		_, err := from.Write([]byte(msg))
+		written <- err
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(to, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != msg {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handOver moves rr to a fresh Conn over its carrier through MarshalState.
+func handOver(t *testing.T, rr *Conn, isServer bool, config *Config) *Conn {
+	t.Helper()
+	key := bytes.Repeat([]byte{7}, 32)
+	state, err := rr.MarshalState(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := NewConnConfig(context.Background(), rr.Conn, isServer, seed, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = resumed.UnmarshalState(bytes.Repeat([]byte{8}, 32), state); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("wrong key: got %v, want ErrInvalidState", err)
+	}
+	if err = resumed.UnmarshalState(key, state); err != nil {
+		t.Fatal(err)
+	}
+	return resumed
+}
+
+func TestMarshalState(t *testing.T) {
+	client, server := newTestPair(t, nil, nil)
+	if _, err := client.MarshalState(bytes.Repeat([]byte{7}, 32)); !errors.Is(err, ErrStateBusy) {
+		t.Fatalf("before the handshake: got %v, want ErrStateBusy", err)
+	}
+	roundTripMsg(t, client, server, "before the upgrade")
+	roundTripMsg(t, server, client, "reply before the upgrade")
+
+	resumed := handOver(t, client, false, nil)
+	roundTripMsg(t, resumed, server, "after the upgrade")
+	roundTripMsg(t, server, resumed, "reply after the upgrade")
+}
+
+func TestMarshalStateRetuned(t *testing.T) {
+	// As in TestAdaptiveBias, every window asks for a higher bias.
+	config := &Config{AdaptiveBias: true, AdaptiveWindow: 4096, MinEntropy: 7.9, MaxEntropy: 8}
+	client, server := newTestPair(t, config, config)
+	msg := string(bytes.Repeat([]byte("retune me"), 1000))
+	for i := 0; i < 3; i++ {
+		roundTripMsg(t, client, server, msg)
+	}
+	roundTripMsg(t, server, client, "reply before the upgrade")
+	if client.biasEpoch == 0 || server.readBiasEpoch == 0 {
+		t.Fatal("no retune before the upgrade")
+	}
+
+	resumed := handOver(t, client, false, config)
+	roundTripMsg(t, resumed, server, "after the upgrade")
+	roundTripMsg(t, server, resumed, "reply after the upgrade")
+	// The server's read direction was retuned.
+	resumedServer := handOver(t, server, true, config)
+	roundTripMsg(t, resumed, resumedServer, "after both upgrades")
+}
@@ -0,0 +1,153 @@
+package riverrun
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time copy of the counters of a Conn.
+type Stats struct {
+	// BytesIn and BytesOut count application bytes returned by Read and
+	// accepted by Write.
+	BytesIn  uint64
+	BytesOut uint64
+	// WireBytesIn and WireBytesOut count the bytes read from and written to
+	// the underlying conn.
+	WireBytesIn  uint64
+	WireBytesOut uint64
+	// FramesIn and FramesOut count frames of any packet type.
+	FramesIn  uint64
+	FramesOut uint64
+	// PaddingBytes counts the padding bytes written.
+	PaddingBytes uint64
+}
+
+// ExpansionRatio returns the number of wire bytes sent per application byte
+// written, or zero if nothing has been written yet.
+func (s Stats) ExpansionRatio() float64 {
+	if s.BytesOut == 0 {
+		return 0
+	}
+	return float64(s.WireBytesOut) / float64(s.BytesOut)
+}
+
+type connStats struct {
+	bytesIn      atomic.Uint64
+	bytesOut     atomic.Uint64
+	wireBytesIn  atomic.Uint64
+	wireBytesOut atomic.Uint64
+	framesIn     atomic.Uint64
+	framesOut    atomic.Uint64
+	paddingBytes atomic.Uint64
+}
+
+func (s *connStats) snapshot() Stats {
+	return Stats{
+		BytesIn:      s.bytesIn.Load(),
+		BytesOut:     s.bytesOut.Load(),
+		WireBytesIn:  s.wireBytesIn.Load(),
+		WireBytesOut: s.wireBytesOut.Load(),
+		FramesIn:     s.framesIn.Load(),
+		FramesOut:    s.framesOut.Load(),
+		PaddingBytes: s.paddingBytes.Load(),
+	}
+}
+
+// wireConn counts the traffic on the underlying conn.  It also keeps the
+// first captureMax bytes read, for handing the conn to a decoy.
+type wireConn struct {
+	net.Conn
+	stats    *connStats
+	deadPeer *deadPeer
+	quota    Quota
+	teardown func(CloseReason)
+	stalls   *stallDetector
+
+	captureMax int
+	capture    []byte
+
+	// detached is set once the failure camouflage owns the conn, and fails
+	// all further writes.
+	detached atomic.Bool
+
+	// writeDeadline mirrors the write deadline of the conn for schedulers.
+	writeDeadline writeDeadline
+}
+
+// deadline returns a channel closed once the write deadline passes.
+func (c *wireConn) deadline() <-chan struct{} {
+	return c.writeDeadline.done()
+}
+
+func (c *wireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.wireBytesIn.Add(uint64(n))
+	c.deadPeer.read(n)
+	if c.quota != nil && n > 0 {
+		if qerr := c.quota.Account(uint64(n), 0); qerr != nil {
+			c.teardown(CloseQuota)
+			return 0, qerr
+		}
+	}
+	if room := c.captureMax - len(c.capture); room > 0 {
+		if room > n {
+			room = n
+		}
+		c.capture = append(c.capture, b[:room]...)
+	}
+	return n, err
+}
+
+// stopCapture returns the captured bytes and stops capturing.
+func (c *wireConn) stopCapture() []byte {
+	captured := c.capture
+	c.capture = nil
+	c.captureMax = 0
+	return captured
+}
+
+func (c *wireConn) Write(b []byte) (int, error) {
+	if c.detached.Load() {
+		return 0, net.ErrClosed
+	}
+	if c.quota != nil {
+		if err := c.quota.Account(0, uint64(len(b))); err != nil {
+			// Not from under the scheduler's lock, see deadPeer.write.
+			go c.teardown(CloseQuota)
+			return 0, err
+		}
+	}
+	var start time.Time
+	if c.stalls != nil {
+		start = time.Now()
+	}
+	n, err := c.deadPeer.write(func() (int, error) { return writeFull(c.Conn, b) })
+	c.stats.wireBytesOut.Add(uint64(n))
+	if c.stalls != nil && err == nil {
+		c.stalls.observe(time.Since(start))
+	}
+	return n, err
+}
+
+// writeFull writes all of b to w.  Some carriers return short writes without
+// an error, the rest is retried so that no frame is cut short.  A write making
+// no progress fails with io.ErrShortWrite.
+func writeFull(w io.Writer, b []byte) (n int, err error) {
+	for n < len(b) && err == nil {
+		var m int
+		m, err = w.Write(b[n:])
+		n += m
+		if m == 0 && err == nil {
+			err = io.ErrShortWrite
+		}
+	}
+	return n, err
+}
+
+// Snapshot returns the current counters of the connection.  It is safe to
+// call concurrently with Read and Write.
+func (rr *Conn) Snapshot() Stats {
+	return rr.stats.snapshot()
+}
@@ -0,0 +1,99 @@
+package riverrun
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StormDetector detects decode failure storms, Failures connections
+// rejecting a frame within Window, among the client connections sharing it
+// through Config.DecodeStorm.  Unlike a prober's garbage, a storm is
+// systematic, e.g. corrupted table files or a seed or profile changed on one
+// end only.  On a storm the cached tables of the failing connection are
+// dropped, along with their TableDir file, so that the connections created
+// from then on derive them afresh.  Servers ignore it, as probers would set it
+// off.
+type StormDetector struct {
+	Failures int
+	Window   time.Duration
+	// OnStorm, if set, is called on a goroutine of its own once per storm
+	// with the Conn completing it, e.g. to reload the settings and
+	// reconnect.
+	OnStorm func(*Conn)
+
+	lock   sync.Mutex
+	times  []time.Time
+	storms atomic.Uint64
+}
+
+// NewStormDetector returns a StormDetector of failures connections rejecting a
+// frame within window.
+func NewStormDetector(failures int, window time.Duration) *StormDetector {
+	return &StormDetector{Failures: failures, Window: window}
+}
+
+func (d *StormDetector) validate() error {
+	if d.Failures <= 0 || d.Window <= 0 {
+		return fmt.Errorf("riverrun: invalid decode storm of %d failures in %s", d.Failures, d.Window)
+	}
+	return nil
+}
+
+// record notes a failure at now and reports whether it completes a storm,
+// after which the count starts over.
+func (d *StormDetector) record(now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	cut := 0
+	for cut < len(d.times) && now.Sub(d.times[cut]) > d.Window {
+		cut++
+	}
+	d.times = append(d.times[cut:], now)
+	if len(d.times) < d.Failures {
+		return false
+	}
+	d.times = d.times[:0]
+	d.storms.Add(1)
+	return true
+}
+
+// Storms returns the number of storms detected.
+func (d *StormDetector) Storms() uint64 {
+	return d.storms.Load()
+}
+
+// decodeFailed counts a connection rejecting a frame towards a storm.
+func (rr *Conn) decodeFailed(err error) {
+	if rr.storm == nil || !rr.stormCounted.CompareAndSwap(false, true) || !rr.storm.record(time.Now()) {
+		return
+	}
+	rr.logger.Infof("riverrun: decode failure storm, deriving tables afresh: %s", err)
+	if rr.readTables != nil {
+		forgetTables(rr.readTables, rr.tables.tableDir)
+	}
+	if rr.storm.OnStorm != nil {
+		go rr.storm.OnStorm(rr)
+	}
+}
+
+// forgetTables drops tables from the table cache and their file in tableDir.
+// Connections using them keep them.
+func forgetTables(tables *tableSet, tableDir string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for fingerprint, cached := range cache {
+		if cached != tables {
+			continue
+		}
+		delete(cache, fingerprint)
+		if tableDir != "" {
+			var fp [sha256.Size]byte
+			copy(fp[:], fingerprint)
+			os.Remove(tableFilePath(tableDir, fp))
+		}
+	}
+}
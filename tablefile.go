@@ -0,0 +1,165 @@
+package riverrun
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/v2fly/riverrun/common/ctstretch"
+)
+
+// Table files hold the forward tables of one key so that several processes
+// using the same seed can map a single copy into memory.  The layout is a
+// fixed header followed by table8 and table16 as native-endian uint64s, and a
+// MAC keyed from the table key, so that a corrupted or planted file is not
+// used:
+//
+//	magic       [8]byte  "rrtables"
+//	version     uint32
+//	byteOrder   uint32   tableFileByteOrder, in the writer's byte order
+//	bits8       uint32
+//	bits16      uint32
+//	entries8    uint32
+//	entries16   uint32
+//	fingerprint [32]byte SHA-256 over the table derivation inputs
+//	padding up to tableFileHeaderLength
+//	table8      [entries8]uint64
+//	table16     [entries16]uint64
+//	mac         [32]byte HMAC-SHA256 over everything before it
+const (
+	tableFileMagic        = "rrtables"
+	tableFileVersion      = 2
+	tableFileByteOrder    = 0x01020304
+	tableFileHeaderLength = 64
+)
+
+// ErrTableFileMismatch is the error returned when a table file does not hold
+// the tables for the requested parameters.
+var ErrTableFileMismatch = errors.New("riverrun: table file does not match connection parameters")
+
+func tableFingerprint(expandedBlockBits8, expandedBlockBits uint64, bias float64, key, iv []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(tableFileMagic))
+	h.Write(key)
+	h.Write(iv)
+	var params [24]byte
+	binary.BigEndian.PutUint64(params[0:], expandedBlockBits8)
+	binary.BigEndian.PutUint64(params[8:], expandedBlockBits)
+	binary.BigEndian.PutUint64(params[16:], math.Float64bits(bias))
+	h.Write(params[:])
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// tableFileMACKey derives the MAC key of the table file from the table key.
+func tableFileMACKey(key []byte) []byte {
+	return ctstretch.TableMAC(key, []byte("riverrun table file"))
+}
+
+func tableFilePath(dir string, fingerprint [sha256.Size]byte) string {
+	return filepath.Join(dir, fmt.Sprintf("%x.tbl", fingerprint[:16]))
+}
+
+func marshalTableFile(fingerprint [sha256.Size]byte, macKey []byte, bits8, bits16 uint64, table8, table16 []uint64) []byte {
+	buf := make([]byte, tableFileHeaderLength+8*(len(table8)+len(table16)), tableFileHeaderLength+8*(len(table8)+len(table16))+ctstretch.TableMACSize)
+	copy(buf, tableFileMagic)
+	ne := binary.NativeEndian
+	ne.PutUint32(buf[8:], tableFileVersion)
+	ne.PutUint32(buf[12:], tableFileByteOrder)
+	ne.PutUint32(buf[16:], uint32(bits8))
+	ne.PutUint32(buf[20:], uint32(bits16))
+	ne.PutUint32(buf[24:], uint32(len(table8)))
+	ne.PutUint32(buf[28:], uint32(len(table16)))
+	copy(buf[32:], fingerprint[:])
+	off := tableFileHeaderLength
+	for _, table := range [][]uint64{table8, table16} {
+		for _, v := range table {
+			ne.PutUint64(buf[off:], v)
+			off += 8
+		}
+	}
+	return append(buf, ctstretch.TableMAC(macKey, buf)...)
+}
+
+// parseTableFile validates the header of a mapped table file and returns
+// table8 and table16 backed directly by data.
+func parseTableFile(data []byte, fingerprint [sha256.Size]byte, macKey []byte, bits8, bits16 uint64) ([]uint64, []uint64, error) {
+	if len(data) < tableFileHeaderLength || !bytes.Equal(data[:8], []byte(tableFileMagic)) {
+		return nil, nil, fmt.Errorf("riverrun: not a table file")
+	}
+	ne := binary.NativeEndian
+	if v := ne.Uint32(data[8:]); v != tableFileVersion {
+		return nil, nil, fmt.Errorf("riverrun: unsupported table file version %d", v)
+	}
+	if ne.Uint32(data[12:]) != tableFileByteOrder {
+		return nil, nil, fmt.Errorf("riverrun: table file has foreign byte order")
+	}
+	if uint64(ne.Uint32(data[16:])) != bits8 || uint64(ne.Uint32(data[20:])) != bits16 ||
+		!bytes.Equal(data[32:64], fingerprint[:]) {
+		return nil, nil, ErrTableFileMismatch
+	}
+	n8, n16 := int(ne.Uint32(data[24:])), int(ne.Uint32(data[28:]))
+	end := tableFileHeaderLength + 8*(n8+n16)
+	if n8 != 256 || n16 != 65536 || len(data) != end+ctstretch.TableMACSize {
+		return nil, nil, fmt.Errorf("riverrun: truncated table file")
+	}
+	if !hmac.Equal(data[end:], ctstretch.TableMAC(macKey, data[:end])) {
+		return nil, nil, fmt.Errorf("riverrun: table file: %w", ctstretch.ErrTableMAC)
+	}
+	// The header keeps the data 8 byte aligned within the page aligned
+	// mapping.
+	all := unsafe.Slice((*uint64)(unsafe.Pointer(&data[tableFileHeaderLength])), n8+n16)
+	table8, table16 := all[:n8:n8], all[n8:]
+	if err := ctstretch.VerifyTable(table8, bits8); err != nil {
+		return nil, nil, fmt.Errorf("riverrun: table file: %w", err)
+	}
+	if err := ctstretch.VerifyTable(table16, bits16); err != nil {
+		return nil, nil, fmt.Errorf("riverrun: table file: %w", err)
+	}
+	return table8, table16, nil
+}
+
+// writeTableFile atomically stores the tables under path.
+func writeTableFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tbl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadTableFile maps the tables for the given parameters from dir, or
+// returns os.ErrNotExist if no process has stored them yet.  Mappings are
+// never released, like the in-process cache they back.
+func loadTableFile(dir string, fingerprint [sha256.Size]byte, macKey []byte, bits8, bits16 uint64) ([]uint64, []uint64, error) {
+	data, err := mapFile(tableFilePath(dir, fingerprint))
+	if err != nil {
+		return nil, nil, err
+	}
+	table8, table16, err := parseTableFile(data, fingerprint, macKey, bits8, bits16)
+	if err != nil {
+		unmapFile(data)
+		return nil, nil, err
+	}
+	return table8, table16, nil
+}
+
+func storeTableFile(dir string, fingerprint [sha256.Size]byte, macKey []byte, bits8, bits16 uint64, table8, table16 []uint64) error {
+	return writeTableFile(tableFilePath(dir, fingerprint), marshalTableFile(fingerprint, macKey, bits8, bits16, table8, table16))
+}
@@ -0,0 +1,104 @@
+package riverrun
+
+import (
+	"context"
+	"crypto/aes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/v2fly/riverrun/common/csrand"
+	"github.com/v2fly/riverrun/common/ctstretch"
+)
+
+func TestTableDir(t *testing.T) {
+	dir := t.TempDir()
+	key, iv := make([]byte, 16), make([]byte, aes.BlockSize)
+	if err := csrand.Bytes(key); err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := tableFingerprint(16, 32, .2, key, iv)
+	load := func() (*tableSet, *recordLogger) {
+		t.Helper()
+		// A fresh cache stands in for another process.
+		mutex.Lock()
+		delete(cache, string(fingerprint[:]))
+		mutex.Unlock()
+		logger := new(recordLogger)
+		tables, err := getTables(context.Background(), nil, 16, 32, .2, key, block, iv, dir, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tables, logger
+	}
+	logged := func(logger *recordLogger, s string) bool {
+		for _, line := range logger.lines {
+			if strings.Contains(line, s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	generated, logger := load()
+	if !logged(logger, "Generating fresh tables") {
+		t.Fatalf("first use did not generate the tables: %q", logger.lines)
+	}
+	if _, err := os.Stat(tableFilePath(dir, fingerprint)); err != nil {
+		t.Fatalf("table file not stored: %v", err)
+	}
+	mapped, logger := load()
+	if !logged(logger, "using mapped tables") || logged(logger, "Generating") {
+		t.Fatalf("second use did not map the file: %q", logger.lines)
+	}
+	for i := range generated.table16 {
+		if mapped.table16[i] != generated.table16[i] {
+			t.Fatalf("mapped table16[%d] differs", i)
+		}
+	}
+
+	// A damaged file is ignored and replaced.
+	if err := os.WriteFile(tableFilePath(dir, fingerprint), []byte("rrtables"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, logger = load()
+	if !logged(logger, "ignoring table file") || !logged(logger, "Generating fresh tables") {
+		t.Fatalf("damaged file: %q", logger.lines)
+	}
+	if _, logger = load(); !logged(logger, "using mapped tables") {
+		t.Fatalf("damaged file not replaced: %q", logger.lines)
+	}
+	mutex.Lock()
+	delete(cache, string(fingerprint[:]))
+	mutex.Unlock()
+}
+
+func TestTableFileMAC(t *testing.T) {
+	key, iv := make([]byte, 16), make([]byte, 16)
+	fingerprint := tableFingerprint(16, 32, .2, key, iv)
+	table8, table16 := make([]uint64, 256), make([]uint64, 65536)
+	for i := range table8 {
+		table8[i] = uint64(i)
+	}
+	for i := range table16 {
+		table16[i] = uint64(i) * 3
+	}
+	data := marshalTableFile(fingerprint, tableFileMACKey(key), 16, 32, table8, table16)
+	// parseTableFile returns slices into data, which must be 8 byte aligned.
+	aligned := make([]uint64, (len(data)+7)/8)
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&aligned[0])), len(data))
+	copy(buf, data)
+	if _, got16, err := parseTableFile(buf, fingerprint, tableFileMACKey(key), 16, 32); err != nil || got16[7] != 21 {
+		t.Fatalf("got %v", err)
+	}
+	buf[tableFileHeaderLength+8] ^= 1
+	if _, _, err := parseTableFile(buf, fingerprint, tableFileMACKey(key), 16, 32); !errors.Is(err, ctstretch.ErrTableMAC) {
+		t.Fatalf("corrupted: got %v, want ErrTableMAC", err)
+	}
+}
@@ -0,0 +1,306 @@
+package riverrun
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/v2fly/riverrun/common/csrand"
+)
+
+const (
+	// DefaultTicketRotation is the default lifetime of a ticket key as the
+	// current key.
+	DefaultTicketRotation = 24 * time.Hour
+	// DefaultTicketGrace is the default time a retired ticket key still
+	// opens tickets.
+	DefaultTicketGrace = 7 * 24 * time.Hour
+
+	ticketKeyIDLength = 16
+	ticketKeyLength   = 32
+
+	// Ticket key files hold the keys of a TicketKeyManager, current key
+	// first:
+	//
+	//	magic   [8]byte "rrtickey"
+	//	version uint32
+	//	count   uint32
+	//	count times:
+	//	  id      [16]byte
+	//	  key     [32]byte
+	//	  created int64    Unix nanoseconds
+	//	  retired int64    Unix nanoseconds, 0 for the current key
+	//
+	// All integers are big-endian.
+	ticketFileMagic   = "rrtickey"
+	ticketFileVersion = 1
+	ticketEntryLength = ticketKeyIDLength + ticketKeyLength + 16
+	ticketMaxKeys     = 1024
+)
+
+var (
+	// ErrTicketKeyUnknown is the error returned by TicketKeyManager.Open for
+	// tickets sealed with a key that expired or was never known.
+	ErrTicketKeyUnknown = errors.New("riverrun: unknown or expired ticket key")
+	// ErrInvalidTicket is the error returned by TicketKeyManager.Open for
+	// tickets that do not authenticate.
+	ErrInvalidTicket = errors.New("riverrun: invalid ticket")
+	// ErrInvalidTicketFile is the error returned by TicketKeyManager.Load
+	// for malformed key files.
+	ErrInvalidTicketFile = errors.New("riverrun: invalid ticket key file")
+)
+
+// TicketKey is a key sealing resumption tickets.
+type TicketKey struct {
+	ID      [ticketKeyIDLength]byte
+	Key     [ticketKeyLength]byte
+	Created time.Time
+	// Retired is when the key stopped being the current key, zero for the
+	// current key.
+	Retired time.Time
+}
+
+// TicketKeyManager holds the keys sealing resumption tickets on a server.
+// The current key is replaced once per rotation interval, and retired keys
+// keep opening tickets for a grace window, so that tickets outlive a
+// rotation.  Saving the keys
+// with Save and restoring them with Load on start keeps outstanding tickets
+// valid across restarts.
+//
+// A TicketKeyManager is safe for concurrent use.
+type TicketKeyManager struct {
+	lock     sync.Mutex
+	rotation time.Duration
+	grace    time.Duration
+	now      func() time.Time
+
+	// keys[0] is the current key, followed by the retired keys, newest
+	// first.
+	keys []TicketKey
+}
+
+// NewTicketKeyManager returns a TicketKeyManager with a fresh key, rotating
+// keys every rotation and accepting retired keys for grace.  Zero durations
+// select the defaults.
+func NewTicketKeyManager(rotation, grace time.Duration) (*TicketKeyManager, error) {
+	if rotation < 0 || grace < 0 {
+		return nil, fmt.Errorf("riverrun: invalid ticket key rotation %s or grace %s", rotation, grace)
+	}
+	if rotation == 0 {
+		rotation = DefaultTicketRotation
+	}
+	if grace == 0 {
+		grace = DefaultTicketGrace
+	}
+	m := &TicketKeyManager{rotation: rotation, grace: grace, now: time.Now}
+	if err := m.Rotate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Rotate retires the current key and replaces it by a fresh one right away,
+// e.g. after a suspected compromise.
+func (m *TicketKeyManager) Rotate() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.rotate(m.now())
+}
+
+func (m *TicketKeyManager) rotate(now time.Time) error {
+	key := TicketKey{Created: now}
+	if err := csrand.Bytes(key.ID[:]); err != nil {
+		return err
+	}
+	if err := csrand.Bytes(key.Key[:]); err != nil {
+		return err
+	}
+	if len(m.keys) > 0 {
+		m.keys[0].Retired = now
+	}
+	// Load refuses files of more than ticketMaxKeys keys, so the oldest
+	// keys go first when many rotations fall within the grace window.
+	m.keys = append([]TicketKey{key}, m.keys[:min(len(m.keys), ticketMaxKeys-1)]...)
+	return nil
+}
+
+// update rotates the current key if it is due, and drops the retired keys
+// past their grace window.
+func (m *TicketKeyManager) update() error {
+	now := m.now()
+	if len(m.keys) == 0 || now.Sub(m.keys[0].Created) >= m.rotation {
+		if err := m.rotate(now); err != nil {
+			return err
+		}
+	}
+	n := 1
+	for ; n < len(m.keys); n++ {
+		if now.Sub(m.keys[n].Retired) >= m.grace {
+			break
+		}
+	}
+	m.keys = m.keys[:n]
+	return nil
+}
+
+// Current returns the key new tickets are sealed with.
+func (m *TicketKeyManager) Current() (TicketKey, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.update(); err != nil {
+		return TicketKey{}, err
+	}
+	return m.keys[0], nil
+}
+
+// Keys returns the current key followed by the retired keys still accepted.
+func (m *TicketKeyManager) Keys() ([]TicketKey, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.update(); err != nil {
+		return nil, err
+	}
+	return append([]TicketKey(nil), m.keys...), nil
+}
+
+// Lookup returns the accepted key with the given id.
+func (m *TicketKeyManager) Lookup(id [ticketKeyIDLength]byte) (TicketKey, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.update(); err != nil {
+		return TicketKey{}, false
+	}
+	for _, key := range m.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return TicketKey{}, false
+}
+
+// Seal encrypts and authenticates state with the current key.  The ticket
+// starts with the key id, followed by a random nonce and the AES-GCM sealed
+// state.
+func (m *TicketKeyManager) Seal(state []byte) ([]byte, error) {
+	key, err := m.Current()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+	ticket := make([]byte, ticketKeyIDLength+aead.NonceSize(), ticketKeyIDLength+aead.NonceSize()+len(state)+aead.Overhead())
+	copy(ticket, key.ID[:])
+	nonce := ticket[ticketKeyIDLength:]
+	if err = csrand.Bytes(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(ticket, nonce, state, key.ID[:]), nil
+}
+
+// Open returns the state sealed in ticket, if its key is still accepted.
+func (m *TicketKeyManager) Open(ticket []byte) ([]byte, error) {
+	if len(ticket) < ticketKeyIDLength {
+		return nil, ErrInvalidTicket
+	}
+	var id [ticketKeyIDLength]byte
+	copy(id[:], ticket)
+	key, ok := m.Lookup(id)
+	if !ok {
+		return nil, ErrTicketKeyUnknown
+	}
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+	rest := ticket[ticketKeyIDLength:]
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidTicket
+	}
+	state, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], id[:])
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+	return state, nil
+}
+
+func (key *TicketKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.Key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Save writes the accepted keys to w, at most ticketMaxKeys of them as m
+// keeps no more.  The output holds secret keys and must be stored
+// accordingly.
+func (m *TicketKeyManager) Save(w io.Writer) error {
+	keys, err := m.Keys()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 16, 16+ticketEntryLength*len(keys))
+	copy(buf, ticketFileMagic)
+	binary.BigEndian.PutUint32(buf[8:], ticketFileVersion)
+	binary.BigEndian.PutUint32(buf[12:], uint32(len(keys)))
+	for _, key := range keys {
+		buf = append(buf, key.ID[:]...)
+		buf = append(buf, key.Key[:]...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(key.Created.UnixNano()))
+		var retired int64
+		if !key.Retired.IsZero() {
+			retired = key.Retired.UnixNano()
+		}
+		buf = binary.BigEndian.AppendUint64(buf, uint64(retired))
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// Load replaces the keys of m by those saved to r.  Keys that expired since
+// are dropped, and the current key is rotated if it is due.
+func (m *TicketKeyManager) Load(r io.Reader) error {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return ErrInvalidTicketFile
+	}
+	count := binary.BigEndian.Uint32(header[12:])
+	if !bytes.Equal(header[:8], []byte(ticketFileMagic)) ||
+		binary.BigEndian.Uint32(header[8:]) != ticketFileVersion ||
+		count == 0 || count > ticketMaxKeys {
+		return ErrInvalidTicketFile
+	}
+	buf := make([]byte, ticketEntryLength*int(count))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return ErrInvalidTicketFile
+	}
+
+	keys := make([]TicketKey, count)
+	for i := range keys {
+		entry := buf[i*ticketEntryLength:]
+		copy(keys[i].ID[:], entry)
+		copy(keys[i].Key[:], entry[ticketKeyIDLength:])
+		off := ticketKeyIDLength + ticketKeyLength
+		keys[i].Created = time.Unix(0, int64(binary.BigEndian.Uint64(entry[off:])))
+		retired := int64(binary.BigEndian.Uint64(entry[off+8:]))
+		if (retired == 0) != (i == 0) {
+			return ErrInvalidTicketFile
+		}
+		if retired != 0 {
+			keys[i].Retired = time.Unix(0, retired)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.keys = keys
+	return m.update()
+}
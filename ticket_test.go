@@ -0,0 +1,101 @@
+package riverrun
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTicketKeyRotation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	m, err := NewTicketKeyManager(time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.now = func() time.Time { return now }
+	m.keys = nil
+	m.Rotate()
+
+	ticket, err := m.Seal([]byte("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotated, but within the grace window.
+	now = now.Add(90 * time.Minute)
+	if state, err := m.Open(ticket); err != nil || string(state) != "state" {
+		t.Fatalf("Open after rotation: %q, %v", state, err)
+	}
+	if keys, _ := m.Keys(); len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	// Past the grace window.
+	now = now.Add(2 * time.Hour)
+	if _, err := m.Open(ticket); !errors.Is(err, ErrTicketKeyUnknown) {
+		t.Fatalf("Open after grace: got %v, want ErrTicketKeyUnknown", err)
+	}
+
+	ticket, _ = m.Seal([]byte("state"))
+	ticket[len(ticket)-1] ^= 1
+	if _, err := m.Open(ticket); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("Open of tampered ticket: got %v, want ErrInvalidTicket", err)
+	}
+}
+
+func TestTicketKeySaveLoad(t *testing.T) {
+	m, err := NewTicketKeyManager(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := m.Seal([]byte("old"))
+	m.Rotate()
+	current, _ := m.Seal([]byte("current"))
+
+	var buf bytes.Buffer
+	if err := m.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restarted, _ := NewTicketKeyManager(0, 0)
+	if err := restarted.Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"old", "current"} {
+		ticket := old
+		if want == "current" {
+			ticket = current
+		}
+		if state, err := restarted.Open(ticket); err != nil || string(state) != want {
+			t.Fatalf("Open %s ticket: %q, %v", want, state, err)
+		}
+	}
+
+	buf.Bytes()[0] ^= 1
+	if err := restarted.Load(&buf); !errors.Is(err, ErrInvalidTicketFile) {
+		t.Fatalf("Load of corrupt file: got %v, want ErrInvalidTicketFile", err)
+	}
+}
+
+func TestTicketKeySaveLoadLimit(t *testing.T) {
+	m, err := NewTicketKeyManager(time.Hour, 1000*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < ticketMaxKeys+10; i++ {
+		m.Rotate()
+	}
+	ticket, _ := m.Seal([]byte("state"))
+	var buf bytes.Buffer
+	if err := m.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restarted, _ := NewTicketKeyManager(time.Hour, 1000*time.Hour)
+	if err := restarted.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := restarted.Keys(); len(keys) != ticketMaxKeys {
+		t.Fatalf("got %d keys, want %d", len(keys), ticketMaxKeys)
+	}
+	if state, err := restarted.Open(ticket); err != nil || string(state) != "state" {
+		t.Fatalf("Open: %q, %v", state, err)
+	}
+}
@@ -0,0 +1,92 @@
+package tlscarrier
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// LetsEncrypt is the ACME directory of Let's Encrypt, the default of ACME.
+const LetsEncrypt = acme.LetsEncryptURL
+
+// ErrNoDomains is the error returned by ACME.TLSConfig without domains.
+var ErrNoDomains = errors.New("tlscarrier: no ACME domains")
+
+// ACME obtains and renews certificates for the cover domains of a bridge from
+// an ACME CA, so that a prober completing the handshake finds a valid
+// certificate for the domain, as on any HTTPS site.  The CA is validated
+// with the tls-alpn-01 challenge on the listener itself, which therefore
+// has to be reachable on port 443; HTTPHandler answers http-01 on port 80
+// as well.
+type ACME struct {
+	// Domains are the names certificates are requested for.  Hellos for
+	// other names get none, so that the CA is not asked for them.
+	Domains []string
+	// CacheDir keeps the account key and certificates across restarts, to
+	// stay clear of the rate limits of the CA.  Empty keeps them in memory.
+	CacheDir string
+	// Email is the contact of the account, optional.
+	Email string
+	// DirectoryURL defaults to LetsEncrypt.
+	DirectoryURL string
+
+	manager *autocert.Manager
+}
+
+// Manager returns the autocert manager of a, built on first use.
+func (a *ACME) Manager() (*autocert.Manager, error) {
+	if a.manager != nil {
+		return a.manager, nil
+	}
+	if len(a.Domains) == 0 {
+		return nil, ErrNoDomains
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(a.Domains...),
+		Email:      a.Email,
+	}
+	if a.CacheDir != "" {
+		m.Cache = autocert.DirCache(a.CacheDir)
+	}
+	if a.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: a.DirectoryURL}
+	}
+	a.manager = m
+	return m, nil
+}
+
+// TLSConfig returns a server config with the certificates of a.  Like
+// NewListener, it answers browser hellos with HTTP/1.1.
+func (a *ACME) TLSConfig() (*tls.Config, error) {
+	m, err := a.Manager()
+	if err != nil {
+		return nil, err
+	}
+	config := m.TLSConfig()
+	config.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	return config, nil
+}
+
+// HTTPHandler answers the http-01 challenges of the CA and hands every other
+// request to fallback, or redirects it to HTTPS if fallback is nil.
+func (a *ACME) HTTPHandler(fallback http.Handler) (http.Handler, error) {
+	m, err := a.Manager()
+	if err != nil {
+		return nil, err
+	}
+	return m.HTTPHandler(fallback), nil
+}
+
+// NewACMEListener returns a listener serving TLS with the certificates of a.
+func NewACMEListener(ln net.Listener, a *ACME) (net.Listener, error) {
+	config, err := a.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(ln, config), nil
+}
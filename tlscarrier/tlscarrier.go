@@ -0,0 +1,121 @@
+// Package tlscarrier wraps riverrun connections in genuine TLS sessions.  The
+// client sends the ClientHello of a real browser, by way of uTLS, so the
+// outer protocol holds up to fingerprinting, and the riverrun stream inside
+// is what the TLS records carry.
+//
+// The server needs nothing special, any TLS stack will do.  NewListener is
+// crypto/tls with an ALPN answer fitting the browser hellos, and
+// NewACMEListener the same with certificates for the cover domain from an
+// ACME CA such as Let's Encrypt.
+package tlscarrier
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// Fingerprint names the browser whose ClientHello a Dialer sends.
+type Fingerprint string
+
+// Fingerprints, which follow the latest browser version uTLS knows of.
+const (
+	Chrome  Fingerprint = "chrome"
+	Firefox Fingerprint = "firefox"
+	Safari  Fingerprint = "safari"
+	Edge    Fingerprint = "edge"
+	IOS     Fingerprint = "ios"
+	// Randomized sends a fresh random ClientHello on each dial.
+	Randomized Fingerprint = "randomized"
+)
+
+var helloIDs = map[Fingerprint]utls.ClientHelloID{
+	Chrome:     utls.HelloChrome_Auto,
+	Firefox:    utls.HelloFirefox_Auto,
+	Safari:     utls.HelloSafari_Auto,
+	Edge:       utls.HelloEdge_Auto,
+	IOS:        utls.HelloIOS_Auto,
+	Randomized: utls.HelloRandomizedALPN,
+}
+
+// Fingerprints returns the names of the known fingerprints, sorted.
+func Fingerprints() []string {
+	names := make([]string, 0, len(helloIDs))
+	for fp := range helloIDs {
+		names = append(names, string(fp))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Dialer dials TLS connections with a browser fingerprint.
+type Dialer struct {
+	// Fingerprint defaults to Chrome.
+	Fingerprint Fingerprint
+	// ServerName is sent as SNI and verified against the certificate, it
+	// defaults to the host of the dialed address.
+	ServerName string
+	// RootCAs verifies the server certificate, it defaults to the system
+	// roots.
+	RootCAs *x509.CertPool
+	// InsecureSkipVerify accepts any certificate, e.g. a self-signed one
+	// whose trust comes from the riverrun seed alone.
+	InsecureSkipVerify bool
+	// Dial connects to the server.  It defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialContext connects to addr and completes the TLS handshake within ctx.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	fp := d.Fingerprint
+	if fp == "" {
+		fp = Chrome
+	}
+	id, ok := helloIDs[fp]
+	if !ok {
+		return nil, fmt.Errorf("tlscarrier: unknown fingerprint %q", fp)
+	}
+	serverName := d.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+	dial := d.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	uconn := utls.UClient(conn, &utls.Config{
+		ServerName:         serverName,
+		RootCAs:            d.RootCAs,
+		InsecureSkipVerify: d.InsecureSkipVerify,
+	}, id)
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return uconn, nil
+}
+
+// NewListener returns a listener serving TLS with config.  Browser hellos
+// offer HTTP/2 and HTTP/1.1, so unless config sets NextProtos the server
+// picks HTTP/1.1, as an HTTP/1.1-only web server would.
+func NewListener(ln net.Listener, config *tls.Config) net.Listener {
+	if len(config.NextProtos) == 0 {
+		config = config.Clone()
+		config.NextProtos = []string{"http/1.1"}
+	}
+	return tls.NewListener(ln, config)
+}
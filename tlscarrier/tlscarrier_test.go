@@ -0,0 +1,158 @@
+package tlscarrier
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/v2fly/riverrun"
+	"github.com/v2fly/riverrun/common/drbg"
+)
+
+const testSeed = "000102030405060708090a0b0c0d0e0f1011121314151617"
+
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cover.example"},
+		DNSNames:     []string{"cover.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestFingerprints(t *testing.T) {
+	seed, err := drbg.SeedFromHex(testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, pool := testCertificate(t)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &riverrun.Listener{Listener: NewListener(tcp, &tls.Config{Certificates: []tls.Certificate{cert}}), Seed: seed}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	msg := []byte("riverrun inside tls")
+	for _, fp := range Fingerprints() {
+		d := &Dialer{Fingerprint: Fingerprint(fp), ServerName: "cover.example", RootCAs: pool}
+		carrier, err := d.DialContext(context.Background(), "tcp", tcp.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %s", fp, err)
+		}
+		conn, err := riverrun.NewConn(carrier, false, seed, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("%s: %s", fp, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("%s: echo mismatch", fp)
+		}
+		conn.Close()
+	}
+
+	d := &Dialer{Fingerprint: Chrome, ServerName: "other.example", RootCAs: pool}
+	if _, err := d.DialContext(context.Background(), "tcp", tcp.Addr().String()); err == nil {
+		t.Fatal("accepted a certificate for the wrong name")
+	}
+}
+
+func TestACMECache(t *testing.T) {
+	if _, err := (&ACME{}).TLSConfig(); !errors.Is(err, ErrNoDomains) {
+		t.Fatalf("got %v, want ErrNoDomains", err)
+	}
+
+	// A certificate in the cache is served without asking the CA.
+	cert, pool := testCertificate(t)
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cached := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	cached = append(cached, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})...)
+	if err = os.WriteFile(filepath.Join(dir, "cover.example"), cached, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := NewACMEListener(tcp, &ACME{Domains: []string{"cover.example"}, CacheDir: dir, DirectoryURL: "http://127.0.0.1:1/directory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	d := &Dialer{ServerName: "cover.example", RootCAs: pool}
+	conn, err := d.DialContext(context.Background(), "tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	d.ServerName = "other.example"
+	d.InsecureSkipVerify = true
+	if _, err = d.DialContext(context.Background(), "tcp", tcp.Addr().String()); err == nil {
+		t.Fatal("served a certificate for a name not in Domains")
+	}
+}
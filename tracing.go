@@ -0,0 +1,66 @@
+package riverrun
+
+import "context"
+
+// Tracer starts the spans of connections, see Config.Tracer.  Package
+// riverrun/otel implements it with OpenTelemetry, so that the dependency is
+// only linked into programs that use it.
+type Tracer interface {
+	// Start starts the span name as a child of the span in ctx, if any.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetString(key, value string)
+	SetInt(key string, value int64)
+	SetFloat(key string, value float64)
+	SetBool(key string, value bool)
+	// End ends the span, recording err if not nil.
+	End(err error)
+}
+
+// The spans started, and their attributes.
+const (
+	// SpanHandshake covers NewConnConfig, table generation included.
+	SpanHandshake = "riverrun.handshake"
+	// SpanTables covers getting the tables of one direction.
+	SpanTables = "riverrun.tables"
+	// SpanWrite covers a Write, SpanRead a Read.
+	SpanWrite = "riverrun.write"
+	SpanRead  = "riverrun.read"
+
+	AttrTraceID   = "riverrun.trace_id"
+	AttrServer    = "riverrun.server"
+	AttrCacheHit  = "riverrun.cache_hit"
+	AttrBytes     = "riverrun.bytes"
+	AttrWireBytes = "riverrun.wire_bytes"
+	AttrExpansion = "riverrun.expansion_ratio"
+)
+
+type nopSpan struct{}
+
+func (nopSpan) SetString(string, string) {}
+func (nopSpan) SetInt(string, int64)     {}
+func (nopSpan) SetFloat(string, float64) {}
+func (nopSpan) SetBool(string, bool)     {}
+func (nopSpan) End(error)                {}
+
+type tracerKey struct{}
+
+// withTracer returns ctx carrying t for startSpan.
+func withTracer(ctx context.Context, t Tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// startSpan starts a span with the Tracer in ctx, or a no-op span without.
+func startSpan(ctx context.Context, name string) (context.Context, Span) {
+	t, ok := ctx.Value(tracerKey{}).(Tracer)
+	if !ok {
+		return ctx, nopSpan{}
+	}
+	return t.Start(ctx, name)
+}
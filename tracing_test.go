@@ -0,0 +1,98 @@
+package riverrun
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/v2fly/riverrun/common/log"
+)
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]interface{}
+	ended bool
+}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &recordedSpan{name: name, attrs: make(map[string]interface{})}
+	t.spans = append(t.spans, s)
+	return ctx, &recordingSpan{t, s}
+}
+
+func (t *recordingTracer) find(name string) *recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.spans {
+		if s.name == name && s.ended {
+			return s
+		}
+	}
+	return nil
+}
+
+type recordingSpan struct {
+	t *recordingTracer
+	s *recordedSpan
+}
+
+func (s *recordingSpan) set(key string, value interface{}) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.s.attrs[key] = value
+}
+
+func (s *recordingSpan) SetString(key, value string)        { s.set(key, value) }
+func (s *recordingSpan) SetInt(key string, value int64)     { s.set(key, value) }
+func (s *recordingSpan) SetFloat(key string, value float64) { s.set(key, value) }
+func (s *recordingSpan) SetBool(key string, value bool)     { s.set(key, value) }
+
+func (s *recordingSpan) End(error) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.s.ended = true
+}
+
+func TestTracer(t *testing.T) {
+	if log.Hardened {
+		t.Skip("riverrun_hardened builds refuse Tracer")
+	}
+	clientTracer, serverTracer := new(recordingTracer), new(recordingTracer)
+	client, server := newTestPair(t, &Config{Tracer: clientTracer}, &Config{Tracer: serverTracer})
+
+	msg := []byte("traced payload")
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(server, make([]byte, len(msg)))
+		read <- err
+	}()
+	if _, err := client.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := clientTracer.find(SpanHandshake)
+	if handshake == nil || handshake.attrs[AttrTraceID] != client.TraceID() || handshake.attrs[AttrServer] != false {
+		t.Errorf("handshake span: %+v", handshake)
+	}
+	if tables := clientTracer.find(SpanTables); tables == nil || tables.attrs[AttrCacheHit] == nil {
+		t.Errorf("tables span: %+v", tables)
+	}
+	write := clientTracer.find(SpanWrite)
+	if write == nil || write.attrs[AttrBytes] != int64(len(msg)) || write.attrs[AttrExpansion].(float64) <= 1 {
+		t.Errorf("write span: %+v", write)
+	}
+	if r := serverTracer.find(SpanRead); r == nil || r.attrs[AttrWireBytes].(int64) <= 0 {
+		t.Errorf("read span: %+v", r)
+	}
+}
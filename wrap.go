@@ -0,0 +1,97 @@
+package riverrun
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/v2fly/riverrun/common/drbg"
+	"github.com/v2fly/riverrun/common/log"
+)
+
+// Option configures WrapClient and WrapServer.  Options apply in order, and
+// WithConfig and WithProfile replace the whole Config, so they come first.
+type Option func(*wrapOptions) error
+
+type wrapOptions struct {
+	ctx    context.Context
+	config Config
+}
+
+// WithConfig starts from a copy of config.
+func WithConfig(config *Config) Option {
+	return func(o *wrapOptions) error {
+		if config == nil {
+			return errors.New("riverrun: nil Config")
+		}
+		o.config = *config
+		return nil
+	}
+}
+
+// WithProfile starts from the named profile, see LookupProfile.
+func WithProfile(name string) Option {
+	return func(o *wrapOptions) error {
+		config, err := LookupProfile(name)
+		if err != nil {
+			return err
+		}
+		o.config = *config
+		return nil
+	}
+}
+
+// WithLogger sets Config.Logger.
+func WithLogger(logger log.Logger) Option {
+	return func(o *wrapOptions) error {
+		o.config.Logger = logger
+		return nil
+	}
+}
+
+// WithHooks sets Config.Hooks, e.g. to count frames for metrics.
+func WithHooks(hooks Hooks) Option {
+	return func(o *wrapOptions) error {
+		o.config.Hooks = hooks
+		return nil
+	}
+}
+
+// WithTracer sets Config.Tracer.
+func WithTracer(tracer Tracer) Option {
+	return func(o *wrapOptions) error {
+		o.config.Tracer = tracer
+		return nil
+	}
+}
+
+// WithContext bounds the setup of the connection, table generation included,
+// by ctx.
+func WithContext(ctx context.Context) Option {
+	return func(o *wrapOptions) error {
+		o.ctx = ctx
+		return nil
+	}
+}
+
+// WrapClient returns the client Conn over conn, which may be any carrier, for
+// seed and the settings of opts.  It is NewConnConfig with the settings
+// spelled as options.
+func WrapClient(conn net.Conn, seed *drbg.Seed, opts ...Option) (*Conn, error) {
+	return wrap(conn, false, seed, opts)
+}
+
+// WrapServer is WrapClient for the server end.
+func WrapServer(conn net.Conn, seed *drbg.Seed, opts ...Option) (*Conn, error) {
+	return wrap(conn, true, seed, opts)
+}
+
+func wrap(conn net.Conn, isServer bool, seed *drbg.Seed, opts []Option) (*Conn, error) {
+	o := &wrapOptions{ctx: context.Background()}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return NewConnConfig(o.ctx, conn, isServer, seed, &o.config)
+}